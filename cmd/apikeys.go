@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/apikey"
+)
+
+// create, revoke and list the API keys the daemon accepts
+func runAPIKeys(args []string) {
+	const usage = "Usage: api-keys create <name> -scopes <scope>[,<scope>...] | api-keys revoke <name> | api-keys list"
+	if len(args) == 0 {
+		usagef(usage)
+	}
+	fs := flag.NewFlagSet("api-keys "+args[0], flag.ExitOnError)
+	var scopes *string
+	if args[0] == "create" {
+		scopes = fs.String("scopes", "", "comma separated scopes: "+strings.Join(apikey.Scopes(), ", "))
+	}
+	configFlag(fs)
+	outputFlag(fs)
+	positional := parseArgs(fs, args[1:])
+
+	switch {
+	case args[0] == "list" && len(positional) == 0:
+	case (args[0] == "create" || args[0] == "revoke") && len(positional) == 1:
+		// changing who may use the API is worth a record
+		auditCommand, auditArgs = "api-keys "+args[0], args[1:]
+	default:
+		usagef(usage)
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	switch args[0] {
+	case "create":
+		var list []string
+		for _, scope := range strings.Split(*scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				list = append(list, scope)
+			}
+		}
+		key, err := apikey.Create(dbConn, positional[0], list)
+		if err != nil {
+			fatal(err, "Error creating the API key")
+		}
+		outputFormat.Print(struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+			Key    string   `json:"key"`
+		}{positional[0], list, key}, func() {
+			fmt.Printf("Created key %s with scopes %s:\n\n    %s\n\nKeep it somewhere safe; it can't be shown again.\n", positional[0], strings.Join(list, ", "), key)
+		})
+	case "revoke":
+		if err := apikey.Revoke(dbConn, positional[0]); err != nil {
+			fatal(err, "Error revoking the API key")
+		}
+		outputFormat.Print(struct {
+			Revoked string `json:"revoked"`
+		}{positional[0]}, func() {
+			fmt.Printf("Revoked key %s.\n", positional[0])
+		})
+	case "list":
+		keys, err := apikey.List(dbConn)
+		if err != nil {
+			fatal(err, "Error listing API keys")
+		}
+		outputFormat.Print(keys, func() {
+			if len(keys) == 0 {
+				fmt.Println("No API keys.")
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSCOPES\tCREATED\tBY\tLAST USED\tREVOKED")
+			for _, k := range keys {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.Name, strings.Join(k.Scopes, ","), k.CreatedAt.Local().Format(time.RFC3339), k.CreatedBy, formatTime(k.LastUsedAt, "never"), formatTime(k.RevokedAt, "-"))
+			}
+			w.Flush()
+		})
+	}
+}
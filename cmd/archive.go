@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/compression"
+	"db-delta-tracker/pkg/objstore"
+
+	"github.com/lib/pq"
+)
+
+// how many deltas the archive command writes per file by default
+const archiveRotateRows = 100000
+
+// what the archive command moved, for -output json
+type archiveResult struct {
+	Before   time.Time `json:"before"`
+	Archived int       `json:"archived"`
+	Files    []string  `json:"files"`
+}
+
+// handle `archive [-dir <dir>] [-older-than 7d] [-rotate-rows N]`: drain the
+// deltas made before a time from the deltas table into archive files, a new
+// file every -rotate-rows deltas, listing each in the directory's index.
+// Restores read them back with -archive-dir.
+func runArchive(args []string) {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write archive files to (default retention.archive_dir)")
+	olderThan := fs.String("older-than", "", "archive deltas older than this, e.g. 7d or 12h (default retention.keep_for)")
+	rotateRows := fs.Int64("rotate-rows", archiveRotateRows, "start a new file after this many deltas")
+	archiveCodec := fs.String("codec", "", "format of archive files: "+strings.Join(codec.Names(), ", ")+" (default retention.archive_codec, or json)")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	// flags given on the command line win over the config
+	retention := cfg.Retention
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dir":
+			retention.ArchiveDir = *dir
+		case "older-than":
+			retention.KeepFor = *olderThan
+		case "codec":
+			retention.ArchiveCodec = *archiveCodec
+		}
+	})
+	if retention.ArchiveDir == "" {
+		usagef("Usage: archive --dir <dir> --older-than <age> [--rotate-rows <n>] [--codec json|msgpack|protobuf]")
+	}
+	keep, err := retention.Keep()
+	if err != nil {
+		usagef("Invalid age %q: %v", retention.KeepFor, err)
+	}
+	if keep == 0 {
+		usagef("Nothing to archive: set -older-than, or retention.keep_for in the config")
+	}
+	if *rotateRows < 1 {
+		usagef("-rotate-rows must be at least 1")
+	}
+	archiveWith, err := codec.Lookup(retention.ArchiveCodec)
+	if err != nil {
+		usagef("Invalid archive codec: %v", err)
+	}
+
+	result := archiveResult{Before: time.Now().Add(-keep)}
+	result.Files, result.Archived, err = drainToArchive(retention.ArchiveDir, result.Before, *rotateRows, archiveWith)
+	if err != nil {
+		fatal(err, "Error archiving deltas")
+	}
+	if result.Files == nil {
+		result.Files = []string{}
+	}
+	outputFormat.Print(result, func() {
+		fmt.Printf("Archived %d deltas made before %s into %d files in %s.\n", result.Archived, result.Before.Format(time.RFC3339), len(result.Files), retention.ArchiveDir)
+	})
+}
+
+// move every delta made before a time into archive files of up to perFile
+// deltas each, returning the files written and how many deltas they hold
+func drainToArchive(dir string, before time.Time, perFile int64, c codec.Codec) ([]string, int, error) {
+	var files []string
+	total := 0
+	for {
+		path, moved, err := archiveOldestDeltas(dir, before, perFile, c)
+		if err != nil {
+			return files, total, err
+		}
+		if moved == 0 {
+			return files, total, nil
+		}
+		files = append(files, path)
+		total += moved
+		log.Printf("Archived %d deltas to %s.", moved, path)
+	}
+}
+
+// move the oldest deltas, up to limit of those made before a time (zero for
+// any), out of the deltas table into a new file in dir, written with codec c,
+// returning the file written and how many deltas it holds
+func archiveOldestDeltas(dir string, before time.Time, limit int64, c codec.Codec) (string, int, error) {
+	if limit <= 0 {
+		return "", 0, nil
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, action, table_name, old_data, new_data, timestamp, COALESCE(txid, 0), COALESCE(statement, ''), context, COALESCE(origin, '')
+		FROM deltas
+		WHERE $2::timestamptz IS NULL OR timestamp < $2
+		ORDER BY timestamp, id
+		LIMIT $1
+		FOR UPDATE
+	`, limit, sql.NullTime{Time: before, Valid: !before.IsZero()})
+	if err != nil {
+		return "", 0, fmt.Errorf("error fetching deltas: %v", err)
+	}
+
+	var deltas []Delta
+	var ids []int64
+	for rows.Next() {
+		var delta Delta
+		if err := rows.Scan(&delta.ID, &delta.Action, &delta.TableName, &delta.OldData, &delta.NewData, &delta.Timestamp, &delta.TxID, &delta.Statement, &delta.Context, &delta.Origin); err != nil {
+			rows.Close()
+			return "", 0, fmt.Errorf("error scanning delta: %v", err)
+		}
+		deltas = append(deltas, delta)
+		ids = append(ids, delta.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", 0, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	if len(deltas) == 0 {
+		return "", 0, nil
+	}
+
+	// the file must be safely on disk, or uploaded, before the rows are deleted
+	name := fmt.Sprintf("deltas-%s-%d%s", deltas[0].Timestamp.UTC().Format("20060102T150405Z"), deltas[0].ID, c.Extension())
+	compressWith, _ := compression.Lookup(cfg.Retention.ArchiveCompression) // checked by Validate
+	name = compressWith.FileName(name)
+	fileName := objstore.Join(dir, name)
+	if err := writeDeltasFile(fileName, deltas, c); err != nil {
+		return "", 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM deltas WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		objstore.Remove(context.Background(), fileName)
+		return "", 0, fmt.Errorf("failed to delete archived deltas: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		objstore.Remove(context.Background(), fileName)
+		return "", 0, fmt.Errorf("failed to commit archiving: %v", err)
+	}
+
+	if err := addToArchiveIndex(dir, name, deltas); err != nil {
+		return fileName, len(deltas), fmt.Errorf("archived %d deltas to %s, but %v", len(deltas), fileName, err)
+	}
+	return fileName, len(deltas), nil
+}
+
+// the file listing an archive directory's files, so a restore can tell
+// when one has gone missing
+const archiveIndexName = "index.json"
+
+// an archive file as the index lists it
+type archiveEntry struct {
+	File    string    `json:"file"` // relative to the archive directory
+	Deltas  int       `json:"deltas"`
+	FirstID int64     `json:"first_id"`
+	LastID  int64     `json:"last_id"`
+	From    time.Time `json:"from"` // the first delta's timestamp
+	To      time.Time `json:"to"`   // the last delta's
+	Tables  []string  `json:"tables"`
+}
+
+// read an archive directory's index; a directory without one has none
+func readArchiveIndex(dir string) ([]archiveEntry, bool, error) {
+	data, err := objstore.ReadFile(context.Background(), objstore.Join(dir, archiveIndexName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read archive index: %v", err)
+	}
+	var entries []archiveEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, false, fmt.Errorf("failed to parse archive index %s: %v", objstore.Join(dir, archiveIndexName), err)
+	}
+	return entries, true, nil
+}
+
+// list a newly written archive file, by its name in dir, in the directory's index
+func addToArchiveIndex(dir, name string, deltas []Delta) error {
+	entries, _, err := readArchiveIndex(dir)
+	if err != nil {
+		return err
+	}
+	entry := archiveEntry{File: name, Deltas: len(deltas), FirstID: deltas[0].ID, LastID: deltas[len(deltas)-1].ID,
+		From: deltas[0].Timestamp, To: deltas[len(deltas)-1].Timestamp, Tables: []string{}}
+	for _, delta := range deltas {
+		if delta.TableName != "" && !containsString(entry.Tables, delta.TableName) {
+			entry.Tables = append(entry.Tables, delta.TableName)
+		}
+	}
+	sort.Strings(entry.Tables)
+	entries = append(entries, entry)
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode archive index: %v", err)
+	}
+	if err := objstore.WriteFile(context.Background(), objstore.Join(dir, archiveIndexName), append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write archive index: %v", err)
+	}
+	return nil
+}
+
+// write deltas with a codec, compressed as the file's extension says;
+// objstore.WriteFile never leaves a partial archive behind, even if it
+// crashes part way
+func writeDeltasFile(fileName string, deltas []Delta, c codec.Codec) error {
+	var buf bytes.Buffer
+	enc := c.NewEncoder(&buf)
+	for _, delta := range deltas {
+		if err := enc.Encode(delta); err != nil {
+			return fmt.Errorf("failed to encode delta %d: %v", delta.ID, err)
+		}
+	}
+	data, err := compression.Compress(fileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := objstore.WriteFile(context.Background(), fileName, data); err != nil {
+		return fmt.Errorf("failed to write archive file: %v", err)
+	}
+	return nil
+}
+
+// read every archived delta in dir, whatever codec and compression each file
+// was written with, in replay order
+func readArchivedDeltas(dir string) ([]Delta, error) {
+	names, err := objstore.List(context.Background(), dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archive files: %v", err)
+	}
+	var files []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "deltas-") {
+			files = append(files, name)
+		}
+	}
+
+	// a file the index lists and the directory doesn't have took its deltas with it
+	index, ok, err := readArchiveIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		for _, entry := range index {
+			if !containsString(files, entry.File) {
+				return nil, fmt.Errorf("archive file %s, listed in %s with deltas %d to %d, is missing", entry.File, archiveIndexName, entry.FirstID, entry.LastID)
+			}
+		}
+	}
+
+	var deltas []Delta
+	for _, name := range files {
+		c, ok := codec.ForFile(compression.Trim(name))
+		if !ok {
+			continue // e.g. a .tmp file left by a crash
+		}
+		fileName := objstore.Join(dir, name)
+		data, err := objstore.ReadFile(context.Background(), fileName)
+		if err == nil {
+			data, err = compression.Decompress(fileName, data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive file: %v", err)
+		}
+
+		dec := c.NewDecoder(bytes.NewReader(data))
+		for {
+			var delta Delta
+			err := dec.Decode(&delta)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode archive file %s: %v", fileName, err)
+			}
+			deltas = append(deltas, delta)
+		}
+	}
+
+	sort.SliceStable(deltas, func(i, j int) bool {
+		if deltas[i].Timestamp.Equal(deltas[j].Timestamp) {
+			return deltas[i].ID < deltas[j].ID
+		}
+		return deltas[i].Timestamp.Before(deltas[j].Timestamp)
+	})
+	return deltas, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"db-delta-tracker/pkg/backup"
+	"db-delta-tracker/pkg/compression"
+	"db-delta-tracker/pkg/objstore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// the formats backup writes tables in, with their file extensions
+var backupFormats = map[string]string{"json": ".json", "csv": ".csv"}
+
+// what backup wrote
+type backupResult struct {
+	Format string        `json:"format"`
+	Tables []backedTable `json:"tables"`
+}
+
+type backedTable struct {
+	Table    string `json:"table"`
+	File     string `json:"file"`
+	Rows     int    `json:"rows"`
+	Snapshot string `json:"snapshot"` // txid_current_snapshot the rows were read at
+}
+
+// copy the source's tables into a file each, as they are now: JSON as init
+// backs them up, or CSV with a header row for spreadsheets and COPY
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write a file per table into, local or s3://, gs:// or az://")
+	format := fs.String("format", "json", "file format: json or csv")
+	onlyTables := fs.String("tables", "", "comma separated tables to back up; default all but those backup.exclude leaves out")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *dir == "" {
+		usagef("Usage: backup --dir <dir> [--format json|csv] [--tables <table>,...]")
+	}
+	if _, ok := backupFormats[*format]; !ok {
+		usagef("-format must be json or csv")
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, err := backupTables(*dir, *format, splitList(*onlyTables))
+	if err != nil {
+		fatal(err, "Error backing up tables")
+	}
+	outputFormat.Print(result, func() {
+		for _, t := range result.Tables {
+			fmt.Printf("%s: %d rows in %s\n", t.Table, t.Rows, t.File)
+		}
+	})
+}
+
+// read each table in its own repeatable read transaction and write it to
+// <table><ext> in dir, compressed as backup.compression says
+func backupTables(dir, format string, only []string) (backupResult, error) {
+	result := backupResult{Format: format, Tables: []backedTable{}}
+	tables := only
+	if len(tables) == 0 {
+		names, err := getTableNames()
+		if err != nil {
+			return result, err
+		}
+		for _, name := range names {
+			if (name != "deltas" || cfg.Backup.IncludeDeltas) && !cfg.Backup.Excludes(name) {
+				tables = append(tables, name)
+			}
+		}
+	}
+	sort.Strings(tables)
+
+	method, _ := compression.Lookup(cfg.Backup.Compression) // checked by Validate
+	timeout, _ := cfg.Timeouts.Snapshot.Duration()
+	for _, table := range tables {
+		if !tableExists(dbConn, table) {
+			return result, fmt.Errorf("table %s does not exist", table)
+		}
+		rows, snapshot, err := backup.Table(context.Background(), dbConn, table, backup.Options{StatementTimeout: timeout})
+		if err != nil {
+			return result, err
+		}
+		path := objstore.Join(dir, method.FileName(table+backupFormats[format]))
+		if format == "json" {
+			err = backup.WriteFile(path, rows)
+		} else {
+			err = writeCSVFile(path, table, rows)
+		}
+		if err != nil {
+			return result, err
+		}
+		log.Printf("Backed up %s: %d rows.", table, len(rows))
+		result.Tables = append(result.Tables, backedTable{Table: table, File: path, Rows: len(rows), Snapshot: snapshot})
+	}
+	return result, nil
+}
+
+// write a table's rows as CSV, with its columns in the source's order
+func writeCSVFile(path, table string, rows []tracker.Row) error {
+	columns, err := materializeColumns(table, rows)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, columns, rows); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	data, err := compression.Compress(path, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := objstore.WriteFile(context.Background(), path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// how many transactions' commit timestamps are read per query
+const txidsPerQuery = 1000
+
+// a base backup taken by another tool, e.g. pg_dump or a managed service's
+// snapshot, already restored into the target; only the deltas it doesn't
+// contain are replayed on top of it
+type baseBackup struct {
+	snapshot *txSnapshot // the transaction snapshot it was read at, when known
+	takenAt  time.Time   // otherwise the time it was taken
+}
+
+// parse the -base-snapshot and -base-time flag values; nil when neither is set
+func parseBaseBackup(snapshot, takenAt string) (*baseBackup, error) {
+	switch {
+	case snapshot != "" && takenAt != "":
+		return nil, fmt.Errorf("-base-snapshot and -base-time can't be combined")
+	case snapshot != "":
+		snap, err := parseTxSnapshot(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		return &baseBackup{snapshot: &snap}, nil
+	case takenAt != "":
+		at, err := time.Parse(time.RFC3339, takenAt)
+		if err != nil {
+			return nil, fmt.Errorf("-base-time must be an RFC 3339 time, e.g. 2024-05-01T12:00:00Z: %v", err)
+		}
+		return &baseBackup{takenAt: at}, nil
+	}
+	return nil, nil
+}
+
+// drop the deltas whose changes the base backup already contains, marks and
+// renames included. Against a time, a delta is contained when its transaction
+// committed before it, which is known when the source has
+// track_commit_timestamp on; otherwise the time the transaction started is
+// all there is to go by.
+func (b *baseBackup) skipContained(deltas []Delta) ([]Delta, error) {
+	if b.snapshot != nil {
+		kept := deltas[:0]
+		for _, delta := range deltas {
+			if delta.TxID == 0 || !b.snapshot.contains(delta.TxID) {
+				kept = append(kept, delta)
+			}
+		}
+		return kept, nil
+	}
+
+	committed, err := commitTimes(deltas)
+	if err != nil {
+		return nil, err
+	}
+	if committed == nil {
+		log.Printf("Warning: track_commit_timestamp is off on the source, so deltas are compared with -base-time by when their transaction started; transactions running while the base backup was taken may be replayed twice or not at all.")
+	}
+	kept := deltas[:0]
+	for _, delta := range deltas {
+		at, ok := committed[delta.TxID]
+		if !ok {
+			at = delta.Timestamp
+		}
+		if !at.Before(b.takenAt) {
+			kept = append(kept, delta)
+		}
+	}
+	return kept, nil
+}
+
+// when each delta's transaction committed, or nil if the source doesn't track
+// it. Transactions too old for the commit timestamps still kept are left out.
+func commitTimes(deltas []Delta) (map[int64]time.Time, error) {
+	var tracked string
+	if err := dbConn.QueryRow("SELECT current_setting('track_commit_timestamp')").Scan(&tracked); err != nil {
+		return nil, fmt.Errorf("failed to read track_commit_timestamp: %v", err)
+	}
+	if tracked != "on" {
+		return nil, nil
+	}
+
+	seen := make(map[int64]bool)
+	var txids []int64
+	for _, delta := range deltas {
+		if delta.TxID != 0 && !seen[delta.TxID] {
+			seen[delta.TxID] = true
+			txids = append(txids, delta.TxID)
+		}
+	}
+	committed := make(map[int64]time.Time, len(txids))
+	for start := 0; start < len(txids); start += txidsPerQuery {
+		end := min(start+txidsPerQuery, len(txids))
+		// txids carry an epoch above the 32 bits of the xid the commit timestamp is kept by
+		rows, err := dbConn.Query(`
+			SELECT t, pg_xact_commit_timestamp((t % 4294967296)::text::xid)
+			FROM unnest($1::bigint[]) t
+			WHERE txid_status(t) = 'committed'
+		`, pq.Array(txids[start:end]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit timestamps: %v", err)
+		}
+		for rows.Next() {
+			var txid int64
+			var at *time.Time
+			if err := rows.Scan(&txid, &at); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan a commit timestamp: %v", err)
+			}
+			if at != nil {
+				committed[txid] = *at
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read commit timestamps: %v", err)
+		}
+	}
+	return committed, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// who last changed each column of a row, like git blame for a database row
+type blameResult struct {
+	Table   string        `json:"table"`
+	Key     tracker.Row   `json:"key"`
+	Deltas  int           `json:"deltas"`            // recorded for the row
+	Deleted *blameChange  `json:"deleted,omitempty"` // the delete that removed the row, if its latest change was one
+	Columns []columnBlame `json:"columns"`           // in name order
+}
+
+type columnBlame struct {
+	Column string       `json:"column"`
+	Value  interface{}  `json:"value"`                 // the latest value the deltas show
+	Change *blameChange `json:"last_change,omitempty"` // unset if no delta changed it since capture began
+}
+
+// the delta that last set a column
+type blameChange struct {
+	DeltaID   int64            `json:"delta_id"`
+	Action    string           `json:"action"`
+	Timestamp time.Time        `json:"timestamp"`
+	User      string           `json:"user,omitempty"` // role that logged in; unset for deltas from before it was recorded
+	Old       interface{}      `json:"old,omitempty"`
+	New       interface{}      `json:"new,omitempty"`
+	Context   *json.RawMessage `json:"context,omitempty"`
+	Origin    string           `json:"origin,omitempty"`
+}
+
+// report the last delta that changed each column of one row
+func runBlame(args []string) {
+	fs := flag.NewFlagSet("blame", flag.ExitOnError)
+	pk := fs.String("pk", "", "the row's key; comma separated values in key column order for a composite key")
+	configFlag(fs)
+	outputFlag(fs)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 || *pk == "" {
+		usagef("Usage: blame <table> --pk <value>[,<value>...]")
+	}
+	table := positional[0]
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, err := blameRow(table, strings.Split(*pk, ","))
+	if err != nil {
+		fatal(err, "Error blaming row")
+	}
+	outputFormat.Print(result, func() {
+		fmt.Printf("%s %s: %d deltas\n", result.Table, formatRow(result.Key), result.Deltas)
+		if d := result.Deleted; d != nil {
+			fmt.Printf("Deleted by delta %d at %s (%s)\n", d.DeltaID, d.Timestamp.Format(time.RFC3339), blameUser(d))
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "COLUMN\tVALUE\tDELTA\tWHEN\tUSER\tCHANGE")
+		for _, c := range result.Columns {
+			value, _ := json.Marshal(c.Value)
+			if c.Change == nil {
+				fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t(unchanged since capture began)\n", c.Column, value)
+				continue
+			}
+			old := "(none)"
+			if c.Change.Action != "INSERT" {
+				encoded, _ := json.Marshal(c.Change.Old)
+				old = string(encoded)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s %s -> %s\n", c.Column, value, c.Change.DeltaID,
+				c.Change.Timestamp.Format(time.RFC3339), blameUser(c.Change), c.Change.Action, old, value)
+		}
+		w.Flush()
+	})
+}
+
+func blameUser(c *blameChange) string {
+	if c.User == "" {
+		return "-"
+	}
+	return c.User
+}
+
+// walk a row's deltas, oldest first, keeping the last one to change each
+// column. The row is found by the table's key as the source has it now,
+// matched as text against the old and new values of each delta. A delete
+// followed by an insert under the same key starts the row's history over.
+func blameRow(table string, values []string) (blameResult, error) {
+	result := blameResult{Table: table, Columns: []columnBlame{}}
+	if !tableExists(dbConn, table) {
+		return result, fmt.Errorf("table %s does not exist", table)
+	}
+	key, err := restore.RowKey(context.Background(), dbConn, table)
+	if err != nil {
+		return result, err
+	}
+	if len(key) == 0 {
+		return result, fmt.Errorf("%s has no primary key or id column to find the row by", table)
+	}
+	if len(values) != len(key) {
+		return result, fmt.Errorf("%s is keyed by %s; --pk needs %d values", table, strings.Join(key, ", "), len(key))
+	}
+
+	result.Key = make(tracker.Row, len(key))
+	args := []interface{}{table}
+	for i, column := range key {
+		result.Key[column] = values[i]
+		args = append(args, column, values[i])
+	}
+	// the key columns and values are $2 and $3, $4 and $5, and so on
+	match := func(payload string) string {
+		conditions := make([]string, len(key))
+		for i := range key {
+			conditions[i] = fmt.Sprintf("%s->>$%d = $%d", payload, 2*i+2, 2*i+3)
+		}
+		return strings.Join(conditions, " AND ")
+	}
+	rows, err := dbConn.Query(fmt.Sprintf(`
+		SELECT id, action, old_data, new_data, timestamp, db_user, context, origin
+		FROM deltas
+		WHERE table_name = $1 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+		  AND ((%s) OR (%s))
+		ORDER BY timestamp, id
+	`, match("old_data"), match("new_data")), args...)
+	if err != nil {
+		return result, fmt.Errorf("error fetching the row's deltas: %v", err)
+	}
+	defer rows.Close()
+
+	last := make(map[string]*blameChange)
+	var current tracker.Row
+	for rows.Next() {
+		var delta Delta
+		var user, origin sql.NullString
+		if err := rows.Scan(&delta.ID, &delta.Action, &delta.OldData, &delta.NewData, &delta.Timestamp, &user, &delta.Context, &origin); err != nil {
+			return result, fmt.Errorf("error scanning delta: %v", err)
+		}
+		oldData, newData, err := diffPayloads(delta)
+		if err != nil {
+			return result, err
+		}
+		result.Deltas++
+		change := func(column string) *blameChange {
+			return &blameChange{DeltaID: delta.ID, Action: delta.Action, Timestamp: delta.Timestamp,
+				User: user.String, Old: oldData[column], New: newData[column], Context: delta.Context, Origin: origin.String}
+		}
+
+		switch delta.Action {
+		case "INSERT":
+			last = make(map[string]*blameChange)
+			for column := range newData {
+				last[column] = change(column)
+			}
+			current, result.Deleted = newData, nil
+		case "UPDATE":
+			for _, column := range changedColumns(oldData, newData) {
+				last[column] = change(column)
+			}
+			current, result.Deleted = newData, nil
+		case "DELETE":
+			current, result.Deleted = oldData, change("")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	if result.Deltas == 0 {
+		return result, fmt.Errorf("no deltas recorded for %s %s", table, formatRow(result.Key))
+	}
+
+	columns := make([]string, 0, len(current))
+	for column := range current {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		result.Columns = append(result.Columns, columnBlame{Column: column, Value: current[column], Change: last[column]})
+	}
+	return result, nil
+}
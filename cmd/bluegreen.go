@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+)
+
+// the databases a blue/green restore worked with
+type blueGreenResult struct {
+	Active   string `json:"active"`   // now holds the new restore
+	Previous string `json:"previous"` // the copy it replaced, kept as a fallback
+	Base     string `json:"base"`     // the untouched init copy each green copy starts from
+}
+
+// restore into a fresh green copy of the restored database and swap it in
+// only once it replayed cleanly, so whoever reads the restored database never
+// sees one half way through a replay. Every green copy starts from the base
+// copy, which is taken from the restored database on the first run, so that
+// first run has to come before any plain restore.
+func restoreBlueGreen(opts restoreOptions) (restoreResult, error) {
+	var result restoreResult
+	active := cfg.Target.DBName
+	names := blueGreenResult{Active: active, Previous: active + "_previous", Base: active + "_base"}
+	green := active + "_green"
+
+	// CREATE, DROP and RENAME DATABASE run from the server's maintenance database
+	admin, err := cfg.Target.WithDatabase("postgres").Open()
+	if err == nil {
+		err = admin.Ping()
+	}
+	if err != nil {
+		return result, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the target server: %v", err))
+	}
+	defer admin.Close()
+
+	hasBase, err := databaseExists(admin, names.Base)
+	if err != nil {
+		return result, err
+	}
+	if !hasBase {
+		log.Printf("Keeping a copy of %s as %s, the base every green copy starts from.", active, names.Base)
+		if err := copyDatabase(admin, names.Base, active); err != nil {
+			return result, err
+		}
+	}
+
+	log.Printf("Restoring into %s.", green)
+	if err := dropDatabase(admin, green); err != nil {
+		return result, err
+	}
+	if err := copyDatabase(admin, green, names.Base); err != nil {
+		return result, err
+	}
+
+	target := cfg.Target
+	cfg.Target, restoreDB = cfg.Target.WithDatabase(green), green
+	result, err = RestoreDatabase(opts)
+	cfg.Target, restoreDB = target, active
+	if err != nil {
+		return result, fmt.Errorf("%v (%s is unchanged; %s is left for inspection)", err, active, green)
+	}
+	if len(result.Orphans) > 0 {
+		return result, exitcode.Wrap(exitcode.Mismatch, fmt.Errorf("%s has rows whose parent is missing; not swapping it in (%s is unchanged)", green, active))
+	}
+
+	// the swap itself: active becomes previous, green becomes active. Sessions
+	// on the active copy are ended, since a database in use can't be renamed;
+	// until the second rename they get "database does not exist", never a
+	// partial restore
+	log.Printf("Swapping %s in as %s, keeping the old copy as %s.", green, active, names.Previous)
+	if err := dropDatabase(admin, names.Previous); err != nil {
+		return result, err
+	}
+	if err := terminateSessions(admin, active); err != nil {
+		return result, err
+	}
+	if _, err := admin.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", ident.Quote(active), ident.Quote(names.Previous))); err != nil {
+		return result, fmt.Errorf("failed to rename %s to %s: %v", active, names.Previous, err)
+	}
+	if err := terminateSessions(admin, green); err != nil {
+		return result, err
+	}
+	if _, err := admin.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", ident.Quote(green), ident.Quote(active))); err != nil {
+		return result, fmt.Errorf("failed to rename %s to %s, %s is still available as %s: %v", green, active, active, names.Previous, err)
+	}
+	result.BlueGreen = &names
+	return result, nil
+}
+
+func databaseExists(admin *sql.DB, name string) (bool, error) {
+	var exists bool
+	if err := admin.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %v", name, err)
+	}
+	return exists, nil
+}
+
+// create a database as a copy of another, which can have no other sessions
+// while it is copied
+func copyDatabase(admin *sql.DB, name, from string) error {
+	if err := terminateSessions(admin, from); err != nil {
+		return err
+	}
+	if _, err := admin.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", ident.Quote(name), ident.Quote(from))); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %v", from, name, err)
+	}
+	return nil
+}
+
+func dropDatabase(admin *sql.DB, name string) error {
+	if err := terminateSessions(admin, name); err != nil {
+		return err
+	}
+	if _, err := admin.Exec("DROP DATABASE IF EXISTS " + ident.Quote(name)); err != nil {
+		return fmt.Errorf("failed to drop %s: %v", name, err)
+	}
+	return nil
+}
+
+// end every other session connected to a database
+func terminateSessions(admin *sql.DB, name string) error {
+	_, err := admin.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()", name)
+	if err != nil {
+		return fmt.Errorf("failed to end sessions on %s: %v", name, err)
+	}
+	return nil
+}
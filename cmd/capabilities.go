@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"db-delta-tracker/pkg/ident"
+)
+
+// admin roles that give away a managed PostgreSQL service, where even the
+// most privileged login is no superuser and some statements are refused
+var managedServiceRoles = []struct{ role, service string }{
+	{"rds_superuser", "Amazon RDS"},
+	{"cloudsqlsuperuser", "Google Cloud SQL"},
+	{"azure_pg_admin", "Azure Database for PostgreSQL"},
+}
+
+// what the login may do on a target database
+type targetCapabilities struct {
+	Service   string `json:"service,omitempty"` // the managed service, if one was recognized
+	Superuser bool   `json:"superuser"`
+}
+
+// look at the target before writing to it, so statements it would refuse
+// are skipped and summarized instead of failing the restore half way
+func probeTarget(conn *sql.DB) (targetCapabilities, error) {
+	var c targetCapabilities
+	if err := conn.QueryRow("SELECT rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&c.Superuser); err != nil {
+		return c, fmt.Errorf("failed to probe the target's capabilities: %v", err)
+	}
+	for _, m := range managedServiceRoles {
+		var exists bool
+		if err := conn.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", m.role).Scan(&exists); err != nil {
+			return c, fmt.Errorf("failed to probe the target's capabilities: %v", err)
+		}
+		if exists {
+			c.Service = m.service
+			break
+		}
+	}
+	if c.Service != "" && !c.Superuser {
+		log.Printf("The restored database looks like %s; statements it refuses are skipped and listed at the end.", c.Service)
+	}
+	return c, nil
+}
+
+// whether the login may alter a table (index, rename), which takes
+// membership in the role owning it
+func canAlterTable(conn *sql.DB, table string) (bool, error) {
+	var ok bool
+	err := conn.QueryRow("SELECT pg_has_role(relowner, 'USAGE') FROM pg_class WHERE oid = $1::regclass", ident.Quote(table)).Scan(&ok)
+	if err != nil {
+		return false, fmt.Errorf("failed to check ownership of %s: %v", table, err)
+	}
+	return ok, nil
+}
+
+// operations left out because the target doesn't allow them, reported at
+// the end of a restore or merge
+var skippedOperations []string
+
+// record an operation as skipped, warning about it now as well
+func skipOperation(format string, args ...interface{}) {
+	op := fmt.Sprintf(format, args...)
+	log.Printf("Warning: skipped %s.", op)
+	skippedOperations = append(skippedOperations, op)
+}
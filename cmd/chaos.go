@@ -0,0 +1,71 @@
+//go:build chaos
+
+package main
+
+import (
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// faults a chaos build injects into replay, to check that an interrupted,
+// slow or duplicated replay still ends with the right rows
+var chaos struct {
+	dropRate      float64       // chance of failing before a delta as if the connection dropped
+	delay         time.Duration // wait before each source transaction
+	duplicateRate float64       // chance of replaying a delta twice in a row
+	seed          int64
+
+	rng      *rand.Rand
+	lastTxID int64
+}
+
+func chaosFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&chaos.dropRate, "chaos-drop-rate", 0, "chaos: chance (0-1) of dropping the connection before each delta")
+	fs.DurationVar(&chaos.delay, "chaos-delay", 0, "chaos: delay before applying each source transaction")
+	fs.Float64Var(&chaos.duplicateRate, "chaos-duplicate-rate", 0, "chaos: chance (0-1) of delivering each delta twice")
+	fs.Int64Var(&chaos.seed, "chaos-seed", 0, "chaos: seed for the injected faults (0 = random)")
+}
+
+func chaosRand() *rand.Rand {
+	if chaos.rng == nil {
+		if chaos.seed == 0 {
+			chaos.seed = time.Now().UnixNano()
+		}
+		log.Printf("Chaos: injecting faults with seed %d.", chaos.seed)
+		chaos.rng = rand.New(rand.NewSource(chaos.seed))
+	}
+	return chaos.rng
+}
+
+// deliver some deltas twice, as a capture or transport retry would
+func chaosDeltas(deltas []Delta) []Delta {
+	if chaos.duplicateRate <= 0 {
+		return deltas
+	}
+	rng := chaosRand()
+	out := make([]Delta, 0, len(deltas))
+	for _, delta := range deltas {
+		out = append(out, delta)
+		if rng.Float64() < chaos.duplicateRate {
+			log.Printf("Chaos: duplicating delta %d.", delta.ID)
+			out = append(out, delta)
+		}
+	}
+	return out
+}
+
+// slow down or break the replay before a delta is applied
+func chaosBeforeApply(delta Delta) error {
+	if chaos.delay > 0 && (delta.TxID != chaos.lastTxID || delta.TxID == 0) {
+		chaos.lastTxID = delta.TxID
+		time.Sleep(chaos.delay)
+	}
+	if chaos.dropRate > 0 && chaosRand().Float64() < chaos.dropRate {
+		return fmt.Errorf("chaos: dropped connection before delta %d: %w", delta.ID, driver.ErrBadConn)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !chaos
+
+package main
+
+import "flag"
+
+// fault injection is only compiled in with -tags chaos, see chaos.go
+func chaosFlags(fs *flag.FlagSet)        {}
+func chaosDeltas(deltas []Delta) []Delta { return deltas }
+func chaosBeforeApply(delta Delta) error { return nil }
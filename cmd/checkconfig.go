@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+
+	"github.com/lib/pq"
+)
+
+// outcome of a single check-config check
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // PASS, WARN or FAIL
+	Detail string `json:"detail"`
+}
+
+func pass(name, detail string) checkResult { return checkResult{name, "PASS", detail} }
+func warn(name, detail string) checkResult { return checkResult{name, "WARN", detail} }
+func fail(name, detail string) checkResult { return checkResult{name, "FAIL", detail} }
+
+// validate the config and try every connection it describes, so
+// misconfiguration shows up before a scheduled job runs
+func runCheckConfig(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for each connection")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	results := checkConfig(configPath, profile, *timeout)
+	failed := false
+	for _, r := range results {
+		failed = failed || r.Status == "FAIL"
+	}
+
+	report := struct {
+		OK     bool          `json:"ok"`
+		Checks []checkResult `json:"checks"`
+	}{!failed, results}
+	outputFormat.Print(report, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+		}
+		w.Flush()
+	})
+
+	if failed {
+		os.Exit(checkExitCode(results))
+	}
+}
+
+// pick the exit status for failed checks: config problems first, since
+// they make every later check meaningless, then unreachable databases
+func checkExitCode(results []checkResult) int {
+	code := exitcode.Failure
+	for _, r := range results {
+		if r.Status != "FAIL" {
+			continue
+		}
+		if strings.HasPrefix(r.Name, "config ") {
+			return exitcode.Config
+		}
+		if strings.HasSuffix(r.Name, ": connect") {
+			code = exitcode.Connection
+		}
+	}
+	return code
+}
+
+// run every check against the config file at path, with a profile applied
+func checkConfig(path, profile string, timeout time.Duration) []checkResult {
+	c, err := config.Load(path, profile)
+	if err != nil {
+		return []checkResult{fail("config file", err.Error())}
+	}
+	if readOnly {
+		c.Source, c.Target = c.Source.ReadOnly(), c.Target.ReadOnly()
+	}
+	detail := path
+	if c.Profile != "" {
+		detail = fmt.Sprintf("%s (profile %s)", path, c.Profile)
+	}
+	results := []checkResult{pass("config file", detail)}
+
+	errs := c.Validate()
+	for _, err := range errs {
+		results = append(results, fail("config fields", err.Error()))
+	}
+	if len(errs) > 0 {
+		// connecting with incomplete settings would only repeat the errors
+		return results
+	}
+	if c.Retention.MaxSize != "" {
+		if _, err := parseBytes(c.Retention.MaxSize); err != nil {
+			return append(results, fail("config fields", "retention.max_size: "+err.Error()))
+		}
+	}
+	if _, err := codec.Lookup(c.Retention.ArchiveCodec); err != nil {
+		return append(results, fail("config fields", "retention.archive_codec: "+err.Error()))
+	}
+	results = append(results, pass("config fields", "all required fields set"))
+
+	results = append(results, checkSource(c, timeout)...)
+	results = append(results, checkTarget(c, timeout)...)
+	for _, route := range c.Routes {
+		results = append(results, checkRoute(route, timeout))
+	}
+	for _, shard := range c.Merge.Shards {
+		results = append(results, checkShard(shard, timeout))
+	}
+	if c.Notify.Webhook != "" {
+		results = append(results, checkWebhook(c.Notify.Webhook, timeout))
+	}
+	return results
+}
+
+// check the tracked database: reachable, and the login may install capture
+func checkSource(c *config.Config, timeout time.Duration) []checkResult {
+	db, version, err := connectWithTimeout(c.Source, timeout)
+	if err != nil {
+		return []checkResult{fail("source: connect", fmt.Sprintf("%v (password from %s)", err, c.Source.PasswordSource()))}
+	}
+	defer db.Close()
+	results := []checkResult{
+		pass("source: connect", "PostgreSQL "+version+roleDetail(c.Source)),
+		pass("source: password", "from "+c.Source.PasswordSource()),
+	}
+
+	var canCreate bool
+	err = db.QueryRow("SELECT has_database_privilege(current_database(), 'CREATE') AND has_schema_privilege('public', 'CREATE')").Scan(&canCreate)
+	results = append(results, privilegeResult("source: create deltas table and schema", canCreate, err,
+		"needs CREATE on the database and on schema public"))
+
+	var missing sql.NullString
+	err = db.QueryRow(`
+		SELECT string_agg(table_name, ', ' ORDER BY table_name)
+		FROM information_schema.tables
+		WHERE table_schema = 'public' AND table_type = 'BASE TABLE'
+			AND NOT (has_table_privilege(format('%I.%I', table_schema, table_name), 'TRIGGER')
+				AND has_table_privilege(format('%I.%I', table_schema, table_name), 'SELECT'))
+	`).Scan(&missing)
+	results = append(results, privilegeResult("source: trigger and read tables", !missing.Valid, err,
+		"missing TRIGGER or SELECT on: "+missing.String))
+
+	// init creates the restored database from the source connection
+	var targetExists, canCreateDB bool
+	err = db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM pg_database WHERE datname = $1),
+			(SELECT rolcreatedb OR rolsuper FROM pg_roles WHERE rolname = current_user)
+	`, c.Target.DBName).Scan(&targetExists, &canCreateDB)
+	if err == nil && !targetExists {
+		results = append(results, privilegeResult("source: create restored database", canCreateDB, nil,
+			fmt.Sprintf("%s doesn't exist and the login lacks CREATEDB", c.Target.DBName)))
+	} else if err != nil {
+		results = append(results, fail("source: create restored database", err.Error()))
+	}
+
+	return results
+}
+
+// check the restored database: reachable and writable
+func checkTarget(c *config.Config, timeout time.Duration) []checkResult {
+	db, version, err := connectWithTimeout(c.Target, timeout)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "3D000" {
+			return []checkResult{warn("target: connect", fmt.Sprintf("%s doesn't exist yet; init creates it", c.Target.DBName))}
+		}
+		return []checkResult{fail("target: connect", fmt.Sprintf("%v (password from %s)", err, c.Target.PasswordSource()))}
+	}
+	defer db.Close()
+	results := []checkResult{
+		pass("target: connect", "PostgreSQL "+version+roleDetail(c.Target)),
+		pass("target: password", "from "+c.Target.PasswordSource()),
+	}
+
+	var canCreate bool
+	err = db.QueryRow("SELECT has_schema_privilege('public', 'CREATE')").Scan(&canCreate)
+	results = append(results, privilegeResult("target: create tables", canCreate, err,
+		"needs CREATE on schema public"))
+
+	if caps, err := probeTarget(db); err != nil {
+		results = append(results, fail("target: capabilities", err.Error()))
+	} else if caps.Service != "" && !caps.Superuser {
+		results = append(results, warn("target: capabilities", caps.Service+"; indexes and renames on tables the login doesn't own are skipped"))
+	} else {
+		results = append(results, pass("target: capabilities", fmt.Sprintf("superuser: %v", caps.Superuser)))
+	}
+
+	return results
+}
+
+// check a merge shard is reachable and has a deltas table to read
+func checkShard(shard config.Shard, timeout time.Duration) checkResult {
+	name := "shard " + shard.Name + ": connect"
+	db, version, err := connectWithTimeout(shard.Source, timeout)
+	if err != nil {
+		return fail(name, fmt.Sprintf("%v (password from %s)", err, shard.Source.PasswordSource()))
+	}
+	defer db.Close()
+
+	var hasDeltas bool
+	if err := db.QueryRow("SELECT has_table_privilege('deltas', 'SELECT')").Scan(&hasDeltas); err != nil || !hasDeltas {
+		return fail(name, "can't read the deltas table; run init on the shard first")
+	}
+	return pass(name, "PostgreSQL "+version+roleDetail(shard.Source))
+}
+
+// check a routed target database accepts connections
+func checkRoute(route config.Route, timeout time.Duration) checkResult {
+	name := "route " + route.Target.DBName + ": connect"
+	db, version, err := connectWithTimeout(route.Target, timeout)
+	if err != nil {
+		return fail(name, fmt.Sprintf("%v (password from %s)", err, route.Target.PasswordSource()))
+	}
+	db.Close()
+	return pass(name, fmt.Sprintf("PostgreSQL %s, tables %v%s", version, route.Tables, roleDetail(route.Target)))
+}
+
+// check the notification webhook's host accepts connections, without sending anything
+func checkWebhook(webhook string, timeout time.Duration) checkResult {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return fail("notify: webhook", err.Error())
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), timeout)
+	if err != nil {
+		return fail("notify: webhook", err.Error())
+	}
+	conn.Close()
+	return pass("notify: webhook", u.Host+" reachable")
+}
+
+// open a connection and make sure it answers within the timeout, returning
+// the server version
+func connectWithTimeout(conn config.Connection, timeout time.Duration) (*sql.DB, string, error) {
+	seconds := max(1, int(timeout.Seconds()))
+	db, err := conn.Open("connect_timeout", strconv.Itoa(seconds))
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var version string
+	if err := db.QueryRowContext(ctx, "SHOW server_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, "", err
+	}
+	return db, version, nil
+}
+
+// note the role a connection switches to; privileges are checked for it
+func roleDetail(conn config.Connection) string {
+	if conn.Role == "" {
+		return ""
+	}
+	return " (as role " + conn.Role + ")"
+}
+
+// turn a privilege query into a check result
+func privilegeResult(name string, ok bool, err error, problem string) checkResult {
+	if err != nil {
+		return fail(name, err.Error())
+	}
+	if !ok {
+		return fail(name, problem)
+	}
+	return pass(name, "ok")
+}
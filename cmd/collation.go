@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// a database's encoding and default locale
+type databaseLocale struct {
+	Encoding, Collate, Ctype string
+}
+
+func readDatabaseLocale(db *sql.DB) (databaseLocale, error) {
+	var l databaseLocale
+	err := db.QueryRow(`
+		SELECT pg_encoding_to_char(encoding), datcollate, datctype
+		FROM pg_database WHERE datname = current_database()
+	`).Scan(&l.Encoding, &l.Collate, &l.Ctype)
+	if err != nil {
+		return l, fmt.Errorf("failed to read database encoding: %v", err)
+	}
+	return l, nil
+}
+
+// the collation of every collatable column of the public tables, by
+// "table.column"
+func readColumnCollations(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query(`
+		SELECT c.relname, a.attname, co.collname
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_collation co ON co.oid = a.attcollation
+		WHERE n.nspname = 'public' AND c.relkind = 'r' AND a.attnum > 0 AND NOT a.attisdropped
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read column collations: %v", err)
+	}
+	defer rows.Close()
+
+	collations := make(map[string]string)
+	for rows.Next() {
+		var table, column, collation string
+		if err := rows.Scan(&table, &column, &collation); err != nil {
+			return nil, fmt.Errorf("failed to scan column collation: %v", err)
+		}
+		collations[table+"."+column] = collation
+	}
+	return collations, rows.Err()
+}
+
+// compare the encoding and collations of the original and restored
+// databases, warning about each difference: a different collation can
+// change how text sorts and which values a unique index treats as equal, and
+// a different encoding can reject characters the original accepted
+func checkCollations(restoredConn *sql.DB) ([]string, error) {
+	source, err := readDatabaseLocale(dbConn)
+	if err != nil {
+		return nil, err
+	}
+	target, err := readDatabaseLocale(restoredConn)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []string
+	if source.Encoding != target.Encoding {
+		mismatches = append(mismatches, fmt.Sprintf("encoding is %s in the original but %s in the restored database", source.Encoding, target.Encoding))
+	}
+	if source.Collate != target.Collate {
+		mismatches = append(mismatches, fmt.Sprintf("default collation is %s in the original but %s in the restored database", source.Collate, target.Collate))
+	}
+	if source.Ctype != target.Ctype {
+		mismatches = append(mismatches, fmt.Sprintf("character classification (LC_CTYPE) is %s in the original but %s in the restored database", source.Ctype, target.Ctype))
+	}
+
+	sourceColumns, err := readColumnCollations(dbConn)
+	if err != nil {
+		return nil, err
+	}
+	targetColumns, err := readColumnCollations(restoredConn)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(sourceColumns))
+	for column := range sourceColumns {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		collation := sourceColumns[column]
+		if restored, ok := targetColumns[column]; ok && restored != collation {
+			mismatches = append(mismatches, fmt.Sprintf("column %s is collated %s in the original but %s in the restored database", column, collation, restored))
+		}
+	}
+
+	for _, m := range mismatches {
+		log.Printf("Warning: %s.", m)
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+
+	"github.com/lib/pq"
+)
+
+// what `compact` did to the deltas table, for -output json
+type compactResult struct {
+	Before    time.Time `json:"before"`
+	Read      int       `json:"deltas_read"`
+	Removed   int       `json:"deltas_removed"`         // folded into another delta, or cancelled out
+	Rewritten int       `json:"deltas_rewritten"`       // now carrying the net effect of their chain
+	HeldBy    []string  `json:"held_back_by,omitempty"` // consumers that haven't read deltas before -older-than yet
+	DryRun    bool      `json:"dry_run,omitempty"`
+}
+
+// handle `compact [-older-than 24h] [-tables a,b] [-dry-run]`: squash each
+// row's chain of deltas in the deltas table into its net effect, the way
+// restore -squash does at replay time, so the table shrinks and later
+// restores replay less
+func runCompact(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 24*time.Hour, "only compact deltas at least this old; newer ones keep every intermediate state")
+	onlyTables := fs.String("tables", "", "comma separated tables to compact; default all")
+	dryRun := fs.Bool("dry-run", false, "report what would be compacted without changing the deltas table")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *olderThan < 0 {
+		usagef("-older-than can't be negative")
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, err := compactDeltas(time.Now().Add(-*olderThan), splitList(*onlyTables), *dryRun)
+	if err != nil {
+		fatal(err, "Error compacting deltas")
+	}
+	outputFormat.Print(result, func() {
+		verb := "Removed"
+		if result.DryRun {
+			verb = "Would remove"
+		}
+		fmt.Printf("%s %d of %d deltas before %s and rewrote %d.\n", verb, result.Removed, result.Read, result.Before.Format(time.RFC3339), result.Rewritten)
+	})
+}
+
+// squash the deltas each transaction made before a time, once it has
+// finished. Only a transaction's own deltas are squashed together, since a
+// base backup or snapshot can fall between two transactions but never inside
+// one; marks and renames split them further, so restores to a mark still
+// stop at exactly the state it recorded. Deltas already contained in a
+// table's snapshot, and those a kafka sink, receiver or merge hasn't read
+// yet, are left alone.
+func compactDeltas(before time.Time, tables []string, dryRun bool) (compactResult, error) {
+	result := compactResult{Before: before, DryRun: dryRun}
+
+	// a consumer past the first delta of a chain would never see the
+	// changes folded into it
+	var err error
+	if result.Before, result.HeldBy, err = unreadSince(before); err != nil {
+		return result, err
+	}
+	if len(result.HeldBy) > 0 {
+		log.Printf("Warning: leaving the deltas made since %s alone, since %s hasn't read them yet.", result.Before.Format(time.RFC3339), strings.Join(result.HeldBy, " and "))
+	}
+	before = result.Before
+
+	snapshots, err := loadTableSnapshots()
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := dbConn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// a transaction still running may yet add deltas in the middle of a
+	// chain, so only those of transactions older than every running one are
+	// read; a row another transaction is changing is locked by it, so its
+	// chain so far is complete
+	var xmin int64
+	if err := tx.QueryRow("SELECT txid_snapshot_xmin(txid_current_snapshot())").Scan(&xmin); err != nil {
+		return result, fmt.Errorf("failed to read the oldest running transaction: %v", err)
+	}
+	rows, err := tx.Query(`
+		SELECT id, action, table_name, old_data, new_data, timestamp, COALESCE(txid, 0), COALESCE(statement, ''), context, COALESCE(origin, '')
+		FROM deltas
+		WHERE timestamp < $1 AND COALESCE(txid, 0) < $2
+		  AND (cardinality($3::text[]) = 0 OR table_name = ANY($3) OR action IN ($4, $5))
+		ORDER BY timestamp, id
+	`, before, xmin, pq.Array(tables), markAction, renameAction)
+	if err != nil {
+		return result, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	var deltas []Delta
+	for rows.Next() {
+		var delta Delta
+		if err := rows.Scan(&delta.ID, &delta.Action, &delta.TableName, &delta.OldData, &delta.NewData, &delta.Timestamp, &delta.TxID, &delta.Statement, &delta.Context, &delta.Origin); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("error scanning delta: %v", err)
+		}
+		deltas = append(deltas, delta)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+
+	// rows are keyed as the source keys them
+	keys := make(map[string][]string)
+	keyFor := func(table string) ([]string, error) {
+		if key, ok := keys[table]; ok {
+			return key, nil
+		}
+		key, err := restore.RowKey(context.Background(), dbConn, table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the key of %s: %v", table, err)
+		}
+		keys[table] = key
+		return key, nil
+	}
+
+	original := make(map[int64]Delta, len(deltas))
+	var kept []Delta
+	var segment []Delta
+	flush := func() error {
+		squashed, err := squashDeltas(segment, keyFor)
+		if err != nil {
+			return err
+		}
+		kept = append(kept, squashed...)
+		segment = segment[:0]
+		return nil
+	}
+	var segmentTx int64
+	for _, delta := range deltas {
+		if delta.Action == markAction || delta.Action == renameAction {
+			if err := flush(); err != nil {
+				return result, err
+			}
+			continue
+		}
+		// deltas without a txid can't be told apart by transaction, so
+		// each is a segment of its own
+		if len(segment) > 0 && (delta.TxID != segmentTx || delta.TxID == 0) {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+		segmentTx = delta.TxID
+		// restores skip these, so squashing them with later deltas would
+		// lose the changes the snapshot doesn't contain
+		if snap, ok := snapshots[delta.TableName]; ok && snap.contains(delta.TxID) {
+			continue
+		}
+		result.Read++
+		original[delta.ID] = delta
+		segment = append(segment, delta)
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	survived := make(map[int64]bool, len(kept))
+	var rewritten []Delta
+	for _, delta := range kept {
+		survived[delta.ID] = true
+		was := original[delta.ID]
+		if delta.Action != was.Action || !samePayload(delta.NewData, was.NewData) {
+			rewritten = append(rewritten, delta)
+		}
+	}
+	var removed []int64
+	for id := range original {
+		if !survived[id] {
+			removed = append(removed, id)
+		}
+	}
+	result.Removed, result.Rewritten = len(removed), len(rewritten)
+	if dryRun || (len(removed) == 0 && len(rewritten) == 0) {
+		return result, nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM deltas WHERE id = ANY($1)", pq.Array(removed)); err != nil {
+		return result, fmt.Errorf("failed to delete compacted deltas: %v", err)
+	}
+	for _, delta := range rewritten {
+		var newData *string
+		if delta.NewData != nil {
+			text := string(*delta.NewData)
+			newData = &text
+		}
+		// the delta keeps the first position of its chain, so it still
+		// replays before deltas of other rows that came to depend on it
+		_, err := tx.Exec("UPDATE deltas SET action = $2, new_data = $3::jsonb WHERE id = $1", delta.ID, delta.Action, newData)
+		if err != nil {
+			return result, fmt.Errorf("failed to rewrite delta %d: %v", delta.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit compaction: %v", err)
+	}
+	log.Printf("Compacted %d deltas into %d; run VACUUM on the deltas table to reuse the space.", result.Read, result.Read-result.Removed)
+	return result, nil
+}
+
+// whether two payloads hold the same JSON text
+func samePayload(a, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(*a, *b)
+}
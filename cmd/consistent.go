@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+)
+
+// applies deltas in transactions on each target. With -consistent the deltas
+// of one source transaction are applied in one transaction, and each commit
+// records in delta_tracker.replay_position which source transaction the
+// target now reflects, so readers never see part of a source transaction and
+// can tell how current their view is. -batch-size commits every that many
+// deltas instead (at the next source transaction boundary with -consistent),
+// and -single-transaction only once all of them are applied, so a failed
+// restore rolls back what it had applied since the last commit. Otherwise
+// every statement commits on its own, as before. With -pipeline, statements
+// in a transaction are queued and sent that many per round trip.
+type replayBatch struct {
+	consistent bool
+	size       int            // deltas per transaction with -batch-size; 0 for none
+	whole      bool           // with -single-transaction, commit only at the end
+	count      int            // deltas begun in the open transaction
+	applied    int            // statements run in the open transaction
+	targets    *replayTargets // names the databases statements run on
+	timeout    time.Duration  // statement_timeout of each statement, from timeouts.replay; 0 for the server's
+	retry      bool           // apply a source transaction that times out a statement at a time
+	txid       int64          // source transaction being applied; 0 when none is open
+	at         time.Time      // when it was made on the source
+	txs        map[*sql.DB]*sql.Tx
+	run        []replayStatement // run in the open transactions, to rerun if they time out
+	split      bool              // the source transaction is being applied a statement at a time
+	pipeline   int               // statements sent per round trip with -pipeline; 0 or 1 sends each alone
+	queued     []replayStatement // waiting to be sent in the open transactions
+}
+
+// a statement applying a delta, kept until its transaction commits
+type replayStatement struct {
+	conn  *sql.DB
+	delta Delta
+	query string
+	args  []interface{}
+}
+
+func newReplayBatch(opts restoreOptions, targets *replayTargets, timeout config.PhaseTimeout) *replayBatch {
+	d, _ := timeout.Duration() // checked by Validate
+	return &replayBatch{consistent: opts.consistent, size: opts.batchSize, whole: opts.singleTx, pipeline: opts.pipeline,
+		targets: targets, timeout: d, retry: timeout.Retry(), txs: make(map[*sql.DB]*sql.Tx)}
+}
+
+// whether statements run in transactions spanning several deltas
+func (b *replayBatch) enabled() bool {
+	return b.consistent || b.size > 0 || b.whole
+}
+
+// how many statements the open transaction ran, which a rollback undoes
+func (b *replayBatch) uncommitted() int {
+	return b.applied
+}
+
+// create the position table on a target; it has a single row
+func createReplayPosition(conn *sql.DB) error {
+	_, err := conn.Exec(`
+		CREATE SCHEMA IF NOT EXISTS delta_tracker;
+		CREATE TABLE IF NOT EXISTS delta_tracker.replay_position (
+			only_row BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (only_row),
+			txid BIGINT NOT NULL,
+			consistent_as_of TIMESTAMPTZ NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create replay position table: %v", err)
+	}
+	return nil
+}
+
+// start applying a delta, first committing the open transaction when it is
+// full: with -consistent when the delta belongs to another source
+// transaction (and the batch has -batch-size deltas), otherwise once it has
+// -batch-size deltas. With -consistent, deltas without a txid are applied on
+// their own.
+func (b *replayBatch) next(delta Delta) error {
+	if !b.enabled() {
+		return nil
+	}
+	sameTx := b.consistent && delta.TxID == b.txid && delta.TxID != 0
+	full := b.count > 0 && !b.whole && !sameTx && (b.size == 0 || b.count >= b.size)
+	if full {
+		if err := b.commit(); err != nil {
+			return err
+		}
+	}
+	b.txid, b.at = delta.TxID, delta.Timestamp
+	b.count++
+	return nil
+}
+
+// run the statement applying a delta on a target, inside the open source
+// transaction, recording it in the replay log. With on_timeout: retry, a
+// source transaction that times out is rolled back and applied again a
+// statement at a time; a single statement can't be split, so one that times
+// out on its own always fails the restore.
+func (b *replayBatch) exec(conn *sql.DB, delta Delta, query string, args ...interface{}) error {
+	if !b.enabled() || b.split {
+		return b.execAlone(conn, delta, query, args)
+	}
+	tx, ok := b.txs[conn]
+	if !ok {
+		var err error
+		if tx, err = b.begin(conn); err != nil {
+			return err
+		}
+		b.txs[conn] = tx
+	}
+	statement := replayStatement{conn, delta, query, args}
+	if b.pipeline > 1 {
+		b.queued = append(b.queued, statement)
+		b.applied++
+		if len(b.queued) < b.pipeline {
+			return nil
+		}
+		return b.flush()
+	}
+
+	target := b.targets.nameOf(conn)
+	err := recordStatement(target, delta.ID, query, args, func() (sql.Result, error) {
+		return lockWatcher.run(conn, target, delta, func(ctx context.Context) (sql.Result, error) {
+			return tx.ExecContext(ctx, query, args...)
+		})
+	})
+	switch {
+	case err == nil:
+		b.run = append(b.run, statement)
+		b.applied++
+		return nil
+	case !isStatementTimeout(err):
+		return err
+	case !b.retry:
+		return b.timedOut(err)
+	}
+	return b.applySplit(append(b.run, statement))
+}
+
+// roll back the open transactions and apply the statements they ran, or
+// were about to run, again a statement at a time
+func (b *replayBatch) applySplit(rerun []replayStatement) error {
+	if b.consistent {
+		log.Printf("Warning: source transaction %d took longer than %s; applying it a statement at a time, so readers can see it half applied.", b.txid, b.timeout)
+	} else {
+		log.Printf("Warning: a batch of %d deltas took longer than %s; applying it a statement at a time, so a failure leaves it half applied.", b.count, b.timeout)
+	}
+	txid, at, count := b.txid, b.at, b.count
+	b.rollback()
+	b.txid, b.at, b.count, b.split = txid, at, count, true
+	for _, s := range rerun {
+		if err := b.execAlone(s.conn, s.delta, s.query, s.args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run a statement in a transaction of its own
+func (b *replayBatch) execAlone(conn *sql.DB, delta Delta, query string, args []interface{}) error {
+	target := b.targets.nameOf(conn)
+	if b.timeout == 0 {
+		return recordStatement(target, delta.ID, query, args, func() (sql.Result, error) {
+			return lockWatcher.run(conn, target, delta, func(ctx context.Context) (sql.Result, error) {
+				return conn.ExecContext(ctx, query, args...)
+			})
+		})
+	}
+
+	tx, err := b.begin(conn)
+	if err != nil {
+		return err
+	}
+	err = recordStatement(target, delta.ID, query, args, func() (sql.Result, error) {
+		return lockWatcher.run(conn, target, delta, func(ctx context.Context) (sql.Result, error) {
+			return tx.ExecContext(ctx, query, args...)
+		})
+	})
+	if err == nil {
+		err = recordStatement(target, 0, "COMMIT", nil, func() (sql.Result, error) {
+			return nil, tx.Commit()
+		})
+	}
+	if err != nil {
+		tx.Rollback()
+		if isStatementTimeout(err) {
+			return b.timedOut(err)
+		}
+	}
+	return err
+}
+
+// open a transaction on a target with the replay statement timeout
+func (b *replayBatch) begin(conn *sql.DB) (*sql.Tx, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if b.timeout > 0 {
+		query := statementTimeoutQuery(b.timeout)
+		err := recordStatement(b.targets.nameOf(conn), 0, query, nil, func() (sql.Result, error) {
+			return tx.Exec(query)
+		})
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to set statement_timeout: %v", err)
+		}
+	}
+	return tx, nil
+}
+
+func (b *replayBatch) timedOut(err error) error {
+	return fmt.Errorf("statement took longer than timeouts.replay.statement (%s): %v", b.timeout, err)
+}
+
+// moves a target's replay position, just before each commit
+const replayPositionQuery = `INSERT INTO delta_tracker.replay_position (txid, consistent_as_of, applied_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+	ON CONFLICT (only_row) DO UPDATE SET txid = EXCLUDED.txid, consistent_as_of = EXCLUDED.consistent_as_of, applied_at = EXCLUDED.applied_at`
+
+// commit the open transaction on every target it touched, moving their
+// replay position along with it with -consistent
+func (b *replayBatch) commit() error {
+	if err := b.flush(); err != nil {
+		b.rollback()
+		return err
+	}
+	for conn, tx := range b.txs {
+		delete(b.txs, conn)
+		target := b.targets.nameOf(conn)
+		var err error
+		if b.consistent {
+			err = recordStatement(target, 0, replayPositionQuery, []interface{}{b.txid, b.at}, func() (sql.Result, error) {
+				return tx.Exec(replayPositionQuery, b.txid, b.at)
+			})
+		}
+		if err == nil {
+			err = recordStatement(target, 0, "COMMIT", nil, func() (sql.Result, error) {
+				return nil, tx.Commit()
+			})
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			b.rollback()
+			if !b.consistent {
+				return fmt.Errorf("error committing replayed deltas: %v", err)
+			}
+			return fmt.Errorf("error committing source transaction %d: %v", b.txid, err)
+		}
+	}
+	b.txid, b.run, b.queued, b.split, b.count, b.applied = 0, nil, nil, false, 0, 0
+	return nil
+}
+
+// give up on the open source transaction, e.g. when one of its deltas failed
+func (b *replayBatch) rollback() {
+	for conn, tx := range b.txs {
+		tx.Rollback()
+		delete(b.txs, conn)
+	}
+	b.txid, b.run, b.queued, b.split, b.count, b.applied = 0, nil, nil, false, 0, 0
+}
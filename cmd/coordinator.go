@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+)
+
+// how long the coordinator waits on an agent, and an agent on the coordinator
+const fleetTimeout = 30 * time.Second
+
+// the coordinator's view of one agent, for -output json and GET /fleet
+type agentState struct {
+	Name       string         `json:"name"`
+	URL        string         `json:"url"`
+	Reachable  bool           `json:"reachable"`
+	Error      string         `json:"error,omitempty"`
+	Status     *captureStatus `json:"status,omitempty"`
+	LagSeconds *float64       `json:"lag_seconds,omitempty"` // how far its target trails its source; see captureStatus.lag
+}
+
+// hold the configs of many tracked databases in one place and watch the
+// daemons running next to each of them. Each daemon, started with
+// -coordinator and -agent, fetches its config from here; the coordinator
+// gathers their status and lag and starts their jobs. Without -listen it
+// prints the fleet's state once and exits.
+func runCoordinator(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	fleetPath := fs.String("fleet", "fleet.yaml", "path to the fleet file listing the agents and their configs")
+	listen := fs.String("listen", "", "address to serve the fleet API on, e.g. :8000 (empty = print the fleet's state and exit)")
+	token := fs.String("token", os.Getenv("DELTA_FLEET_TOKEN"), "token shared with the agents (default $DELTA_FLEET_TOKEN)")
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	fleet, err := config.LoadFleet(*fleetPath)
+	if err != nil {
+		fatal(exitcode.Wrap(exitcode.Config, err), "Error loading the fleet")
+	}
+	client := &fleetClient{token: *token, http: &http.Client{Timeout: fleetTimeout}}
+
+	if *listen == "" {
+		states := client.states(fleet)
+		outputFormat.Print(states, func() {
+			for _, state := range states {
+				state.print()
+			}
+		})
+		for _, state := range states {
+			if !state.Reachable {
+				os.Exit(exitcode.Connection)
+			}
+		}
+		return
+	}
+
+	if *token == "" {
+		log.Printf("Warning: no -token set, so anyone who can reach %s can read the fleet's configs and start its jobs.", *listen)
+	}
+	server := &http.Server{Addr: *listen, Handler: coordinatorHandler(fleet, client)}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	log.Printf("Coordinating %d agents on %s.", len(fleet.Agents), *listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(err, "Error serving the fleet API")
+	}
+	log.Println("Coordinator stopped.")
+}
+
+// the coordinator's HTTP API; every path but /healthz needs the token, if set:
+//
+//	GET /fleet                         every agent's status and lag
+//	GET /agents/<name>/config          the agent's config file, its profile in X-Delta-Profile
+//	POST /agents/<name>/jobs/<job>/run start a run of one of the agent's jobs now
+//	GET /healthz                       200 while the coordinator runs
+func coordinatorHandler(fleet *config.Fleet, client *fleetClient) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/fleet", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, client.states(fleet), nil)
+	})
+	mux.HandleFunc("/agents/", func(w http.ResponseWriter, r *http.Request) {
+		name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/agents/"), "/")
+		agent, ok := fleet.Agent(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no agent %q", name), http.StatusNotFound)
+			return
+		}
+		if rest == "config" {
+			data, err := os.ReadFile(agent.Config)
+			if err != nil {
+				log.Printf("Coordinator: %v", err)
+				http.Error(w, "failed to read the agent's config", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Agent %s fetched its config.", agent.Name)
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Header().Set("X-Delta-Profile", agent.Profile)
+			w.Write(data)
+			return
+		}
+		if job, ok := strings.CutPrefix(rest, "jobs/"); ok && strings.HasSuffix(job, "/run") {
+			if r.Method != http.MethodPost {
+				http.Error(w, "POST to run a job", http.StatusMethodNotAllowed)
+				return
+			}
+			// pass the agent's answer on, e.g. 409 while the job is running
+			resp, err := client.do(http.MethodPost, strings.TrimSuffix(agent.URL, "/")+"/jobs/"+job)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to reach agent %s: %v", agent.Name, err), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || authorized(client.token, w, r) {
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+// talks to agents, and agents to the coordinator, with the fleet's token
+type fleetClient struct {
+	token string
+	http  *http.Client
+}
+
+// make a request without a body
+func (c *fleetClient) do(method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// GET a URL, returning the body of a 200 answer and its headers
+func (c *fleetClient) get(url string) ([]byte, http.Header, error) {
+	resp, err := c.do(http.MethodGet, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, resp.Header, nil
+}
+
+// ask every agent for its status at once; one that can't be reached is
+// reported as such rather than holding up the rest
+func (c *fleetClient) states(fleet *config.Fleet) []agentState {
+	states := make([]agentState, len(fleet.Agents))
+	var wg sync.WaitGroup
+	for i, agent := range fleet.Agents {
+		wg.Add(1)
+		go func(i int, agent config.Agent) {
+			defer wg.Done()
+			state := agentState{Name: agent.Name, URL: agent.URL}
+			data, _, err := c.get(strings.TrimSuffix(agent.URL, "/") + "/status")
+			if err == nil {
+				state.Status = &captureStatus{}
+				err = json.Unmarshal(data, state.Status)
+			}
+			if err != nil {
+				state.Status, state.Error = nil, err.Error()
+			} else {
+				state.Reachable = true
+				if lag := state.Status.lag(); lag != nil {
+					seconds := lag.Seconds()
+					state.LagSeconds = &seconds
+				}
+			}
+			states[i] = state
+		}(i, agent)
+	}
+	wg.Wait()
+	return states
+}
+
+// print an agent's state as text, a few lines per agent
+func (state agentState) print() {
+	if !state.Reachable {
+		fmt.Printf("%-17sunreachable: %s\n", state.Name, state.Error)
+		return
+	}
+	status := state.Status
+	capture := "active"
+	if status.Paused {
+		capture = "paused since " + status.PausedSince.Format(time.RFC3339)
+	}
+	fmt.Printf("%-17s%s, capture %s, %d deltas (%s)\n", state.Name, status.Database, capture, status.DeltaRows, formatBytes(status.DeltaBytes))
+	if lag := status.lag(); lag != nil {
+		fmt.Printf("%-17srestored through %s, %s behind\n", "", status.RestoredThrough.Format(time.RFC3339), lag.Round(time.Second))
+	}
+	for _, run := range status.Jobs {
+		detail := fmt.Sprintf("%s, started %s", run.Outcome, run.StartedAt.Format(time.RFC3339))
+		if run.Error != "" {
+			detail += ": " + run.Error
+		}
+		fmt.Printf("%-17sjob %s (%s): %s\n", "", run.Job, run.Command, detail)
+	}
+}
+
+// fetch this agent's config from the coordinator into a temporary file and
+// use it, and the profile the fleet file gives, as -config and -profile
+// would; the jobs' child processes read it from there too. Returns the
+// file's path, for removing once the daemon stops.
+func fetchAgentConfig(coordinator, agent, token string) (string, error) {
+	client := &fleetClient{token: token, http: &http.Client{Timeout: fleetTimeout}}
+	data, header, err := client.get(strings.TrimSuffix(coordinator, "/") + "/agents/" + agent + "/config")
+	if err != nil {
+		return "", exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to fetch the config of agent %s from %s: %v", agent, coordinator, err))
+	}
+	f, err := os.CreateTemp("", "delta-tracker-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("failed to save the fetched config: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to save the fetched config: %v", err)
+	}
+	configPath, profile = f.Name(), header.Get("X-Delta-Profile")
+	log.Printf("Fetched the config of agent %s from %s.", agent, coordinator)
+	return f.Name(), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// a position in a deltas table, read in id order, that never moves past an
+// id whose delta may still be committed. Ids are handed out as deltas are
+// inserted, not as their transactions commit, so a gap after LastID may be
+// a delta that shows up later.
+type deltaCursor struct {
+	// every delta up to it has been passed on
+	LastID int64
+
+	// once every transaction that was running when a gap was seen has
+	// finished (the snapshot xmin reaches Horizon), the ids missing up to
+	// GapsUpTo never will be, e.g. those of rolled back transactions or
+	// pruned deltas
+	Horizon  int64
+	GapsUpTo int64
+}
+
+// the deltas at the front of a batch read after LastID, with the snapshot's
+// xmin and xmax, that can be passed on without skipping one committed
+// later. The caller moves LastID once it has passed them on.
+func (c *deltaCursor) ready(deltas []Delta, xmin, xmax int64) []Delta {
+	settled := c.Horizon != 0 && xmin >= c.Horizon
+	var ready []Delta
+	expected := c.LastID + 1
+	for _, d := range deltas {
+		if d.ID != expected && !(settled && d.ID <= c.GapsUpTo) {
+			if c.Horizon == 0 || settled {
+				c.Horizon, c.GapsUpTo = xmax, deltas[len(deltas)-1].ID
+			}
+			break
+		}
+		ready = append(ready, d)
+		expected = d.ID + 1
+	}
+	if settled && expected > c.GapsUpTo {
+		c.Horizon, c.GapsUpTo = 0, 0
+	}
+	return ready
+}
+
+// whether a gap is holding the cursor back until running transactions end
+func (c *deltaCursor) waiting() bool {
+	return c.Horizon != 0
+}
+
+// read up to limit deltas after an id, all of them if limit is 0, with the
+// xmin and xmax of the snapshot they were read in
+func readDeltasAfter(ctx context.Context, db *sql.DB, after int64, limit int) ([]Delta, int64, int64, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var xmin, xmax int64
+	if err := tx.QueryRow(`SELECT txid_snapshot_xmin(s), txid_snapshot_xmax(s) FROM txid_current_snapshot() s`).Scan(&xmin, &xmax); err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to read the running transactions: %v", err)
+	}
+	var n interface{} // LIMIT NULL reads them all
+	if limit > 0 {
+		n = limit
+	}
+	rows, err := tx.Query(`
+		SELECT id, action, table_name, old_data, new_data, timestamp, COALESCE(txid, 0), COALESCE(statement, ''), context, COALESCE(origin, '')
+		FROM deltas
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`, after, n)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	defer rows.Close()
+	var deltas []Delta
+	for rows.Next() {
+		var delta Delta
+		if err := rows.Scan(&delta.ID, &delta.Action, &delta.TableName, &delta.OldData, &delta.NewData, &delta.Timestamp, &delta.TxID, &delta.Statement, &delta.Context, &delta.Origin); err != nil {
+			return nil, 0, 0, fmt.Errorf("error scanning delta: %v", err)
+		}
+		deltas = append(deltas, delta)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	return deltas, xmin, xmax, nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"db-delta-tracker/pkg/apikey"
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/opslog"
+)
+
+// held while a job runs, so a run started over the API can't overlap a
+// scheduled one
+var jobLocks = make(map[string]*sync.Mutex)
+
+// run the jobs under jobs: in the config on their schedules, recording each
+// run in delta_tracker.job_runs, and serve the history and warm plans over HTTP
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := fs.String("listen", "", "address to serve the HTTP API (job history, warm plan) on, e.g. :8080 (empty = no API)")
+	token := fs.String("token", os.Getenv("DELTA_FLEET_TOKEN"), "token allowing every API request, which the coordinator presents; others need an API key (default $DELTA_FLEET_TOKEN)")
+	coordinator := fs.String("coordinator", "", "URL of a coordinator to fetch the config from, instead of -config")
+	agent := fs.String("agent", "", "this daemon's name in the coordinator's fleet file (with -coordinator)")
+	deltasRate := fs.Float64("deltas-rate", 5, "requests per second each API caller may make to GET /deltas (0 = unlimited)")
+	configFlag(fs)
+	parseFlags(fs, args)
+
+	if (*coordinator == "") != (*agent == "") {
+		usagef("-coordinator and -agent go together")
+	}
+	if *coordinator != "" {
+		path, err := fetchAgentConfig(*coordinator, *agent, *token)
+		if err != nil {
+			fatal(err, "Error fetching the config")
+		}
+		defer os.Remove(path)
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+	if len(cfg.Jobs) == 0 {
+		fatal(exitcode.Wrap(exitcode.Config, fmt.Errorf("no jobs under jobs: in the config")), "Nothing to schedule")
+	}
+	if err := createJobRunsTable(dbConn); err != nil {
+		fatal(err, "Error preparing job history")
+	}
+	if *listen != "" && *token == "" && !loopback(*listen) {
+		keys, err := apikey.Any(dbConn)
+		if err != nil {
+			fatal(err, "Error checking API keys")
+		}
+		if !keys {
+			usagef("Set -token or $DELTA_FLEET_TOKEN, or create an API key, to serve the API on %s; without either, only a loopback address such as 127.0.0.1:8080 may be used", *listen)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *listen != "" {
+		server := &http.Server{Addr: *listen, Handler: apiHandler(*token, newRateLimiter(*deltasRate))}
+		go func() {
+			log.Printf("Serving the HTTP API on %s.", *listen)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("HTTP API stopped: %v", err)
+			}
+		}()
+		defer server.Shutdown(context.Background())
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range cfg.Jobs {
+		jobLocks[job.Name] = &sync.Mutex{}
+	}
+	for _, job := range cfg.Jobs {
+		wg.Add(1)
+		go func(job config.Job) {
+			defer wg.Done()
+			scheduleJob(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+	// and for runs started over the API
+	for _, mu := range jobLocks {
+		mu.Lock()
+	}
+	log.Println("Daemon stopped.")
+}
+
+// run a job now and then every interval until ctx is done; a run in progress
+// is left to finish, and runs of one job never overlap
+func scheduleJob(ctx context.Context, job config.Job) {
+	interval, _ := job.Interval() // checked by Validate
+	log.Printf("Scheduled job %s (%s) every %s.", job.Name, job.Command, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		jobLocks[job.Name].Lock()
+		if err := runJob(job, "daemon job "+job.Name); err != nil {
+			log.Printf("Job %s: %v", job.Name, err)
+		}
+		jobLocks[job.Name].Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run one job as a child process of this program with JSON output, so its
+// result and exit code can be recorded as they are; actor is who the run is
+// on behalf of in the operations log
+func runJob(job config.Job, actor string) error {
+	id, err := startJobRun(dbConn, job.Name, job.Command)
+	if err != nil {
+		return err
+	}
+	log.Printf("Job %s started (run %d).", job.Name, id)
+
+	code, stdout, errLine := runChild(job, actor)
+	if err := finishJobRun(dbConn, id, code, bytes.TrimSpace(stdout), errLine); err != nil {
+		return err
+	}
+	log.Printf("Job %s finished with exit code %d (run %d).", job.Name, code, id)
+	return nil
+}
+
+// run a job's command, returning its exit code, its JSON result and, when
+// it failed, the last line it logged
+func runChild(job config.Job, actor string) (int, []byte, string) {
+	self, err := os.Executable()
+	if err != nil {
+		return exitcode.Failure, nil, fmt.Sprintf("failed to find this program: %v", err)
+	}
+	args := []string{job.Command, "-config", configPath, "-output", "json"}
+	if profile != "" {
+		args = append(args, "-profile", profile)
+	}
+	cmd := exec.Command(self, append(args, job.Args...)...)
+	cmd.Env = append(os.Environ(), opslog.ActorEnv+"="+actor)
+
+	var stdout bytes.Buffer
+	var lastLine lastLineWriter
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &lastLine)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return exitcode.Failure, nil, fmt.Sprintf("failed to start: %v", err)
+		}
+		return exitErr.ExitCode(), stdout.Bytes(), lastLine.String()
+	}
+	return exitcode.OK, stdout.Bytes(), ""
+}
+
+// keeps the last complete line written to it
+type lastLineWriter struct {
+	mu      sync.Mutex
+	partial []byte
+	last    string
+}
+
+func (w *lastLineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(w.partial[:i])); line != "" {
+			w.last = line
+		}
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lastLineWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if line := strings.TrimSpace(string(w.partial)); line != "" {
+		return line
+	}
+	return w.last
+}
+
+// the daemon's HTTP API; every path but /healthz needs the token or an API
+// key with the path's scope (see apiScope), once either is set up:
+//
+//	GET /jobs              the latest run of every job
+//	GET /jobs/<name>       the recent runs of one job, newest first (?limit=, default 20)
+//	POST /jobs/<name>/run  start a run of a job now, unless one is running
+//	GET /status            the same as the status command's JSON
+//	GET /deltas            a page of deltas, filtered (see parseDeltasQuery) and rate limited
+//	GET /warm-plan         the most changed tables and rows (?since=, default 1h; ?top=, default 100)
+//	GET /healthz           200 while the daemon runs
+func apiHandler(token string, deltasLimit *rateLimiter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		runs, err := loadJobRuns(dbConn, "", true, len(cfg.Jobs)+100)
+		writeJSON(w, runs, err)
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		if job, ok := strings.CutSuffix(name, "/run"); ok {
+			startJob(w, r, job)
+			return
+		}
+		limit := 20
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		runs, err := loadJobRuns(dbConn, name, false, limit)
+		if err == nil && len(runs) == 0 {
+			http.Error(w, fmt.Sprintf("no runs of job %q", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, runs, err)
+	})
+	mux.HandleFunc("/warm-plan", func(w http.ResponseWriter, r *http.Request) {
+		since, top := time.Hour, 100
+		if v := r.URL.Query().Get("since"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "since must be a positive duration, e.g. 30m", http.StatusBadRequest)
+				return
+			}
+			since = d
+		}
+		if v := r.URL.Query().Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "top must be a positive number", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+		plan, err := hotPlan(since, top)
+		writeJSON(w, plan, err)
+	})
+	mux.HandleFunc("/deltas", deltasLimit.wrap(listDeltas))
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := loadStatus()
+		writeJSON(w, status, err)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if caller, ok := authorizedCaller(token, w, r); ok {
+			mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+		}
+	})
+}
+
+// the context key for who made an API request: "key <name>", "the token",
+// or empty while the API is open
+type callerKey struct{}
+
+// who a request comes from, if it carries the token or an API key with the
+// scope its path needs, answering it if not. Without a token and with no API
+// keys, the API is open to requests from loopback addresses.
+func authorizedCaller(token string, w http.ResponseWriter, r *http.Request) (string, bool) {
+	presented, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+		return "the token", true
+	}
+	key, err := apikey.Authenticate(dbConn, presented)
+	if err != nil {
+		log.Printf("API: %v", err)
+		http.Error(w, "failed to check the API key", http.StatusInternalServerError)
+		return "", false
+	}
+	if key != nil {
+		if scope := apiScope(r); scope != "" && !key.Allows(scope) {
+			http.Error(w, fmt.Sprintf("key %s lacks the %s scope", key.Name, scope), http.StatusForbidden)
+			return "", false
+		}
+		return "key " + key.Name, true
+	}
+	if token == "" {
+		keys, err := apikey.Any(dbConn)
+		if err != nil {
+			log.Printf("API: %v", err)
+			http.Error(w, "failed to check the API key", http.StatusInternalServerError)
+			return "", false
+		}
+		if !keys && loopback(r.RemoteAddr) {
+			return "", true
+		}
+	}
+	http.Error(w, "missing or wrong token or API key", http.StatusUnauthorized)
+	return "", false
+}
+
+// the scope an API key needs for a request; empty for paths the API doesn't
+// serve, and jobs it doesn't have, which are answered with a 404
+func apiScope(r *http.Request) string {
+	switch path := r.URL.Path; {
+	case path == "/status":
+		return apikey.ReadStatus
+	case path == "/warm-plan", path == "/deltas":
+		return apikey.ReadDeltas
+	case path == "/jobs":
+		return apikey.ReadJobs
+	case strings.HasPrefix(path, "/jobs/"):
+		name, run := strings.CutSuffix(strings.TrimPrefix(path, "/jobs/"), "/run")
+		if !run {
+			return apikey.ReadJobs
+		}
+		for _, job := range cfg.Jobs {
+			if job.Name == name {
+				return apikey.RunScope(job.Command)
+			}
+		}
+	}
+	return ""
+}
+
+// start a run of a job in the background, unless one is running already
+func startJob(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST to run a job", http.StatusMethodNotAllowed)
+		return
+	}
+	var job config.Job
+	for _, j := range cfg.Jobs {
+		if j.Name == name {
+			job = j
+		}
+	}
+	if job.Name == "" {
+		http.Error(w, fmt.Sprintf("no job %q", name), http.StatusNotFound)
+		return
+	}
+	if !jobLocks[job.Name].TryLock() {
+		http.Error(w, fmt.Sprintf("job %q is running", name), http.StatusConflict)
+		return
+	}
+	actor := fmt.Sprintf("daemon job %s, started over the API by %s", job.Name, r.RemoteAddr)
+	if caller, _ := r.Context().Value(callerKey{}).(string); caller != "" {
+		actor = fmt.Sprintf("daemon job %s, started over the API with %s by %s", job.Name, caller, r.RemoteAddr)
+	}
+	go func() {
+		defer jobLocks[job.Name].Unlock()
+		if err := runJob(job, actor); err != nil {
+			log.Printf("Job %s: %v", job.Name, err)
+		}
+	}()
+	log.Printf("Job %s started over the API.", job.Name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// whether an address to listen on, or a request came from, is a loopback
+// one; a listen address without a host is every interface's
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// whether a request carries the token, answering it if not
+func authorized(token string, w http.ResponseWriter, r *http.Request) bool {
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1 {
+		return true
+	}
+	http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+	return false
+}
+
+// answer with v as JSON, or with a 500 for err
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		log.Printf("API: %v", err)
+		http.Error(w, "failed to read the original database", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// the daemon's API is open without a token or API key only on these
+func TestLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"127.8.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		"127.0.0.1":      true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"[::]:8080":      false,
+		"10.0.0.5:8080":  false,
+		"db-host:8080":   false,
+		"192.0.2.1:5431": false,
+	} {
+		if got := loopback(addr); got != want {
+			t.Errorf("loopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
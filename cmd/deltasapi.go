@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// how many deltas a page of GET /deltas holds, by default and at most
+const (
+	deltasPageSize    = 100
+	maxDeltasPageSize = 1000
+)
+
+// the fields GET /deltas can return, in order, with the column each reads
+// and whether it holds JSON
+var deltaFields = []struct {
+	name, column string
+	json         bool
+}{
+	{"id", "id", false},
+	{"action", "action", false},
+	{"table_name", "table_name", false},
+	{"old_data", "old_data", true},
+	{"new_data", "new_data", true},
+	{"timestamp", "timestamp", false},
+	{"txid", "COALESCE(txid, 0)", false},
+	{"statement", "COALESCE(statement, '')", false},
+	{"context", "context", true},
+	{"origin", "COALESCE(origin, '')", false},
+}
+
+// a page of deltas; Next is the cursor for the page after it, empty on the
+// last page. A page stops short of an id a running transaction may still
+// commit a delta under, so it can come back with fewer deltas than asked
+// for, or none, and a Next to try again with once the transaction ends.
+type deltasPage struct {
+	Deltas []map[string]interface{} `json:"deltas"`
+	Next   string                   `json:"next,omitempty"`
+}
+
+// a query for a page of deltas, as GET /deltas takes it
+type deltasQuery struct {
+	after   deltaCursor // the cursor: the id of the last delta already seen, and any gap holding it back
+	limit   int
+	tables  []string
+	actions []string
+	since   time.Time
+	until   time.Time
+	fields  []string // empty for every field
+}
+
+// read a deltasQuery from a request's query string
+func parseDeltasQuery(r *http.Request) (deltasQuery, error) {
+	q := deltasQuery{limit: deltasPageSize}
+	values := r.URL.Query()
+	if v := values.Get("after"); v != "" {
+		c, err := parseDeltasCursor(v)
+		if err != nil {
+			return q, fmt.Errorf("after must be the next cursor of an earlier page")
+		}
+		q.after = c
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeltasPageSize {
+			return q, fmt.Errorf("limit must be a number from 1 to %d", maxDeltasPageSize)
+		}
+		q.limit = n
+	}
+	q.tables = splitList(values.Get("table"))
+	q.actions = splitList(values.Get("action"))
+	for _, t := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &q.since}, {"until", &q.until}} {
+		if v := values.Get(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time, e.g. 2024-05-01T12:00:00Z", t.name)
+			}
+			*t.time = parsed
+		}
+	}
+	for _, field := range splitList(values.Get("fields")) {
+		known := false
+		for _, f := range deltaFields {
+			known = known || f.name == field
+		}
+		if !known {
+			return q, fmt.Errorf("unknown field %q", field)
+		}
+		q.fields = append(q.fields, field)
+	}
+	return q, nil
+}
+
+// a cursor as a page's next: the id of the last delta seen, followed by the
+// horizon and end of the gaps after it while they hold it back, e.g. 120 or
+// 120.9051.180
+func formatDeltasCursor(c deltaCursor) string {
+	if c.Horizon == 0 {
+		return strconv.FormatInt(c.LastID, 10)
+	}
+	return fmt.Sprintf("%d.%d.%d", c.LastID, c.Horizon, c.GapsUpTo)
+}
+
+func parseDeltasCursor(v string) (deltaCursor, error) {
+	var c deltaCursor
+	parts := strings.Split(v, ".")
+	if len(parts) != 1 && len(parts) != 3 {
+		return c, fmt.Errorf("invalid cursor %q", v)
+	}
+	for i, field := range []*int64{&c.LastID, &c.Horizon, &c.GapsUpTo}[:len(parts)] {
+		n, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil || n < 0 {
+			return c, fmt.Errorf("invalid cursor %q", v)
+		}
+		*field = n
+	}
+	return c, nil
+}
+
+// read a page of deltas in id order, reading only the columns of the fields
+// asked for, so leaving out old_data and new_data keeps pages small. As
+// with kafka-sink, a gap in the ids while transactions are running may be a
+// delta yet to be committed, so the page ends before it.
+func loadDeltasPage(db *sql.DB, q deltasQuery) (deltasPage, error) {
+	page := deltasPage{Deltas: []map[string]interface{}{}}
+	var names, columns []string
+	isJSON := make(map[string]bool)
+	for _, f := range deltaFields {
+		if f.name == "id" || len(q.fields) == 0 || containsString(q.fields, f.name) {
+			names = append(names, f.name)
+			columns = append(columns, f.column)
+			isJSON[f.name] = f.json
+		}
+	}
+
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return page, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	var xmin, xmax, maxID int64
+	if err := tx.QueryRow(`SELECT txid_snapshot_xmin(s), txid_snapshot_xmax(s), (SELECT COALESCE(MAX(id), 0) FROM deltas) FROM txid_current_snapshot() s`).Scan(&xmin, &xmax, &maxID); err != nil {
+		return page, fmt.Errorf("failed to read the running transactions: %v", err)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT %s FROM deltas
+		WHERE id > $1
+			AND (cardinality($2::text[]) = 0 OR table_name = ANY($2))
+			AND (cardinality($3::text[]) = 0 OR action = ANY($3))
+			AND ($4::timestamptz IS NULL OR timestamp > $4)
+			AND ($5::timestamptz IS NULL OR timestamp <= $5)
+		ORDER BY id
+		LIMIT $6
+	`, strings.Join(columns, ", ")), q.after.LastID, pq.Array(q.tables), pq.Array(q.actions),
+		sql.NullTime{Time: q.since, Valid: !q.since.IsZero()}, sql.NullTime{Time: q.until, Valid: !q.until.IsZero()}, q.limit+1)
+	if err != nil {
+		return page, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		values := make([]interface{}, len(names))
+		targets := make([]interface{}, len(names))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return page, fmt.Errorf("error scanning delta: %v", err)
+		}
+		delta := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			// text, and the JSON payloads, come back as bytes
+			if b, ok := values[i].([]byte); ok {
+				if isJSON[name] {
+					values[i] = json.RawMessage(b)
+				} else {
+					values[i] = string(b)
+				}
+			}
+			delta[name] = values[i]
+		}
+		page.Deltas = append(page.Deltas, delta)
+	}
+	if err := rows.Err(); err != nil {
+		return page, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	rows.Close()
+	id := func(i int) int64 { return page.Deltas[i]["id"].(int64) }
+
+	next := q.after
+	settled := next.Horizon != 0 && xmin >= next.Horizon
+	if xmin != xmax {
+		// the ids the page spans, past the gaps known to be settled; a page
+		// short of a full one spans every delta there is
+		from, to := next.LastID, maxID
+		if settled && next.GapsUpTo > from {
+			from = next.GapsUpTo
+		}
+		if len(page.Deltas) > q.limit {
+			to = id(q.limit - 1)
+		}
+		gap, err := firstDeltaGap(tx, from, to)
+		if err != nil {
+			return page, err
+		}
+		if gap != 0 {
+			kept := 0
+			for kept < len(page.Deltas) && id(kept) < gap {
+				kept++
+			}
+			page.Deltas = page.Deltas[:kept]
+			next.LastID = gap - 1
+			if next.Horizon == 0 || settled {
+				next.Horizon, next.GapsUpTo = xmax, maxID
+			}
+			page.Next = formatDeltasCursor(next)
+			return page, nil
+		}
+	}
+	// the extra delta read says whether there is a next page
+	if len(page.Deltas) > q.limit {
+		page.Deltas = page.Deltas[:q.limit]
+		next.LastID = id(q.limit - 1)
+		if settled && next.LastID >= next.GapsUpTo {
+			next.Horizon, next.GapsUpTo = 0, 0
+		}
+		page.Next = formatDeltasCursor(next)
+	}
+	return page, nil
+}
+
+// the first id missing from the deltas table after from and before to, or 0
+// if none is
+func firstDeltaGap(tx *sql.Tx, from, to int64) (int64, error) {
+	if to <= from {
+		return 0, nil
+	}
+	var present int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM deltas WHERE id > $1 AND id <= $2", from, to).Scan(&present); err != nil {
+		return 0, fmt.Errorf("failed to look for gaps in the delta ids: %v", err)
+	}
+	if present == to-from {
+		return 0, nil
+	}
+	var gap int64
+	err := tx.QueryRow(`
+		SELECT COALESCE(
+			(SELECT $1::bigint + 1 WHERE NOT EXISTS (SELECT 1 FROM deltas WHERE id = $1::bigint + 1)),
+			(SELECT d.id + 1 FROM deltas d
+				WHERE d.id > $1 AND d.id < $2 AND NOT EXISTS (SELECT 1 FROM deltas n WHERE n.id = d.id + 1)
+				ORDER BY d.id LIMIT 1),
+			0)
+	`, from, to).Scan(&gap)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look for gaps in the delta ids: %v", err)
+	}
+	return gap, nil
+}
+
+// GET /deltas: a page of deltas, filtered and projected as the query asks
+func listDeltas(w http.ResponseWriter, r *http.Request) {
+	q, err := parseDeltasQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := loadDeltasPage(dbConn, q)
+	writeJSON(w, page, err)
+}
+
+// limits how often each API caller may make a request, allowing bursts of
+// up to a second's worth
+type rateLimiter struct {
+	perSecond float64
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+}
+
+// how many callers' buckets are kept before idle ones are dropped
+const maxRateBuckets = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{perSecond: perSecond, buckets: make(map[string]*tokenBucket)}
+}
+
+// wrap a handler, answering 429 to callers over the limit; a limit of 0
+// lets every request through
+func (l *rateLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.perSecond > 0 {
+			if wait := l.take(apiCallerName(r)); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// take a token from a caller's bucket, returning how long until there is
+// one if it is empty
+func (l *rateLimiter) take(caller string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	burst := math.Max(l.perSecond, 1)
+	if len(l.buckets) > maxRateBuckets {
+		// forget callers whose buckets have long been full again
+		for name, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, name)
+			}
+		}
+	}
+	b, ok := l.buckets[caller]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[caller] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// who a request is limited as: its API key or the token, or its address
+// while the API is open
+func apiCallerName(r *http.Request) string {
+	if caller, _ := r.Context().Value(callerKey{}).(string); caller != "" {
+		return caller
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
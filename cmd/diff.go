@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
+)
+
+// compare tables as they were at two points in time, as told by the deltas
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	from := fs.String("from", "", "RFC 3339 timestamp of the earlier state")
+	to := fs.String("to", "", "RFC 3339 timestamp of the later state (default now)")
+	table := fs.String("table", "", "compare only this table")
+	migrationDir := fs.String("migration-dir", "", "also write the net changes to up.sql and down.sql in this directory")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *from == "" {
+		usagef("Usage: diff --from <timestamp> [--to <timestamp>] [--table <table>] [--migration-dir <dir>]")
+	}
+	fromTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		usagef("Invalid --from timestamp %q: %v", *from, err)
+	}
+	toTime := time.Now()
+	if *to != "" {
+		if toTime, err = time.Parse(time.RFC3339, *to); err != nil {
+			usagef("Invalid --to timestamp %q: %v", *to, err)
+		}
+	}
+	if !toTime.After(fromTime) {
+		usagef("--to must be after --from")
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, err := diffTables(fromTime, toTime, *table)
+	if err != nil {
+		fatal(err, "Error comparing")
+	}
+	if *migrationDir != "" {
+		if err := writeMigration(*migrationDir, result); err != nil {
+			fatal(err, "Error writing migration scripts")
+		}
+	}
+	printDiff(result)
+}
+
+// how tables differ between two points in time
+type diffResult struct {
+	From   time.Time   `json:"from"`
+	To     time.Time   `json:"to"`
+	Tables []tableDiff `json:"tables"` // only tables that differ
+}
+
+type tableDiff struct {
+	Table   string    `json:"table"`
+	Added   []rowDiff `json:"added"`
+	Removed []rowDiff `json:"removed"`
+	Changed []rowDiff `json:"changed"`
+}
+
+// a row that differs: Before is unset for an added row and After for a
+// removed one
+type rowDiff struct {
+	Key     tracker.Row `json:"key,omitempty"` // by key column; unset for tables without a key
+	Before  tracker.Row `json:"before,omitempty"`
+	After   tracker.Row `json:"after,omitempty"`
+	Columns []string    `json:"columns,omitempty"` // that changed, for a changed row
+}
+
+// the state of a row at both ends, as far as the deltas between them tell
+type rowStates struct {
+	key           tracker.Row
+	before, after tracker.Row
+}
+
+// compare each table's rows as they were at from with the rows at to. Only
+// the deltas made in (from, to] are needed: a row's state at from is the old
+// values of its first delta in that range, and its state at to the new
+// values of its last. Rows are told apart by the table's primary key (or id)
+// as the source has it now; rows of a table without one are compared by
+// their content, so they show up as removed and added rather than changed.
+func diffTables(from, to time.Time, table string) (diffResult, error) {
+	result := diffResult{From: from, To: to, Tables: []tableDiff{}}
+
+	var filter, tables []string
+	if table != "" {
+		filter = []string{table}
+	}
+	rows, err := dbConn.Query(`
+		SELECT id, action, table_name, old_data, new_data, timestamp
+		FROM deltas
+		WHERE timestamp > $1 AND timestamp <= $2 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+		  AND (cardinality($3::text[]) = 0 OR table_name = ANY($3))
+		ORDER BY timestamp, id
+	`, from, to, pq.Array(filter))
+	if err != nil {
+		return result, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	byTable := make(map[string][]Delta)
+	for rows.Next() {
+		var delta Delta
+		if err := rows.Scan(&delta.ID, &delta.Action, &delta.TableName, &delta.OldData, &delta.NewData, &delta.Timestamp); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("error scanning delta: %v", err)
+		}
+		if byTable[delta.TableName] == nil {
+			tables = append(tables, delta.TableName)
+		}
+		byTable[delta.TableName] = append(byTable[delta.TableName], delta)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	sort.Strings(tables)
+
+	for _, name := range tables {
+		deltas := byTable[name]
+		// a dropped table's rows are compared by their content
+		var key []string
+		if tableExists(dbConn, name) {
+			if key, err = restore.RowKey(context.Background(), dbConn, name); err != nil {
+				return result, err
+			}
+		}
+		var d tableDiff
+		if len(key) == 0 {
+			d, err = diffByContent(name, deltas)
+		} else {
+			d, err = diffByKey(name, key, deltas)
+		}
+		if err != nil {
+			return result, err
+		}
+		if len(d.Added)+len(d.Removed)+len(d.Changed) > 0 {
+			result.Tables = append(result.Tables, d)
+		}
+	}
+	return result, nil
+}
+
+// follow each row's deltas by key; an update that changes a row's key
+// removes the row under its old key and adds it under the new one
+func diffByKey(table string, key []string, deltas []Delta) (tableDiff, error) {
+	states := make(map[string]*rowStates)
+	var order []string
+	state := func(row tracker.Row, before tracker.Row) *rowStates {
+		k := keyString(key, row)
+		s, ok := states[k]
+		if !ok {
+			values, _ := restore.KeyOf(key, row)
+			s = &rowStates{key: values, before: before}
+			states[k] = s
+			order = append(order, k)
+		}
+		return s
+	}
+
+	for _, delta := range deltas {
+		oldData, newData, err := diffPayloads(delta)
+		if err != nil {
+			return tableDiff{}, err
+		}
+		if (oldData != nil && keyString(key, oldData) == "") || (newData != nil && keyString(key, newData) == "") {
+			log.Printf("Warning: delta %d of %s has no complete key; it is left out of the comparison.", delta.ID, table)
+			continue
+		}
+		switch {
+		case delta.Action == "INSERT":
+			// a key not seen before had no row at from
+			state(newData, nil).after = newData
+		case delta.Action == "DELETE":
+			state(oldData, oldData).after = nil
+		case keyString(key, oldData) == keyString(key, newData):
+			state(oldData, oldData).after = newData
+		default:
+			state(oldData, oldData).after = nil
+			state(newData, nil).after = newData
+		}
+	}
+
+	d := tableDiff{Table: table, Added: []rowDiff{}, Removed: []rowDiff{}, Changed: []rowDiff{}}
+	for _, k := range order {
+		s := states[k]
+		switch {
+		case s.before == nil && s.after != nil:
+			d.Added = append(d.Added, rowDiff{Key: s.key, After: s.after})
+		case s.before != nil && s.after == nil:
+			d.Removed = append(d.Removed, rowDiff{Key: s.key, Before: s.before})
+		case s.before != nil && s.after != nil:
+			if columns := changedColumns(s.before, s.after); len(columns) > 0 {
+				d.Changed = append(d.Changed, rowDiff{Key: s.key, Before: s.before, After: s.after, Columns: columns})
+			}
+		}
+	}
+	return d, nil
+}
+
+// count the rows the deltas removed and added by their content; identical
+// rows can't be told apart, so a row removed and added again cancels out
+func diffByContent(table string, deltas []Delta) (tableDiff, error) {
+	net := make(map[string]int)
+	content := make(map[string]tracker.Row)
+	var order []string
+	count := func(row tracker.Row, n int) error {
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		k := string(encoded)
+		if _, ok := content[k]; !ok {
+			content[k] = row
+			order = append(order, k)
+		}
+		net[k] += n
+		return nil
+	}
+
+	for _, delta := range deltas {
+		oldData, newData, err := diffPayloads(delta)
+		if err != nil {
+			return tableDiff{}, err
+		}
+		if oldData != nil {
+			if err := count(oldData, -1); err != nil {
+				return tableDiff{}, fmt.Errorf("delta %d: %v", delta.ID, err)
+			}
+		}
+		if newData != nil {
+			if err := count(newData, 1); err != nil {
+				return tableDiff{}, fmt.Errorf("delta %d: %v", delta.ID, err)
+			}
+		}
+	}
+
+	d := tableDiff{Table: table, Added: []rowDiff{}, Removed: []rowDiff{}, Changed: []rowDiff{}}
+	for _, k := range order {
+		for n := net[k]; n > 0; n-- {
+			d.Added = append(d.Added, rowDiff{After: content[k]})
+		}
+		for n := net[k]; n < 0; n++ {
+			d.Removed = append(d.Removed, rowDiff{Before: content[k]})
+		}
+	}
+	return d, nil
+}
+
+// a delta's old and new rows, nil where it has none, keeping every digit of
+// numbers
+func diffPayloads(delta Delta) (tracker.Row, tracker.Row, error) {
+	var rows [2]tracker.Row
+	for i, raw := range []*json.RawMessage{delta.OldData, delta.NewData} {
+		if raw == nil || string(*raw) == "null" {
+			continue
+		}
+		row, err := tracker.DecodeRow(*raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("delta %d: %v", delta.ID, err)
+		}
+		rows[i] = row
+	}
+	return rows[0], rows[1], nil
+}
+
+// the columns whose values differ between two versions of a row, sorted
+func changedColumns(before, after tracker.Row) []string {
+	var columns []string
+	for column, value := range after {
+		if old, ok := before[column]; !ok || !reflect.DeepEqual(old, value) {
+			columns = append(columns, column)
+		}
+	}
+	for column := range before {
+		if _, ok := after[column]; !ok {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func printDiff(result diffResult) {
+	outputFormat.Print(result, func() {
+		fmt.Printf("--- %s\n+++ %s\n", result.From.Format(time.RFC3339), result.To.Format(time.RFC3339))
+		for _, t := range result.Tables {
+			fmt.Printf("\n%s: %d added, %d removed, %d changed\n", t.Table, len(t.Added), len(t.Removed), len(t.Changed))
+			for _, r := range t.Removed {
+				fmt.Printf("- %s\n", formatRow(r.Before))
+			}
+			for _, r := range t.Added {
+				fmt.Printf("+ %s\n", formatRow(r.After))
+			}
+			for _, r := range t.Changed {
+				fmt.Printf("~ %s\n", formatRow(r.Key))
+				for _, column := range r.Columns {
+					fmt.Printf("    %s: %s -> %s\n", column, formatValue(r.Before, column), formatValue(r.After, column))
+				}
+			}
+		}
+	})
+}
+
+func formatRow(row tracker.Row) string {
+	encoded, _ := json.Marshal(row)
+	return string(encoded)
+}
+
+// a column's value as JSON, or "(none)" for a column the row doesn't have
+func formatValue(row tracker.Row, column string) string {
+	value, ok := row[column]
+	if !ok {
+		return "(none)"
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// write a diff's net changes as a pair of migration scripts in dir: up.sql
+// turns a database holding the rows as they were at the diff's from into
+// one holding them as they were at to, and down.sql turns it back. Each runs
+// in one transaction, with its values written out as literals, ordered so
+// no row is written before the parent it references.
+func writeMigration(dir string, result diffResult) error {
+	relations, err := loadRelations(dbConn)
+	if err != nil {
+		return err
+	}
+	// statements are fitted to the tables as the original database has them
+	builder := restore.NewBuilder(dbConn)
+	builder.SkipAmbiguous(cfg.Keyless.Skip())
+
+	up, down, err := migrationDeltas(result)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create migration directory: %v", err)
+	}
+	for _, script := range []struct {
+		name   string
+		deltas []Delta
+		what   string
+	}{
+		{"up.sql", up, fmt.Sprintf("from %s to %s", result.From.Format(time.RFC3339), result.To.Format(time.RFC3339))},
+		{"down.sql", down, fmt.Sprintf("from %s back to %s", result.To.Format(time.RFC3339), result.From.Format(time.RFC3339))},
+	} {
+		deltas, err := orderByRelations(script.deltas, relations)
+		if err != nil {
+			return err
+		}
+		var sql strings.Builder
+		fmt.Fprintf(&sql, "-- net data changes %s, written by db-delta-tracker diff\nBEGIN;\n\n", script.what)
+		for _, delta := range deltas {
+			query, args, err := builder.Statement(context.Background(), delta)
+			if err != nil {
+				return fmt.Errorf("%s: %v", script.name, err)
+			}
+			sql.WriteString(restore.Inline(query, args) + ";\n")
+		}
+		sql.WriteString("\nCOMMIT;\n")
+
+		path := filepath.Join(dir, script.name)
+		if err := os.WriteFile(path, []byte(sql.String()), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		log.Printf("Wrote %d statements to %s.", len(deltas), path)
+	}
+	return nil
+}
+
+// the deltas applying a diff, and the ones reverting it. Tables the original
+// database no longer has are left out, since there is nothing to fit the
+// statements to.
+func migrationDeltas(result diffResult) ([]Delta, []Delta, error) {
+	var up, down []Delta
+	for _, t := range result.Tables {
+		if !tableExists(dbConn, t.Table) {
+			log.Printf("Warning: %s no longer exists in the original database; its changes are left out of the scripts.", t.Table)
+			continue
+		}
+		add := func(deltas *[]Delta, action string, before, after tracker.Row) error {
+			delta := Delta{Action: action, TableName: t.Table}
+			for _, p := range []struct {
+				row  tracker.Row
+				dest **json.RawMessage
+			}{{before, &delta.OldData}, {after, &delta.NewData}} {
+				if p.row == nil {
+					continue
+				}
+				data, err := json.Marshal(p.row)
+				if err != nil {
+					return fmt.Errorf("failed to encode a row of %s: %v", t.Table, err)
+				}
+				raw := json.RawMessage(data)
+				*p.dest = &raw
+			}
+			*deltas = append(*deltas, delta)
+			return nil
+		}
+		for _, r := range t.Removed {
+			if err := add(&up, "DELETE", r.Before, nil); err != nil {
+				return nil, nil, err
+			}
+			if err := add(&down, "INSERT", nil, r.Before); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, r := range t.Changed {
+			if err := add(&up, "UPDATE", r.Before, r.After); err != nil {
+				return nil, nil, err
+			}
+			if err := add(&down, "UPDATE", r.After, r.Before); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, r := range t.Added {
+			if err := add(&up, "INSERT", nil, r.After); err != nil {
+				return nil, nil, err
+			}
+			if err := add(&down, "DELETE", r.After, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return up, down, nil
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// free space can't be checked on this platform
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("free space check is not supported on this platform")
+}
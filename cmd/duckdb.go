@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/objstore"
+	"db-delta-tracker/pkg/parquet"
+
+	"github.com/lib/pq"
+)
+
+// DuckDB types for the PostgreSQL ones (information_schema data_type) that
+// have a close match; other columns stay VARCHAR
+var duckDBTypes = map[string]string{
+	"smallint":                    "SMALLINT",
+	"integer":                     "INTEGER",
+	"bigint":                      "BIGINT",
+	"real":                        "REAL",
+	"double precision":            "DOUBLE",
+	"boolean":                     "BOOLEAN",
+	"date":                        "DATE",
+	"timestamp without time zone": "TIMESTAMP",
+	"timestamp with time zone":    "TIMESTAMPTZ",
+	"uuid":                        "UUID",
+	"json":                        "JSON",
+	"jsonb":                       "JSON",
+}
+
+// load the materialized tables, and the deltas that brought them there as a
+// deltas table to look back through, into a DuckDB database file. The data
+// goes through Parquet files in dir and the duckdb command line tool, whose
+// script is kept in dir as load.sql to run again or by hand.
+func loadDuckDB(file, dir string, tables []materializedTable, deltas []Delta) error {
+	written := make(map[string]bool)
+	for _, t := range tables {
+		written[t.Table] = true
+	}
+	var kept []Delta
+	for _, d := range deltas {
+		if written[d.TableName] || d.Action == markAction || d.Action == renameAction {
+			kept = append(kept, d)
+		}
+	}
+	deltas = kept
+
+	deltasFile := filepath.Join(dir, "_deltas.parquet")
+	if err := writeDeltasParquet(deltasFile, deltas); err != nil {
+		return err
+	}
+
+	var script strings.Builder
+	for _, t := range tables {
+		columns, err := duckDBColumns(t.Table, t.Columns)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&script, "CREATE OR REPLACE TABLE %s AS SELECT %s FROM read_parquet(%s);\n",
+			ident.Quote(t.Table), columns, pq.QuoteLiteral(absPath(t.File)))
+	}
+	fmt.Fprintf(&script, `CREATE OR REPLACE TABLE deltas AS SELECT
+	CAST(id AS BIGINT) AS id, action, table_name, CAST(old_data AS JSON) AS old_data, CAST(new_data AS JSON) AS new_data,
+	CAST("timestamp" AS TIMESTAMPTZ) AS "timestamp", CAST(txid AS BIGINT) AS txid, origin
+FROM read_parquet(%s);
+`, pq.QuoteLiteral(absPath(deltasFile)))
+
+	scriptFile := filepath.Join(dir, "load.sql")
+	if err := os.WriteFile(scriptFile, []byte(script.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", scriptFile, err)
+	}
+
+	duckdb, err := exec.LookPath("duckdb")
+	if err != nil {
+		return fmt.Errorf("the duckdb command line tool isn't on PATH; install it, or run duckdb %s < %s", file, scriptFile)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(duckdb, file)
+	cmd.Stdin = strings.NewReader(script.String())
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("duckdb failed to load %s: %v: %s", file, err, strings.TrimSpace(stderr.String()))
+	}
+	log.Printf("Loaded %d tables and %d deltas into %s.", len(tables), len(deltas), file)
+	return nil
+}
+
+// the select list casting a materialized table's text columns back to the
+// types the source has for them
+func duckDBColumns(table string, columns []string) (string, error) {
+	types := make(map[string]string)
+	rows, err := dbConn.Query(`
+		SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = $1
+	`, table)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column, dataType string
+		if err := rows.Scan(&column, &dataType); err != nil {
+			return "", fmt.Errorf("failed to read the columns of %s: %v", table, err)
+		}
+		types[column] = duckDBTypes[dataType]
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		selected[i] = ident.Quote(column)
+		if t := types[column]; t != "" {
+			selected[i] = fmt.Sprintf("TRY_CAST(%[1]s AS %[2]s) AS %[1]s", ident.Quote(column), t)
+		}
+	}
+	return strings.Join(selected, ", "), nil
+}
+
+// write deltas as a Parquet file of text columns, locally or in object
+// storage
+func writeDeltasParquet(path string, deltas []Delta) error {
+	text := func(s string) *string { return &s }
+
+	rows := make([][]*string, len(deltas))
+	for i, d := range deltas {
+		var oldData, newData *string
+		if d.OldData != nil {
+			oldData = text(string(*d.OldData))
+		}
+		if d.NewData != nil {
+			newData = text(string(*d.NewData))
+		}
+		rows[i] = []*string{text(strconv.FormatInt(d.ID, 10)), text(d.Action), text(d.TableName), oldData, newData,
+			text(d.Timestamp.Format(time.RFC3339Nano)), text(strconv.FormatInt(d.TxID, 10)), text(d.Origin)}
+	}
+	var buf bytes.Buffer
+	columns := []string{"id", "action", "table_name", "old_data", "new_data", "timestamp", "txid", "origin"}
+	if err := parquet.Write(&buf, columns, rows); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := objstore.WriteFile(context.Background(), path, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// a path duckdb finds wherever it runs
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"time"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/objstore"
+	"db-delta-tracker/pkg/parquet"
+	"db-delta-tracker/pkg/schemaregistry"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// the formats export writes, with their file extensions
+var exportFormats = map[string]string{"parquet": ".parquet", "avro": ".avro"}
+
+// what export wrote
+type exportResult struct {
+	Format   string         `json:"format"`
+	Files    []exportedFile `json:"files"`
+	SchemaID int            `json:"schema_id,omitempty"` // of the Avro schema in schema_registry
+}
+
+type exportedFile struct {
+	File  string `json:"file"`
+	Table string `json:"table,omitempty"` // the backed up table; empty for the deltas
+	Rows  int    `json:"rows"`
+}
+
+// write the change history, and optionally init's table backups, as files
+// analytics tools and data lakes read directly
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write into, local or s3://, gs:// or az://")
+	format := fs.String("format", "parquet", "file format: parquet or avro")
+	since := fs.String("since", "", "RFC 3339 time to export deltas recorded after")
+	until := fs.String("until", "", "RFC 3339 time to export deltas recorded up to")
+	onlyTables := fs.String("tables", "", "comma separated tables to export deltas and backups of; default all")
+	backups := fs.Bool("backups", false, "also export init's backup of each table")
+	archiveDir := fs.String("archive-dir", "", "directory of archived deltas to export along with the deltas table")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *dir == "" {
+		usagef("Usage: export --dir <dir> [--format parquet|avro] [--since <timestamp>] [--until <timestamp>] [--tables <table>,...] [--backups]")
+	}
+	if _, ok := exportFormats[*format]; !ok {
+		usagef("-format must be parquet or avro")
+	}
+	if *backups && *format != "parquet" {
+		usagef("-backups needs -format parquet")
+	}
+	var sinceTime, untilTime time.Time
+	for _, t := range []struct {
+		flag  string
+		value string
+		time  *time.Time
+	}{{"since", *since, &sinceTime}, {"until", *until, &untilTime}} {
+		if t.value == "" {
+			continue
+		}
+		var err error
+		if *t.time, err = time.Parse(time.RFC3339, t.value); err != nil {
+			usagef("-%s must be an RFC 3339 time, e.g. 2024-05-01T12:00:00Z: %v", t.flag, err)
+		}
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	// consumers can look the schema up before the files arrive
+	var schemaID int
+	if *format == "avro" && cfg.SchemaRegistry.URL != "" {
+		var err error
+		if schemaID, err = schemaregistry.Register(context.Background(), cfg.SchemaRegistry.URL, cfg.SchemaRegistry.Subject, schemaregistry.Avro, codec.AvroSchema); err != nil {
+			fatal(exitcode.Wrap(exitcode.Connection, err), "Error registering the Avro schema")
+		}
+		log.Printf("Registered the delta schema under %s as schema %d.", cfg.SchemaRegistry.Subject, schemaID)
+	}
+
+	result, err := export(*dir, *format, sinceTime, untilTime, splitList(*onlyTables), *backups, *archiveDir)
+	if err != nil {
+		fatal(err, "Error exporting")
+	}
+	result.SchemaID = schemaID
+	outputFormat.Print(result, func() {
+		for _, f := range result.Files {
+			fmt.Printf("%d rows in %s\n", f.Rows, f.File)
+		}
+	})
+}
+
+// write the deltas between since and until (zero for no bound) to
+// deltas<ext> in dir and, with backups, each table's backup to
+// backups/<table><ext>
+func export(dir, format string, since, until time.Time, only []string, backups bool, archiveDir string) (exportResult, error) {
+	result := exportResult{Format: format, Files: []exportedFile{}}
+
+	all, _, err := loadDeltas(&quarantine{}, archiveDir)
+	if err != nil {
+		return result, err
+	}
+	deltas := make([]Delta, 0, len(all))
+	for _, d := range all {
+		if !since.IsZero() && !d.Timestamp.After(since) {
+			continue
+		}
+		if !until.IsZero() && d.Timestamp.After(until) {
+			continue
+		}
+		if len(only) > 0 && !containsString(only, d.TableName) {
+			continue
+		}
+		deltas = append(deltas, d)
+	}
+	path := objstore.Join(dir, "deltas"+exportFormats[format])
+	if format == "avro" {
+		err = writeDeltasFile(path, deltas, codec.Avro)
+	} else {
+		err = writeDeltasParquet(path, deltas)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Files = append(result.Files, exportedFile{File: path, Rows: len(deltas)})
+	log.Printf("Exported %d deltas to %s.", len(deltas), path)
+
+	if !backups {
+		return result, nil
+	}
+	tables := only
+	if len(tables) == 0 {
+		if tables, err = getTableNames(); err != nil {
+			return result, err
+		}
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if table == "deltas" {
+			continue
+		}
+		rows, err := tracker.FileSnapshots(cfg.BackupFile).Snapshot(context.Background(), table)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: %s has no backup; skipping it.", table)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		columns, err := materializeColumns(table, rows)
+		if err != nil {
+			return result, err
+		}
+		var buf bytes.Buffer
+		path := objstore.Join(dir, "backups/"+table+exportFormats[format])
+		if err := parquet.Write(&buf, columns, textValues(columns, rows)); err != nil {
+			return result, fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		if err := objstore.WriteFile(context.Background(), path, buf.Bytes()); err != nil {
+			return result, fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		result.Files = append(result.Files, exportedFile{File: path, Table: table, Rows: len(rows)})
+	}
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// a window in which capture was paused, so the deltas table misses changes
+type captureGap struct {
+	from time.Time
+	to   *time.Time // nil while capture is still paused
+}
+
+// fetch the recorded capture gaps, oldest first
+func loadCaptureGaps() ([]captureGap, error) {
+	var exists bool
+	if err := dbConn.QueryRow("SELECT to_regclass('delta_tracker.events') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up events table: %v", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	rows, err := dbConn.Query("SELECT started_at, ended_at FROM delta_tracker.events WHERE kind = 'capture_gap' ORDER BY started_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch capture gaps: %v", err)
+	}
+	defer rows.Close()
+
+	var gaps []captureGap
+	for rows.Next() {
+		var gap captureGap
+		if err := rows.Scan(&gap.from, &gap.to); err != nil {
+			return nil, fmt.Errorf("failed to scan capture gap: %v", err)
+		}
+		gaps = append(gaps, gap)
+	}
+	return gaps, rows.Err()
+}
+
+// describe a gap for log messages
+func (g captureGap) String() string {
+	if g.to == nil {
+		return fmt.Sprintf("since %s (still paused)", g.from.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("from %s to %s", g.from.Format(time.RFC3339), g.to.Format(time.RFC3339))
+}
+
+// warn that the restored database can't reflect changes made while paused
+func warnCaptureGaps() error {
+	gaps, err := loadCaptureGaps()
+	if err != nil {
+		return err
+	}
+	for _, gap := range gaps {
+		log.Printf("Warning: capture was paused %s; changes made in that window are not in the deltas table.", gap)
+	}
+	return nil
+}
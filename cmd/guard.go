@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/capture"
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/exitcode"
+)
+
+// limits on how large the deltas table may grow
+type deltasLimits struct {
+	maxRows  int64
+	maxBytes int64
+	warnAt   float64 // fraction of a limit at which warnings start
+}
+
+// check the deltas table against its size limits, meant to be run from cron;
+// limits default to the config's retention settings
+func runGuard(args []string) {
+	fs := flag.NewFlagSet("guard", flag.ExitOnError)
+	maxRows := fs.Int64("max-rows", 0, "maximum number of rows in the deltas table (0 = no limit)")
+	maxSize := fs.String("max-size", "", "maximum size of the deltas table, e.g. 500MB or 20GB")
+	warnAt := fs.Float64("warn-at", 0.8, "fraction of a limit at which to start warning")
+	archiveDir := fs.String("archive-dir", "", "when a limit is exceeded, move the oldest deltas into files in this directory")
+	archiveCodec := fs.String("archive-codec", "", "format of archive files: "+strings.Join(codec.Names(), ", ")+" (default json)")
+	fs.StringVar(&notifyWebhook, "notify-webhook", "", "URL to POST notifications to (overrides notify.webhook in the config)")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	// flags given on the command line win over the config
+	retention := cfg.Retention
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-rows":
+			retention.MaxRows = *maxRows
+		case "max-size":
+			retention.MaxSize = *maxSize
+		case "warn-at":
+			retention.WarnAt = *warnAt
+		case "archive-dir":
+			retention.ArchiveDir = *archiveDir
+		case "archive-codec":
+			retention.ArchiveCodec = *archiveCodec
+		}
+	})
+	if notifyWebhook == "" {
+		notifyWebhook = cfg.Notify.Webhook
+	}
+
+	limits := deltasLimits{maxRows: retention.MaxRows, warnAt: retention.WarnAt}
+	if retention.MaxSize != "" {
+		n, err := parseBytes(retention.MaxSize)
+		if err != nil {
+			usagef("Invalid max size: %v", err)
+		}
+		limits.maxBytes = n
+	}
+	if limits.maxRows == 0 && limits.maxBytes == 0 {
+		usagef("Nothing to guard: set -max-rows and/or -max-size, or retention in the config")
+	}
+	archiveWith, err := codec.Lookup(retention.ArchiveCodec)
+	if err != nil {
+		usagef("Invalid archive codec: %v", err)
+	}
+	if readOnly && retention.ArchiveDir != "" {
+		usagef("-read-only can't be combined with archiving, which deletes from the deltas table")
+	}
+
+	// sampled rows nothing has changed since their window ended are only
+	// logged when something comes along to do it
+	var closed int
+	if !readOnly {
+		if closed, err = capture.FlushSampled(context.Background(), dbConn); err != nil {
+			fatal(err, "Error logging sampled rows")
+		}
+	}
+
+	result, err := guardDeltasTable(limits, retention.ArchiveDir, archiveWith)
+	if err != nil {
+		fatal(err, "Error checking deltas table")
+	}
+	result.SampleWindowsClosed = closed
+	outputFormat.Print(result, func() {})
+	if result.Exceeded {
+		// let schedulers see the table is over its limit
+		exit(exitcode.Limit)
+	}
+}
+
+// what guard found; notifications have already been sent for it
+type guardResult struct {
+	Rows         int64  `json:"rows"`
+	Bytes        int64  `json:"bytes"` // of live rows, leaving out dead tuples and free space
+	MaxRows      int64  `json:"max_rows,omitempty"`
+	MaxBytes     int64  `json:"max_bytes,omitempty"`
+	Exceeded     bool   `json:"exceeded"` // still over a limit after any archiving
+	ArchivedTo   string `json:"archived_to,omitempty"`
+	ArchivedRows int    `json:"archived_rows,omitempty"`
+
+	SampleWindowsClosed int `json:"sample_windows_closed,omitempty"` // of sampled rows, their folded updates logged
+}
+
+// count the deltas and the bytes they take up. The relation's own size
+// doesn't shrink when rows are deleted, only once a VACUUM FULL rewrites it,
+// so it would stay over the limit however much was archived; the rows'
+// sizes are summed instead.
+func measureDeltas() (int64, int64, error) {
+	var rowCount, size int64
+	err := dbConn.QueryRow("SELECT COUNT(*), COALESCE(SUM(pg_column_size(d.*)), 0) FROM deltas d").Scan(&rowCount, &size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to measure deltas table: %v", err)
+	}
+	return rowCount, size, nil
+}
+
+// whether the deltas table is over one of its limits
+func (l deltasLimits) exceeded(rowCount, size int64) bool {
+	return (l.maxRows > 0 && rowCount >= l.maxRows) || (l.maxBytes > 0 && size >= l.maxBytes)
+}
+
+// compare the deltas table with its limits, warning as they are approached
+// and archiving the oldest deltas with codec c when a limit is passed and
+// archiveDir is set
+func guardDeltasTable(limits deltasLimits, archiveDir string, c codec.Codec) (guardResult, error) {
+	rowCount, size, err := measureDeltas()
+	if err != nil {
+		return guardResult{}, err
+	}
+	result := guardResult{Rows: rowCount, Bytes: size, MaxRows: limits.maxRows, MaxBytes: limits.maxBytes}
+
+	// how many of the oldest rows must go to get back under the warning level
+	var excess int64
+
+	if limits.maxRows > 0 {
+		ratio := float64(rowCount) / float64(limits.maxRows)
+		if ratio >= 1 {
+			notify("critical", fmt.Sprintf("deltas table has %d rows, over its limit of %d", rowCount, limits.maxRows))
+		} else if ratio >= limits.warnAt {
+			notify("warning", fmt.Sprintf("deltas table has %d rows, %.0f%% of its limit of %d", rowCount, ratio*100, limits.maxRows))
+		}
+		if ratio >= 1 {
+			excess = max(excess, rowCount-int64(float64(limits.maxRows)*limits.warnAt))
+		}
+	}
+
+	if limits.maxBytes > 0 {
+		ratio := float64(size) / float64(limits.maxBytes)
+		if ratio >= 1 {
+			notify("critical", fmt.Sprintf("deltas table is %s, over its limit of %s", formatBytes(size), formatBytes(limits.maxBytes)))
+		} else if ratio >= limits.warnAt {
+			notify("warning", fmt.Sprintf("deltas table is %s, %.0f%% of its limit of %s", formatBytes(size), ratio*100, formatBytes(limits.maxBytes)))
+		}
+		if ratio >= 1 {
+			// assume rows are roughly the same size
+			keep := float64(rowCount) * float64(limits.maxBytes) * limits.warnAt / float64(size)
+			excess = max(excess, rowCount-int64(keep))
+		}
+	}
+
+	if !limits.exceeded(rowCount, size) {
+		log.Printf("Deltas table within limits (%d rows, %s).", rowCount, formatBytes(size))
+		return result, nil
+	}
+	result.Exceeded = true
+	if archiveDir == "" {
+		return result, nil
+	}
+
+	path, moved, err := archiveOldestDeltas(archiveDir, time.Time{}, excess, c)
+	if err != nil {
+		notify("critical", fmt.Sprintf("automatic archiving of the deltas table failed: %v", err))
+		return result, err
+	}
+	notify("info", fmt.Sprintf("archived the %d oldest deltas to %s", moved, path))
+	result.ArchivedTo, result.ArchivedRows = path, moved
+
+	// rows are only roughly the same size, so check what archiving left
+	if result.Rows, result.Bytes, err = measureDeltas(); err != nil {
+		return result, err
+	}
+	result.Exceeded = limits.exceeded(result.Rows, result.Bytes)
+	if result.Exceeded {
+		notify("critical", fmt.Sprintf("deltas table is still over a limit after archiving (%d rows, %s)", result.Rows, formatBytes(result.Bytes)))
+	}
+	return result, nil
+}
+
+// parse a size such as 512MB or 20GB (binary units)
+func parseBytes(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q", value)
+			}
+			return int64(n * float64(unit.size)), nil
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n, nil
+}
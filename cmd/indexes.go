@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+)
+
+// make sure every restored table that UPDATE/DELETE deltas look up has an
+// index leading on the columns they look rows up by before replay starts, so
+// long replays don't turn into a sequential scan per delta; tables with a
+// primary key always have one, so this only indexes id on tables without.
+// Tables with neither are left as they are
+func ensureReplayIndexes(restoredConn *sql.DB, builder *restore.Builder, deltas []Delta) error {
+	seen := make(map[string]bool)
+	for _, delta := range deltas {
+		if delta.Action == "INSERT" || delta.Action == renameAction || seen[delta.TableName] {
+			continue
+		}
+		seen[delta.TableName] = true
+
+		if !tableExists(restoredConn, delta.TableName) {
+			continue
+		}
+
+		key, err := builder.Key(context.Background(), delta.TableName)
+		if err != nil {
+			return err
+		}
+		// rows matched on all their columns have no column worth indexing
+		if len(key) == 0 {
+			continue
+		}
+		indexed, err := hasReplayIndex(restoredConn, delta.TableName, key[0])
+		if err != nil {
+			return err
+		}
+		if indexed {
+			continue
+		}
+
+		// managed services often restore into tables the login doesn't own;
+		// replay still works there, only slower
+		if ok, err := canAlterTable(restoredConn, delta.TableName); err != nil {
+			return err
+		} else if !ok {
+			skipOperation("replay index on %s (the login doesn't own it)", delta.TableName)
+			continue
+		}
+
+		indexName := delta.TableName + "_replay_id_idx"
+		_, err = restoredConn.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", ident.Quote(indexName), ident.Quote(delta.TableName), ident.List(key)))
+		if err != nil {
+			return fmt.Errorf("failed to create replay index on %s: %v", delta.TableName, err)
+		}
+		log.Printf("Created replay index %s on restored table %s.", indexName, delta.TableName)
+	}
+	return nil
+}
+
+// check whether a valid index (primary key, unique or plain) leads on a column
+func hasReplayIndex(restoredConn *sql.DB, tableName, column string) (bool, error) {
+	var exists bool
+	err := restoredConn.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM pg_index i
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+			WHERE i.indrelid = $1::regclass AND i.indisvalid AND a.attname = $2
+		)`, ident.Quote(tableName), column).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check replay index on %s: %v", tableName, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/backup"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// the advisory lock an in-place restore holds on the source, so two can't
+// repair it at once
+const inPlaceLock = 0x64656c74 // "delt"
+
+// what an in-place restore changed on the source
+type inPlaceResult struct {
+	Database    string         `json:"database"`
+	Until       time.Time      `json:"until"`
+	SnapshotDir string         `json:"snapshot_dir"` // the affected tables as they were before, as a backup bundle
+	Tables      []inPlaceTable `json:"tables"`
+}
+
+type inPlaceTable struct {
+	Table    string `json:"table"`
+	Inserted int    `json:"inserted"`
+	Updated  int    `json:"updated"`
+	Deleted  int    `json:"deleted"`
+}
+
+// the statements bringing one table back to its rebuilt state
+type repair struct {
+	inPlaceTable
+	deletes, writes []rollbackStatement
+}
+
+// repair the source itself: bring every table changed after until back to
+// its state at that time, rebuilt from the backup bundle and the deltas up
+// to until
+func runInPlace(bundle string, until time.Time, q *quarantine, only []string, archiveDir, confirm string) {
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, err := restoreInPlace(bundle, until, q, only, archiveDir, confirm)
+	if err != nil {
+		fatal(err, "Error restoring in place")
+	}
+	outputFormat.Print(result, func() {
+		for _, t := range result.Tables {
+			fmt.Printf("%s: %d inserted, %d updated, %d deleted\n", t.Table, t.Inserted, t.Updated, t.Deleted)
+		}
+		if result.SnapshotDir != "" {
+			fmt.Printf("The tables as they were before are in %s.\n", result.SnapshotDir)
+		}
+	})
+}
+
+func restoreInPlace(bundle string, until time.Time, q *quarantine, only []string, archiveDir, confirm string) (inPlaceResult, error) {
+	database := cfg.Source.DBName
+	result := inPlaceResult{Database: database, Until: until, Tables: []inPlaceTable{}}
+	if info, err := os.Stat(bundle); err != nil || !info.IsDir() {
+		return result, fmt.Errorf("backup bundle %s is not a directory", bundle)
+	}
+
+	// the bundle holds the backups under the names init gives them
+	inBundle := func(table string) (string, error) {
+		path, err := cfg.BackupFile(table)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(bundle, filepath.Base(path)), nil
+	}
+	rebuilt, err := rebuildTables(until, q, archiveDir, inBundle)
+	if err != nil {
+		return result, err
+	}
+
+	// the tables to repair are those changed since until, and those
+	// quarantined changes were made to before it
+	affected, err := changedSince(until, only)
+	if err != nil {
+		return result, err
+	}
+	for _, d := range rebuilt.quarantined {
+		if !d.Timestamp.After(until) && !containsString(affected, d.TableName) && (len(only) == 0 || containsString(only, d.TableName)) {
+			affected = append(affected, d.TableName)
+		}
+	}
+	sort.Strings(affected)
+	if len(affected) == 0 {
+		log.Printf("No table of %s changed after %s; nothing to repair.", database, until.Format(time.RFC3339))
+		return result, nil
+	}
+	for _, table := range affected {
+		if len(cfg.Mask.Columns.For(table)) > 0 {
+			return result, fmt.Errorf("%s has masked columns; restoring it in place would write the masked values into %s", table, database)
+		}
+		if t := rebuilt.tables[table]; t == nil || !t.backedUp {
+			return result, fmt.Errorf("the bundle %s has no backup of %s", bundle, table)
+		}
+	}
+
+	log.Printf("This replaces the contents of %s in %s with their state at %s.", strings.Join(affected, ", "), database, until.Format(time.RFC3339))
+	if err := confirmInPlace(database, confirm); err != nil {
+		return result, err
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", inPlaceLock).Scan(&locked); err != nil {
+		return result, fmt.Errorf("failed to take the in-place restore lock: %v", err)
+	}
+	if !locked {
+		return result, exitcode.Wrap(exitcode.Conflict, fmt.Errorf("another in-place restore of %s is running", database))
+	}
+	// reads go on, but no one writes to the tables while they are repaired
+	quoted := make([]string, len(affected))
+	for i, table := range affected {
+		quoted[i] = ident.Quote(table)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", strings.Join(quoted, ", "))); err != nil {
+		return result, fmt.Errorf("failed to lock %s: %v", strings.Join(affected, ", "), err)
+	}
+
+	// keep the tables as they are now before changing anything
+	result.SnapshotDir = filepath.Join(bundle, "pre-repair-"+time.Now().UTC().Format("20060102T150405Z"))
+	builder := restore.NewBuilder(dbConn)
+	builder.SkipAmbiguous(cfg.Keyless.Skip())
+	var repairs []repair
+	for _, table := range affected {
+		current, err := currentRows(tx, table)
+		if err != nil {
+			return result, err
+		}
+		path, err := inBundle(table)
+		if err != nil {
+			return result, err
+		}
+		if err := backup.WriteFile(filepath.Join(result.SnapshotDir, filepath.Base(path)), current); err != nil {
+			return result, err
+		}
+		r, err := repairTable(builder, table, current, rebuilt.tables[table])
+		if err != nil {
+			return result, err
+		}
+		repairs = append(repairs, r)
+	}
+	log.Printf("Saved the current contents of %d tables to %s.", len(affected), result.SnapshotDir)
+
+	// children's rows go before their parents' are deleted, and parents'
+	// are written before their children's
+	relations, err := loadRelations(dbConn)
+	if err != nil {
+		return result, err
+	}
+	repairs = parentsFirst(repairs, relations)
+	run := func(s rollbackStatement) error {
+		fmt.Fprintf(outputFormat.Progress(), "Executing query: %s\n", s.Query)
+		fmt.Fprintf(outputFormat.Progress(), "         With values: %v\n", s.Values)
+		if _, err := tx.Exec(s.Query, s.Values...); err != nil {
+			return fmt.Errorf("failed to repair: %v (nothing was changed; the query was %s)", err, s.Query)
+		}
+		return nil
+	}
+	for i := len(repairs) - 1; i >= 0; i-- {
+		for _, s := range repairs[i].deletes {
+			if err := run(s); err != nil {
+				return result, err
+			}
+		}
+	}
+	for _, r := range repairs {
+		for _, s := range r.writes {
+			if err := run(s); err != nil {
+				return result, err
+			}
+		}
+		result.Tables = append(result.Tables, r.inPlaceTable)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit the repair: %v", err)
+	}
+	log.Printf("Restored %d tables of %s in place to %s.", len(repairs), database, until.Format(time.RFC3339))
+	return result, nil
+}
+
+// the tables with changes after until, among only if given; a rename after
+// until can't be undone this way
+func changedSince(until time.Time, only []string) ([]string, error) {
+	rows, err := dbConn.Query(`
+		SELECT table_name, bool_or(action = $2)
+		FROM deltas
+		WHERE timestamp > $1 AND action <> $3
+		GROUP BY table_name
+		ORDER BY table_name
+	`, until, renameAction, markAction)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		var renamed bool
+		if err := rows.Scan(&table, &renamed); err != nil {
+			return nil, fmt.Errorf("error scanning delta: %v", err)
+		}
+		if len(only) > 0 && !containsString(only, table) {
+			continue
+		}
+		if renamed {
+			return nil, fmt.Errorf("%s was renamed after %s; restore in place to a time after the rename", table, until.Format(time.RFC3339))
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	return tables, nil
+}
+
+// ask for the database's name before changing it, unless -confirm gave it
+func confirmInPlace(database, confirm string) error {
+	if confirm == "" {
+		fmt.Fprintf(os.Stderr, "Type the database name (%s) to go on: ", database)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		confirm = strings.TrimSpace(line)
+	}
+	if confirm != database {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("not confirmed; nothing was changed"))
+	}
+	return nil
+}
+
+// read a table's rows as the triggers record them
+func currentRows(tx *sql.Tx, table string) ([]tracker.Row, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t", ident.Quote(table)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %v", table, err)
+	}
+	defer rows.Close()
+	all := []tracker.Row{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to scan row from table %s: %v", table, err)
+		}
+		row, err := tracker.DecodeRow([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode row from table %s: %v", table, err)
+		}
+		all = append(all, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %v", table, err)
+	}
+	return all, nil
+}
+
+// the statements turning a table's current rows into its rebuilt ones,
+// leaving alone the rows that already match. Rows are matched by key, or on
+// all their columns for tables without one.
+func repairTable(builder *restore.Builder, table string, current []tracker.Row, target *tableRows) (repair, error) {
+	r := repair{inPlaceTable: inPlaceTable{Table: table}}
+	now := &tableRows{key: target.key, index: make(map[string][]int)}
+	for _, row := range current {
+		now.insert(row)
+	}
+	ctx := context.Background()
+	for _, row := range target.live() {
+		positions := now.index[now.identity(row)]
+		if len(positions) == 0 {
+			query, values, err := builder.Insert(ctx, table, row)
+			if err != nil {
+				return r, err
+			}
+			r.writes = append(r.writes, rollbackStatement{query, values})
+			r.Inserted++
+			continue
+		}
+		existing := now.rows[positions[len(positions)-1]]
+		now.remove(row)
+		if sameColumns(row, existing) {
+			continue
+		}
+		// only tables with a key get here, since without one the row's
+		// identity is all of it
+		key, err := restore.KeyOf(target.key, existing)
+		if err != nil {
+			return r, err
+		}
+		query, values, err := builder.Update(ctx, table, row, key)
+		if err != nil {
+			return r, err
+		}
+		r.writes = append(r.writes, rollbackStatement{query, values})
+		r.Updated++
+	}
+	for _, row := range now.live() {
+		var query string
+		var values []interface{}
+		var err error
+		if len(target.key) == 0 {
+			query, values, err = builder.DeleteRow(ctx, table, row)
+		} else {
+			var key map[string]interface{}
+			if key, err = restore.KeyOf(target.key, row); err == nil {
+				query, values, err = builder.Delete(ctx, table, key)
+			}
+		}
+		if err != nil {
+			return r, err
+		}
+		r.deletes = append(r.deletes, rollbackStatement{query, values})
+		r.Deleted++
+	}
+	return r, nil
+}
+
+// whether every column of want has the same value in row; columns left out
+// of the deltas are not compared
+func sameColumns(want, row tracker.Row) bool {
+	for column, value := range want {
+		if !reflect.DeepEqual(value, row[column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// order repairs so each table comes after the tables it references; tables
+// in a cycle keep their order
+func parentsFirst(repairs []repair, relations []relation) []repair {
+	parents := make(map[string][]string)
+	for _, r := range relations {
+		if r.Parent != r.Child {
+			parents[r.Child] = append(parents[r.Child], r.Parent)
+		}
+	}
+	byTable := make(map[string]repair)
+	var names []string
+	for _, r := range repairs {
+		byTable[r.Table] = r
+		names = append(names, r.Table)
+	}
+	sort.Strings(names)
+
+	var ordered []repair
+	placed := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var place func(table string)
+	place = func(table string) {
+		if placed[table] || visiting[table] {
+			return
+		}
+		visiting[table] = true
+		for _, parent := range parents[table] {
+			if _, ok := byTable[parent]; ok {
+				place(parent)
+			}
+		}
+		placed[table] = true
+		ordered = append(ordered, byTable[table])
+	}
+	for _, name := range names {
+		place(name)
+	}
+	return ordered
+}
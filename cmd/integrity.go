@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"db-delta-tracker/pkg/ident"
+)
+
+// rows left pointing at a parent row the restored database doesn't have
+type orphanReport struct {
+	Relation string   `json:"relation"`
+	Missing  int      `json:"missing_parents"` // distinct parent keys referenced but not found
+	Sample   []string `json:"sample"`          // a few of them
+}
+
+// how many missing parent keys an orphan report lists
+const orphanSampleSize = 5
+
+// check every relation on the databases the restore wrote to and report the
+// child rows whose parent is missing. Quarantined, filtered and skipped
+// deltas can leave such rows behind even where the source had none. A
+// relation whose tables were routed to different databases can't be checked
+// and is left out.
+func checkIntegrity(targets *replayTargets, relations []relation) ([]orphanReport, error) {
+	var reports []orphanReport
+	for _, r := range relations {
+		conn := targets.connFor(r.Child)
+		if conn != targets.connFor(r.Parent) {
+			log.Printf("Not checking %s: its tables were restored into different databases.", r)
+			continue
+		}
+		if !tableExists(conn, r.Child) || !tableExists(conn, r.Parent) {
+			continue
+		}
+
+		report, err := findOrphans(conn, r)
+		if err != nil {
+			return reports, err
+		}
+		if report.Missing > 0 {
+			log.Printf("Warning: rows of %s reference %d missing %s rows (%s), e.g. %v.", r.Child, report.Missing, r.Parent, r, report.Sample)
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+// the narrowest range of child ids a timed out check is split down to
+const verifyMinRange = 1000
+
+// count the parent keys one relation's child rows reference but the parent
+// table lacks, under timeouts.verify; with on_timeout: retry, a check that
+// times out is redone over ranges of child ids, halving a range each time
+// it times out again
+func findOrphans(conn *sql.DB, r relation) (orphanReport, error) {
+	timeout, _ := cfg.Timeouts.Verify.Duration() // checked by Validate
+	report, err := queryOrphans(conn, r, timeout)
+	switch {
+	case err == nil || !isStatementTimeout(err):
+		return report, err
+	case !cfg.Timeouts.Verify.Retry():
+		return report, fmt.Errorf("checking %s took longer than timeouts.verify.statement (%s): %v", r, timeout, err)
+	}
+
+	var low, high sql.NullInt64
+	if err := conn.QueryRow("SELECT min(id), max(id) FROM "+ident.Quote(r.Child)).Scan(&low, &high); err != nil {
+		return report, fmt.Errorf("failed to find the id range of %s: %v", r.Child, err)
+	}
+	log.Printf("Checking %s took longer than %s, retrying over ranges of %s ids.", r, timeout, r.Child)
+	missing := make(map[string]bool)
+	if err := orphansInRange(conn, r, timeout, low.Int64, high.Int64+1, missing); err != nil {
+		return report, err
+	}
+
+	report.Missing = len(missing)
+	for key := range missing {
+		report.Sample = append(report.Sample, key)
+	}
+	sort.Strings(report.Sample)
+	if len(report.Sample) > orphanSampleSize {
+		report.Sample = report.Sample[:orphanSampleSize]
+	}
+	return report, nil
+}
+
+// check a whole relation in one query
+func queryOrphans(conn *sql.DB, r relation, timeout time.Duration) (orphanReport, error) {
+	report := orphanReport{Relation: r.String(), Sample: []string{}}
+	err := withStatementTimeout(conn, timeout, func(tx *sql.Tx) error {
+		rows, err := tx.Query(fmt.Sprintf(`
+			SELECT c.%[2]s::text, count(*) OVER ()
+			FROM %[1]s c
+			WHERE c.%[2]s IS NOT NULL
+			  AND NOT EXISTS (SELECT 1 FROM %[3]s p WHERE p.%[4]s = c.%[2]s)
+			GROUP BY c.%[2]s
+			LIMIT %[5]d
+		`, ident.Quote(r.Child), ident.Quote(r.Column), ident.Quote(r.Parent), ident.Quote(r.ParentColumn), orphanSampleSize))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key, &report.Missing); err != nil {
+				return err
+			}
+			report.Sample = append(report.Sample, key)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to check %s: %w", r, err)
+	}
+	return report, nil
+}
+
+// collect the missing parent keys referenced by child rows with ids in
+// [low, high), splitting the range in two when checking it times out
+func orphansInRange(conn *sql.DB, r relation, timeout time.Duration, low, high int64, missing map[string]bool) error {
+	err := withStatementTimeout(conn, timeout, func(tx *sql.Tx) error {
+		rows, err := tx.Query(fmt.Sprintf(`
+			SELECT DISTINCT c.%[2]s::text
+			FROM %[1]s c
+			WHERE c.id >= $1 AND c.id < $2 AND c.%[2]s IS NOT NULL
+			  AND NOT EXISTS (SELECT 1 FROM %[3]s p WHERE p.%[4]s = c.%[2]s)
+		`, ident.Quote(r.Child), ident.Quote(r.Column), ident.Quote(r.Parent), ident.Quote(r.ParentColumn)), low, high)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			missing[key] = true
+		}
+		return rows.Err()
+	})
+	switch {
+	case err == nil:
+		return nil
+	case !isStatementTimeout(err):
+		return fmt.Errorf("failed to check %s: %v", r, err)
+	case high-low <= verifyMinRange:
+		return fmt.Errorf("checking %s for ids %d to %d still took longer than %s: %v", r, low, high-1, timeout, err)
+	}
+	middle := low + (high-low)/2
+	if err := orphansInRange(conn, r, timeout, low, middle, missing); err != nil {
+		return err
+	}
+	return orphansInRange(conn, r, timeout, middle, high, missing)
+}
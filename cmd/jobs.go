@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// one run of a scheduled job, as kept in delta_tracker.job_runs
+type jobRun struct {
+	ID        int64            `json:"id"`
+	Job       string           `json:"job"`
+	Command   string           `json:"command"`
+	StartedAt time.Time        `json:"started_at"`
+	EndedAt   *time.Time       `json:"ended_at,omitempty"`
+	Outcome   string           `json:"outcome"` // running, ok or failed
+	ExitCode  *int             `json:"exit_code,omitempty"`
+	Stats     *json.RawMessage `json:"stats,omitempty"` // the command's JSON result
+	Error     string           `json:"error,omitempty"` // the last line it logged, when it failed
+}
+
+// create the job history table next to the tool's other bookkeeping
+func createJobRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE SCHEMA IF NOT EXISTS delta_tracker;
+		CREATE TABLE IF NOT EXISTS delta_tracker.job_runs (
+			id BIGSERIAL PRIMARY KEY,
+			job TEXT NOT NULL,
+			command TEXT NOT NULL,
+			started_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			ended_at TIMESTAMPTZ,
+			outcome TEXT NOT NULL DEFAULT 'running',
+			exit_code INT,
+			stats JSONB,
+			error TEXT
+		);
+		CREATE INDEX IF NOT EXISTS job_runs_job_started_idx ON delta_tracker.job_runs (job, started_at DESC);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create job history table: %v", err)
+	}
+	return nil
+}
+
+// record that a job run started, returning its id
+func startJobRun(db *sql.DB, job, command string) (int64, error) {
+	var id int64
+	err := db.QueryRow("INSERT INTO delta_tracker.job_runs (job, command) VALUES ($1, $2) RETURNING id", job, command).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record start of job %s: %v", job, err)
+	}
+	return id, nil
+}
+
+// record how a job run ended
+func finishJobRun(db *sql.DB, id int64, code int, stats []byte, errLine string) error {
+	outcome := "ok"
+	if code != 0 {
+		outcome = "failed"
+	}
+	var statsArg interface{}
+	if json.Valid(stats) {
+		statsArg = stats
+	}
+	_, err := db.Exec(`
+		UPDATE delta_tracker.job_runs
+		SET ended_at = CURRENT_TIMESTAMP, outcome = $2, exit_code = $3, stats = $4, error = NULLIF($5, '')
+		WHERE id = $1
+	`, id, outcome, code, statsArg, errLine)
+	if err != nil {
+		return fmt.Errorf("failed to record end of job run %d: %v", id, err)
+	}
+	return nil
+}
+
+// read job runs, newest first: the runs of one job, or of every job when
+// job is empty; latest keeps only the newest run of each job
+func loadJobRuns(db *sql.DB, job string, latest bool, limit int) ([]jobRun, error) {
+	// the table only exists once the daemon has run
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('delta_tracker.job_runs') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up job history: %v", err)
+	}
+	if !exists {
+		return []jobRun{}, nil
+	}
+
+	query := `
+		SELECT id, job, command, started_at, ended_at, outcome, exit_code, stats, COALESCE(error, '')
+		FROM delta_tracker.job_runs
+		WHERE $1 = '' OR job = $1
+		ORDER BY started_at DESC, id DESC
+		LIMIT $2`
+	if latest {
+		query = `
+		SELECT DISTINCT ON (job) id, job, command, started_at, ended_at, outcome, exit_code, stats, COALESCE(error, '')
+		FROM delta_tracker.job_runs
+		WHERE $1 = '' OR job = $1
+		ORDER BY job, started_at DESC, id DESC
+		LIMIT $2`
+	}
+	rows, err := db.Query(query, job, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job history: %v", err)
+	}
+	defer rows.Close()
+
+	runs := []jobRun{}
+	for rows.Next() {
+		var r jobRun
+		var code sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.Job, &r.Command, &r.StartedAt, &r.EndedAt, &r.Outcome, &code, &r.Stats, &r.Error); err != nil {
+			return nil, fmt.Errorf("failed to scan job run: %v", err)
+		}
+		if code.Valid {
+			c := int(code.Int64)
+			r.ExitCode = &c
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// when the latest run of a command that succeeded started, or nil if none
+// has; a restore job's run holds every delta made before it started
+func lastJobSuccess(db *sql.DB, command string) (*time.Time, error) {
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('delta_tracker.job_runs') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up job history: %v", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	var at *time.Time
+	err := db.QueryRow("SELECT max(started_at) FROM delta_tracker.job_runs WHERE command = $1 AND outcome = 'ok'", command).Scan(&at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job history: %v", err)
+	}
+	return at, nil
+}
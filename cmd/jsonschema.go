@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"db-delta-tracker/pkg/mask"
+	"db-delta-tracker/pkg/objstore"
+)
+
+// the JSON Schema dialect json-schema writes
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// a table's row schema, as json-schema found it
+type tableSchema struct {
+	Table   string                 `json:"table"`
+	From    string                 `json:"from"`              // catalog or deltas
+	Sampled int                    `json:"sampled,omitempty"` // payloads read, from deltas
+	File    string                 `json:"file,omitempty"`
+	Schema  map[string]interface{} `json:"schema"`
+}
+
+// JSON Schemas for PostgreSQL types (information_schema data_type) whose
+// values to_jsonb doesn't turn into strings, or whose strings have a format;
+// other types are strings
+var jsonSchemaTypes = map[string]map[string]interface{}{
+	"smallint":                    {"type": "integer"},
+	"integer":                     {"type": "integer"},
+	"bigint":                      {"type": "integer"},
+	"numeric":                     {"type": "number"},
+	"real":                        {"type": "number"},
+	"double precision":            {"type": "number"},
+	"boolean":                     {"type": "boolean"},
+	"json":                        {},
+	"jsonb":                       {},
+	"ARRAY":                       {"type": "array"},
+	"date":                        {"type": "string", "format": "date"},
+	"timestamp without time zone": {"type": "string", "format": "date-time"},
+	"timestamp with time zone":    {"type": "string", "format": "date-time"},
+	"time without time zone":      {"type": "string", "format": "time"},
+	"uuid":                        {"type": "string", "format": "uuid"},
+}
+
+// infer a JSON Schema for the rows each table's deltas record in old_data
+// and new_data, from the catalog or from recent payloads, so consumers of
+// the delta stream can validate them and generate code
+func runJSONSchema(args []string) {
+	fs := flag.NewFlagSet("json-schema", flag.ExitOnError)
+	from := fs.String("from", "catalog", "where to infer the schemas from: catalog (the tables' column types) or deltas (recent payloads)")
+	sample := fs.Int("sample", 1000, "with -from deltas, how many of each table's latest deltas to read")
+	onlyTables := fs.String("tables", "", "comma separated tables; default every tracked table (catalog) or every table with deltas (deltas)")
+	dir := fs.String("dir", "", "write each schema to <table>.schema.json in this directory, local or s3://, gs:// or az://, instead of printing them")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if (*from != "catalog" && *from != "deltas") || *sample < 1 {
+		usagef("Usage: json-schema [-from catalog|deltas] [-sample <n>] [-tables <table>,...] [-dir <dir>]")
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	schemas, err := inferSchemas(*from, splitList(*onlyTables), *sample)
+	if err != nil {
+		fatal(err, "Error inferring schemas")
+	}
+	if *dir != "" {
+		for i, s := range schemas {
+			data, _ := json.MarshalIndent(s.Schema, "", "  ")
+			schemas[i].File = objstore.Join(*dir, s.Table+".schema.json")
+			if err := objstore.WriteFile(context.Background(), schemas[i].File, append(data, '\n')); err != nil {
+				fatal(fmt.Errorf("failed to write %s: %v", schemas[i].File, err), "Error writing schemas")
+			}
+		}
+	}
+	outputFormat.Print(schemas, func() {
+		for _, s := range schemas {
+			if s.File != "" {
+				fmt.Printf("%s: %s\n", s.Table, s.File)
+				continue
+			}
+			data, _ := json.MarshalIndent(s.Schema, "", "  ")
+			fmt.Printf("%s:\n%s\n", s.Table, data)
+		}
+	})
+}
+
+// the schemas of the given tables, or of every table from has
+func inferSchemas(from string, tables []string, sample int) ([]tableSchema, error) {
+	if len(tables) == 0 {
+		var err error
+		if tables, err = schemaTables(from); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(tables)
+
+	schemas := []tableSchema{}
+	for _, table := range tables {
+		s := tableSchema{Table: table, From: from}
+		var err error
+		if from == "catalog" {
+			s.Schema, err = catalogSchema(table)
+		} else {
+			s.Schema, s.Sampled, err = payloadSchema(table, sample)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.Schema == nil {
+			log.Printf("Warning: no schema for %s: it has no %s.", table, map[string]string{"catalog": "columns", "deltas": "recent row payloads"}[from])
+			continue
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// the tables init tracks, or those with row deltas
+func schemaTables(from string) ([]string, error) {
+	if from == "catalog" {
+		names, err := getTableNames()
+		if err != nil {
+			return nil, err
+		}
+		var tables []string
+		for _, name := range names {
+			if name != "deltas" && cfg.Capture.Tracks(name) {
+				tables = append(tables, name)
+			}
+		}
+		return tables, nil
+	}
+	rows, err := dbConn.Query(`SELECT DISTINCT table_name FROM deltas WHERE action IN ('INSERT', 'UPDATE', 'DELETE')`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the tables with deltas: %v", err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("failed to list the tables with deltas: %v", err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// a column as a table's deltas record it
+type capturedColumn struct {
+	name     string
+	dataType string // as information_schema names it
+	nullable bool
+	number   int    // attnum
+	masked   string // how capture masks it, if it does
+}
+
+// a table's columns, in order, leaving out capture.exclude_columns
+func capturedColumns(table string) ([]capturedColumn, error) {
+	rows, err := dbConn.Query(`
+		SELECT column_name, data_type, is_nullable = 'YES', ordinal_position
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = $1
+		ORDER BY ordinal_position
+	`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	excluded := append(append([]string{}, cfg.Capture.ExcludeColumns["*"]...), cfg.Capture.ExcludeColumns[table]...)
+	masked := map[string]string{}
+	if cfg.Mask.Capturing() {
+		masked = cfg.Mask.Columns.For(table)
+	}
+	var columns []capturedColumn
+	for rows.Next() {
+		var c capturedColumn
+		if err := rows.Scan(&c.name, &c.dataType, &c.nullable, &c.number); err != nil {
+			return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+		}
+		if containsString(excluded, c.name) {
+			continue
+		}
+		c.masked = masked[c.name]
+		columns = append(columns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	return columns, nil
+}
+
+// a row schema from a table's column types, as to_jsonb encodes them,
+// typing masked columns as what masking leaves; nil for a table without
+// columns
+func catalogSchema(table string) (map[string]interface{}, error) {
+	columns, err := capturedColumns(table)
+	if err != nil || len(columns) == 0 {
+		return nil, err
+	}
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, c := range columns {
+		property := map[string]interface{}{"type": "string"}
+		if t, ok := jsonSchemaTypes[c.dataType]; ok {
+			property = make(map[string]interface{}, len(t))
+			for k, v := range t {
+				property[k] = v
+			}
+		}
+		nullable := c.nullable
+		switch c.masked {
+		case mask.Hash:
+			property, nullable = map[string]interface{}{"type": "string"}, true
+		case mask.Redact:
+			property, nullable = map[string]interface{}{"type": "null"}, false
+		}
+		if t, ok := property["type"].(string); ok && nullable {
+			property["type"] = []string{t, "null"}
+		}
+		property["description"] = "PostgreSQL " + c.dataType
+		properties[c.name] = property
+		required = append(required, c.name)
+	}
+	return rowSchema(table, "its column types", properties, required), nil
+}
+
+// a row schema from the JSON types a table's latest payloads hold, returning
+// how many payloads were read; nil for a table without any
+func payloadSchema(table string, sample int) (map[string]interface{}, int, error) {
+	rows, err := dbConn.Query(`
+		SELECT payload FROM (
+			SELECT old_data, new_data FROM deltas
+			WHERE table_name = $1 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+			ORDER BY id DESC
+			LIMIT $2
+		) d, LATERAL (VALUES (old_data), (new_data)) AS p(payload)
+		WHERE payload IS NOT NULL
+	`, table, sample)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read the deltas of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	types := map[string]map[string]bool{} // JSON types seen, by key
+	present := map[string]int{}           // payloads holding each key
+	payloads := 0
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, fmt.Errorf("failed to read the deltas of %s: %v", table, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var row map[string]interface{}
+		if err := dec.Decode(&row); err != nil {
+			return nil, 0, fmt.Errorf("a delta of %s holds a payload that isn't a JSON object: %v", table, err)
+		}
+		payloads++
+		for key, value := range row {
+			if types[key] == nil {
+				types[key] = map[string]bool{}
+			}
+			types[key][jsonType(value)] = true
+			present[key]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read the deltas of %s: %v", table, err)
+	}
+	if payloads == 0 {
+		return nil, 0, nil
+	}
+
+	properties := map[string]interface{}{}
+	required := []string{}
+	for key, seen := range types {
+		if seen["integer"] && seen["number"] {
+			delete(seen, "integer")
+		}
+		var list []string
+		for t := range seen {
+			list = append(list, t)
+		}
+		sort.Strings(list)
+		property := map[string]interface{}{}
+		switch {
+		case seen["object"] && seen["array"]:
+			// json or jsonb columns hold anything
+		case len(list) == 1:
+			property["type"] = list[0]
+		default:
+			property["type"] = list
+		}
+		properties[key] = property
+		if present[key] == payloads {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	return rowSchema(table, fmt.Sprintf("%d recent payloads", payloads), properties, required), payloads, nil
+}
+
+// the JSON Schema type of a decoded value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func rowSchema(table, inferredFrom string, properties map[string]interface{}, required []string) map[string]interface{} {
+	return map[string]interface{}{
+		"$schema":     jsonSchemaDialect,
+		"title":       table,
+		"description": fmt.Sprintf("A row of %s as the old_data and new_data of its deltas hold it, inferred from %s.", table, inferredFrom),
+		"type":        "object",
+		"properties":  properties,
+		"required":    required,
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/kafka"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/schemaregistry"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// what a kafka-sink run published
+type kafkaSinkResult struct {
+	Name      string `json:"name"`
+	Published int64  `json:"published"` // this run
+	LastID    int64  `json:"last_id"`   // the last delta published, over every run
+}
+
+// publishes the deltas table, in id order, to the kafka config's topics
+type kafkaSink struct {
+	name     string
+	producer *kafka.Producer
+	schemaID int // of the Avro schema, with format avro
+
+	// how far it has published: every delta up to LastID has been published
+	deltaCursor
+
+	keys   map[string][]string   // the key columns messages are keyed by, by table
+	topics map[string]string     // by table
+	protos map[string]*sinkProto // with format protobuf, by table
+}
+
+// a table's typed protobuf schema, as the sink publishes it
+type sinkProto struct {
+	proto  codec.TableProto
+	ids    map[string]int  // registered schema ids, by topic
+	readAt int64           // the delta it was last read for
+	warned map[string]bool // columns warned of as missing from the schema
+}
+
+// tail the deltas table and publish every delta to Kafka, as the kafka
+// config says, until interrupted. The position is kept in the source, moved
+// only once the brokers have a batch, so deltas are published at least once.
+func runKafkaSink(args []string) {
+	fs := flag.NewFlagSet("kafka-sink", flag.ExitOnError)
+	name := fs.String("name", "kafka", "name the sink's position is kept under, so several sinks can publish the same deltas")
+	interval := fs.Duration("interval", time.Second, "how often to look for new deltas")
+	batch := fs.Int("batch", 500, "most deltas to publish at once")
+	fromStart := fs.Bool("from-start", false, "on the sink's first run, publish the deltas recorded before it too")
+	once := fs.Bool("once", false, "publish the deltas recorded so far, then exit")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *interval <= 0 || *batch < 1 {
+		usagef("Usage: kafka-sink [-name <name>] [-interval <duration>] [-batch <n>] [-from-start] [-once]")
+	}
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+	if len(cfg.Kafka.Brokers) == 0 {
+		fatal(exitcode.Wrap(exitcode.Config, fmt.Errorf("kafka.brokers is not set")), "Error starting the sink")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sink, err := openKafkaSink(ctx, *name, *fromStart)
+	if err != nil {
+		fatal(err, "Error starting the sink")
+	}
+	defer sink.producer.Close()
+
+	result := kafkaSinkResult{Name: *name}
+	log.Printf("Publishing the deltas after %d to %s.", sink.LastID, cfg.Kafka.Topic)
+	for {
+		n, err := sink.publish(ctx, *batch)
+		result.Published += int64(n)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			if *once {
+				fatal(exitcode.Wrap(exitcode.Connection, err), "Error publishing deltas")
+			}
+			// the batch is published again on the next try
+			log.Printf("Warning: %v; retrying in %s.", err, *interval)
+		} else if n == *batch {
+			continue
+		} else if *once && !sink.waiting() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(*interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	result.LastID = sink.LastID
+	outputFormat.Print(result, func() {
+		fmt.Printf("Published %d deltas to Kafka; the sink %q is at delta %d.\n", result.Published, result.Name, result.LastID)
+	})
+}
+
+// set up a sink, reading its position or, on its first run, starting it
+// at the beginning or the latest delta
+func openKafkaSink(ctx context.Context, name string, fromStart bool) (*kafkaSink, error) {
+	if _, err := dbConn.Exec(`
+		CREATE SCHEMA IF NOT EXISTS delta_tracker;
+		CREATE TABLE IF NOT EXISTS delta_tracker.kafka_sinks (
+			name TEXT PRIMARY KEY,
+			last_id BIGINT NOT NULL,
+			published BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create the kafka sinks table: %v", err)
+	}
+	start := "0"
+	if !fromStart {
+		start = "(SELECT COALESCE(MAX(id), 0) FROM deltas)"
+	}
+	if _, err := dbConn.Exec(`INSERT INTO delta_tracker.kafka_sinks (name, last_id) VALUES ($1, `+start+`) ON CONFLICT (name) DO NOTHING`, name); err != nil {
+		return nil, fmt.Errorf("failed to start the kafka sink %s: %v", name, err)
+	}
+
+	s := &kafkaSink{
+		name: name,
+		producer: kafka.NewProducer(kafka.Config{
+			Brokers:  cfg.Kafka.Brokers,
+			TLS:      cfg.Kafka.TLS,
+			Username: cfg.Kafka.Username,
+			Password: cfg.Kafka.Password,
+		}),
+		keys:   make(map[string][]string),
+		topics: make(map[string]string),
+		protos: make(map[string]*sinkProto),
+	}
+	if err := dbConn.QueryRow(`SELECT last_id FROM delta_tracker.kafka_sinks WHERE name = $1`, name).Scan(&s.LastID); err != nil {
+		return nil, fmt.Errorf("failed to read the position of the kafka sink %s: %v", name, err)
+	}
+	if cfg.Kafka.Format == "avro" {
+		id, err := schemaregistry.Register(ctx, cfg.SchemaRegistry.URL, cfg.SchemaRegistry.Subject, schemaregistry.Avro, codec.AvroSchema)
+		if err != nil {
+			return nil, exitcode.Wrap(exitcode.Connection, err)
+		}
+		s.schemaID = id
+	}
+	return s, nil
+}
+
+// publish the deltas after the high-water mark, up to limit of them,
+// stopping short of any id that may yet be committed, and move the mark;
+// returns how many were published
+func (s *kafkaSink) publish(ctx context.Context, limit int) (int, error) {
+	deltas, xmin, xmax, err := readDeltasAfter(ctx, dbConn, s.LastID, limit)
+	if err != nil {
+		return 0, err
+	}
+	ready := s.ready(deltas, xmin, xmax)
+	if len(ready) == 0 {
+		return 0, nil
+	}
+
+	messages := make([]kafka.Message, 0, len(ready))
+	for _, d := range ready {
+		m, err := s.message(ctx, d)
+		if err != nil {
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	if err := s.producer.Produce(ctx, messages); err != nil {
+		return 0, fmt.Errorf("failed to publish deltas %d to %d: %v", ready[0].ID, ready[len(ready)-1].ID, err)
+	}
+	last := ready[len(ready)-1].ID
+	if _, err := dbConn.Exec(`
+		UPDATE delta_tracker.kafka_sinks SET last_id = $2, published = published + $3, updated_at = CURRENT_TIMESTAMP
+		WHERE name = $1
+	`, s.name, last, len(ready)); err != nil {
+		return 0, fmt.Errorf("failed to move the position of the kafka sink %s: %v", s.name, err)
+	}
+	s.LastID = last
+	return len(ready), nil
+}
+
+// a delta as a Kafka message, keyed by its row's key so a row's changes
+// stay in order on one partition, or by its table for tables without a key
+// and deltas that aren't row changes
+func (s *kafkaSink) message(ctx context.Context, d Delta) (kafka.Message, error) {
+	topic, ok := s.topics[d.TableName]
+	if !ok {
+		var err error
+		if topic, err = config.Expand(cfg.Kafka.Topic, cfg.Data(d.TableName)); err != nil {
+			return kafka.Message{}, exitcode.Wrap(exitcode.Config, fmt.Errorf("kafka.topic: %v", err))
+		}
+		s.topics[d.TableName] = topic
+	}
+
+	var value []byte
+	switch cfg.Kafka.Format {
+	case "avro":
+		value = schemaregistry.Frame(s.schemaID, codec.EncodeAvro(d))
+	case "protobuf":
+		var err error
+		if value, err = s.protobuf(ctx, d, topic); err != nil {
+			return kafka.Message{}, err
+		}
+	default:
+		value, _ = json.Marshal(d)
+	}
+	key, err := s.key(ctx, d)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{
+		Topic: topic,
+		Key:   key,
+		Value: value,
+		Time:  d.Timestamp,
+		// consumers can drop the deltas they see twice by id
+		Headers: []kafka.Header{
+			{Key: "delta_id", Value: []byte(strconv.FormatInt(d.ID, 10))},
+			{Key: "table", Value: []byte(d.TableName)},
+			{Key: "action", Value: []byte(d.Action)},
+		},
+	}, nil
+}
+
+// the JSON of a row delta's key columns, e.g. {"id":42}, or the table name
+func (s *kafkaSink) key(ctx context.Context, d Delta) ([]byte, error) {
+	payload := d.NewData
+	if payload == nil {
+		payload = d.OldData
+	}
+	if payload == nil || (d.Action != "INSERT" && d.Action != "UPDATE" && d.Action != "DELETE") {
+		return []byte(d.TableName), nil
+	}
+	key, ok := s.keys[d.TableName]
+	if !ok {
+		// a dropped table's rows are keyed by the table
+		if tableExists(dbConn, d.TableName) {
+			var err error
+			if key, err = restore.RowKey(ctx, dbConn, d.TableName); err != nil {
+				return nil, err
+			}
+		}
+		s.keys[d.TableName] = key
+	}
+	if len(key) == 0 {
+		return []byte(d.TableName), nil
+	}
+	row, err := tracker.DecodeRow(*payload)
+	if err != nil {
+		return nil, fmt.Errorf("delta %d holds a row that isn't a JSON object: %v", d.ID, err)
+	}
+	values, err := restore.KeyOf(key, row)
+	if err != nil {
+		// e.g. a key column left out by capture.exclude_columns
+		return []byte(d.TableName), nil
+	}
+	data, _ := json.Marshal(values)
+	return data, nil
+}
+
+// a delta as its table's typed Delta message, framed with the schema's id
+// when there is a schema registry. A row with columns the schema lacks, or
+// values that don't fit it, has the table's schema read again, since its
+// columns may have changed since it was read.
+func (s *kafkaSink) protobuf(ctx context.Context, d Delta, topic string) ([]byte, error) {
+	sp, err := s.tableProto(d, false)
+	if err != nil {
+		return nil, err
+	}
+	msg, unknown, err := sp.proto.Encode(d)
+	if (err != nil || sp.unwarned(unknown)) && sp.readAt < d.ID {
+		if sp, err = s.tableProto(d, true); err != nil {
+			return nil, err
+		}
+		msg, unknown, err = sp.proto.Encode(d)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode a delta of %s as protobuf: %v", d.TableName, err)
+	}
+	for _, column := range unknown {
+		// e.g. a column dropped since, or the rows of a dropped table
+		if !sp.warned[column] {
+			sp.warned[column] = true
+			log.Printf("Warning: %s has no column %s, so its values in delta %d and later ones are left out of protobuf messages.", d.TableName, column, d.ID)
+		}
+	}
+	if cfg.SchemaRegistry.URL == "" {
+		return msg, nil
+	}
+
+	id, ok := sp.ids[topic]
+	if !ok {
+		// subjects are named as with TopicRecordNameStrategy, as each table
+		// has a message of its own and they may share a topic
+		subject := topic + "-" + sp.proto.Package + "." + sp.proto.MessageName()
+		if id, err = schemaregistry.Register(ctx, cfg.SchemaRegistry.URL, subject, schemaregistry.Protobuf, sp.proto.Proto()); err != nil {
+			return nil, err
+		}
+		sp.ids[topic] = id
+	}
+	return schemaregistry.FrameProtobuf(id, msg), nil
+}
+
+// whether any of the columns hasn't been warned of yet
+func (sp *sinkProto) unwarned(columns []string) bool {
+	for _, column := range columns {
+		if !sp.warned[column] {
+			return true
+		}
+	}
+	return false
+}
+
+// the typed protobuf schema of a delta's table, read from the catalog the
+// first time or again with reload; a table that no longer exists has no
+// columns
+func (s *kafkaSink) tableProto(d Delta, reload bool) (*sinkProto, error) {
+	table := d.TableName
+	if sp, ok := s.protos[table]; ok && !reload {
+		return sp, nil
+	}
+	p := codec.TableProto{Package: protoPackage, Table: table}
+	if tableExists(dbConn, table) {
+		var err error
+		if p, err = tableProto(table); err != nil {
+			return nil, err
+		}
+	}
+	sp := &sinkProto{proto: p, ids: make(map[string]int), readAt: d.ID, warned: make(map[string]bool)}
+	if old, ok := s.protos[table]; ok {
+		sp.warned = old.warned
+	}
+	s.protos[table] = sp
+	return sp, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
+)
+
+// how the rows of a table came and went, as told by the deltas
+type lifecycleReport struct {
+	Table      string         `json:"table"`
+	Rows       int            `json:"rows"`       // with any delta
+	Created    int            `json:"created"`    // inserted since capture began
+	Deleted    int            `json:"deleted"`    // whose latest change deleted them
+	Modified   int            `json:"modified"`   // updates, over all rows
+	Lifecycles []rowLifecycle `json:"lifecycles"` // in order of first delta, up to -limit
+}
+
+type rowLifecycle struct {
+	Key           tracker.Row `json:"key"`
+	CreatedAt     *time.Time  `json:"created_at"` // unset for rows that existed before capture began
+	Modifications int         `json:"modifications"`
+	DeletedAt     *time.Time  `json:"deleted_at"` // unset for rows still there
+	FirstSeen     time.Time   `json:"first_seen"`
+	LastSeen      time.Time   `json:"last_seen"`
+}
+
+// summarize each row's creation, modifications and deletion
+func runLifecycle(args []string) {
+	fs := flag.NewFlagSet("lifecycle", flag.ExitOnError)
+	fromPK := fs.String("from-pk", "", "only rows whose key is at least this")
+	toPK := fs.String("to-pk", "", "only rows whose key is at most this")
+	limit := fs.Int("limit", 1000, "how many rows to list (0 = all); the totals count every row")
+	configFlag(fs)
+	outputFlag(fs)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 || *limit < 0 {
+		usagef("Usage: lifecycle <table> [--from-pk <value>] [--to-pk <value>] [--limit <n>]")
+	}
+	table := positional[0]
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	report, err := rowLifecycles(table, *fromPK, *toPK, *limit)
+	if err != nil {
+		fatal(err, "Error building the lifecycle report")
+	}
+	outputFormat.Print(report, func() {
+		fmt.Printf("%s: %d rows, %d created, %d deleted, %d modifications\n", report.Table, report.Rows, report.Created, report.Deleted, report.Modified)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tCREATED\tMODIFICATIONS\tDELETED")
+		for _, r := range report.Lifecycles {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", formatRow(r.Key), formatTime(r.CreatedAt, "before capture"), r.Modifications, formatTime(r.DeletedAt, "-"))
+		}
+		w.Flush()
+		if len(report.Lifecycles) < report.Rows {
+			fmt.Printf("... %d more rows; raise --limit to list them\n", report.Rows-len(report.Lifecycles))
+		}
+	})
+}
+
+func formatTime(t *time.Time, none string) string {
+	if t == nil {
+		return none
+	}
+	return t.Format(time.RFC3339)
+}
+
+// group a table's deltas by the key they carry. A row was created at its
+// first delta if that is an insert, and deleted at its last if that is a
+// delete; a row deleted and inserted again under the same key counts as one.
+// A key range needs a single column key, and compares numbers as numbers.
+func rowLifecycles(table, fromPK, toPK string, limit int) (lifecycleReport, error) {
+	report := lifecycleReport{Table: table, Lifecycles: []rowLifecycle{}}
+	if !tableExists(dbConn, table) {
+		return report, fmt.Errorf("table %s does not exist", table)
+	}
+	key, err := restore.RowKey(context.Background(), dbConn, table)
+	if err != nil {
+		return report, err
+	}
+	if len(key) == 0 {
+		return report, fmt.Errorf("%s has no primary key or id column to tell its rows apart by", table)
+	}
+	if (fromPK != "" || toPK != "") && len(key) > 1 {
+		return report, fmt.Errorf("%s is keyed by %s; a key range needs a single column key", table, strings.Join(key, ", "))
+	}
+
+	fields := make([]string, len(key))
+	for i, column := range key {
+		fields[i] = fmt.Sprintf("%[1]s, COALESCE(new_data, old_data)->%[1]s", pq.QuoteLiteral(column))
+	}
+	args := []interface{}{table}
+	var bounds []string
+	for _, bound := range []struct{ value, op string }{{fromPK, ">="}, {toPK, "<="}} {
+		if bound.value != "" {
+			args = append(args, keyBound(bound.value))
+			bounds = append(bounds, fmt.Sprintf("AND COALESCE(new_data, old_data)->%s %s $%d::jsonb", pq.QuoteLiteral(key[0]), bound.op, len(args)))
+		}
+	}
+	rowsQuery := fmt.Sprintf(`
+		SELECT jsonb_build_object(%s) AS row_key,
+			(array_agg(action ORDER BY timestamp, id))[1] AS first_action,
+			(array_agg(action ORDER BY timestamp DESC, id DESC))[1] AS last_action,
+			count(*) FILTER (WHERE action = 'UPDATE') AS modifications,
+			min(timestamp) AS first_seen,
+			max(timestamp) AS last_seen
+		FROM deltas
+		WHERE table_name = $1 AND action IN ('INSERT', 'UPDATE', 'DELETE') %s
+		GROUP BY 1
+	`, strings.Join(fields, ", "), strings.Join(bounds, " "))
+
+	err = dbConn.QueryRow(fmt.Sprintf(`
+		SELECT count(*),
+			count(*) FILTER (WHERE first_action = 'INSERT'),
+			count(*) FILTER (WHERE last_action = 'DELETE'),
+			COALESCE(sum(modifications), 0)
+		FROM (%s) r
+	`, rowsQuery), args...).Scan(&report.Rows, &report.Created, &report.Deleted, &report.Modified)
+	if err != nil {
+		return report, fmt.Errorf("failed to count the rows of %s: %v", table, err)
+	}
+
+	limitClause := ""
+	if limit > 0 {
+		limitClause = fmt.Sprintf("LIMIT %d", limit)
+	}
+	rows, err := dbConn.Query(fmt.Sprintf(`
+		SELECT row_key::text, first_action, last_action, modifications, first_seen, last_seen
+		FROM (%s) r
+		ORDER BY first_seen, row_key
+		%s
+	`, rowsQuery, limitClause), args...)
+	if err != nil {
+		return report, fmt.Errorf("failed to read the rows of %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r rowLifecycle
+		var rowKey, first, last string
+		if err := rows.Scan(&rowKey, &first, &last, &r.Modifications, &r.FirstSeen, &r.LastSeen); err != nil {
+			return report, fmt.Errorf("failed to scan a row of %s: %v", table, err)
+		}
+		if r.Key, err = tracker.DecodeRow([]byte(rowKey)); err != nil {
+			return report, fmt.Errorf("failed to decode a row key of %s: %v", table, err)
+		}
+		if first == "INSERT" {
+			r.CreatedAt = &r.FirstSeen
+		}
+		if last == "DELETE" {
+			r.DeletedAt = &r.LastSeen
+		}
+		report.Lifecycles = append(report.Lifecycles, r)
+	}
+	if err := rows.Err(); err != nil {
+		return report, fmt.Errorf("failed to read the rows of %s: %v", table, err)
+	}
+	return report, nil
+}
+
+// a --from-pk or --to-pk value as JSON: a number if it is one, so ids
+// compare as numbers, and a string otherwise
+func keyBound(value string) string {
+	var n json.Number
+	if json.Unmarshal([]byte(value), &n) == nil {
+		return value
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
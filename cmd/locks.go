@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+
+	"github.com/lib/pq"
+)
+
+// the application_name of restore's sessions on its targets, unless the
+// connection sets its own; it is how a waiting replay is found in
+// pg_stat_activity, by restore itself and by status
+const restoreAppName = "delta-tracker restore"
+
+// the application_names restore's sessions run under on the target and
+// every routed target
+func replayAppNames() []string {
+	names := []string{restoreAppName}
+	for _, conn := range append([]config.Connection{cfg.Target}, routeTargets()...) {
+		if name := conn.Params["application_name"]; name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func routeTargets() []config.Connection {
+	var conns []config.Connection
+	for _, route := range cfg.Routes {
+		conns = append(conns, route.Target)
+	}
+	return conns
+}
+
+// open a connection to a target for replaying into it
+func openReplayConn(conn config.Connection) (*sql.DB, error) {
+	return conn.Open("fallback_application_name", restoreAppName)
+}
+
+// a session holding up a replay session's lock request
+type lockBlocker struct {
+	WaitingPID  int     `json:"waiting_pid"` // the replay session
+	Lock        string  `json:"lock"`        // what it waits for, e.g. RowExclusiveLock on orders
+	PID         int     `json:"pid"`
+	User        string  `json:"user"`
+	Application string  `json:"application"`
+	State       string  `json:"state"`               // e.g. idle in transaction
+	XactSeconds float64 `json:"transaction_seconds"` // how long its transaction has been open
+	Query       string  `json:"query"`               // its current or last statement
+}
+
+func (b lockBlocker) String() string {
+	return fmt.Sprintf("pid %d (%s, %s, %s, transaction open %s) holds up pid %d waiting for %s: %s",
+		b.PID, b.User, b.Application, b.State, time.Duration(b.XactSeconds*float64(time.Second)).Round(time.Second), b.WaitingPID, b.Lock, b.Query)
+}
+
+// find the sessions blocking the lock requests of sessions running under
+// one of appNames on the database conn is connected to
+func findLockBlockers(conn *sql.DB, appNames []string) ([]lockBlocker, error) {
+	rows, err := conn.Query(`
+		SELECT w.pid,
+			w.mode || ' on ' || CASE w.locktype
+				WHEN 'relation' THEN w.relation::regclass::text
+				WHEN 'tuple' THEN 'a row of ' || w.relation::regclass::text
+				WHEN 'transactionid' THEN 'transaction ' || w.transactionid::text
+				ELSE w.locktype END,
+			b.pid, COALESCE(b.usename, ''), COALESCE(b.application_name, ''), COALESCE(b.state, ''),
+			COALESCE(EXTRACT(EPOCH FROM now() - b.xact_start), 0), left(COALESCE(b.query, ''), 200)
+		FROM pg_locks w
+		JOIN pg_stat_activity a ON a.pid = w.pid
+		CROSS JOIN LATERAL unnest(pg_blocking_pids(w.pid)) AS blocker(pid)
+		JOIN pg_stat_activity b ON b.pid = blocker.pid
+		WHERE NOT w.granted AND a.datname = current_database() AND a.application_name = ANY($1)
+		ORDER BY w.pid, b.pid
+	`, pq.Array(appNames))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up blocking sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var blockers []lockBlocker
+	for rows.Next() {
+		var b lockBlocker
+		if err := rows.Scan(&b.WaitingPID, &b.Lock, &b.PID, &b.User, &b.Application, &b.State, &b.XactSeconds, &b.Query); err != nil {
+			return nil, fmt.Errorf("failed to scan blocking session: %v", err)
+		}
+		b.Query = strings.Join(strings.Fields(b.Query), " ")
+		blockers = append(blockers, b)
+	}
+	return blockers, rows.Err()
+}
+
+// what replay does about a statement held up by another session's lock:
+// report the blockers every reportAfter while it waits, and once it has
+// waited maxWait (if set), cancel it and abort the restore or skip the delta
+type lockWatch struct {
+	appNames    []string      // of the replay sessions, see replayAppNames
+	reportAfter time.Duration // 0 turns the watch off
+	maxWait     time.Duration // 0 waits as long as it takes
+	action      string        // abort or skip, once maxWait has passed
+	waits       []lockWait    // every statement that was held up, for the result
+}
+
+// a replayed statement that was held up by a lock
+type lockWait struct {
+	DeltaID  int64         `json:"delta_id"`
+	Target   string        `json:"target"`
+	Seconds  float64       `json:"seconds"`
+	Outcome  string        `json:"outcome"` // applied, failed, aborted or skipped
+	Blockers []lockBlocker `json:"blockers"`
+}
+
+// returned by a statement lockWatch cancelled with the skip action
+var errLockSkipped = errors.New("skipped after waiting for a lock")
+
+// set by restore's lock flags; nil runs statements unwatched
+var lockWatcher *lockWatch
+
+// run a replay statement on a target, watching for it being held up by
+// another session's lock
+func (w *lockWatch) run(conn *sql.DB, target string, delta Delta, stmt func(ctx context.Context) (sql.Result, error)) (sql.Result, error) {
+	if w == nil || w.reportAfter <= 0 {
+		return stmt(context.Background())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var res sql.Result
+	var err error
+	done := make(chan struct{})
+	go func() {
+		res, err = stmt(ctx)
+		close(done)
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(w.reportAfter)
+	defer ticker.Stop()
+	var wait *lockWait
+	for {
+		select {
+		case <-done:
+			if wait != nil {
+				wait.Seconds = time.Since(start).Seconds()
+				wait.Outcome = "applied"
+				if err != nil {
+					wait.Outcome = "failed"
+				}
+			}
+			return res, err
+		case <-ticker.C:
+		}
+
+		blockers, lookupErr := findLockBlockers(conn, w.appNames)
+		if lookupErr != nil {
+			log.Printf("Warning: %v", lookupErr)
+			continue
+		}
+		if len(blockers) == 0 {
+			continue
+		}
+		waited := time.Since(start).Round(time.Second)
+		log.Printf("Replaying delta %d into %s has waited %s for a lock:", delta.ID, target, waited)
+		for _, b := range blockers {
+			log.Printf("  %s", b)
+		}
+		if wait == nil {
+			w.waits = append(w.waits, lockWait{DeltaID: delta.ID, Target: target})
+			wait = &w.waits[len(w.waits)-1]
+		}
+		wait.Blockers = blockers
+
+		if w.maxWait <= 0 || time.Since(start) < w.maxWait {
+			continue
+		}
+		cancel()
+		<-done
+		wait.Seconds = time.Since(start).Seconds()
+		if err == nil {
+			// it finished before the cancel reached it
+			wait.Outcome = "applied"
+			return res, nil
+		}
+		if w.action == "skip" {
+			wait.Outcome = "skipped"
+			log.Printf("Warning: skipping delta %d after waiting %s for a lock on %s.", delta.ID, waited, target)
+			return nil, errLockSkipped
+		}
+		wait.Outcome = "aborted"
+		return nil, fmt.Errorf("gave up after waiting %s for a lock held by pid %d (%s): %v", waited, blockers[0].PID, blockers[0].State, err)
+	}
+}
@@ -1,39 +1,159 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/envflag"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/opslog"
+	"db-delta-tracker/pkg/output"
+	"db-delta-tracker/pkg/tracker"
 
 	_ "github.com/lib/pq"
 )
 
 var (
-	dbConn    *sql.DB // initialize database connection
-	dbName    = "" // ENTER DATABASE NAME
-	restoreDB = fmt.Sprintf("%s_restored", dbName) // restored database name
+	dbConn     *sql.DB              // initialize database connection
+	cfg        *config.Config       // settings loaded from the config file
+	configPath = config.DefaultPath // set by each command's -config flag
+	profile    string               // set by each command's -profile flag
+	readOnly   bool                 // set by the -read-only flag of commands that only read
+	dbName     string               // original database name, from the config
+	restoreDB  string               // restored database name, from the config
+
+	outputFormat = output.Table // set by each command's -output flag
+
+	// the command and arguments to record in the operations log once
+	// connected, for commands that change something, and the record
+	auditCommand string
+	auditArgs    []string
+	operation    *opslog.Operation
 )
 
-type Delta struct {
-	Action    string          `json:"action"`
-	TableName string          `json:"table_name"`
-	OldData   *json.RawMessage `json:"old_data,omitempty"` // pointer to handle nulls
-	NewData   *json.RawMessage `json:"new_data,omitempty"` // pointer to handle nulls
-	Timestamp string          `json:"timestamp"`
+// the commands recorded in the operations log; the ones left out only read
+var auditedCommands = map[string]bool{
+	"restore": true, "rollback-table": true, "guard": true, "merge": true,
+	"compact": true, "prune": true, "archive": true,
 }
 
-// initialize the DB connection
+// a captured change, as the library reads it
+type Delta = tracker.Delta
+
+// load the config and initialize the DB connection
 func initDB() error {
+	if err := loadConfig(); err != nil {
+		return err
+	}
+
+	var err error
+	dbConn, err = cfg.Source.Open()
+	if err != nil {
+		return exitcode.Wrap(exitcode.Config, fmt.Errorf("invalid connection settings: %v", err))
+	}
+	if err := dbConn.Ping(); err != nil {
+		return exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the database: %v", err))
+	}
+	if auditCommand != "" && !readOnly {
+		startOperation()
+	}
+	return nil
+}
+
+// record this run in the operations log, through a connection of its own
+// so the end is recorded after the command closes dbConn; a run that can't
+// be recorded goes ahead regardless
+func startOperation() {
+	conn, err := cfg.Source.Open()
+	if err == nil {
+		operation, err = opslog.Start(conn, auditCommand, auditArgs)
+	}
+	if err != nil {
+		log.Printf("Warning: not recording this run in the operations log: %v", err)
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// record how this run ended in the operations log, if it is recorded there
+func finishOperation(code int, err error) {
+	if operation == nil {
+		return
+	}
+	if err := operation.Finish(code, err); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	operation = nil
+}
+
+// exit with a status, recording it in the operations log first
+func exit(code int) {
+	finishOperation(code, nil)
+	os.Exit(code)
+}
+
+// load and validate the config selected by -config and -profile
+func loadConfig() error {
 	var err error
-	connStr := "user= password= dbname=" + dbName + " sslmode=disable" // ENTER DATABASE DETAILS HERE
-	dbConn, err = sql.Open("postgres", connStr)
+	cfg, err = config.Load(configPath, profile)
 	if err != nil {
-		return fmt.Errorf("failed to connect to the database: %v", err)
+		return exitcode.Wrap(exitcode.Config, err)
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return exitcode.Wrap(exitcode.Config, fmt.Errorf("invalid config: %v (run check-config for details)", errs[0]))
+	}
+	dbName, restoreDB = cfg.Source.DBName, cfg.Target.DBName
+	if cfg.Profile != "" {
+		log.Printf("Using profile %s.", cfg.Profile)
+	}
+	if readOnly {
+		cfg.Source, cfg.Target = cfg.Source.ReadOnly(), cfg.Target.ReadOnly()
+		for i := range cfg.Routes {
+			cfg.Routes[i].Target = cfg.Routes[i].Target.ReadOnly()
+		}
+		log.Printf("Read-only mode: both databases reject writes from this session.")
 	}
 	return nil
 }
 
+// log a fatal error and exit with the status for its class (see pkg/exitcode)
+func fatal(err error, prefix string) {
+	log.Printf("%s: %v", prefix, err)
+	finishOperation(exitcode.Of(err), err)
+	os.Exit(exitcode.Of(err))
+}
+
+// log a command line mistake and exit with the usage status
+func usagef(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	finishOperation(exitcode.Usage, fmt.Errorf(format, args...))
+	os.Exit(exitcode.Usage)
+}
+
+// register the -config and -profile flags every command accepts
+func configFlag(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", config.DefaultPath, "path to the config file")
+	fs.StringVar(&profile, "profile", "", "config profile (environment) to use")
+}
+
+// register the -output flag choosing between text and JSON results
+func outputFlag(fs *flag.FlagSet) {
+	fs.Var(&outputFormat, "output", "result format: table or json")
+}
+
+// register -read-only on commands that can run without writing anything
+func readOnlyFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&readOnly, "read-only", false, "open every connection read-only (default_transaction_read_only), so nothing can be written")
+}
+
 // fetch table names from the original database 
 func getTableNames() ([]string, error) {
 	var tables []string
@@ -62,119 +182,405 @@ func getTableNames() ([]string, error) {
 	return tables, nil
 }
 
-// applies the deltas to the restored database
-func RestoreDatabase() error {
+// options controlling which deltas are replayed and how
+type restoreOptions struct {
+	quarantine *quarantine // deltas to hold back
+	squash     bool        // apply only the net effect of each row's deltas
+	archiveDir string      // directory of archived deltas replayed before the table
+	origins    []string    // replay only deltas stamped with these origins; empty means all
+	tables     []string    // replay only the deltas of these tables; empty means all
+	consistent bool        // apply each source transaction in one target transaction
+	batchSize  int         // commit every this many deltas; 0 commits each on its own
+	singleTx   bool        // commit once every delta is applied
+	pipeline   int         // statements sent per round trip inside those transactions; 0 or 1 for one at a time
+	toMark     string      // replay only the deltas recorded before the last mark with this label
+	until      time.Time   // replay only the deltas made at or before this time; zero for all
+	base       *baseBackup // replay only the deltas this base backup doesn't contain; nil for init's copies
+
+	skipPreflight bool // don't check the target has room for the restore
+	skipIntegrity bool // don't look for orphaned rows after replaying
+}
+
+// counts of what a restore did, for -output json
+type restoreResult struct {
+	Tables          []string       `json:"tables"`
+	Loaded          int            `json:"deltas_loaded"`
+	Filtered        int            `json:"deltas_other_origins"`     // stamped with an origin not selected by -origins
+	OtherTables     int            `json:"deltas_other_tables"`      // of tables not selected by -tables
+	Snapshotted     int            `json:"deltas_in_snapshots"`      // already contained in a table re-snapshot
+	InBase          int            `json:"deltas_in_base,omitempty"` // already contained in the -base-time or -base-snapshot backup
+	Squashed        int            `json:"deltas_squashed"`          // folded into another delta by -squash
+	PastUntil       int            `json:"deltas_past_until"`        // made after the -until cutoff
+	Applied         int            `json:"deltas_applied"`
+	AppliedByTarget map[string]int `json:"deltas_applied_by_target,omitempty"` // by database, when routes are configured
+	Skipped         int            `json:"deltas_skipped"`                     // for tables missing from the restored database
+	Quarantined     []Delta        `json:"quarantined"`
+	Orphans         []orphanReport `json:"orphans,omitempty"` // relations left with missing parents
+
+	LocaleMismatches  []string           `json:"locale_mismatches,omitempty"`  // encoding and collation differences
+	Target            targetCapabilities `json:"target"`                       // what the restored database allows
+	SkippedOperations []string           `json:"skipped_operations,omitempty"` // left out because the target refuses them
+	BlueGreen         *blueGreenResult   `json:"blue_green,omitempty"`         // the databases -blue-green swapped
+	LockWaits         []lockWait         `json:"lock_waits,omitempty"`         // statements held up by other sessions' locks
+	ToMark            *markPosition      `json:"to_mark,omitempty"`            // the mark -to-mark stopped at
+	Sequences         []sequenceSync     `json:"sequences,omitempty"`          // moved up to the source's values
+	Shipped           *shipStats         `json:"shipped,omitempty"`            // sent to a receiver with -ship-to
+
+	// row keys left out because the restored table has no such column, by
+	// table and column, with how many values each lost
+	SkippedColumns map[string]map[string]int `json:"skipped_columns,omitempty"`
+}
+
+// applies the deltas to the restored database, skipping quarantined ones
+func RestoreDatabase(opts restoreOptions) (result restoreResult, err error) {
+	result = restoreResult{Quarantined: []Delta{}}
 	
 	// open connection
-	restoredConnStr := "user= password= dbname=" + restoreDB + " sslmode=disable" // ENTER DETAILS HEREE
-	restoredConn, err := sql.Open("postgres", restoredConnStr)
+	restoredConn, err := openReplayConn(cfg.Target)
+	if err == nil {
+		err = restoredConn.Ping()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to connect to the restored database: %v", err)
+		return result, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the restored database: %v", err))
 	}
 	defer restoredConn.Close()
 
-	// fetch all deltas from the deltas table, ordered by timestamp
-	rows, err := dbConn.Query("SELECT action, table_name, old_data, new_data FROM deltas ORDER BY timestamp")
+	// tables routed elsewhere in the config are replayed into their own databases
+	targets, err := openReplayTargets(restoredConn)
 	if err != nil {
-		return fmt.Errorf("error fetching deltas: %v", err)
+		return result, err
+	}
+	defer targets.Close()
+	if len(cfg.Routes) > 0 {
+		result.AppliedByTarget = make(map[string]int)
 	}
-	defer rows.Close()
 
-	// iterate over the deltas and apply each change to the restored database
-	for rows.Next() {
-		var delta Delta
-		
-		// use pointer in case of nulls
-		if err := rows.Scan(&delta.Action, &delta.TableName, &delta.OldData, &delta.NewData); err != nil {
-			return fmt.Errorf("error scanning delta: %v", err)
+	// find out what the target refuses before writing to it
+	result.Target, err = probeTarget(restoredConn)
+	if err != nil {
+		return result, err
+	}
+
+	// abort early if the target is going to run out of disk
+	if !opts.skipPreflight {
+		if err := preflightDiskSpace(restoredConn); err != nil {
+			return result, err
+		}
+	}
+
+	// text can sort and compare differently under another locale
+	result.LocaleMismatches, err = checkCollations(restoredConn)
+	if err != nil {
+		return result, err
+	}
+
+	// changes made while capture was paused can't be replayed
+	if err := warnCaptureGaps(); err != nil {
+		return result, err
+	}
+
+	// the deltas to replay, read and filtered on the source
+	deltas, quarantined, err := selectDeltas(opts, &result)
+	defer printQuarantined(quarantined)
+	if err != nil {
+		return result, err
+	}
+
+	// foreign keys and configured relations, to order and check the replay by
+	relations, err := loadRelations(dbConn)
+	if err != nil {
+		return result, err
+	}
+
+	// replace each row's chain of deltas with its net effect
+	if opts.squash {
+		unsquashed := len(deltas)
+		deltas, err = squashDeltas(deltas, func(table string) ([]string, error) {
+			conn := targets.connFor(table)
+			if !tableExists(conn, table) {
+				return []string{"id"}, nil // its deltas are skipped anyway
+			}
+			return targets.builder(conn).Key(context.Background(), table)
+		})
+		if err != nil {
+			return result, err
 		}
+		result.Squashed = unsquashed - len(deltas)
+		log.Printf("Squashed %d deltas into %d.", unsquashed, len(deltas))
 
+		// squashed deltas can land ahead of the parent rows they reference
+		if deltas, err = orderByRelations(deltas, relations); err != nil {
+			return result, err
+		}
+	}
+
+	// updates and deletes find their rows by key, so index it before replaying
+	for conn, routed := range targets.group(deltas) {
+		if err := ensureReplayIndexes(conn, targets.builder(conn), routed); err != nil {
+			return result, err
+		}
+		if opts.consistent {
+			if err := createReplayPosition(conn); err != nil {
+				return result, err
+			}
+		}
+	}
+	batch := newReplayBatch(opts, targets, cfg.Timeouts.Replay)
+	defer func() {
+		// deltas of a transaction that never committed aren't applied
+		result.Applied -= batch.uncommitted()
+		batch.rollback()
+	}()
+
+	// iterate over the deltas and apply each change to the restored database
+	for _, delta := range deltas {
 		// build restored table name
 		restoreTable := fmt.Sprintf("%s", delta.TableName)
+		conn := targets.connFor(restoreTable)
+		// markers only label a point in the stream
+		if delta.Action == markAction {
+			continue
+		}
+		if err := chaosBeforeApply(delta); err != nil {
+			return result, err
+		}
+		if err := batch.next(delta); err != nil {
+			return result, err
+		}
+
+		// a table renamed on the source is renamed on its restored copy,
+		// wherever the old name was routed
+		if delta.Action == renameAction {
+			from, _, err := renamedTables(delta)
+			if err != nil {
+				return result, err
+			}
+			// the rename would wait on the locks of the open transaction
+			if err := batch.commit(); err != nil {
+				return result, err
+			}
+			if targets.connFor(from) != conn {
+				log.Printf("Warning: %s was renamed to %s, which routes to another database; its copy stays where it is.", from, restoreTable)
+			}
+			renamed, err := applyRename(targets.connFor(from), targets.nameFor(from), delta)
+			if err != nil {
+				return result, err
+			}
+			if renamed {
+				targets.builder(targets.connFor(from)).Forget(from)
+				targets.builder(targets.connFor(from)).Forget(restoreTable)
+				result.Applied++
+			} else {
+				result.Skipped++
+			}
+			continue
+		}
 
 		// just make sure restored tablae doesn't exist
-		if !tableExists(restoredConn, restoreTable) {
+		if !tableExists(conn, restoreTable) {
 			log.Printf("Skipping delta for non-existent table %s in the restored database", restoreTable)
+			result.Skipped++
 			continue
 		}
 
-		// for each action, have a different delta
-		switch delta.Action {
-		case "INSERT":
-			var newData map[string]interface{}
-			if err := json.Unmarshal(*delta.NewData, &newData); err != nil {
-				return fmt.Errorf("error unmarshalling new_data: %v", err)
-			}
+		// build the statement that applies the delta, fitted to the restored table
+		query, args, err := targets.builder(conn).Statement(context.Background(), delta)
+		if err != nil {
+			return result, err
+		}
 
-			// then just insert that delta into the restored table
-			_, err := restoredConn.Exec(fmt.Sprintf("INSERT INTO %s (id, name, age) VALUES ($1, $2, $3)", restoreTable), newData["id"], newData["name"], newData["age"])
-			
-			// format query
-			query := fmt.Sprintf("INSERT INTO %s (id, name, age) VALUES ($1, $2, $3)", restoreTable)
+		// run it, echoing it and recording it in the replay log
+		err = batch.exec(conn, delta, query, args...)
+		if err == errLockSkipped {
+			result.Skipped++
+			continue
+		}
+		if isAmbiguousMatch(err) {
+			return result, fmt.Errorf("error applying %s: delta %d matches several identical rows of %s, which has no key (keyless.on_multiple: skip leaves such deltas out): %v",
+				strings.ToLower(delta.Action), delta.ID, restoreTable, err)
+		}
+		if err != nil {
+			return result, fmt.Errorf("error applying %s: %v", strings.ToLower(delta.Action), err)
+		}
+		result.Applied++
+		if len(cfg.Routes) > 0 {
+			result.AppliedByTarget[targets.nameFor(restoreTable)]++
+		}
+	}
+	if err := batch.commit(); err != nil {
+		return result, err
+	}
 
-			// print query and values
-			fmt.Printf("Executing query: %s\n", query)
-			fmt.Printf("         With values: id = %v, name = %v, age = %v\n", newData["id"], newData["name"], newData["age"])
+	// columns the source has and a restored table doesn't lose their values
+	result.SkippedColumns = targets.skippedColumns()
+	for table, columns := range result.SkippedColumns {
+		for column, n := range columns {
+			log.Printf("Warning: %s has no column %s; %d values of it were left out.", table, column, n)
+		}
+	}
 
-			
-			if err != nil {
-				return fmt.Errorf("error applying insert: %v", err)
-			}
+	// new rows in the restored database mustn't take the restored rows' ids
+	result.Sequences, err = syncSequences(targets, opts.tables)
+	if err != nil {
+		return result, err
+	}
 
-		case "UPDATE":
-			var oldData map[string]interface{}
-			if delta.OldData != nil {
-				if err := json.Unmarshal(*delta.OldData, &oldData); err != nil {
-					return fmt.Errorf("error unmarshalling old_data: %v", err)
+	// skipped and filtered deltas can leave children without their parents
+	if !opts.skipIntegrity {
+		if len(opts.tables) > 0 {
+			// only the relations of the replayed tables can have changed
+			var touched []relation
+			for _, r := range relations {
+				if containsString(opts.tables, r.Child) || containsString(opts.tables, r.Parent) {
+					touched = append(touched, r)
 				}
 			}
+			relations = touched
+		}
+		result.Orphans, err = checkIntegrity(targets, relations)
+		if err != nil {
+			return result, err
+		}
+	}
 
-			var newData map[string]interface{}
-			if delta.NewData != nil {
-				if err := json.Unmarshal(*delta.NewData, &newData); err != nil {
-					return fmt.Errorf("error unmarshalling new_data: %v", err)
-				}
+	return result, nil
+}
+
+// read the deltas a restore replays, in order, and narrow them down as opts
+// select, counting what was left out in result; the quarantined deltas are
+// returned separately
+func selectDeltas(opts restoreOptions, result *restoreResult) ([]Delta, []Delta, error) {
+	// fetch all deltas from the deltas table, ordered by timestamp
+	deltas, quarantined, err := loadDeltas(opts.quarantine, opts.archiveDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	result.Loaded = len(deltas) + len(quarantined)
+	result.Quarantined = append(result.Quarantined, quarantined...)
+
+	// stop where the application marked a business operation as complete
+	if opts.toMark != "" {
+		if deltas, result.ToMark, err = cutAtMark(deltas, opts.toMark); err != nil {
+			return nil, quarantined, err
+		}
+	}
+
+	// recover to a moment in time rather than the latest state
+	if !opts.until.IsZero() {
+		var cut int
+		deltas, cut = cutAtTime(deltas, opts.until)
+		result.PastUntil = cut
+		log.Printf("Replaying up to %s; %d later deltas are left out.", opts.until.Format(time.RFC3339), cut)
+	}
+
+	// merged delta streams can be replayed one origin at a time
+	if len(opts.origins) > 0 {
+		selected := deltas[:0]
+		for _, delta := range deltas {
+			if containsString(opts.origins, delta.Origin) {
+				selected = append(selected, delta)
 			}
+		}
+		result.Filtered = len(deltas) - len(selected)
+		deltas = selected
+	}
 
-			// update data in appropiate restored table
-			_, err := restoredConn.Exec(fmt.Sprintf("UPDATE %s SET name = $1, age = $2 WHERE id = $3", restoreTable), newData["name"], newData["age"], oldData["id"])
-			if err != nil {
-				return fmt.Errorf("error applying update: %v", err)
+	// a single damaged table can be restored without touching the others;
+	// a rename is kept when either name is selected
+	if len(opts.tables) > 0 {
+		selected := deltas[:0]
+		for _, delta := range deltas {
+			keep := delta.Action == markAction || containsString(opts.tables, delta.TableName)
+			if !keep && delta.Action == renameAction {
+				from, _, err := renamedTables(delta)
+				if err != nil {
+					return nil, quarantined, err
+				}
+				keep = containsString(opts.tables, from)
+			}
+			if keep {
+				selected = append(selected, delta)
 			}
+		}
+		result.OtherTables = len(deltas) - len(selected)
+		deltas = selected
+	}
 
-			// format query
-			updateQuery := fmt.Sprintf("UPDATE %s SET name = $1, age = $2 WHERE id = $3", restoreTable)
+	// tables re-copied after the initial backup already contain their older
+	// changes; a base backup from elsewhere contains every change before it
+	loaded := len(deltas)
+	if opts.base != nil {
+		if deltas, err = opts.base.skipContained(deltas); err != nil {
+			return nil, quarantined, err
+		}
+		result.InBase = loaded - len(deltas)
+		log.Printf("Skipped %d deltas already contained in the base backup.", result.InBase)
+	} else {
+		if deltas, err = skipSnapshotted(deltas); err != nil {
+			return nil, quarantined, err
+		}
+		result.Snapshotted = loaded - len(deltas)
+	}
+	return chaosDeltas(deltas), quarantined, nil
+}
 
-			// print query and values
-			fmt.Printf("Executing query: %s\n", updateQuery)
-			fmt.Printf("        With values: name = %v, age = %v, id = %v\n", newData["name"], newData["age"], oldData["id"])
+// fetch the deltas to replay in order, separating out the quarantined ones;
+// archived deltas (if any) come first since they are the oldest
+func loadDeltas(q *quarantine, archiveDir string) ([]Delta, []Delta, error) {
+	var all []Delta
+	if archiveDir != "" {
+		archived, err := readArchivedDeltas(archiveDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading archived deltas: %v", err)
+		}
+		all = archived
+	}
 
+	current, err := queryDeltas(dbConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	all = append(all, current...)
+	if err := maskDeltas(all); err != nil {
+		return nil, nil, err
+	}
 
+	// skip writes from quarantined transactions
+	var deltas, quarantined []Delta
+	for _, delta := range all {
+		if q.contains(delta) {
+			quarantined = append(quarantined, delta)
+			continue
+		}
+		deltas = append(deltas, delta)
+	}
 
-		case "DELETE":
-			var oldData map[string]interface{}
-			if delta.OldData != nil {
-				if err := json.Unmarshal(*delta.OldData, &oldData); err != nil {
-					return fmt.Errorf("error unmarshalling old_data: %v", err)
-				}
-			}
+	return deltas, quarantined, nil
+}
 
-			// delete from restore table
-			_, err := restoredConn.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", restoreTable), oldData["id"])
-			if err != nil {
-				return fmt.Errorf("error applying delete: %v", err)
-			}
+// read a database's deltas table in replay order
+func queryDeltas(db *sql.DB) ([]Delta, error) {
+	rows, err := db.Query("SELECT id, action, table_name, old_data, new_data, timestamp, COALESCE(txid, 0), COALESCE(statement, ''), context, COALESCE(origin, '') FROM deltas ORDER BY timestamp, id")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	defer rows.Close()
 
-			// format query
-			deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE id = $1", restoreTable)
+	var deltas []Delta
+	for rows.Next() {
+		var delta Delta
 
-			// print query and values
-			fmt.Printf("Executing query: %s\n", deleteQuery)
-			fmt.Printf("        With values: id = %v\n", oldData["id"])
+		// use pointer in case of nulls
+		if err := rows.Scan(&delta.ID, &delta.Action, &delta.TableName, &delta.OldData, &delta.NewData, &delta.Timestamp, &delta.TxID, &delta.Statement, &delta.Context, &delta.Origin); err != nil {
+			return nil, fmt.Errorf("error scanning delta: %v", err)
 		}
+		deltas = append(deltas, delta)
 	}
 
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	return deltas, nil
 }
 
 // check if a table exists in the restored database 
@@ -195,25 +601,302 @@ func tableExists(dbConn *sql.DB, tableName string) bool {
 }
 
 func main() {
+	// the first argument selects the command; restoring is the default
+	command, args := "restore", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if auditedCommands[command] {
+		auditCommand, auditArgs = command, args
+	}
+
+	switch command {
+	case "restore":
+		runRestore(args)
+	case "rollback-table":
+		runRollbackTable(args)
+	case "guard":
+		runGuard(args)
+	case "status":
+		runStatus(args)
+	case "check-config":
+		runCheckConfig(args)
+	case "merge":
+		runMerge(args)
+	case "daemon":
+		runDaemon(args)
+	case "selftest":
+		runSelftest(args)
+	case "verify":
+		runVerify(args)
+	case "warm-plan":
+		runWarmPlan(args)
+	case "diff":
+		runDiff(args)
+	case "blame":
+		runBlame(args)
+	case "lifecycle":
+		runLifecycle(args)
+	case "materialize":
+		runMaterialize(args)
+	case "backup":
+		runBackup(args)
+	case "export":
+		runExport(args)
+	case "json-schema":
+		runJSONSchema(args)
+	case "kafka-sink":
+		runKafkaSink(args)
+	case "proto-schema":
+		runProtoSchema(args)
+	case "recovery-target":
+		runRecoveryTarget(args)
+	case "compact":
+		runCompact(args)
+	case "prune":
+		runPrune(args)
+	case "receive":
+		runReceive(args)
+	case "archive":
+		runArchive(args)
+	case "coordinator":
+		runCoordinator(args)
+	case "ops":
+		runOps(args)
+	case "api-keys":
+		runAPIKeys(args)
+	default:
+		usagef("Unknown command %q (expected restore, rollback-table, guard, status, check-config, merge, daemon, selftest, verify, warm-plan, diff, blame, lifecycle, materialize, backup, export, json-schema, kafka-sink, proto-schema, recovery-target, compact, prune, receive, archive, coordinator, ops or api-keys)", command)
+	}
+	finishOperation(exitcode.OK, nil)
+}
+
+// parse a command's flags, then take the ones not given from the environment
+// (DELTA_TRACKER_<FLAG>, see pkg/envflag)
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if err := envflag.Apply(fs); err != nil {
+		usagef("%v", err)
+	}
+}
+
+// parse flags that may appear before or after positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			if err := envflag.Apply(fs); err != nil {
+				usagef("%v", err)
+			}
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// the flags restore takes with -in-place, which reads nothing but the
+// backup and the deltas, together with those every command takes
+var inPlaceFlags = map[string]bool{"in-place": true, "from-backup": true, "until": true, "confirm": true, "tables": true, "archive-dir": true,
+	"quarantine-txids": true, "quarantine-range": true, "config": true, "profile": true, "output": true}
+
+// the flags restore takes with -ship-to, which only chooses the deltas the
+// receiver applies, together with those every command takes
+var shipFlags = map[string]bool{"ship-to": true, "ship-batch": true, "ship-token": true, "ship-retries": true, "tables": true, "archive-dir": true,
+	"quarantine-txids": true, "quarantine-range": true, "origins": true, "to-mark": true, "until": true, "base-time": true, "base-snapshot": true,
+	"config": true, "profile": true, "output": true}
+
+// replay the deltas into the restored database
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	quarantineTxIDs := fs.String("quarantine-txids", "", "comma separated source transaction ids whose deltas are skipped")
+	quarantineRanges := fs.String("quarantine-range", "", "comma separated <from>/<to> RFC 3339 time ranges whose deltas are skipped")
+	squash := fs.Bool("squash", false, "apply only the net effect of each row's deltas (skips intermediate states)")
+	skipPreflight := fs.Bool("skip-preflight", false, "don't check the restored database has enough disk space")
+	archiveDir := fs.String("archive-dir", "", "directory of archived deltas to replay before the deltas table")
+	blueGreen := fs.Bool("blue-green", false, "restore into a fresh copy and swap it in as the restored database only if it replays cleanly")
+	skipIntegrity := fs.Bool("skip-integrity", false, "don't check the restored database for rows whose parent row is missing")
+	consistent := fs.Bool("consistent", false, "apply each source transaction in one transaction and record the restored database's position in delta_tracker.replay_position")
+	replayLogPath := fs.String("replay-log", "", "append every statement the restore runs, with its arguments, target, duration and outcome, to this NDJSON file")
+	origins := fs.String("origins", "", "comma separated origin labels; only deltas stamped with one of them are replayed")
+	onlyTables := fs.String("tables", "", "comma separated tables; only their deltas are replayed and the other tables are left alone")
+	lockReport := fs.Duration("lock-report-after", 10*time.Second, "log the sessions blocking a replayed statement once it has waited this long for a lock, and again as often (0 = never)")
+	lockWait := fs.Duration("lock-wait", 0, "how long a replayed statement may wait for another session's lock before -on-lock-wait applies (0 = wait as long as it takes)")
+	onLockWait := fs.String("on-lock-wait", "abort", "what to do once a statement has waited -lock-wait: abort the restore or skip the delta")
+	toMark := fs.String("to-mark", "", "replay only the deltas recorded before the last mark with this label (see dbdelta_mark)")
+	until := fs.String("until", "", "replay only the deltas made at or before this RFC 3339 time, e.g. 2024-05-01T12:00:00Z")
+	batchSize := fs.Int("batch-size", 0, "apply deltas in transactions of this many, so a failure rolls back the unfinished one (0 = each statement commits on its own)")
+	singleTransaction := fs.Bool("single-transaction", false, "apply every delta in one transaction per target, so a failed restore changes nothing")
+	pipeline := fs.Int("pipeline", 0, "send up to this many statements per round trip to the target, inside the transactions of -batch-size, -single-transaction or -consistent (0 = one at a time)")
+	inPlace := fs.Bool("in-place", false, "repair the original database instead, bringing the tables changed after -until back to their state then")
+	fromBackup := fs.String("from-backup", "", "with -in-place, the directory of table backups (as init writes them) to rebuild the tables from")
+	confirm := fs.String("confirm", "", "with -in-place, the original database's name, instead of typing it when asked")
+	baseTime := fs.String("base-time", "", "the restored database was loaded from a pg_dump or managed snapshot taken at this RFC 3339 time; replay only the deltas after it")
+	baseSnapshot := fs.String("base-snapshot", "", "like -base-time, but the txid_current_snapshot() the base backup was read at, for an exact cut")
+	shipTo := fs.String("ship-to", "", "send the deltas in compressed batches to a receiver near the target (see the receive command), e.g. http://replica-host:9090, instead of replaying them from here")
+	shipBatch := fs.Int("ship-batch", 5000, "with -ship-to, deltas per batch, each applied in one transaction by the receiver")
+	shipToken := fs.String("ship-token", os.Getenv("DELTA_SHIP_TOKEN"), "with -ship-to, the receiver's token (default $DELTA_SHIP_TOKEN)")
+	shipRetries := fs.Int("ship-retries", 10, "with -ship-to, how many times to retry a request the receiver didn't answer before giving up")
+	chaosFlags(fs)
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *consistent && *squash {
+		usagef("-consistent can't be combined with -squash, which doesn't keep source transactions together")
+	}
+	if *onLockWait != "abort" && *onLockWait != "skip" {
+		usagef("-on-lock-wait must be abort or skip")
+	}
+	if *onLockWait == "skip" && *consistent {
+		usagef("-on-lock-wait skip can't be combined with -consistent, which would have to roll back the rest of the source transaction")
+	}
+	if *batchSize < 0 {
+		usagef("-batch-size can't be negative")
+	}
+	if *singleTransaction && *batchSize > 0 {
+		usagef("-single-transaction can't be combined with -batch-size")
+	}
+	if *onLockWait == "skip" && (*batchSize > 0 || *singleTransaction) {
+		usagef("-on-lock-wait skip can't be combined with -batch-size or -single-transaction, which would have to roll back the rest of the transaction")
+	}
+	if *pipeline < 0 {
+		usagef("-pipeline can't be negative")
+	}
+	if *pipeline > 1 && *batchSize == 0 && !*singleTransaction && !*consistent {
+		usagef("-pipeline needs -batch-size, -single-transaction or -consistent, so the statements it sends together share a transaction")
+	}
+	if *lockWait > 0 && *lockReport <= 0 {
+		usagef("-lock-wait needs -lock-report-after, which checks for blocking sessions")
+	}
+	q, err := parseQuarantine(*quarantineTxIDs, *quarantineRanges)
+	if err != nil {
+		usagef("Error parsing quarantine: %v", err)
+	}
+	var untilTime time.Time
+	if *until != "" {
+		if untilTime, err = time.Parse(time.RFC3339, *until); err != nil {
+			usagef("-until must be an RFC 3339 time, e.g. 2024-05-01T12:00:00Z: %v", err)
+		}
+	}
+	base, err := parseBaseBackup(*baseSnapshot, *baseTime)
+	if err != nil {
+		usagef("Error parsing base backup: %v", err)
+	}
+
+	// an in-place restore writes to the original database in one transaction
+	if *inPlace {
+		if *fromBackup == "" || *until == "" {
+			usagef("Usage: restore --in-place --from-backup <dir> --until <timestamp> [--tables <table>,...] [--confirm <database>]")
+		}
+		fs.Visit(func(f *flag.Flag) {
+			if !inPlaceFlags[f.Name] {
+				usagef("-%s can't be combined with -in-place", f.Name)
+			}
+		})
+		runInPlace(*fromBackup, untilTime, q, splitList(*onlyTables), *archiveDir, *confirm)
+		return
+	}
+	if *fromBackup != "" || *confirm != "" {
+		usagef("-from-backup and -confirm only apply with -in-place")
+	}
+
+	// the receiver applies the deltas, so only the source side of a restore runs here
+	if *shipTo != "" {
+		fs.Visit(func(f *flag.Flag) {
+			if !shipFlags[f.Name] {
+				usagef("-%s can't be combined with -ship-to", f.Name)
+			}
+		})
+		if *shipBatch < 1 {
+			usagef("-ship-batch must be at least 1")
+		}
+		if err := initDB(); err != nil {
+			fatal(err, "Error initializing DB")
+		}
+		defer dbConn.Close()
+		result, err := shipDeltas(restoreOptions{quarantine: q, archiveDir: *archiveDir, origins: splitList(*origins), tables: splitList(*onlyTables),
+			toMark: *toMark, until: untilTime, base: base}, *shipTo, *shipToken, *shipBatch, *shipRetries)
+		if err != nil {
+			if result.Applied > 0 {
+				err = exitcode.Wrap(exitcode.Partial, err)
+			}
+			fatal(err, "Error shipping deltas")
+		}
+		log.Printf("Shipped %d deltas; the receiver applied %d.", result.Shipped.Deltas, result.Applied)
+		outputFormat.Print(result, func() {})
+		return
+	}
 	
 	// initialize the database connection to the original database
 	if err := initDB(); err != nil {
-		log.Fatalf("Error initializing DB: %v", err)
+		fatal(err, "Error initializing DB")
 	}
 	defer dbConn.Close()
 
 	// fetch the list of tables in the original database 
 	tables, err := getTableNames()
 	if err != nil {
-		log.Fatalf("Error fetching table names: %v", err)
+		fatal(err, "Error fetching table names")
 	}
 
+	if selected := splitList(*onlyTables); len(selected) > 0 {
+		for _, table := range selected {
+			if !containsString(tables, table) {
+				log.Printf("Warning: %s is not a table of the original database; only deltas recorded under that name are replayed.", table)
+			}
+		}
+		tables = selected
+	}
 	log.Printf("Restoring tables: %v", tables)
 
+	if *replayLogPath != "" {
+		if err := openReplayLog(*replayLogPath); err != nil {
+			fatal(err, "Error opening replay log")
+		}
+		defer closeReplayLog()
+	}
+
+	lockWatcher = &lockWatch{appNames: replayAppNames(), reportAfter: *lockReport, maxWait: *lockWait, action: *onLockWait}
+
 	// call the restore function to apply deltas from the original database
-	if err := RestoreDatabase(); err != nil {
-		log.Fatalf("Error restoring database: %v", err)
+	restore := RestoreDatabase
+	if *blueGreen {
+		restore = restoreBlueGreen
+	}
+	result, err := restore(restoreOptions{
+		quarantine:    q,
+		squash:        *squash,
+		archiveDir:    *archiveDir,
+		origins:       splitList(*origins),
+		tables:        splitList(*onlyTables),
+		consistent:    *consistent,
+		batchSize:     *batchSize,
+		singleTx:      *singleTransaction,
+		pipeline:      *pipeline,
+		toMark:        *toMark,
+		until:         untilTime,
+		base:          base,
+		skipPreflight: *skipPreflight,
+		skipIntegrity: *skipIntegrity,
+	})
+	if err != nil {
+		// the restored database is left part way through the deltas, unless
+		// they went into a green copy that was never swapped in
+		if result.Applied > 0 && !*blueGreen {
+			err = exitcode.Wrap(exitcode.Partial, err)
+		}
+		fatal(err, "Error restoring database")
+	}
+	result.Tables = tables
+	result.SkippedOperations = skippedOperations
+	result.LockWaits = lockWatcher.waits
+	if len(skippedOperations) > 0 {
+		log.Printf("Skipped %d operations the restored database doesn't allow; the restore is otherwise complete.", len(skippedOperations))
 	}
 
 	log.Println("Database has been restored successfully.")
+	outputFormat.Print(result, func() {})
 }
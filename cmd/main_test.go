@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// flags every command takes, which DELTA_TRACKER_* variables also set, must
+// not be refused in the modes of restore that allow only some flags
+func TestRestoreModesAcceptCommonFlags(t *testing.T) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configFlag(fs)
+	outputFlag(fs)
+	for mode, allowed := range map[string]map[string]bool{"-in-place": inPlaceFlags, "-ship-to": shipFlags} {
+		fs.VisitAll(func(f *flag.Flag) {
+			if !allowed[f.Name] {
+				t.Errorf("-%s isn't accepted with %s", f.Name, mode)
+			}
+		})
+	}
+}
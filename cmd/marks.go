@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+)
+
+// the action of the marker deltas applications record with dbdelta_mark
+// (see restore.MarkAction)
+const markAction = restore.MarkAction
+
+// where a restore with -to-mark stopped
+type markPosition struct {
+	Label     string    `json:"label"`
+	DeltaID   int64     `json:"delta_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// keep the deltas made at or before a time, returning them and how many were
+// left out
+func cutAtTime(deltas []Delta, until time.Time) ([]Delta, int) {
+	kept := make([]Delta, 0, len(deltas))
+	for _, delta := range deltas {
+		if !delta.Timestamp.After(until) {
+			kept = append(kept, delta)
+		}
+	}
+	return kept, len(deltas) - len(kept)
+}
+
+// keep the deltas recorded before the last mark with the given label,
+// returning them and the mark; it is an error if there is no such mark
+func cutAtMark(deltas []Delta, label string) ([]Delta, *markPosition, error) {
+	for i := len(deltas) - 1; i >= 0; i-- {
+		if deltas[i].Action != markAction {
+			continue
+		}
+		l, err := restore.MarkLabel(deltas[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if l == label {
+			log.Printf("Replaying up to mark %q (delta %d, %s); %d later deltas are left out.",
+				label, deltas[i].ID, deltas[i].Timestamp.Format(time.RFC3339), len(deltas)-i-1)
+			return deltas[:i], &markPosition{label, deltas[i].ID, deltas[i].Timestamp}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no mark %q in the deltas; record one with SELECT dbdelta_mark('%s')", label, label)
+}
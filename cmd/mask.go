@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// mask the deltas' rows with mask.columns when mask.at is restore, so the
+// databases they are replayed into never hold the plain values; with the
+// default mask.at, the triggers have masked them already
+func maskDeltas(deltas []Delta) error {
+	if !cfg.Mask.Restoring() {
+		return nil
+	}
+	for i := range deltas {
+		for _, data := range []**json.RawMessage{&deltas[i].OldData, &deltas[i].NewData} {
+			if *data == nil {
+				continue
+			}
+			masked, err := cfg.Mask.Columns.Row(deltas[i].TableName, **data)
+			if err != nil {
+				return fmt.Errorf("failed to mask delta %d: %v", deltas[i].ID, err)
+			}
+			raw := json.RawMessage(masked)
+			*data = &raw
+		}
+	}
+	return nil
+}
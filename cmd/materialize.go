@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"db-delta-tracker/pkg/parquet"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// the formats materialize writes tables in, with their file extensions
+var materializeFormats = map[string]string{"csv": ".csv", "ndjson": ".ndjson", "parquet": ".parquet"}
+
+// what materialize wrote
+type materializeResult struct {
+	Until     time.Time           `json:"until"`
+	Format    string              `json:"format"`
+	Tables    []materializedTable `json:"tables"`
+	Applied   int                 `json:"deltas_applied"`
+	Missing   int                 `json:"deltas_missing_rows"` // updates and deletes of rows the state didn't have
+	PastUntil int                 `json:"deltas_past_until"`
+}
+
+type materializedTable struct {
+	Table   string   `json:"table"`
+	File    string   `json:"file"`
+	Rows    int      `json:"rows"`
+	Columns []string `json:"columns"`
+}
+
+// rebuild each table's rows as of a point in time from init's backups and
+// the deltas after them, and write them to files; no restored database is
+// needed, only the source for its deltas
+func runMaterialize(args []string) {
+	fs := flag.NewFlagSet("materialize", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write a file per table into")
+	format := fs.String("format", "csv", "file format: csv, ndjson or parquet")
+	until := fs.String("until", "", "RFC 3339 time to materialize the tables as of (default now)")
+	onlyTables := fs.String("tables", "", "comma separated tables to write; default all")
+	archiveDir := fs.String("archive-dir", "", "directory of archived deltas to apply before the deltas table")
+	duckdbFile := fs.String("duckdb", "", "also load the tables and their deltas into this DuckDB database file (implies -format parquet)")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *dir == "" {
+		usagef("Usage: materialize --dir <dir> [--format csv|ndjson|parquet] [--until <timestamp>] [--tables <table>,...]")
+	}
+	if *duckdbFile != "" {
+		*format = "parquet"
+	}
+	if _, ok := materializeFormats[*format]; !ok {
+		usagef("-format must be csv, ndjson or parquet")
+	}
+	untilTime := time.Now()
+	if *until != "" {
+		var err error
+		if untilTime, err = time.Parse(time.RFC3339, *until); err != nil {
+			usagef("-until must be an RFC 3339 time, e.g. 2024-05-01T12:00:00Z: %v", err)
+		}
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, deltas, err := materialize(*dir, *format, untilTime, splitList(*onlyTables), *archiveDir)
+	if err != nil {
+		fatal(err, "Error materializing tables")
+	}
+	if *duckdbFile != "" {
+		if err := loadDuckDB(*duckdbFile, *dir, result.Tables, deltas); err != nil {
+			fatal(err, "Error loading DuckDB")
+		}
+	}
+	outputFormat.Print(result, func() {
+		for _, t := range result.Tables {
+			fmt.Printf("%s: %d rows in %s\n", t.Table, t.Rows, t.File)
+		}
+	})
+}
+
+// a table's rows rebuilt in memory, found by key or, for tables without
+// one, by their content
+type tableRows struct {
+	key   []string
+	rows  []tracker.Row    // nil where a row was deleted
+	index map[string][]int // positions of the rows with each identity
+
+	backedUp bool // started from init's backup
+	changed  bool // by a delta
+}
+
+func (t *tableRows) identity(row tracker.Row) string {
+	if k := keyString(t.key, row); len(t.key) > 0 && k != "" {
+		return k
+	}
+	encoded, _ := json.Marshal(row)
+	return string(encoded)
+}
+
+func (t *tableRows) insert(row tracker.Row) {
+	id := t.identity(row)
+	t.index[id] = append(t.index[id], len(t.rows))
+	t.rows = append(t.rows, row)
+}
+
+// take a row out by its identity, reporting whether there was one
+func (t *tableRows) remove(row tracker.Row) (int, bool) {
+	id := t.identity(row)
+	positions := t.index[id]
+	if len(positions) == 0 {
+		return 0, false
+	}
+	i := positions[len(positions)-1]
+	if len(positions) == 1 {
+		delete(t.index, id)
+	} else {
+		t.index[id] = positions[:len(positions)-1]
+	}
+	t.rows[i] = nil
+	return i, true
+}
+
+func (t *tableRows) live() []tracker.Row {
+	var rows []tracker.Row
+	for _, row := range t.rows {
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// rebuild the tables as of until and write those selected to dir, returning
+// what was written and the deltas applied
+func materialize(dir, format string, until time.Time, only []string, archiveDir string) (materializeResult, []Delta, error) {
+	result := materializeResult{Until: until, Format: format, Tables: []materializedTable{}}
+
+	rebuilt, err := rebuildTables(until, &quarantine{}, archiveDir, cfg.BackupFile)
+	if err != nil {
+		return result, nil, err
+	}
+	result.Applied, result.Missing, result.PastUntil = rebuilt.applied, rebuilt.missing, rebuilt.pastUntil
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return result, nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	var tables []string
+	for name, t := range rebuilt.tables {
+		// tables init left out and no delta touched have nothing to write
+		if !t.backedUp && !t.changed {
+			continue
+		}
+		if len(only) == 0 || containsString(only, name) {
+			tables = append(tables, name)
+		}
+	}
+	sort.Strings(tables)
+	for _, name := range tables {
+		rows := rebuilt.tables[name].live()
+		columns, err := materializeColumns(name, rows)
+		if err != nil {
+			return result, nil, err
+		}
+		path := filepath.Join(dir, name+materializeFormats[format])
+		if err := writeMaterialized(path, format, columns, rows); err != nil {
+			return result, nil, err
+		}
+		result.Tables = append(result.Tables, materializedTable{Table: name, File: path, Rows: len(rows), Columns: columns})
+	}
+	return result, rebuilt.deltas, nil
+}
+
+// the tables' rows as of a point in time
+type rebuiltTables struct {
+	tables      map[string]*tableRows
+	deltas      []Delta // applied to the backups
+	quarantined []Delta
+
+	applied   int
+	missing   int // updates and deletes of rows the state didn't have
+	pastUntil int
+}
+
+// rebuild every table's rows as of until in memory, starting from the
+// backups backupFile finds and applying the deltas after them
+func rebuildTables(until time.Time, q *quarantine, archiveDir string, backupFile tracker.FileSnapshots) (rebuiltTables, error) {
+	var rebuilt rebuiltTables
+
+	names, err := getTableNames()
+	if err != nil {
+		return rebuilt, err
+	}
+	deltas, quarantined, err := loadDeltas(q, archiveDir)
+	if err != nil {
+		return rebuilt, err
+	}
+	rebuilt.quarantined = quarantined
+	deltas, rebuilt.pastUntil = cutAtTime(deltas, until)
+	if deltas, err = skipSnapshotted(deltas); err != nil {
+		return rebuilt, err
+	}
+	rebuilt.deltas = deltas
+
+	// every table starts out as init backed it up
+	state := make(map[string]*tableRows)
+	table := func(name string) (*tableRows, error) {
+		if t, ok := state[name]; ok {
+			return t, nil
+		}
+		t := &tableRows{index: make(map[string][]int)}
+		if tableExists(dbConn, name) {
+			var err error
+			if t.key, err = restore.RowKey(context.Background(), dbConn, name); err != nil {
+				return nil, err
+			}
+		}
+		path, err := backupFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err == nil {
+			rows, err := backupFile.Snapshot(context.Background(), name)
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rows {
+				t.insert(row)
+			}
+			t.backedUp = true
+		}
+		state[name] = t
+		return t, nil
+	}
+	for _, name := range names {
+		if name == "deltas" {
+			continue
+		}
+		if _, err := table(name); err != nil {
+			return rebuilt, err
+		}
+	}
+
+	for _, delta := range deltas {
+		switch delta.Action {
+		case markAction:
+			continue
+		case renameAction:
+			from, to, err := renamedTables(delta)
+			if err != nil {
+				return rebuilt, err
+			}
+			t, err := table(from)
+			if err != nil {
+				return rebuilt, err
+			}
+			state[to] = t
+			delete(state, from)
+			rebuilt.applied++
+			continue
+		}
+		t, err := table(delta.TableName)
+		if err != nil {
+			return rebuilt, err
+		}
+		oldData, newData, err := diffPayloads(delta)
+		if err != nil {
+			return rebuilt, err
+		}
+		if !t.backedUp && !t.changed {
+			log.Printf("Warning: %s has no backup; it is rebuilt from its deltas alone.", delta.TableName)
+		}
+		t.changed = true
+		switch delta.Action {
+		case "INSERT":
+			t.insert(newData)
+		case "UPDATE":
+			if i, ok := t.remove(oldData); ok {
+				id := t.identity(newData)
+				t.rows[i] = newData
+				t.index[id] = append(t.index[id], i)
+			} else {
+				rebuilt.missing++
+				t.insert(newData)
+			}
+		case "DELETE":
+			if _, ok := t.remove(oldData); !ok {
+				rebuilt.missing++
+			}
+		}
+		rebuilt.applied++
+	}
+	if rebuilt.missing > 0 {
+		log.Printf("Warning: %d updates and deletes found no row to change; the backups may be older than the deltas kept.", rebuilt.missing)
+	}
+	rebuilt.tables = state
+	return rebuilt, nil
+}
+
+// a table's columns in the source's order, or sorted for a table the source
+// no longer has, followed by any the rows have that it doesn't
+func materializeColumns(table string, rows []tracker.Row) ([]string, error) {
+	dbRows, err := dbConn.Query(`
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = $1
+		ORDER BY ordinal_position
+	`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	defer dbRows.Close()
+	var columns []string
+	seen := make(map[string]bool)
+	for dbRows.Next() {
+		var column string
+		if err := dbRows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+		}
+		columns = append(columns, column)
+		seen[column] = true
+	}
+	if err := dbRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+
+	var extra []string
+	for _, row := range rows {
+		for column := range row {
+			if !seen[column] {
+				seen[column] = true
+				extra = append(extra, column)
+			}
+		}
+	}
+	sort.Strings(extra)
+	return append(columns, extra...), nil
+}
+
+// write rows to path in a format; csv writes NULL as an empty field
+func writeMaterialized(path, format string, columns []string, rows []tracker.Row) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	switch format {
+	case "csv":
+		err = writeCSV(w, columns, rows)
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			if err = enc.Encode(row); err != nil {
+				break
+			}
+		}
+	case "parquet":
+		err = parquet.Write(w, columns, textValues(columns, rows))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+// write rows as CSV with a header row, NULL as an empty field
+func writeCSV(w io.Writer, columns []string, rows []tracker.Row) error {
+	cw := csv.NewWriter(w)
+	cw.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			if v := textValue(row[column]); v != nil {
+				record[i] = *v
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// rows as text values in the order of columns, as parquet.Write takes them
+func textValues(columns []string, rows []tracker.Row) [][]*string {
+	values := make([][]*string, len(rows))
+	for r, row := range rows {
+		values[r] = make([]*string, len(columns))
+		for i, column := range columns {
+			values[r][i] = textValue(row[column])
+		}
+	}
+	return values
+}
+
+// a value as text, the way psql shows it; nil for NULL
+func textValue(value interface{}) *string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = fmt.Sprint(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		s = string(encoded)
+	}
+	return &s
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// consolidate the deltas of several shard databases into the target,
+// keeping their primary keys apart as configured under merge: in the config
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the statements without applying them")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := loadConfig(); err != nil {
+		fatal(err, "Error loading config")
+	}
+	if len(cfg.Merge.Shards) == 0 {
+		fatal(exitcode.Wrap(exitcode.Config, fmt.Errorf("no shards under merge.shards in the config")), "Nothing to merge")
+	}
+
+	result, err := mergeShards(cfg.Merge, *dryRun)
+	if err != nil {
+		if result.Applied > 0 {
+			err = exitcode.Wrap(exitcode.Partial, err)
+		}
+		fatal(err, "Error merging shards")
+	}
+	log.Printf("Merged %d deltas from %d shards into %s.", result.Applied, len(cfg.Merge.Shards), restoreDB)
+	result.SkippedOperations = skippedOperations
+	outputFormat.Print(result, func() {})
+}
+
+// what merge did, for -output json
+type mergeResult struct {
+	Strategy  string           `json:"strategy"`
+	Loaded    map[string]int   `json:"deltas_loaded"` // by shard
+	Applied   int              `json:"deltas_applied"`
+	Skipped   int              `json:"deltas_skipped"` // for tables missing from the target
+	Positions map[string]int64 `json:"positions"`      // the last delta merged, or that would be with -dry-run, by shard
+	DryRun    bool             `json:"dry_run"`
+
+	SkippedOperations []string `json:"skipped_operations,omitempty"` // left out because the target refuses them
+}
+
+// a delta together with the shard it was read from
+type shardDelta struct {
+	Delta
+	shard config.Shard
+}
+
+// moves a shard's position, in the transaction that applied its delta
+const mergePositionQuery = `INSERT INTO delta_tracker.merge_positions (shard, last_id, horizon, gaps_up_to, merged_at) VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+	ON CONFLICT (shard) DO UPDATE SET last_id = EXCLUDED.last_id, horizon = EXCLUDED.horizon, gaps_up_to = EXCLUDED.gaps_up_to, merged_at = EXCLUDED.merged_at`
+
+func mergeShards(m config.Merge, dryRun bool) (mergeResult, error) {
+	result := mergeResult{Strategy: m.Strategy, Loaded: make(map[string]int), Positions: make(map[string]int64), DryRun: dryRun}
+
+	targetConn, err := cfg.Target.Open()
+	if err == nil {
+		err = targetConn.Ping()
+	}
+	if err != nil {
+		return result, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the target database: %v", err))
+	}
+	defer targetConn.Close()
+
+	positions, err := loadMergePositions(targetConn, m.Shards, dryRun)
+	if err != nil {
+		return result, err
+	}
+
+	var shards [][]shardDelta
+	for _, shard := range m.Shards {
+		deltas, err := loadShardDeltas(shard, positions[shard.Name])
+		if err != nil {
+			return result, err
+		}
+		var loaded []shardDelta
+		for _, delta := range deltas {
+			delta.Origin = shard.Name
+			loaded = append(loaded, shardDelta{delta, shard})
+		}
+		shards = append(shards, loaded)
+		result.Loaded[shard.Name] = len(deltas)
+	}
+	merged := interleaveShards(shards)
+
+	target := newMergeTarget(targetConn)
+	if m.Strategy == "composite" {
+		if err := checkShardColumn(targetConn, m.ShardColumn, merged); err != nil {
+			return result, err
+		}
+	}
+
+	for _, delta := range merged {
+		position := positions[delta.shard.Name]
+
+		// a shard's markers don't mark a point in the merged stream
+		if delta.Action == markAction {
+			position.LastID = delta.ID
+			continue
+		}
+		if delta.Action == renameAction {
+			if dryRun {
+				from, to, err := renamedTables(delta.Delta)
+				if err != nil {
+					return result, err
+				}
+				logStatement(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", ident.Quote(from), ident.Quote(to)), nil)
+				position.LastID = delta.ID
+				continue
+			}
+			renamed, err := applyRename(targetConn, cfg.Target.DBName, delta.Delta)
+			if err != nil {
+				return result, fmt.Errorf("delta %d from shard %s: %v", delta.ID, delta.shard.Name, err)
+			}
+			target.forget()
+			if renamed {
+				result.Applied++
+			}
+			position.LastID = delta.ID
+			if err := saveMergePosition(targetConn, delta.shard.Name, position); err != nil {
+				return result, err
+			}
+			continue
+		}
+		if !tableExists(targetConn, delta.TableName) {
+			log.Printf("Skipping delta for non-existent table %s in the target database", delta.TableName)
+			result.Skipped++
+			position.LastID = delta.ID
+			continue
+		}
+
+		query, values, err := target.statement(m, delta)
+		if err != nil {
+			return result, fmt.Errorf("delta %d from shard %s: %v", delta.ID, delta.shard.Name, err)
+		}
+
+		logStatement(query, values)
+		if dryRun {
+			position.LastID = delta.ID
+			continue
+		}
+		applied := *position
+		applied.LastID = delta.ID
+		if err := applyMergeDelta(targetConn, delta.shard.Name, &applied, query, values); err != nil {
+			return result, fmt.Errorf("error applying delta %d from shard %s: %v", delta.ID, delta.shard.Name, err)
+		}
+		*position = applied
+		result.Applied++
+	}
+
+	for _, shard := range m.Shards {
+		result.Positions[shard.Name] = positions[shard.Name].LastID
+		if dryRun {
+			continue
+		}
+		if err := saveMergePosition(targetConn, shard.Name, positions[shard.Name]); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// read where each shard's last merge stopped, from the target; a dry run
+// doesn't create the table, and starts shards it has no position for at the
+// beginning
+func loadMergePositions(targetConn *sql.DB, shards []config.Shard, dryRun bool) (map[string]*deltaCursor, error) {
+	positions := make(map[string]*deltaCursor, len(shards))
+	for _, shard := range shards {
+		positions[shard.Name] = &deltaCursor{}
+	}
+	if !dryRun {
+		if _, err := targetConn.Exec(`
+			CREATE SCHEMA IF NOT EXISTS delta_tracker;
+			CREATE TABLE IF NOT EXISTS delta_tracker.merge_positions (
+				shard TEXT PRIMARY KEY,
+				last_id BIGINT NOT NULL,
+				horizon BIGINT NOT NULL DEFAULT 0,
+				gaps_up_to BIGINT NOT NULL DEFAULT 0,
+				merged_at TIMESTAMPTZ NOT NULL
+			)
+		`); err != nil {
+			return nil, fmt.Errorf("failed to create merge positions table: %v", err)
+		}
+	} else {
+		var exists bool
+		if err := targetConn.QueryRow("SELECT to_regclass('delta_tracker.merge_positions') IS NOT NULL").Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to look for merge positions: %v", err)
+		}
+		if !exists {
+			return positions, nil
+		}
+	}
+
+	rows, err := targetConn.Query("SELECT shard, last_id, horizon, gaps_up_to FROM delta_tracker.merge_positions")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read merge positions: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var c deltaCursor
+		if err := rows.Scan(&name, &c.LastID, &c.Horizon, &c.GapsUpTo); err != nil {
+			return nil, fmt.Errorf("failed to read merge positions: %v", err)
+		}
+		if position, ok := positions[name]; ok {
+			*position = c
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read merge positions: %v", err)
+	}
+	return positions, nil
+}
+
+func saveMergePosition(targetConn *sql.DB, shard string, c *deltaCursor) error {
+	if _, err := targetConn.Exec(mergePositionQuery, shard, c.LastID, c.Horizon, c.GapsUpTo); err != nil {
+		return fmt.Errorf("failed to record the merge position of shard %s: %v", shard, err)
+	}
+	return nil
+}
+
+// apply a shard's delta and move the shard's position in one transaction, so
+// a merge that stops partway picks up after the last delta it applied
+func applyMergeDelta(targetConn *sql.DB, shard string, c *deltaCursor, query string, values []interface{}) error {
+	tx, err := targetConn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(query, values...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(mergePositionQuery, shard, c.LastID, c.Horizon, c.GapsUpTo); err != nil {
+		return fmt.Errorf("failed to record the merge position of shard %s: %v", shard, err)
+	}
+	return tx.Commit()
+}
+
+// read one shard's deltas after its position, in id order, up to the first
+// that a transaction still running on the shard may yet commit before
+func loadShardDeltas(shard config.Shard, position *deltaCursor) ([]Delta, error) {
+	db, err := shard.Source.Open()
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		return nil, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to shard %s: %v", shard.Name, err))
+	}
+	defer db.Close()
+
+	deltas, xmin, xmax, err := readDeltasAfter(context.Background(), db, position.LastID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("shard %s: %v", shard.Name, err)
+	}
+	deltas = position.ready(deltas, xmin, xmax)
+	if position.waiting() {
+		log.Printf("Shard %s has transactions still running; their deltas are left for the next merge.", shard.Name)
+	}
+	if err := maskDeltas(deltas); err != nil {
+		return nil, fmt.Errorf("shard %s: %v", shard.Name, err)
+	}
+	return deltas, nil
+}
+
+// interleave the shards' deltas by time. Each shard's keep their id order,
+// which is the order the shard wrote them in, so its position only moves
+// forward; on equal timestamps shards apply in config order.
+func interleaveShards(shards [][]shardDelta) []shardDelta {
+	var merged []shardDelta
+	next := make([]int, len(shards))
+	for {
+		pick := -1
+		for i, deltas := range shards {
+			if next[i] == len(deltas) {
+				continue
+			}
+			if pick == -1 || deltas[next[i]].Timestamp.Before(shards[pick][next[pick]].Timestamp) {
+				pick = i
+			}
+		}
+		if pick == -1 {
+			return merged
+		}
+		merged = append(merged, shards[pick][next[pick]])
+		next[pick]++
+	}
+}
+
+// what merge reads from the target's catalog, table by table
+type mergeTarget struct {
+	conn      *sql.DB
+	relations []relation
+	loaded    bool                // whether relations have been read
+	keys      map[string][]string // by table
+	shifted   map[string][]string // offset strategy's columns, by table
+}
+
+func newMergeTarget(conn *sql.DB) *mergeTarget {
+	return &mergeTarget{conn: conn, keys: make(map[string][]string), shifted: make(map[string][]string)}
+}
+
+// drop what was read from the catalog, once a table was renamed
+func (t *mergeTarget) forget() {
+	t.keys, t.shifted, t.loaded = make(map[string][]string), make(map[string][]string), false
+}
+
+// the columns rows of a table are matched by
+func (t *mergeTarget) key(table string) ([]string, error) {
+	if key, ok := t.keys[table]; ok {
+		return key, nil
+	}
+	key, err := restore.RowKey(context.Background(), t.conn, table)
+	if err != nil {
+		return nil, err
+	}
+	t.keys[table] = key
+	return key, nil
+}
+
+// the columns the offset strategy shifts in a table's rows: its key when
+// that is a single column, and the columns of foreign keys and configured
+// relations pointing at another table's such key, so rows keep referencing
+// their own shard's parents
+func (t *mergeTarget) offsetColumns(table string) ([]string, error) {
+	if columns, ok := t.shifted[table]; ok {
+		return columns, nil
+	}
+	if !t.loaded {
+		relations, err := loadRelations(t.conn)
+		if err != nil {
+			return nil, err
+		}
+		t.relations, t.loaded = relations, true
+	}
+
+	var columns []string
+	key, err := t.key(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 1 {
+		columns = append(columns, key[0])
+	}
+	for _, r := range t.relations {
+		if r.Child != table || containsString(columns, r.Column) {
+			continue
+		}
+		parentKey, err := t.key(r.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if len(parentKey) == 1 && parentKey[0] == r.ParentColumn {
+			columns = append(columns, r.Column)
+		}
+	}
+	t.shifted[table] = columns
+	return columns, nil
+}
+
+// build the statement applying a shard's delta with its keys remapped
+func (t *mergeTarget) statement(m config.Merge, delta shardDelta) (string, []interface{}, error) {
+	switch delta.Action {
+	case "INSERT":
+		row, err := t.remappedRow(m, delta.shard, delta.TableName, delta.NewData)
+		if err != nil {
+			return "", nil, err
+		}
+		query, values := insertStatement(delta.TableName, row)
+		return query, values, nil
+	case "UPDATE":
+		oldRow, err := t.remappedRow(m, delta.shard, delta.TableName, delta.OldData)
+		if err != nil {
+			return "", nil, err
+		}
+		newRow, err := t.remappedRow(m, delta.shard, delta.TableName, delta.NewData)
+		if err != nil {
+			return "", nil, err
+		}
+		key, err := t.mergeKey(m, delta.TableName, oldRow)
+		if err != nil {
+			return "", nil, err
+		}
+		query, values := updateByKey(delta.TableName, newRow, key)
+		return query, values, nil
+	case "DELETE":
+		oldRow, err := t.remappedRow(m, delta.shard, delta.TableName, delta.OldData)
+		if err != nil {
+			return "", nil, err
+		}
+		key, err := t.mergeKey(m, delta.TableName, oldRow)
+		if err != nil {
+			return "", nil, err
+		}
+		query, values := deleteByKey(delta.TableName, key)
+		return query, values, nil
+	}
+	return "", nil, fmt.Errorf("unknown delta action %q", delta.Action)
+}
+
+// decode a row payload and apply the merge strategy to it: tag it with the
+// shard name, or shift its key and the references to other tables' keys by
+// the shard's offset
+func (t *mergeTarget) remappedRow(m config.Merge, shard config.Shard, table string, raw *json.RawMessage) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, fmt.Errorf("missing row data")
+	}
+
+	// keep numbers exact; ids can be larger than a float64 holds precisely
+	row, err := tracker.DecodeRow(*raw)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling row data: %v", err)
+	}
+
+	switch m.Strategy {
+	case "composite":
+		row[m.ShardColumn] = shard.Name
+	case "offset":
+		columns, err := t.offsetColumns(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range columns {
+			value, ok := row[column]
+			if !ok || value == nil {
+				continue
+			}
+			n, ok := value.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("offset strategy needs a numeric %s, got %v", column, value)
+			}
+			id, err := n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("offset strategy needs an integer %s, got %s", column, n)
+			}
+			row[column] = json.Number(strconv.FormatInt(id+shard.Offset, 10))
+		}
+	}
+	return row, nil
+}
+
+// the columns identifying a remapped row in the target: the table's key,
+// with the shard column for the composite strategy
+func (t *mergeTarget) mergeKey(m config.Merge, table string, row map[string]interface{}) (map[string]interface{}, error) {
+	columns, err := t.key(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s has neither a primary key nor an id column to match rows by", table)
+	}
+	key, err := restore.KeyOf(columns, row)
+	if err != nil {
+		return nil, err
+	}
+	if m.Strategy == "composite" {
+		key[m.ShardColumn] = row[m.ShardColumn]
+	}
+	return key, nil
+}
+
+// make sure every table being merged has the shard column, before anything
+// is written
+func checkShardColumn(targetConn *sql.DB, column string, deltas []shardDelta) error {
+	checked := make(map[string]bool)
+	var missing []string
+	for _, delta := range deltas {
+		if checked[delta.TableName] {
+			continue
+		}
+		checked[delta.TableName] = true
+
+		var exists bool
+		err := targetConn.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = 'public' AND table_name = $1 AND column_name = $2
+			)`, delta.TableName, column).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check table %s for column %s: %v", delta.TableName, column, err)
+		}
+		if !exists && tableExists(targetConn, delta.TableName) {
+			missing = append(missing, delta.TableName)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("composite strategy needs a %s column (part of the primary key) on: %v", column, missing)
+	}
+	return nil
+}
+
+// echo a statement the way restore does
+func logStatement(query string, values []interface{}) {
+	fmt.Fprintf(outputFormat.Progress(), "Executing query: %s\n", query)
+	fmt.Fprintf(outputFormat.Progress(), "         With values: %v\n", values)
+}
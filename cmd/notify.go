@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// URL notifications are POSTed to as JSON, in addition to the log
+var notifyWebhook string
+
+// report an operational event to the log and, if configured, the webhook
+func notify(level, message string) {
+	if cfg != nil {
+		if rendered, err := cfg.NotifyMessage(level, message); err == nil {
+			message = rendered
+		}
+	}
+	log.Printf("[%s] %s", strings.ToUpper(level), message)
+	if notifyWebhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"source":  "db-delta-tracker",
+		"level":   level,
+		"message": message,
+		"time":    time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("Failed to encode notification: %v", err)
+		return
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(notifyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to deliver notification: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Notification webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/opslog"
+)
+
+// list the operations log: who ran what, with which arguments, and how it
+// ended
+func runOps(args []string) {
+	const usage = "Usage: ops history [-command <command>] [-user <user>] [-since <7d>] [-limit <n>]"
+	if len(args) == 0 || args[0] != "history" {
+		usagef(usage)
+	}
+	fs := flag.NewFlagSet("ops history", flag.ExitOnError)
+	command := fs.String("command", "", "only runs of this command, e.g. restore or \"init snapshot\"")
+	user := fs.String("user", "", "only runs by this OS or database user, or whose actor mentions it")
+	since := fs.String("since", "", "only runs started within this long, e.g. 7d or 12h")
+	limit := fs.Int("limit", 50, "how many runs to list, newest first")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args[1:])
+
+	if *limit <= 0 {
+		usagef(usage)
+	}
+	filter := opslog.Filter{Command: *command, User: *user, Limit: *limit}
+	if *since != "" {
+		// the same forms as retention.keep_for
+		window, err := config.Retention{KeepFor: *since}.Keep()
+		if err != nil {
+			usagef("Invalid -since %q: %v", *since, err)
+		}
+		filter.Since = time.Now().Add(-window)
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	entries, err := opslog.History(dbConn, filter)
+	if err != nil {
+		fatal(err, "Error reading the operations log")
+	}
+	outputFormat.Print(entries, func() {
+		if len(entries) == 0 {
+			fmt.Println("No operations recorded.")
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTARTED\tCOMMAND\tUSER\tOUTCOME\tARGS")
+		for _, e := range entries {
+			who := e.OSUser + "@" + e.Host
+			if e.Actor != "" {
+				who += " (" + e.Actor + ")"
+			}
+			outcome := e.Outcome
+			if e.ExitCode != nil && *e.ExitCode != 0 {
+				outcome = fmt.Sprintf("%s (exit %d)", outcome, *e.ExitCode)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.StartedAt.Local().Format(time.RFC3339), e.Command, who, outcome, strings.Join(e.Args, " "))
+			if e.Error != "" {
+				fmt.Fprintf(w, "\t\t\t\terror: %s\t\n", e.Error)
+			}
+		}
+		w.Flush()
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"db-delta-tracker/pkg/restore"
+)
+
+// send the queued statements, each target's as one multi-statement query
+// with the values written in as literals, so a whole queue costs a round
+// trip per target instead of one per statement. A queue that times out is
+// applied a statement at a time with on_timeout: retry, like a transaction.
+func (b *replayBatch) flush() error {
+	queued := b.queued
+	b.queued = nil
+	for len(queued) > 0 {
+		conn := queued[0].conn
+		var sent, rest []replayStatement
+		for _, s := range queued {
+			if s.conn == conn {
+				sent = append(sent, s)
+			} else {
+				rest = append(rest, s)
+			}
+		}
+
+		statements := make([]string, len(sent))
+		for i, s := range sent {
+			statements[i] = restore.Inline(s.query, s.args)
+		}
+		query := strings.Join(statements, ";\n")
+		target, tx, first := b.targets.nameOf(conn), b.txs[conn], sent[0].delta
+		err := recordStatement(target, first.ID, query, nil, func() (sql.Result, error) {
+			return lockWatcher.run(conn, target, first, func(ctx context.Context) (sql.Result, error) {
+				return tx.ExecContext(ctx, query)
+			})
+		})
+		switch {
+		case err == nil:
+			b.run = append(b.run, sent...)
+			queued = rest
+			continue
+		case !isStatementTimeout(err):
+			return fmt.Errorf("one of deltas %d to %d: %v", first.ID, sent[len(sent)-1].delta.ID, err)
+		case !b.retry:
+			return b.timedOut(err)
+		}
+		return b.applySplit(append(b.run, queued...))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extra room required on top of the estimate, since indexes, WAL and
+// dead tuples from replayed updates all take space we can't predict exactly
+const preflightHeadroom = 1.2
+
+// estimate how much disk the restore needs and make sure the target has room
+// for it, so a restore fails up front instead of when the disk fills up
+func preflightDiskSpace(restoredConn *sql.DB) error {
+	var tablesSize, deltasSize int64
+	err := dbConn.QueryRow(`
+		SELECT COALESCE(SUM(pg_total_relation_size(format('%I.%I', table_schema, table_name))), 0)
+		FROM information_schema.tables
+		WHERE table_schema = 'public' AND table_type = 'BASE TABLE' AND table_name <> 'deltas'
+	`).Scan(&tablesSize)
+	if err != nil {
+		return fmt.Errorf("failed to measure source table sizes: %v", err)
+	}
+	err = dbConn.QueryRow("SELECT COALESCE(pg_total_relation_size(to_regclass('deltas')), 0)").Scan(&deltasSize)
+	if err != nil {
+		return fmt.Errorf("failed to measure deltas table size: %v", err)
+	}
+
+	// whatever the target already holds doesn't need to be allocated again
+	var targetSize int64
+	if err := restoredConn.QueryRow("SELECT pg_database_size(current_database())").Scan(&targetSize); err != nil {
+		return fmt.Errorf("failed to measure restored database size: %v", err)
+	}
+
+	estimate := tablesSize + deltasSize
+	needed := int64(float64(estimate-targetSize) * preflightHeadroom)
+	if needed < 0 {
+		needed = 0
+	}
+	log.Printf("Preflight: source tables %s, deltas %s, restored database currently %s; about %s more needed.",
+		formatBytes(tablesSize), formatBytes(deltasSize), formatBytes(targetSize), formatBytes(needed))
+
+	// the free space check looks at this machine's disks; a host starting with
+	// a slash is a Unix-domain socket directory, so the server is local
+	if host := cfg.Target.Host; host != "" && host != "localhost" && host != "127.0.0.1" && host != "::1" && !strings.HasPrefix(host, "/") {
+		log.Printf("Warning: restored database is on %s, skipping free space check.", host)
+		return nil
+	}
+
+	path, err := targetTablespacePath(restoredConn)
+	if err != nil {
+		log.Printf("Warning: can't locate the restored database's tablespace, skipping free space check: %v", err)
+		return nil
+	}
+
+	free, err := diskFree(path)
+	if err != nil {
+		log.Printf("Warning: can't check free space at %s (is the target on another host?): %v", path, err)
+		return nil
+	}
+
+	if uint64(needed) > free {
+		return fmt.Errorf("not enough disk space for the restore: about %s needed but only %s free at %s",
+			formatBytes(needed), formatBytes(int64(free)), path)
+	}
+
+	log.Printf("Preflight: %s free at %s.", formatBytes(int64(free)), path)
+	return nil
+}
+
+// find the directory holding the restored database's default tablespace;
+// only usable when the target server runs on this machine
+func targetTablespacePath(restoredConn *sql.DB) (string, error) {
+	var location string
+	err := restoredConn.QueryRow(`
+		SELECT pg_tablespace_location(t.oid)
+		FROM pg_database d
+		JOIN pg_tablespace t ON t.oid = d.dattablespace
+		WHERE d.datname = current_database()
+	`).Scan(&location)
+	if err != nil {
+		return "", err
+	}
+
+	// pg_default has no location of its own and lives in the data directory
+	if location == "" {
+		var dataDir string
+		if err := restoredConn.QueryRow("SELECT current_setting('data_directory')").Scan(&dataDir); err != nil {
+			return "", err
+		}
+		location = filepath.Join(dataDir, "base")
+	}
+
+	if _, err := os.Stat(location); err != nil {
+		return "", err
+	}
+	return location, nil
+}
+
+// render a byte count for log messages
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
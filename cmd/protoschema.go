@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/mask"
+	"db-delta-tracker/pkg/objstore"
+)
+
+// the protobuf package of the typed delta messages
+const protoPackage = "deltatracker.tables"
+
+// a table's generated .proto
+type tableProtoFile struct {
+	Table   string `json:"table"`
+	Message string `json:"message"` // the Delta message, with its package
+	File    string `json:"file,omitempty"`
+	Proto   string `json:"proto"`
+}
+
+// generate a .proto per tracked table declaring the typed Delta messages
+// kafka-sink publishes with format protobuf, so consumers can generate code
+// for them instead of parsing JSON
+func runProtoSchema(args []string) {
+	fs := flag.NewFlagSet("proto-schema", flag.ExitOnError)
+	onlyTables := fs.String("tables", "", "comma separated tables; default every tracked table")
+	dir := fs.String("dir", "", "write each table's definitions to <table>.proto in this directory, local or s3://, gs:// or az://, instead of printing them")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	tables := splitList(*onlyTables)
+	if len(tables) == 0 {
+		var err error
+		if tables, err = schemaTables("catalog"); err != nil {
+			fatal(err, "Error listing tables")
+		}
+	}
+	sort.Strings(tables)
+
+	files := []tableProtoFile{}
+	for _, table := range tables {
+		if !tableExists(dbConn, table) {
+			fatal(fmt.Errorf("table %s does not exist", table), "Error generating definitions")
+		}
+		p, err := tableProto(table)
+		if err != nil {
+			fatal(err, "Error generating definitions")
+		}
+		if len(p.Columns) == 0 {
+			log.Printf("Warning: no definitions for %s: it has no columns.", table)
+			continue
+		}
+		f := tableProtoFile{Table: table, Message: p.Package + "." + p.MessageName(), Proto: p.Proto()}
+		if *dir != "" {
+			f.File = objstore.Join(*dir, table+".proto")
+			if err := objstore.WriteFile(context.Background(), f.File, []byte(f.Proto)); err != nil {
+				fatal(fmt.Errorf("failed to write %s: %v", f.File, err), "Error writing definitions")
+			}
+		}
+		files = append(files, f)
+	}
+	outputFormat.Print(files, func() {
+		for _, f := range files {
+			if f.File != "" {
+				fmt.Printf("%s: %s in %s\n", f.Table, f.Message, f.File)
+				continue
+			}
+			fmt.Printf("// %s\n%s\n", f.Table, f.Proto)
+		}
+	})
+}
+
+// the typed protobuf schema of a table's deltas, from its columns as the
+// deltas record them; hashed columns are strings, whatever their type
+func tableProto(table string) (codec.TableProto, error) {
+	p := codec.TableProto{Package: protoPackage, Table: table}
+	columns, err := capturedColumns(table)
+	if err != nil {
+		return p, err
+	}
+	for _, c := range columns {
+		dataType := c.dataType
+		if c.masked == mask.Hash {
+			dataType = "text"
+		}
+		p.Columns = append(p.Columns, codec.ProtoColumn{Name: c.name, Type: dataType, Number: c.number})
+	}
+
+	rows, err := dbConn.Query(`
+		SELECT attnum FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND attisdropped
+		ORDER BY attnum
+	`, ident.Quote(table))
+	if err != nil {
+		return p, fmt.Errorf("failed to read the dropped columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var number int
+		if err := rows.Scan(&number); err != nil {
+			return p, fmt.Errorf("failed to read the dropped columns of %s: %v", table, err)
+		}
+		p.Dropped = append(p.Dropped, number)
+	}
+	return p, rows.Err()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/config"
+)
+
+// how many deltas prune deletes or archives per transaction
+const pruneBatch = 10000
+
+// what prune removed from the deltas table, for -output json
+type pruneResult struct {
+	Before     time.Time `json:"before"`
+	Deleted    int64     `json:"deleted,omitempty"`
+	Archived   int       `json:"archived,omitempty"`
+	ArchivedTo []string  `json:"archived_to,omitempty"`
+	Kept       int64     `json:"kept_unsnapshotted,omitempty"` // past the window, but no table snapshot contains them yet
+	HeldBy     []string  `json:"held_back_by,omitempty"`       // consumers that haven't read deltas past the window yet
+	DryRun     bool      `json:"dry_run,omitempty"`
+}
+
+// remove the deltas older than the retention window from the deltas table,
+// moving them into archive files when an archive directory is set and
+// deleting them otherwise; meant to be run from cron or as a daemon job
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	keepFor := fs.String("keep", "", "how long to keep deltas, e.g. 30d or 12h (overrides retention.keep_for in the config)")
+	archiveDir := fs.String("archive-dir", "", "move pruned deltas into files in this directory instead of deleting them")
+	archiveCodec := fs.String("archive-codec", "", "format of archive files: "+strings.Join(codec.Names(), ", ")+" (default json)")
+	force := fs.Bool("force", false, "also prune deltas consumers haven't read yet and, without an archive directory, deltas no table snapshot contains yet")
+	dryRun := fs.Bool("dry-run", false, "report what would be pruned without changing the deltas table")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	// flags given on the command line win over the config
+	retention := cfg.Retention
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "keep":
+			retention.KeepFor = *keepFor
+		case "archive-dir":
+			retention.ArchiveDir = *archiveDir
+		case "archive-codec":
+			retention.ArchiveCodec = *archiveCodec
+		}
+	})
+	keep, err := retention.Keep()
+	if err != nil {
+		usagef("Invalid retention window %q: %v", retention.KeepFor, err)
+	}
+	if keep == 0 {
+		usagef("Nothing to prune: set -keep, or retention.keep_for in the config")
+	}
+	archiveWith, err := codec.Lookup(retention.ArchiveCodec)
+	if err != nil {
+		usagef("Invalid archive codec: %v", err)
+	}
+
+	result, err := pruneDeltas(time.Now().Add(-keep), retention, archiveWith, *force, *dryRun)
+	if err != nil {
+		fatal(err, "Error pruning deltas")
+	}
+	outputFormat.Print(result, func() {
+		verb := "Pruned"
+		if result.DryRun {
+			verb = "Would prune"
+		}
+		fmt.Printf("%s %d deltas made before %s.\n", verb, result.Deleted+int64(result.Archived), result.Before.Format(time.RFC3339))
+	})
+}
+
+// archive or delete the deltas made before a time, a batch per transaction.
+// Unless force is set, deltas a kafka sink, receiver or merge hasn't read
+// yet are kept, and without an archive, where the deltas are gone for good,
+// only the deltas a table snapshot already contains are deleted, since
+// restores skip those anyway, along with the marks no kept delta precedes.
+func pruneDeltas(before time.Time, retention config.Retention, c codec.Codec, force, dryRun bool) (pruneResult, error) {
+	result := pruneResult{Before: before, DryRun: dryRun}
+
+	if !force {
+		var err error
+		if result.Before, result.HeldBy, err = unreadSince(before); err != nil {
+			return result, err
+		}
+		if len(result.HeldBy) > 0 {
+			log.Printf("Warning: keeping the deltas made since %s, which %s hasn't read yet; pass -force to prune them anyway.", result.Before.Format(time.RFC3339), strings.Join(result.HeldBy, " and "))
+		}
+	}
+	before = result.Before
+
+	contained := "TRUE"
+	if retention.ArchiveDir == "" && !force {
+		var hasSnapshots bool
+		if err := dbConn.QueryRow("SELECT to_regclass('delta_tracker.table_snapshots') IS NOT NULL").Scan(&hasSnapshots); err != nil {
+			return result, fmt.Errorf("failed to look up table snapshots: %v", err)
+		}
+		snapshotted := func(alias string) string {
+			if !hasSnapshots {
+				return "FALSE"
+			}
+			return fmt.Sprintf(`EXISTS (
+				SELECT 1 FROM delta_tracker.table_snapshots s
+				WHERE s.table_name = %[1]s.table_name AND txid_visible_in_snapshot(%[1]s.txid, s.txid_snapshot::txid_snapshot)
+			)`, alias)
+		}
+		// restores to a mark replay the deltas before it, so it's kept as
+		// long as any of them is
+		contained = fmt.Sprintf(`(action = '%[1]s' AND NOT EXISTS (
+				SELECT 1 FROM deltas kept
+				WHERE (kept.timestamp, kept.id) < (deltas.timestamp, deltas.id) AND kept.action <> '%[1]s' AND NOT %[2]s
+			)) OR %[3]s`, markAction, snapshotted("kept"), snapshotted("deltas"))
+	}
+
+	if dryRun {
+		var older, prunable int64
+		err := dbConn.QueryRow(fmt.Sprintf("SELECT COUNT(*), COUNT(*) FILTER (WHERE %s) FROM deltas WHERE timestamp < $1", contained), before).Scan(&older, &prunable)
+		if err != nil {
+			return result, fmt.Errorf("failed to count old deltas: %v", err)
+		}
+		if retention.ArchiveDir != "" {
+			result.Archived = int(prunable)
+		} else {
+			result.Deleted = prunable
+		}
+		result.Kept = older - prunable
+		return result, nil
+	}
+
+	if retention.ArchiveDir != "" {
+		var err error
+		result.ArchivedTo, result.Archived, err = drainToArchive(retention.ArchiveDir, before, pruneBatch, c)
+		return result, err
+	}
+
+	query := fmt.Sprintf(`
+		DELETE FROM deltas WHERE id IN (
+			SELECT id FROM deltas
+			WHERE timestamp < $1 AND (%s)
+			ORDER BY timestamp, id
+			LIMIT $2
+		)`, contained)
+	for {
+		res, err := dbConn.Exec(query, before, pruneBatch)
+		if err != nil {
+			return result, fmt.Errorf("failed to delete old deltas: %v", err)
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return result, fmt.Errorf("failed to delete old deltas: %v", err)
+		}
+		if deleted == 0 {
+			break
+		}
+		result.Deleted += deleted
+	}
+	log.Printf("Deleted %d deltas made before %s.", result.Deleted, before.Format(time.RFC3339))
+
+	if err := dbConn.QueryRow("SELECT COUNT(*) FROM deltas WHERE timestamp < $1", before).Scan(&result.Kept); err != nil {
+		return result, fmt.Errorf("failed to count old deltas: %v", err)
+	}
+	if result.Kept > 0 {
+		log.Printf("Warning: kept %d deltas past the retention window that no table snapshot contains, since restores from init's copies still need them; snapshot their tables with init snapshot -all, or archive them with -archive-dir.", result.Kept)
+	}
+	return result, nil
+}
+
+// the time of the oldest delta a consumer hasn't read yet, if it is before
+// the given one, with the consumers that haven't read it; every delta made
+// before it has an id they have all read past
+func unreadSince(before time.Time) (time.Time, []string, error) {
+	consumers, err := deltaConsumers()
+	if err != nil {
+		return before, nil, err
+	}
+	var heldBy []string
+	for _, consumer := range consumers {
+		var unread sql.NullTime
+		if err := dbConn.QueryRow("SELECT MIN(timestamp) FROM deltas WHERE id > $1", consumer.LastID).Scan(&unread); err != nil {
+			return before, nil, fmt.Errorf("failed to look up the deltas %s hasn't read: %v", consumer.Name, err)
+		}
+		if unread.Valid && unread.Time.Before(before) {
+			before = unread.Time
+			heldBy = append(heldBy, consumer.Name)
+		}
+	}
+	return before, heldBy, nil
+}
+
+// a reader that keeps its own position in the deltas table, reading the
+// deltas after LastID next
+type deltaConsumer struct {
+	Name   string
+	LastID int64
+}
+
+// the kafka sinks reading the deltas table, and the receiver and merge
+// shard reading it into the target, if the target can be reached from here
+func deltaConsumers() ([]deltaConsumer, error) {
+	var consumers []deltaConsumer
+	var hasSinks bool
+	if err := dbConn.QueryRow("SELECT to_regclass('delta_tracker.kafka_sinks') IS NOT NULL").Scan(&hasSinks); err != nil {
+		return nil, fmt.Errorf("failed to look up kafka sinks: %v", err)
+	}
+	if hasSinks {
+		rows, err := dbConn.Query("SELECT name, last_id FROM delta_tracker.kafka_sinks ORDER BY name")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the kafka sinks' positions: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var consumer deltaConsumer
+			if err := rows.Scan(&consumer.Name, &consumer.LastID); err != nil {
+				return nil, fmt.Errorf("failed to read the kafka sinks' positions: %v", err)
+			}
+			consumer.Name = fmt.Sprintf("the kafka sink %q", consumer.Name)
+			consumers = append(consumers, consumer)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read the kafka sinks' positions: %v", err)
+		}
+	}
+
+	// receivers often run next to a target this host can't reach
+	targetConn, err := cfg.Target.ReadOnly().Open()
+	if err == nil {
+		err = targetConn.Ping()
+	}
+	if err != nil {
+		log.Printf("Warning: couldn't connect to %s to read the receive and merge positions, so deltas a receiver or merge hasn't read yet may be pruned: %v", restoreDB, err)
+		return consumers, nil
+	}
+	defer targetConn.Close()
+
+	receiver, err := receiveConsumer(targetConn, restoreDB)
+	if err != nil {
+		return nil, err
+	}
+	consumers = append(consumers, receiver...)
+	// the receiver keeps a position in each routed database too
+	for _, route := range cfg.Routes {
+		routeConn, err := route.Target.ReadOnly().Open()
+		if err == nil {
+			err = routeConn.Ping()
+		}
+		if err != nil {
+			log.Printf("Warning: couldn't connect to %s to read the receive position, so deltas the receiver hasn't applied to it yet may be pruned: %v", route.Target.DBName, err)
+			continue
+		}
+		receiver, err := receiveConsumer(routeConn, route.Target.DBName)
+		routeConn.Close()
+		if err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, receiver...)
+	}
+
+	var hasMerge bool
+	if err := targetConn.QueryRow("SELECT to_regclass('delta_tracker.merge_positions') IS NOT NULL").Scan(&hasMerge); err != nil {
+		return nil, fmt.Errorf("failed to look up merge positions: %v", err)
+	}
+	for _, shard := range cfg.Merge.Shards {
+		if shard.Source.Host != cfg.Source.Host || shard.Source.Port != cfg.Source.Port || shard.Source.SocketDir != cfg.Source.SocketDir || shard.Source.DBName != cfg.Source.DBName {
+			continue
+		}
+		// a shard merge hasn't started on is read from the beginning
+		consumer := deltaConsumer{Name: fmt.Sprintf("the merge of shard %s", shard.Name)}
+		if hasMerge {
+			err := targetConn.QueryRow("SELECT last_id FROM delta_tracker.merge_positions WHERE shard = $1", shard.Name).Scan(&consumer.LastID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, fmt.Errorf("failed to read the merge position of shard %s: %v", shard.Name, err)
+			}
+		}
+		consumers = append(consumers, consumer)
+	}
+	return consumers, nil
+}
+
+// the receiver applying deltas to a database, if one has
+func receiveConsumer(conn *sql.DB, name string) ([]deltaConsumer, error) {
+	var exists bool
+	if err := conn.QueryRow("SELECT to_regclass('delta_tracker.receive_position') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up the receive position in %s: %v", name, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	consumer := deltaConsumer{Name: "the receiver into " + name}
+	err := conn.QueryRow("SELECT last_id FROM delta_tracker.receive_position").Scan(&consumer.LastID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read the receive position in %s: %v", name, err)
+	}
+	return []deltaConsumer{consumer}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quarantine describes source transactions whose deltas must not be replayed,
+// e.g. the writes of a bad deploy
+type quarantine struct {
+	txids  map[int64]bool
+	ranges []timeRange
+}
+
+// timeRange is an inclusive window of delta timestamps
+type timeRange struct {
+	from time.Time
+	to   time.Time
+}
+
+// parse the -quarantine-txids and -quarantine-range flag values
+//
+//	txids:  comma separated list of transaction ids, e.g. "1234,1240"
+//	ranges: comma separated list of from/to pairs in RFC 3339,
+//	        e.g. "2024-05-01T12:00:00Z/2024-05-01T12:30:00Z"
+func parseQuarantine(txids, ranges string) (*quarantine, error) {
+	q := &quarantine{txids: make(map[int64]bool)}
+
+	for _, field := range splitList(txids) {
+		txid, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quarantined txid %q: %v", field, err)
+		}
+		q.txids[txid] = true
+	}
+
+	for _, field := range splitList(ranges) {
+		bounds := strings.SplitN(field, "/", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid quarantine range %q: expected <from>/<to>", field)
+		}
+		from, err := time.Parse(time.RFC3339, bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quarantine range start %q: %v", bounds[0], err)
+		}
+		to, err := time.Parse(time.RFC3339, bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quarantine range end %q: %v", bounds[1], err)
+		}
+		if to.Before(from) {
+			return nil, fmt.Errorf("invalid quarantine range %q: end is before start", field)
+		}
+		q.ranges = append(q.ranges, timeRange{from: from, to: to})
+	}
+
+	return q, nil
+}
+
+// report whether a delta belongs to a quarantined transaction or time range
+func (q *quarantine) contains(delta Delta) bool {
+	if q.txids[delta.TxID] {
+		return true
+	}
+	for _, r := range q.ranges {
+		if !delta.Timestamp.Before(r.from) && !delta.Timestamp.After(r.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// list the deltas that were held back so they can be reviewed separately
+func printQuarantined(deltas []Delta) {
+	if len(deltas) == 0 {
+		return
+	}
+
+	log.Printf("%d quarantined deltas were skipped:", len(deltas))
+	for _, delta := range deltas {
+		fmt.Fprintf(outputFormat.Progress(), "  txid = %d, timestamp = %s, action = %s, table = %s\n",
+			delta.TxID, delta.Timestamp.Format(time.RFC3339Nano), delta.Action, delta.TableName)
+		if delta.Statement != "" {
+			fmt.Fprintf(outputFormat.Progress(), "    statement = %s\n", delta.Statement)
+		}
+		if delta.Context != nil {
+			fmt.Fprintf(outputFormat.Progress(), "    context = %s\n", *delta.Context)
+		}
+	}
+}
+
+// report whether list holds value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// split a comma separated flag value, ignoring blanks
+func splitList(value string) []string {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"db-delta-tracker/pkg/codec"
+	"db-delta-tracker/pkg/exitcode"
+)
+
+// how far a receiver has applied the shipped deltas; kept in the target and
+// each routed database, so a shipment picks up where the last one stopped
+type receivePosition struct {
+	LastID  int64 `json:"last_id"` // the last delta applied or passed over; 0 before the first
+	Applied int64 `json:"applied"` // statements applied over every shipment
+	Skipped int   `json:"skipped,omitempty"`
+}
+
+// moves the receiver's position, in the transaction that applied the deltas
+const receivePositionQuery = `INSERT INTO delta_tracker.receive_position (last_id, applied, received_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+	ON CONFLICT (only_row) DO UPDATE SET last_id = EXCLUDED.last_id, applied = EXCLUDED.applied, received_at = EXCLUDED.received_at`
+
+// the codec shipped batches are encoded with, before they are gzipped
+var shipCodec, _ = codec.Lookup("protobuf")
+
+// applies batches of deltas shipped by restore -ship-to to the target; one
+// batch at a time, since they must be applied in order
+type receiver struct {
+	mu       sync.Mutex
+	targets  *replayTargets
+	token    string
+	maxBatch int64 // bytes a batch may take, gzipped or not
+}
+
+// run next to the target, applying the delta batches a restore with
+// -ship-to sends over HTTP. The source is never contacted, so only the
+// target needs to be reachable from here.
+func runReceive(args []string) {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	listen := fs.String("listen", ":9090", "address to receive shipped deltas on")
+	token := fs.String("token", os.Getenv("DELTA_SHIP_TOKEN"), "token senders must present (default $DELTA_SHIP_TOKEN)")
+	maxBatch := fs.String("max-batch", "256MB", "largest batch to accept, gzipped or not")
+	configFlag(fs)
+	parseFlags(fs, args)
+
+	if *token == "" {
+		usagef("Set -token or $DELTA_SHIP_TOKEN; without one anyone who can reach the receiver could write to the target")
+	}
+	maxBatchBytes, err := parseBytes(*maxBatch)
+	if err != nil || maxBatchBytes <= 0 {
+		usagef("Invalid -max-batch %q", *maxBatch)
+	}
+
+	if err := loadConfig(); err != nil {
+		fatal(err, "Error loading config")
+	}
+	conn, err := openReplayConn(cfg.Target)
+	if err == nil {
+		err = conn.Ping()
+	}
+	if err != nil {
+		fatal(exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the restored database: %v", err)), "Error connecting")
+	}
+	defer conn.Close()
+	targets, err := openReplayTargets(conn)
+	if err != nil {
+		fatal(err, "Error connecting")
+	}
+	defer targets.Close()
+	for _, db := range targets.all() {
+		if _, err := db.Exec(`
+			CREATE SCHEMA IF NOT EXISTS delta_tracker;
+			CREATE TABLE IF NOT EXISTS delta_tracker.receive_position (
+				only_row BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (only_row),
+				last_id BIGINT NOT NULL,
+				applied BIGINT NOT NULL,
+				received_at TIMESTAMPTZ NOT NULL
+			)
+		`); err != nil {
+			fatal(fmt.Errorf("failed to create receive position table in %s: %v", targets.nameOf(db), err), "Error preparing the restored database")
+		}
+	}
+
+	r := &receiver{targets: targets, token: *token, maxBatch: maxBatchBytes}
+	server := &http.Server{Addr: *listen, Handler: r.handler()}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	log.Printf("Receiving deltas for %s on %s.", cfg.Target.DBName, *listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(err, "Error receiving deltas")
+	}
+	log.Println("Receiver stopped.")
+}
+
+func (r *receiver) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/position", func(w http.ResponseWriter, req *http.Request) {
+		if !r.authorized(w, req) {
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		pos, _, err := r.position()
+		if err != nil {
+			log.Printf("Receive: %v", err)
+			http.Error(w, "failed to read the receive position", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, pos, nil)
+	})
+	mux.HandleFunc("/batches", func(w http.ResponseWriter, req *http.Request) {
+		if !r.authorized(w, req) {
+			return
+		}
+		if req.Method != http.MethodPost {
+			http.Error(w, "POST a batch", http.StatusMethodNotAllowed)
+			return
+		}
+		after, err := strconv.ParseInt(req.Header.Get("X-After-Delta"), 10, 64)
+		if err != nil {
+			http.Error(w, "X-After-Delta must be the id of the delta the batch follows", http.StatusBadRequest)
+			return
+		}
+		deltas, err := decodeBatch(http.MaxBytesReader(w, req.Body, r.maxBatch), r.maxBatch)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errBatchTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		pos, positions, err := r.position()
+		if err != nil {
+			log.Printf("Receive: %v", err)
+			http.Error(w, "failed to read the receive position", http.StatusInternalServerError)
+			return
+		}
+		// a batch sent again after its response was lost, or out of turn
+		if pos.LastID != after {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(pos)
+			return
+		}
+		pos, err = r.apply(pos, positions, deltas)
+		if err != nil {
+			log.Printf("Failed to apply a batch of %d deltas after delta %d: %v", len(deltas), after, err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		log.Printf("Applied %d deltas, up to delta %d.", len(deltas), pos.LastID)
+		writeJSON(w, pos, nil)
+	})
+	return mux
+}
+
+// whether a request carries the receiver's token, answering it if not
+func (r *receiver) authorized(w http.ResponseWriter, req *http.Request) bool {
+	return authorized(r.token, w, req)
+}
+
+// the position recorded in each target, and the one to resume from: the
+// lowest of them, since a batch commits on each target on its own and may
+// have committed on some before failing on another. Applied adds up the
+// statements applied to every target.
+func (r *receiver) position() (receivePosition, map[*sql.DB]receivePosition, error) {
+	var lowest receivePosition
+	positions := make(map[*sql.DB]receivePosition)
+	for i, db := range r.targets.all() {
+		var pos receivePosition
+		err := db.QueryRow("SELECT last_id, applied FROM delta_tracker.receive_position").Scan(&pos.LastID, &pos.Applied)
+		if err != nil && err != sql.ErrNoRows {
+			return lowest, nil, fmt.Errorf("failed to read the receive position in %s: %v", r.targets.nameOf(db), err)
+		}
+		positions[db] = pos
+		if i == 0 || pos.LastID < lowest.LastID {
+			lowest.LastID = pos.LastID
+		}
+		lowest.Applied += pos.Applied
+	}
+	return lowest, positions, nil
+}
+
+// apply a batch in one transaction per target, moving that target's position
+// in the same one. Deltas a target's position is already past were applied
+// by an earlier try of the batch that failed on another target, and are
+// passed over. A rename commits what came before it first, as in a restore,
+// so the positions are recorded on both sides of it.
+func (r *receiver) apply(pos receivePosition, positions map[*sql.DB]receivePosition, deltas []Delta) (receivePosition, error) {
+	for conn, routed := range r.targets.group(deltas) {
+		if err := ensureReplayIndexes(conn, r.targets.builder(conn), routed); err != nil {
+			return pos, err
+		}
+	}
+	batch := newReplayBatch(restoreOptions{singleTx: true}, r.targets, cfg.Timeouts.Replay)
+	defer batch.rollback()
+	applied := make(map[*sql.DB]receivePosition, len(positions))
+	for conn, p := range positions {
+		applied[conn] = p
+	}
+	lastID, skipped := pos.LastID, 0
+
+	// the position of every target after the deltas up to lastID, either in
+	// the open transactions or, with exec nil, each on its own
+	record := func(exec func(conn *sql.DB, query string, args ...interface{}) error) error {
+		for _, conn := range r.targets.all() {
+			p := applied[conn]
+			if p.LastID < lastID {
+				p.LastID = lastID
+			}
+			var err error
+			if exec != nil {
+				err = exec(conn, receivePositionQuery, p.LastID, p.Applied)
+			} else if _, err = conn.Exec(receivePositionQuery, p.LastID, p.Applied); err != nil {
+				err = fmt.Errorf("failed to record the receive position in %s: %v", r.targets.nameOf(conn), err)
+			}
+			if err != nil {
+				return err
+			}
+			applied[conn] = p
+		}
+		return nil
+	}
+	inBatch := func(conn *sql.DB, query string, args ...interface{}) error {
+		return batch.exec(conn, Delta{}, query, args...)
+	}
+	// where the batch got to, once the positions of every target are recorded
+	result := func() receivePosition {
+		out := receivePosition{LastID: lastID, Skipped: skipped}
+		for _, p := range applied {
+			out.Applied += p.Applied
+		}
+		return out
+	}
+
+	for _, delta := range deltas {
+		if delta.Action == markAction {
+			lastID = delta.ID
+			continue
+		}
+		if delta.Action == renameAction {
+			from, _, err := renamedTables(delta)
+			if err != nil {
+				return pos, err
+			}
+			conn := r.targets.connFor(from)
+			if delta.ID <= applied[conn].LastID {
+				lastID = delta.ID
+				continue
+			}
+			if err := record(inBatch); err != nil {
+				return pos, err
+			}
+			if err := batch.commit(); err != nil {
+				return pos, err
+			}
+			pos = result()
+			renamed, err := applyRename(conn, r.targets.nameFor(from), delta)
+			if err != nil {
+				return pos, err
+			}
+			p := applied[conn]
+			if renamed {
+				r.targets.builder(conn).Forget(from)
+				r.targets.builder(conn).Forget(delta.TableName)
+				p.Applied++
+			} else {
+				skipped++
+			}
+			applied[conn] = p
+			lastID = delta.ID
+			if err := record(nil); err != nil {
+				return pos, err
+			}
+			pos = result()
+			continue
+		}
+
+		conn := r.targets.connFor(delta.TableName)
+		if delta.ID <= applied[conn].LastID {
+			lastID = delta.ID
+			continue
+		}
+		if !tableExists(conn, delta.TableName) {
+			log.Printf("Skipping delta for non-existent table %s in the restored database", delta.TableName)
+			skipped++
+			lastID = delta.ID
+			continue
+		}
+		query, args, err := r.targets.builder(conn).Statement(context.Background(), delta)
+		if err != nil {
+			return pos, err
+		}
+		if err := batch.exec(conn, delta, query, args...); err != nil {
+			return pos, fmt.Errorf("error applying delta %d: %v", delta.ID, err)
+		}
+		p := applied[conn]
+		p.Applied++
+		applied[conn] = p
+		lastID = delta.ID
+	}
+
+	if err := record(inBatch); err != nil {
+		return pos, err
+	}
+	if err := batch.commit(); err != nil {
+		return pos, err
+	}
+	return result(), nil
+}
+
+var errBatchTooLarge = errors.New("batch is too large; ship smaller ones with -ship-batch, or raise the receiver's -max-batch")
+
+// read a gzipped batch of deltas as the sender encoded it, refusing one that
+// unzips to more than max bytes
+func decodeBatch(body io.Reader, max int64) ([]Delta, error) {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errBatchTooLarge
+		}
+		return nil, fmt.Errorf("batch is not gzipped: %v", err)
+	}
+	defer zr.Close()
+	unzipped := &io.LimitedReader{R: zr, N: max + 1}
+	var deltas []Delta
+	dec := shipCodec.NewDecoder(unzipped)
+	for {
+		var delta Delta
+		err := dec.Decode(&delta)
+		var tooLarge *http.MaxBytesError
+		if unzipped.N <= 0 || errors.As(err, &tooLarge) {
+			return nil, errBatchTooLarge
+		}
+		if err == io.EOF {
+			return deltas, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode batch: %v", err)
+		}
+		deltas = append(deltas, delta)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// the recovery settings stopping a physical point-in-time recovery where a
+// logical restore would stop
+type recoveryTarget struct {
+	Point    string   `json:"point"` // what the settings stop at, e.g. mark "batch-7"
+	LSN      string   `json:"lsn,omitempty"`
+	Time     string   `json:"time,omitempty"` // set when there is no recorded LSN to stop at
+	Settings []string `json:"settings"`       // lines for postgresql.conf or postgresql.auto.conf
+}
+
+// print the recovery_target settings for a mark, a table snapshot or a time,
+// so a physical backup and the WAL archive recover the source to the same
+// point a restore with -to-mark or -until stops at
+func runRecoveryTarget(args []string) {
+	fs := flag.NewFlagSet("recovery-target", flag.ExitOnError)
+	mark := fs.String("mark", "", "stop where the last mark with this label was recorded")
+	snapshot := fs.String("snapshot", "", "stop once the latest snapshot of this table was taken")
+	until := fs.String("until", "", "stop at this RFC 3339 time")
+	action := fs.String("action", "pause", "what the server does on reaching the target: pause, promote or shutdown")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	given := 0
+	for _, v := range []string{*mark, *snapshot, *until} {
+		if v != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		usagef("Usage: recovery-target --mark <label> | --snapshot <table> | --until <timestamp> [--action pause|promote|shutdown]")
+	}
+	if *action != "pause" && *action != "promote" && *action != "shutdown" {
+		usagef("-action must be pause, promote or shutdown")
+	}
+	var untilTime time.Time
+	if *until != "" {
+		var err error
+		if untilTime, err = time.Parse(time.RFC3339, *until); err != nil {
+			usagef("-until must be an RFC 3339 time, e.g. 2024-05-01T12:00:00Z: %v", err)
+		}
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	var target recoveryTarget
+	var err error
+	switch {
+	case *mark != "":
+		target, err = markRecoveryTarget(*mark)
+	case *snapshot != "":
+		target, err = snapshotRecoveryTarget(*snapshot)
+	default:
+		target = recoveryTarget{Point: "time " + untilTime.Format(time.RFC3339), Time: untilTime.Format("2006-01-02 15:04:05.999999-07:00")}
+	}
+	if err != nil {
+		fatal(err, "Error finding the recovery target")
+	}
+	warnArchiving()
+
+	if target.LSN != "" {
+		target.Settings = append(target.Settings, fmt.Sprintf("recovery_target_lsn = '%s'", target.LSN))
+	} else {
+		target.Settings = append(target.Settings, fmt.Sprintf("recovery_target_time = '%s'", target.Time))
+	}
+	target.Settings = append(target.Settings, "recovery_target_inclusive = on", fmt.Sprintf("recovery_target_action = '%s'", *action))
+
+	outputFormat.Print(target, func() {
+		fmt.Printf("# recover to %s\n", target.Point)
+		for _, line := range target.Settings {
+			fmt.Println(line)
+		}
+	})
+}
+
+// the position of the last mark with a label; a mark recorded without
+// wal.record_lsn only has its time
+func markRecoveryTarget(label string) (recoveryTarget, error) {
+	target := recoveryTarget{Point: fmt.Sprintf("mark %q", label)}
+	var lsn sql.NullString
+	var at time.Time
+	err := dbConn.QueryRow(`
+		SELECT new_data->>'lsn', timestamp FROM deltas
+		WHERE action = $1 AND new_data->>'label' = $2
+		ORDER BY id DESC
+		LIMIT 1
+	`, markAction, label).Scan(&lsn, &at)
+	if err == sql.ErrNoRows {
+		return target, fmt.Errorf("no mark %q in the deltas; record one with SELECT dbdelta_mark('%s')", label, label)
+	}
+	if err != nil {
+		return target, fmt.Errorf("failed to look up mark %q: %v", label, err)
+	}
+	if !lsn.Valid {
+		log.Printf("Warning: mark %q was recorded without its WAL position (set wal.record_lsn and rerun init); recovering to its time instead, which may take in transactions committed in the same instant.", label)
+		target.Time = at.Format("2006-01-02 15:04:05.999999-07:00")
+		return target, nil
+	}
+	target.LSN = lsn.String
+	return target, nil
+}
+
+// the position the latest snapshot of a table was recorded at
+func snapshotRecoveryTarget(table string) (recoveryTarget, error) {
+	target := recoveryTarget{Point: "snapshot of " + table}
+	var lsn sql.NullString
+	var at time.Time
+	err := dbConn.QueryRow(`
+		SELECT lsn::text, taken_at FROM delta_tracker.table_snapshots
+		WHERE table_name = $1
+		ORDER BY taken_at DESC, id DESC
+		LIMIT 1
+	`, table).Scan(&lsn, &at)
+	if err == sql.ErrNoRows {
+		return target, fmt.Errorf("%s has no snapshot; take one with init snapshot %s", table, table)
+	}
+	if err != nil {
+		return target, fmt.Errorf("failed to look up the snapshots of %s: %v", table, err)
+	}
+	if !lsn.Valid {
+		return target, fmt.Errorf("the latest snapshot of %s, taken at %s, was recorded without its WAL position; set wal.record_lsn and take another", table, at.Format(time.RFC3339))
+	}
+	target.LSN = lsn.String
+	return target, nil
+}
+
+// physical recovery needs the WAL archived up to the target
+func warnArchiving() {
+	var mode string
+	if err := dbConn.QueryRow("SELECT current_setting('archive_mode')").Scan(&mode); err != nil {
+		log.Printf("Warning: failed to read archive_mode: %v", err)
+		return
+	}
+	if mode == "off" {
+		log.Printf("Warning: archive_mode is off on the source, so there may be no archived WAL to recover with.")
+	}
+}
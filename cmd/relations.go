@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/heap"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"db-delta-tracker/pkg/config"
+)
+
+// a parent/child link between two tables, either a foreign key declared on
+// the source or one configured under relations:
+type relation struct {
+	config.Relation
+	name string // the constraint's name; empty for a configured relation
+}
+
+func (r relation) String() string {
+	if r.name == "" {
+		return fmt.Sprintf("%s.%s -> %s.%s (configured)", r.Child, r.Column, r.Parent, r.ParentColumn)
+	}
+	return fmt.Sprintf("%s.%s -> %s.%s (%s)", r.Child, r.Column, r.Parent, r.ParentColumn, r.name)
+}
+
+// the single-column foreign keys declared in the public schema of db,
+// followed by the relations configured for the schema's undeclared ones
+func loadRelations(db *sql.DB) ([]relation, error) {
+	rows, err := db.Query(`
+		SELECT c.conname, ch.relname, a.attname, pa.relname, af.attname
+		FROM pg_constraint c
+		JOIN pg_class ch ON ch.oid = c.conrelid
+		JOIN pg_class pa ON pa.oid = c.confrelid
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = c.conkey[1]
+		JOIN pg_attribute af ON af.attrelid = c.confrelid AND af.attnum = c.confkey[1]
+		WHERE c.contype = 'f' AND array_length(c.conkey, 1) = 1
+		  AND c.connamespace = 'public'::regnamespace
+		ORDER BY ch.relname, c.conname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up foreign keys: %v", err)
+	}
+	defer rows.Close()
+
+	var relations []relation
+	for rows.Next() {
+		var r relation
+		if err := rows.Scan(&r.name, &r.Child, &r.Column, &r.Parent, &r.ParentColumn); err != nil {
+			return nil, fmt.Errorf("failed to scan foreign key: %v", err)
+		}
+		relations = append(relations, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to look up foreign keys: %v", err)
+	}
+
+	for _, r := range cfg.Relations {
+		relations = append(relations, relation{Relation: r})
+	}
+	return relations, nil
+}
+
+// a parent row as referenced through a relation: the parent table and
+// column, and the key value
+type relationKey struct {
+	table, column, value string
+}
+
+// reorder deltas so no row is written before the parent it references
+// exists, and no parent is removed before the children pointing at it are.
+// Squashing can break both, since a squashed delta keeps the position of the
+// first delta in its chain. Otherwise the order is kept; deltas caught in a
+// cycle keep their place relative to each other.
+func orderByRelations(deltas []Delta, relations []relation) ([]Delta, error) {
+	if len(relations) == 0 || len(deltas) == 0 {
+		return deltas, nil
+	}
+	children := make(map[string][]relation)
+	parents := make(map[string][]relation)
+	for _, r := range relations {
+		children[r.Child] = append(children[r.Child], r)
+		parents[r.Parent] = append(parents[r.Parent], r)
+	}
+
+	// where each parent key appears (inserted, or updated into) and each
+	// child reference is let go of (deleted, or updated away)
+	appears := make(map[relationKey][]int)
+	released := make(map[relationKey][]int)
+	oldRows := make([]map[string]interface{}, len(deltas))
+	newRows := make([]map[string]interface{}, len(deltas))
+	for i, delta := range deltas {
+		var err error
+		if oldRows[i], err = decodePayload(delta.OldData); err != nil {
+			return nil, fmt.Errorf("error unmarshalling old_data of delta %d: %v", delta.ID, err)
+		}
+		if newRows[i], err = decodePayload(delta.NewData); err != nil {
+			return nil, fmt.Errorf("error unmarshalling new_data of delta %d: %v", delta.ID, err)
+		}
+		for _, r := range parents[delta.TableName] {
+			if key, ok := keyOf(r, r.ParentColumn, newRows[i]); ok {
+				appears[key] = append(appears[key], i)
+			}
+		}
+		for _, r := range children[delta.TableName] {
+			if key, ok := keyOf(r, r.Column, oldRows[i]); ok {
+				released[key] = append(released[key], i)
+			}
+		}
+	}
+
+	// after[j] lists the deltas that have to wait for delta j
+	after := make([][]int, len(deltas))
+	waits := make([]int, len(deltas))
+	edge := func(first, then int) {
+		after[first] = append(after[first], then)
+		waits[then]++
+	}
+	for i := range deltas {
+		table := deltas[i].TableName
+
+		// a child written before its parent is: wait for the parent
+		for _, r := range children[table] {
+			key, ok := keyOf(r, r.Column, newRows[i])
+			if !ok || anyBefore(appears[key], i) {
+				continue
+			}
+			if j, ok := firstAfter(appears[key], i); ok {
+				edge(j, i)
+			}
+		}
+
+		// a parent removed while children still point at it: let them go first
+		for _, r := range parents[table] {
+			key, ok := keyOf(r, r.ParentColumn, oldRows[i])
+			if !ok {
+				continue
+			}
+			if newKey, ok := keyOf(r, r.ParentColumn, newRows[i]); ok && newKey == key {
+				continue
+			}
+			for _, j := range released[key] {
+				if j > i {
+					edge(j, i)
+				}
+			}
+		}
+	}
+
+	// stable topological sort: of the deltas free to go, the earliest goes first
+	ready := &indexHeap{}
+	for i := range deltas {
+		if waits[i] == 0 {
+			heap.Push(ready, i)
+		}
+	}
+	ordered := make([]Delta, 0, len(deltas))
+	placed := make([]bool, len(deltas))
+	for ready.Len() > 0 {
+		i := heap.Pop(ready).(int)
+		ordered = append(ordered, deltas[i])
+		placed[i] = true
+		for _, j := range after[i] {
+			if waits[j]--; waits[j] == 0 {
+				heap.Push(ready, j)
+			}
+		}
+	}
+	if len(ordered) < len(deltas) {
+		log.Printf("Warning: %d deltas depend on each other in a cycle; applying them in their original order.", len(deltas)-len(ordered))
+		for i, delta := range deltas {
+			if !placed[i] {
+				ordered = append(ordered, delta)
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// the parent key a row of either end of r holds in column, if it holds one
+func keyOf(r relation, column string, row map[string]interface{}) (relationKey, bool) {
+	value, ok := row[column]
+	if !ok || value == nil {
+		return relationKey{}, false
+	}
+	return relationKey{r.Parent, r.ParentColumn, fmt.Sprint(value)}, true
+}
+
+// the first position in the ascending list that comes after i
+func firstAfter(positions []int, i int) (int, bool) {
+	for _, p := range positions {
+		if p > i {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// whether the ascending list has a position before i
+func anyBefore(positions []int, i int) bool {
+	return len(positions) > 0 && positions[0] < i
+}
+
+// a min-heap of delta positions
+type indexHeap []int
+
+func (h indexHeap) Len() int            { return len(h) }
+func (h indexHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h indexHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *indexHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *indexHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+)
+
+// the action of the deltas init's event trigger records when a tracked table
+// is renamed (see restore.RenameAction)
+const renameAction = restore.RenameAction
+
+// the names a RENAME delta moves a table between
+func renamedTables(delta Delta) (from, to string, err error) {
+	return restore.RenamedTables(delta)
+}
+
+// rename a table on a target the way it was renamed on the source; nothing
+// is done if the target doesn't have the old table or already has the new
+// one, e.g. when several merged shards rename the same table. target names
+// the database for the replay log.
+func applyRename(conn *sql.DB, target string, delta Delta) (bool, error) {
+	from, to, err := renamedTables(delta)
+	if err != nil {
+		return false, err
+	}
+	if !tableExists(conn, from) || tableExists(conn, to) {
+		log.Printf("Not renaming %s to %s on the target: it has no %s or already has %s.", from, to, from, to)
+		return false, nil
+	}
+	if ok, err := canAlterTable(conn, from); err != nil {
+		return false, err
+	} else if !ok {
+		skipOperation("renaming %s to %s (the login doesn't own %s)", from, to, from)
+		return false, nil
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s RENAME TO %s", ident.Quote(from), ident.Quote(to))
+	err = recordStatement(target, delta.ID, query, nil, func() (sql.Result, error) {
+		return lockWatcher.run(conn, target, delta, func(ctx context.Context) (sql.Result, error) {
+			return conn.ExecContext(ctx, query)
+		})
+	})
+	if err == errLockSkipped {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error renaming %s to %s: %v", from, to, err)
+	}
+	return true, nil
+}
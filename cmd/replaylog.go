@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// one statement a restore ran, as recorded in the -replay-log file
+type replayEntry struct {
+	Time       time.Time     `json:"time"`
+	DeltaID    int64         `json:"delta_id,omitempty"` // the delta it applied; 0 for commits
+	Target     string        `json:"target"`             // database it ran on
+	Query      string        `json:"query"`
+	Args       []interface{} `json:"args,omitempty"`
+	DurationMS float64       `json:"duration_ms"`
+	Rows       int64         `json:"rows"` // rows affected
+	Error      string        `json:"error,omitempty"`
+}
+
+// the open -replay-log file; nil when statements are only echoed
+var replayLog *os.File
+
+// start a replay log at path, appending to it if it exists
+func openReplayLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open replay log: %v", err)
+	}
+	replayLog = f
+	return nil
+}
+
+func closeReplayLog() error {
+	if replayLog == nil {
+		return nil
+	}
+	err := replayLog.Close()
+	replayLog = nil
+	return err
+}
+
+// run a statement, echo it to the progress output and record it with its
+// outcome in the replay log; a log that can't be written fails the statement,
+// since the log would no longer say what was applied
+func recordStatement(target string, deltaID int64, query string, args []interface{}, run func() (sql.Result, error)) error {
+	logStatement(query, args)
+	start := time.Now()
+	res, err := run()
+	if replayLog == nil {
+		return err
+	}
+
+	entry := replayEntry{
+		Time:       start.UTC(),
+		DeltaID:    deltaID,
+		Target:     target,
+		Query:      query,
+		Args:       args,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if res != nil {
+		entry.Rows, _ = res.RowsAffected()
+	}
+	line, merr := json.Marshal(entry)
+	if merr == nil {
+		_, merr = replayLog.Write(append(line, '\n'))
+	}
+	if merr != nil && err == nil {
+		err = fmt.Errorf("failed to write replay log: %v", merr)
+	}
+	return err
+}
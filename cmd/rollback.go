@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// roll a single table on the source back to an earlier point in time
+func runRollbackTable(args []string) {
+	fs := flag.NewFlagSet("rollback-table", flag.ExitOnError)
+	to := fs.String("to", "", "RFC 3339 timestamp to roll the table back to")
+	dryRun := fs.Bool("dry-run", false, "print the inverse statements without applying them")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 || *to == "" {
+		usagef("Usage: rollback-table <table> --to <timestamp> [--dry-run]")
+	}
+	if readOnly && !*dryRun {
+		usagef("-read-only requires --dry-run, since a rollback writes to the table")
+	}
+	table := positional[0]
+
+	target, err := time.Parse(time.RFC3339, *to)
+	if err != nil {
+		usagef("Invalid --to timestamp %q: %v", *to, err)
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	result, err := rollbackTable(table, target, *dryRun)
+	if err != nil {
+		fatal(err, "Error rolling back table "+table)
+	}
+	outputFormat.Print(result, func() {})
+}
+
+// what rollback-table did, or with --dry-run would have done
+type rollbackResult struct {
+	Table      string              `json:"table"`
+	To         time.Time           `json:"to"`
+	DryRun     bool                `json:"dry_run"`
+	Statements []rollbackStatement `json:"statements"` // newest change first
+}
+
+type rollbackStatement struct {
+	Query  string        `json:"query"`
+	Values []interface{} `json:"values"`
+}
+
+// undo every change made to a table after the given time by applying the
+// inverse of its deltas, newest first, in a single transaction on the source
+func rollbackTable(table string, to time.Time, dryRun bool) (rollbackResult, error) {
+	result := rollbackResult{Table: table, To: to, DryRun: dryRun, Statements: []rollbackStatement{}}
+	// deltas masked at capture only hold what masking left of the values
+	if cfg.Mask.Capturing() && len(cfg.Mask.Columns.For(table)) > 0 {
+		return result, fmt.Errorf("%s has columns masked at capture; rolling it back would write the masked values into %s", table, dbName)
+	}
+	if err := warnForeignKeys(table); err != nil {
+		return result, err
+	}
+
+	rows, err := dbConn.Query(`
+		SELECT action, table_name, old_data, new_data, timestamp, COALESCE(txid, 0)
+		FROM deltas
+		WHERE table_name = $1 AND timestamp > $2
+		ORDER BY timestamp DESC, id DESC
+	`, table, to)
+	if err != nil {
+		return result, fmt.Errorf("error fetching deltas: %v", err)
+	}
+
+	var deltas []Delta
+	for rows.Next() {
+		var delta Delta
+		if err := rows.Scan(&delta.Action, &delta.TableName, &delta.OldData, &delta.NewData, &delta.Timestamp, &delta.TxID); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("error scanning delta: %v", err)
+		}
+		deltas = append(deltas, delta)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+
+	if len(deltas) == 0 {
+		log.Printf("No changes to %s after %s, nothing to roll back.", table, to.Format(time.RFC3339))
+		return result, nil
+	}
+
+	// rows are found by the table's primary key, or on all their columns
+	// if it has none
+	key, err := restore.RowKey(context.Background(), dbConn, table)
+	if err != nil {
+		return result, err
+	}
+	builder := restore.NewBuilder(dbConn)
+	builder.SkipAmbiguous(cfg.Keyless.Skip())
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, delta := range deltas {
+		query, values, err := inverseStatement(delta, key, builder)
+		if err != nil {
+			return result, err
+		}
+
+		fmt.Fprintf(outputFormat.Progress(), "Executing query: %s\n", query)
+		fmt.Fprintf(outputFormat.Progress(), "         With values: %v\n", values)
+		result.Statements = append(result.Statements, rollbackStatement{query, values})
+
+		if dryRun {
+			continue
+		}
+		if _, err := tx.Exec(query, values...); err != nil {
+			return result, fmt.Errorf("error applying inverse of %s from %s: %v", delta.Action, delta.Timestamp.Format(time.RFC3339Nano), err)
+		}
+	}
+
+	if dryRun {
+		log.Printf("Dry run: %d inverse statements for %s were not applied.", len(deltas), table)
+		return result, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit rollback: %v", err)
+	}
+
+	log.Printf("Table %s rolled back to %s (%d deltas undone).", table, to.Format(time.RFC3339), len(deltas))
+	return result, nil
+}
+
+// build the statement that reverses a single delta, finding its row by the
+// given key columns, or through builder on all its columns without a key
+func inverseStatement(delta Delta, key []string, builder *restore.Builder) (string, []interface{}, error) {
+	oldData, err := decodePayload(delta.OldData)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshalling old_data: %v", err)
+	}
+	newData, err := decodePayload(delta.NewData)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshalling new_data: %v", err)
+	}
+
+	switch delta.Action {
+	case renameAction:
+		from, _, err := renamedTables(delta)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("%s was renamed from %s at %s; roll back to a time after the rename", delta.TableName, from, delta.Timestamp.Format(time.RFC3339))
+	case "INSERT":
+		// the row was created, so remove it
+		if len(key) == 0 {
+			return builder.DeleteRow(context.Background(), delta.TableName, newData)
+		}
+		current, err := restore.KeyOf(key, newData)
+		if err != nil {
+			return "", nil, err
+		}
+		query, values := deleteByKey(delta.TableName, current)
+		return query, values, nil
+	case "UPDATE":
+		// put the previous values back on the current row
+		if len(key) == 0 {
+			return builder.UpdateRow(context.Background(), delta.TableName, oldData, newData)
+		}
+		current, err := restore.KeyOf(key, newData)
+		if err != nil {
+			return "", nil, err
+		}
+		query, values := updateByKey(delta.TableName, oldData, current)
+		return query, values, nil
+	case "DELETE":
+		// the row was removed, so recreate it
+		query, values := insertStatement(delta.TableName, oldData)
+		return query, values, nil
+	}
+	return "", nil, fmt.Errorf("unknown delta action %q", delta.Action)
+}
+
+// decode a delta payload, treating a SQL NULL as an empty row; numbers are
+// json.Number, so bigint and numeric values keep every digit
+func decodePayload(raw *json.RawMessage) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	return tracker.DecodeRow(*raw)
+}
+
+// warn about foreign keys between the table and others, since only this
+// table is rolled back and related rows are left as they are now
+func warnForeignKeys(table string) error {
+	rows, err := dbConn.Query(`
+		SELECT c.conname, ch.relname, pa.relname
+		FROM pg_constraint c
+		JOIN pg_class ch ON ch.oid = c.conrelid
+		JOIN pg_class pa ON pa.oid = c.confrelid
+		WHERE c.contype = 'f' AND (c.conrelid = $1::regclass OR c.confrelid = $1::regclass)
+	`, ident.Quote(table))
+	if err != nil {
+		return fmt.Errorf("failed to look up foreign keys for %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, child, parent string
+		if err := rows.Scan(&name, &child, &parent); err != nil {
+			return fmt.Errorf("failed to scan foreign key: %v", err)
+		}
+
+		if child == table {
+			log.Printf("Warning: %s references %s (%s); restored rows may point at %s rows that no longer exist.", child, parent, name, parent)
+		}
+		if parent == table {
+			log.Printf("Warning: %s is referenced by %s (%s); removed rows may leave orphans in %s.", parent, child, name, child)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to look up foreign keys for %s: %v", table, err)
+	}
+
+	// the same for the relations only the config knows about
+	for _, r := range cfg.Relations {
+		if r.Child == table {
+			log.Printf("Warning: %s references %s (configured relation on %s); restored rows may point at %s rows that no longer exist.", r.Child, r.Parent, r.Column, r.Parent)
+		}
+		if r.Parent == table {
+			log.Printf("Warning: %s is referenced by %s (configured relation on %s); removed rows may leave orphans in %s.", r.Parent, r.Child, r.Column, r.Child)
+		}
+	}
+	return nil
+}
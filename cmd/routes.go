@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/restore"
+)
+
+// the databases a restore writes to: one per route in the config, and the
+// target for every table no route matches
+type replayTargets struct {
+	routes   []config.Route
+	conns    []*sql.DB // one per route
+	fallback *sql.DB
+	builders map[*sql.DB]*restore.Builder
+}
+
+// connect to every routed database; fallback is the already open target
+func openReplayTargets(fallback *sql.DB) (*replayTargets, error) {
+	t := &replayTargets{routes: cfg.Routes, fallback: fallback, builders: make(map[*sql.DB]*restore.Builder)}
+	for _, route := range cfg.Routes {
+		db, err := openReplayConn(route.Target)
+		if err == nil {
+			err = db.Ping()
+		}
+		if err != nil {
+			t.Close()
+			return nil, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to routed database %s: %v", route.Target.DBName, err))
+		}
+		t.conns = append(t.conns, db)
+	}
+	return t, nil
+}
+
+// the connection a table's deltas are applied through
+func (t *replayTargets) connFor(table string) *sql.DB {
+	for i, route := range t.routes {
+		if route.Matches(table) {
+			return t.conns[i]
+		}
+	}
+	return t.fallback
+}
+
+// the name of the database a table's deltas go to, for reporting
+func (t *replayTargets) nameFor(table string) string {
+	for _, route := range t.routes {
+		if route.Matches(table) {
+			return route.Target.DBName
+		}
+	}
+	return cfg.Target.DBName
+}
+
+// the name of the database a connection goes to, for reporting
+func (t *replayTargets) nameOf(conn *sql.DB) string {
+	for i, db := range t.conns {
+		if db == conn {
+			return t.routes[i].Target.DBName
+		}
+	}
+	return cfg.Target.DBName
+}
+
+// the builder fitting statements to the tables behind a connection
+func (t *replayTargets) builder(conn *sql.DB) *restore.Builder {
+	b, ok := t.builders[conn]
+	if !ok {
+		b = restore.NewBuilder(conn)
+		b.SkipAmbiguous(cfg.Keyless.Skip())
+		t.builders[conn] = b
+	}
+	return b
+}
+
+// the row keys left out of replayed statements because the restored table
+// has no such column, by table and column, with how many values each lost
+func (t *replayTargets) skippedColumns() map[string]map[string]int {
+	skipped := make(map[string]map[string]int)
+	for _, b := range t.builders {
+		for table, columns := range b.Skipped() {
+			skipped[table] = columns
+		}
+	}
+	return skipped
+}
+
+// every database deltas may be applied to, the fallback first
+func (t *replayTargets) all() []*sql.DB {
+	return append([]*sql.DB{t.fallback}, t.conns...)
+}
+
+// close the routed connections; the fallback belongs to the caller
+func (t *replayTargets) Close() {
+	for _, db := range t.conns {
+		db.Close()
+	}
+}
+
+// split deltas by the connection they are applied through
+func (t *replayTargets) group(deltas []Delta) map[*sql.DB][]Delta {
+	groups := make(map[*sql.DB][]Delta)
+	for _, delta := range deltas {
+		conn := t.connFor(delta.TableName)
+		groups[conn] = append(groups[conn], delta)
+	}
+	return groups
+}
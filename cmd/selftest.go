@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/exitcode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the tables selftest creates and changes
+var selftestTables = []string{"selftest_people", "selftest_pets"}
+
+// run init, a random workload, restore and a comparison against scratch
+// databases on the configured servers, to check the environment and the
+// binaries work end to end
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	initBinary := fs.String("init", "", "path to the init program (default: delta-tracker-init next to this program, then on PATH)")
+	operations := fs.Int("operations", 500, "number of random inserts, updates and deletes to replay")
+	seed := fs.Int64("seed", 0, "seed for the random workload, to repeat a failed run (0 = random)")
+	keep := fs.Bool("keep", false, "keep the scratch databases afterwards for inspection")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := loadConfig(); err != nil {
+		fatal(err, "Error loading config")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("Self-test workload seed: %d", *seed)
+
+	results, code := selftest(*initBinary, *operations, *seed, *keep)
+	report := struct {
+		OK     bool          `json:"ok"`
+		Seed   int64         `json:"seed"`
+		Checks []checkResult `json:"checks"`
+	}{code == exitcode.OK, *seed, results}
+	outputFormat.Print(report, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STEP\tRESULT\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+		}
+		w.Flush()
+	})
+	if code != exitcode.OK {
+		os.Exit(code)
+	}
+}
+
+// run every step, stopping at the first failure, and pick the exit status
+func selftest(initBinary string, operations int, seed int64, keep bool) ([]checkResult, int) {
+	source := cfg.Source.WithDatabase(fmt.Sprintf("delta_selftest_%d", time.Now().Unix()))
+	target := cfg.Target.WithDatabase(source.DBName + "_restored")
+
+	initPath, err := findInitBinary(initBinary)
+	if err != nil {
+		return []checkResult{fail("init program", err.Error())}, exitcode.Usage
+	}
+	results := []checkResult{pass("init program", initPath)}
+
+	// scratch databases are created and dropped from the maintenance database
+	admin, err := source.WithDatabase("postgres").Open()
+	if err == nil {
+		err = admin.Ping()
+	}
+	if err != nil {
+		return append(results, fail("scratch database", err.Error())), exitcode.Connection
+	}
+	defer admin.Close()
+
+	if _, err := admin.Exec("CREATE DATABASE " + source.DBName); err != nil {
+		return append(results, fail("scratch database", err.Error())), exitcode.Failure
+	}
+	if !keep {
+		defer func() {
+			dropDatabase(admin, source.DBName)
+			if targetAdmin, err := target.WithDatabase("postgres").Open(); err == nil {
+				dropDatabase(targetAdmin, target.DBName)
+				targetAdmin.Close()
+			}
+		}()
+	}
+	results = append(results, pass("scratch database", fmt.Sprintf("%s, restored into %s", source.DBName, target.DBName)))
+
+	dir, err := os.MkdirTemp("", "delta-selftest")
+	if err != nil {
+		return append(results, fail("scratch config", err.Error())), exitcode.Failure
+	}
+	defer os.RemoveAll(dir)
+	scratchConfig, err := writeSelftestConfig(dir, source, target)
+	if err != nil {
+		return append(results, fail("scratch config", err.Error())), exitcode.Failure
+	}
+
+	sourceConn, err := source.Open()
+	if err == nil {
+		err = createSelftestTables(sourceConn)
+	}
+	if err != nil {
+		return append(results, fail("sample tables", err.Error())), exitcode.Failure
+	}
+	defer sourceConn.Close()
+	results = append(results, pass("sample tables", fmt.Sprintf("%v", selftestTables)))
+
+	if err := runTool(initPath, "-config", scratchConfig, "-profile="); err != nil {
+		return append(results, fail("init", err.Error())), exitcode.Failure
+	}
+	results = append(results, pass("init", "triggers installed, tables copied"))
+
+	applied, err := runSelftestWorkload(sourceConn, rand.New(rand.NewSource(seed)), operations)
+	if err != nil {
+		return append(results, fail("workload", err.Error())), exitcode.Failure
+	}
+	results = append(results, pass("workload", fmt.Sprintf("%d changes in random transactions", applied)))
+
+	self, err := os.Executable()
+	if err == nil {
+		err = runTool(self, "restore", "-config", scratchConfig, "-profile=", "-skip-preflight")
+	}
+	if err != nil {
+		return append(results, fail("restore", err.Error())), exitcode.Failure
+	}
+	results = append(results, pass("restore", "deltas replayed"))
+
+	targetConn, err := target.Open()
+	if err != nil {
+		return append(results, fail("verify", err.Error())), exitcode.Failure
+	}
+	defer targetConn.Close()
+	for _, table := range selftestTables {
+		name := "verify " + table
+		same, rows, err := compareTables(sourceConn, targetConn, table)
+		switch {
+		case err != nil:
+			return append(results, fail(name, err.Error())), exitcode.Failure
+		case !same:
+			return append(results, fail(name, "restored rows differ from the source")), exitcode.Mismatch
+		}
+		results = append(results, pass(name, fmt.Sprintf("%d rows match", rows)))
+	}
+	return results, exitcode.OK
+}
+
+// find the init program: the -init flag, next to this program, or on PATH
+func findInitBinary(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	if self, err := os.Executable(); err == nil {
+		candidate := filepath.Join(filepath.Dir(self), "delta-tracker-init")
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	if found, err := exec.LookPath("delta-tracker-init"); err == nil {
+		return found, nil
+	}
+	return "", errors.New("delta-tracker-init not found; build it with `go build -o delta-tracker-init ./init` or pass -init")
+}
+
+// write a config pointing both programs at the scratch databases, keeping
+// the configured servers and credentials
+func writeSelftestConfig(dir string, source, target config.Connection) (string, error) {
+	scratch := struct {
+		Source config.Connection `yaml:"source"`
+		Target config.Connection `yaml:"target"`
+		Backup struct {
+			Path string `yaml:"path"`
+		} `yaml:"backup"`
+	}{Source: source, Target: target}
+	scratch.Backup.Path = filepath.Join(dir, "{{.Table}}.json")
+
+	data, err := yaml.Marshal(scratch)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "delta-tracker.yaml")
+	return path, os.WriteFile(path, data, 0600)
+}
+
+func createSelftestTables(db *sql.DB) error {
+	for _, table := range selftestTables {
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE %s (id SERIAL PRIMARY KEY, name TEXT, age INT);
+			INSERT INTO %s (name, age) SELECT 'seed ' || n, n FROM generate_series(1, 20) n;
+		`, table, table))
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// make random inserts, updates and deletes in transactions of one to five
+// changes, returning how many changes were made
+func runSelftestWorkload(db *sql.DB, rng *rand.Rand, operations int) (int, error) {
+	made := 0
+	for made < operations {
+		tx, err := db.Begin()
+		if err != nil {
+			return made, err
+		}
+		for n := 1 + rng.Intn(5); n > 0 && made < operations; n-- {
+			table := selftestTables[rng.Intn(len(selftestTables))]
+			name, age := fmt.Sprintf("person %d", rng.Intn(1000000)), rng.Intn(100)
+			switch p := rng.Intn(10); {
+			case p < 5:
+				_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (name, age) VALUES ($1, $2)", table), name, age)
+			case p < 8:
+				_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET name = $1, age = $2 WHERE id = %s", table, pickRow(table, 3)), name, age, rng.Float64())
+			default:
+				_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = %s", table, pickRow(table, 1)), rng.Float64())
+			}
+			if err != nil {
+				tx.Rollback()
+				return made, err
+			}
+			made++
+		}
+		if err := tx.Commit(); err != nil {
+			return made, err
+		}
+	}
+	return made, nil
+}
+
+// a subquery picking an existing row's id from a fraction in [0, 1) bound to
+// parameter n, so the seed alone decides which rows change
+func pickRow(table string, n int) string {
+	return fmt.Sprintf("(SELECT id FROM %s ORDER BY id OFFSET floor($%d::float8 * (SELECT count(*) FROM %s)) LIMIT 1)", table, n, table)
+}
+
+// compare a table's rows in two databases, returning the number of rows
+func compareTables(a, b *sql.DB, table string) (bool, int, error) {
+	query := fmt.Sprintf("SELECT COUNT(*), COALESCE(json_agg(t ORDER BY id), '[]')::text FROM %s t", table)
+	var countA, countB int
+	var rowsA, rowsB string
+	if err := a.QueryRow(query).Scan(&countA, &rowsA); err != nil {
+		return false, 0, fmt.Errorf("failed to read source rows: %v", err)
+	}
+	if err := b.QueryRow(query).Scan(&countB, &rowsB); err != nil {
+		return false, 0, fmt.Errorf("failed to read restored rows: %v", err)
+	}
+	return countA == countB && rowsA == rowsB, countA, nil
+}
+
+// run one of the programs, failing with the last line it logged; -profile=
+// keeps a DELTA_TRACKER_PROFILE meant for the real config from applying
+func runTool(path string, args ...string) error {
+	var lastLine lastLineWriter
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = io.MultiWriter(os.Stderr, &lastLine)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", filepath.Base(path), err, lastLine.String())
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"db-delta-tracker/pkg/ident"
+
+	"github.com/lib/pq"
+)
+
+// a restored sequence moved up to the source's value
+type sequenceSync struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Value  int64  `json:"value"`
+}
+
+// move the sequences behind serial and identity columns of the restored
+// tables up to the values their counterparts on the source have reached, so
+// rows inserted into the restored database don't take ids the restored rows
+// already use. A sequence already further along is left where it is; only
+// tables is synced when given.
+func syncSequences(targets *replayTargets, tables []string) ([]sequenceSync, error) {
+	rows, err := dbConn.Query(`
+		SELECT t.relname, a.attname, s.last_value
+		FROM pg_sequences s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class sc ON sc.relnamespace = n.oid AND sc.relname = s.sequencename
+		JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = sc.oid
+			AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')
+		JOIN pg_class t ON t.oid = d.refobjid
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+		WHERE s.schemaname = 'public' AND s.last_value IS NOT NULL
+		ORDER BY t.relname, a.attname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the source's sequences: %v", err)
+	}
+	var sources []sequenceSync
+	for rows.Next() {
+		var s sequenceSync
+		if err := rows.Scan(&s.Table, &s.Column, &s.Value); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan a sequence: %v", err)
+		}
+		if len(tables) == 0 || containsString(tables, s.Table) {
+			sources = append(sources, s)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the source's sequences: %v", err)
+	}
+
+	synced := []sequenceSync{}
+	for _, s := range sources {
+		conn := targets.connFor(s.Table)
+		if !tableExists(conn, s.Table) {
+			continue
+		}
+		var sequence *string
+		if err := conn.QueryRow("SELECT pg_get_serial_sequence($1, $2)", ident.Quote(s.Table), s.Column).Scan(&sequence); err != nil {
+			return synced, fmt.Errorf("failed to find the sequence of %s.%s: %v", s.Table, s.Column, err)
+		}
+		if sequence == nil {
+			continue
+		}
+		var value int64
+		err := conn.QueryRow(fmt.Sprintf("SELECT setval($1, GREATEST($2, (SELECT last_value FROM %s)))", *sequence), *sequence, s.Value).Scan(&value)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "42501" {
+			skipOperation("syncing sequence %s on %s (the login may not update it)", *sequence, targets.nameFor(s.Table))
+			continue
+		}
+		if err != nil {
+			return synced, fmt.Errorf("failed to sync sequence %s: %v", *sequence, err)
+		}
+		s.Value = value
+		synced = append(synced, s)
+	}
+	if len(synced) > 0 {
+		log.Printf("Moved %d sequences up to the source's values.", len(synced))
+	}
+	return synced, nil
+}
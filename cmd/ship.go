@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/exitcode"
+)
+
+// what a restore with -ship-to sent, alongside the usual counts
+type shipStats struct {
+	Receiver     string `json:"receiver"`
+	ResumedAfter int64  `json:"resumed_after,omitempty"` // the delta the receiver had already applied up to
+	Deltas       int    `json:"deltas"`
+	Batches      int    `json:"batches"`
+	Bytes        int64  `json:"bytes"` // compressed, as sent
+}
+
+// talks to a receiver started with `receive`
+type shipClient struct {
+	url     string
+	token   string
+	retries int
+	http    *http.Client
+}
+
+// send the deltas a restore would replay to a receiver near the target, in
+// gzipped batches, instead of replaying them from here. The receiver keeps
+// its position in the target, so a shipment that is cut off, or run again,
+// starts after the last delta the receiver applied.
+func shipDeltas(opts restoreOptions, to, token string, batchSize, retries int) (restoreResult, error) {
+	result := restoreResult{Quarantined: []Delta{}}
+	client := &shipClient{url: strings.TrimSuffix(to, "/"), token: token, retries: retries, http: &http.Client{Timeout: 10 * time.Minute}}
+	result.Shipped = &shipStats{Receiver: client.url}
+
+	deltas, quarantined, err := selectDeltas(opts, &result)
+	defer printQuarantined(quarantined)
+	if err != nil {
+		return result, err
+	}
+
+	pos, err := client.position()
+	if err != nil {
+		return result, err
+	}
+	start, err := resumeAt(deltas, pos)
+	if err != nil {
+		return result, err
+	}
+	if start > 0 {
+		result.Shipped.ResumedAfter = pos.LastID
+		log.Printf("The receiver has applied up to delta %d; shipping the %d deltas after it.", pos.LastID, len(deltas)-start)
+	}
+
+	applied := pos.Applied
+	for start < len(deltas) {
+		end := min(start+batchSize, len(deltas))
+		after := int64(0)
+		if start > 0 {
+			after = deltas[start-1].ID
+		}
+		body, err := encodeBatch(deltas[start:end])
+		if err != nil {
+			return result, err
+		}
+
+		next, err := client.send(after, body)
+		var conflict *shipConflict
+		if errors.As(err, &conflict) {
+			// the receiver is elsewhere in the stream, e.g. it applied a
+			// batch whose response was lost
+			if start, err = resumeAt(deltas, conflict.pos); err != nil {
+				return result, err
+			}
+			applied = conflict.pos.Applied
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Shipped.Batches++
+		result.Shipped.Deltas += end - start
+		result.Shipped.Bytes += int64(len(body))
+		result.Applied += int(next.Applied - applied)
+		result.Skipped += next.Skipped
+		applied = next.Applied
+		start = end
+		log.Printf("Shipped %d of %d deltas.", start, len(deltas))
+	}
+	return result, nil
+}
+
+// where in deltas to carry on from, given the receiver's position
+func resumeAt(deltas []Delta, pos receivePosition) (int, error) {
+	if pos.LastID == 0 {
+		return 0, nil
+	}
+	for i, delta := range deltas {
+		if delta.ID == pos.LastID {
+			return i + 1, nil
+		}
+	}
+	return 0, exitcode.Wrap(exitcode.Conflict, fmt.Errorf("the receiver has applied up to delta %d, which isn't among the deltas to ship; was it set up for another restore?", pos.LastID))
+}
+
+// gzip a batch of deltas
+func encodeBatch(deltas []Delta) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := shipCodec.NewEncoder(zw)
+	for _, delta := range deltas {
+		if err := enc.Encode(delta); err != nil {
+			return nil, fmt.Errorf("failed to encode delta %d: %v", delta.ID, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress batch: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// the receiver was not where the batch followed on from
+type shipConflict struct {
+	pos receivePosition
+}
+
+func (c *shipConflict) Error() string {
+	return fmt.Sprintf("the receiver is at delta %d", c.pos.LastID)
+}
+
+// the receiver's position
+func (c *shipClient) position() (receivePosition, error) {
+	var pos receivePosition
+	err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.url+"/position", nil)
+	}, &pos)
+	return pos, err
+}
+
+// send a batch following the delta with id after, returning the receiver's
+// new position
+func (c *shipClient) send(after int64, body []byte) (receivePosition, error) {
+	var pos receivePosition
+	err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.url+"/batches", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			req.Header.Set("Content-Encoding", "gzip")
+			req.Header.Set("X-After-Delta", strconv.FormatInt(after, 10))
+		}
+		return req, err
+	}, &pos)
+	return pos, err
+}
+
+// make a request, retrying with backoff while the receiver can't be reached
+// or is unavailable, and decode its JSON answer into v
+func (c *shipClient) do(newRequest func() (*http.Request, error), v interface{}) error {
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.http.Do(req)
+		if err == nil {
+			data, rerr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case rerr != nil:
+				err = rerr
+			case resp.StatusCode == http.StatusOK:
+				return json.Unmarshal(data, v)
+			case resp.StatusCode == http.StatusConflict:
+				conflict := &shipConflict{}
+				if err := json.Unmarshal(data, &conflict.pos); err != nil {
+					return fmt.Errorf("failed to read the receiver's position: %v", err)
+				}
+				return conflict
+			case resp.StatusCode < 500:
+				// e.g. a delta that fails to apply, which no retry will change
+				return fmt.Errorf("the receiver refused the request (%s): %s", resp.Status, strings.TrimSpace(string(data)))
+			default:
+				err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+			}
+		}
+		if attempt >= c.retries {
+			return exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to reach the receiver at %s: %v", c.url, err))
+		}
+		log.Printf("Warning: receiver at %s: %v; retrying in %s.", c.url, err, wait)
+		time.Sleep(wait)
+		wait = min(wait*2, 30*time.Second)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// a txid_current_snapshot() value; transactions visible in it are already
+// contained in the table copy that was read at that snapshot
+type txSnapshot struct {
+	xmin int64
+	xmax int64
+	xip  map[int64]bool // in progress when the snapshot was taken
+}
+
+// parse the xmin:xmax:xip,... text form of a transaction snapshot
+func parseTxSnapshot(value string) (txSnapshot, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return txSnapshot{}, fmt.Errorf("invalid transaction snapshot %q", value)
+	}
+
+	var snap txSnapshot
+	var err error
+	if snap.xmin, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return txSnapshot{}, fmt.Errorf("invalid transaction snapshot %q: %v", value, err)
+	}
+	if snap.xmax, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return txSnapshot{}, fmt.Errorf("invalid transaction snapshot %q: %v", value, err)
+	}
+
+	snap.xip = make(map[int64]bool)
+	for _, field := range splitList(parts[2]) {
+		txid, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return txSnapshot{}, fmt.Errorf("invalid transaction snapshot %q: %v", value, err)
+		}
+		snap.xip[txid] = true
+	}
+	return snap, nil
+}
+
+// report whether a transaction's changes are visible in the snapshot,
+// the same rule as txid_visible_in_snapshot()
+func (s txSnapshot) contains(txid int64) bool {
+	if txid < s.xmin {
+		return true
+	}
+	if txid >= s.xmax {
+		return false
+	}
+	return !s.xip[txid]
+}
+
+// fetch the most recent re-snapshot of each table, if any were taken
+func loadTableSnapshots() (map[string]txSnapshot, error) {
+	var exists bool
+	if err := dbConn.QueryRow("SELECT to_regclass('delta_tracker.table_snapshots') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up table snapshots: %v", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	rows, err := dbConn.Query(`
+		SELECT DISTINCT ON (table_name) table_name, txid_snapshot
+		FROM delta_tracker.table_snapshots
+		ORDER BY table_name, taken_at DESC, id DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch table snapshots: %v", err)
+	}
+	defer rows.Close()
+
+	snapshots := make(map[string]txSnapshot)
+	for rows.Next() {
+		var tableName, value string
+		if err := rows.Scan(&tableName, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan table snapshot: %v", err)
+		}
+		snap, err := parseTxSnapshot(value)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[tableName] = snap
+	}
+	return snapshots, rows.Err()
+}
+
+// drop deltas whose changes are already part of a table's re-snapshot
+func skipSnapshotted(deltas []Delta) ([]Delta, error) {
+	snapshots, err := loadTableSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return deltas, nil
+	}
+
+	kept := deltas[:0]
+	skipped := 0
+	for _, delta := range deltas {
+		if snap, ok := snapshots[delta.TableName]; ok && snap.contains(delta.TxID) {
+			skipped++
+			continue
+		}
+		kept = append(kept, delta)
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped %d deltas already contained in table re-snapshots.", skipped)
+	}
+	return kept, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// rowKey identifies a single row across its chain of deltas
+type rowKey struct {
+	table string
+	key   string // the key columns' values, JSON encoded
+}
+
+// collapse each row's chain of deltas into its net effect:
+//
+//	INSERT + UPDATE...  -> INSERT with the final values
+//	INSERT + ... DELETE -> nothing
+//	UPDATE + UPDATE...  -> UPDATE from the first old values to the last new ones
+//	UPDATE + ... DELETE -> DELETE of the row as it was before the chain
+//
+// the squashed delta keeps the position of the first delta in its chain, so
+// intermediate states (and ordering between different rows) are not preserved.
+// Rows are told apart by the key columns keyFor gives for their table.
+func squashDeltas(deltas []Delta, keyFor func(table string) ([]string, error)) ([]Delta, error) {
+	out := make([]Delta, 0, len(deltas))
+	dropped := make(map[int]bool)
+
+	// index in out of the pending squashed delta for each live row
+	open := make(map[rowKey]int)
+
+	for _, delta := range deltas {
+		oldData, err := decodePayload(delta.OldData)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling old_data: %v", err)
+		}
+		newData, err := decodePayload(delta.NewData)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling new_data: %v", err)
+		}
+
+		key, err := keyFor(delta.TableName)
+		if err != nil {
+			return nil, err
+		}
+
+		// the row a delta starts from, and the row it leaves behind
+		var from, to string
+		switch delta.Action {
+		case "INSERT":
+			to = keyString(key, newData)
+		case "UPDATE":
+			from, to = keyString(key, oldData), keyString(key, newData)
+		case "DELETE":
+			from = keyString(key, oldData)
+		}
+
+		// rows without a key can't be tracked, so pass them through untouched
+		if (delta.Action != "INSERT" && from == "") || (delta.Action != "DELETE" && to == "") {
+			out = append(out, delta)
+			continue
+		}
+
+		fromKey := rowKey{delta.TableName, from}
+		toKey := rowKey{delta.TableName, to}
+
+		idx, ok := open[fromKey]
+		if delta.Action == "INSERT" || !ok {
+			out = append(out, delta)
+			if delta.Action == "DELETE" {
+				delete(open, fromKey)
+			} else {
+				open[toKey] = len(out) - 1
+			}
+			continue
+		}
+
+		pending := &out[idx]
+		delete(open, fromKey)
+
+		switch delta.Action {
+		case "UPDATE":
+			// INSERT or UPDATE followed by an UPDATE keeps its action with the latest values
+			pending.NewData = delta.NewData
+			open[toKey] = idx
+
+		case "DELETE":
+			if pending.Action == "INSERT" {
+				// the row never existed as far as the target is concerned
+				dropped[idx] = true
+				continue
+			}
+			// delete the row as the target knows it, before the chain of updates
+			pending.Action = "DELETE"
+			pending.NewData = nil
+		}
+	}
+
+	squashed := out[:0]
+	for i, delta := range out {
+		if !dropped[i] {
+			squashed = append(squashed, delta)
+		}
+	}
+	return squashed, nil
+}
+
+// the values a row has for the key columns as one string, or "" if any is
+// missing or null, or the table has no key. Rows come from decodePayload,
+// whose numbers are json.Number, so bigint keys past 2^53 stay distinct.
+func keyString(key []string, row map[string]interface{}) string {
+	if len(key) == 0 {
+		return ""
+	}
+	values := make([]interface{}, len(key))
+	for i, column := range key {
+		if row[column] == nil {
+			return ""
+		}
+		values[i] = row[column]
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
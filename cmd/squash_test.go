@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func rawRow(s string) *json.RawMessage {
+	raw := json.RawMessage(s)
+	return &raw
+}
+
+func TestSquashKeepsLargeKeysApart(t *testing.T) {
+	// 2^53 and 2^53+1 are the same float64
+	deltas := []Delta{
+		{ID: 1, Action: "INSERT", TableName: "t", NewData: rawRow(`{"id":9007199254740992,"v":1}`), Timestamp: time.Unix(1, 0)},
+		{ID: 2, Action: "INSERT", TableName: "t", NewData: rawRow(`{"id":9007199254740993,"v":1}`), Timestamp: time.Unix(2, 0)},
+		{ID: 3, Action: "DELETE", TableName: "t", OldData: rawRow(`{"id":9007199254740992,"v":1}`), Timestamp: time.Unix(3, 0)},
+	}
+	squashed, err := squashDeltas(deltas, func(string) ([]string, error) { return []string{"id"}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(squashed) != 1 || squashed[0].ID != 2 {
+		t.Fatalf("squashed to %+v, want only the insert of 9007199254740993", squashed)
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	for _, tt := range []struct {
+		row  string
+		key  []string
+		want string
+	}{
+		{`{"id":9007199254740993}`, []string{"id"}, `[9007199254740993]`},
+		{`{"a":1,"b":"x"}`, []string{"a", "b"}, `[1,"x"]`},
+		{`{"a":null}`, []string{"a"}, ``},
+		{`{"a":1}`, nil, ``},
+	} {
+		row, err := decodePayload(rawRow(tt.row))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyString(tt.key, row); got != tt.want {
+			t.Errorf("keyString(%v, %s) = %q, want %q", tt.key, tt.row, got, tt.want)
+		}
+	}
+}
+
+// a parent's insert and later update become one insert that must still
+// replay before the child inserted between them
+func TestSquashKeepsFirstPosition(t *testing.T) {
+	deltas := []Delta{
+		{ID: 1, Action: "INSERT", TableName: "parents", NewData: rawRow(`{"id":1,"v":1}`), Timestamp: time.Unix(1, 0), TxID: 10},
+		{ID: 2, Action: "INSERT", TableName: "children", NewData: rawRow(`{"id":1,"parent_id":1}`), Timestamp: time.Unix(2, 0), TxID: 11},
+		{ID: 3, Action: "UPDATE", TableName: "parents", OldData: rawRow(`{"id":1,"v":1}`), NewData: rawRow(`{"id":1,"v":2}`), Timestamp: time.Unix(3, 0), TxID: 12},
+		{ID: 4, Action: "UPDATE", TableName: "children", OldData: rawRow(`{"id":1,"parent_id":1}`), NewData: rawRow(`{"id":1,"parent_id":1}`), Timestamp: time.Unix(4, 0), TxID: 13},
+		{ID: 5, Action: "DELETE", TableName: "children", OldData: rawRow(`{"id":1,"parent_id":1}`), Timestamp: time.Unix(5, 0), TxID: 14},
+	}
+	squashed, err := squashDeltas(deltas, func(string) ([]string, error) { return []string{"id"}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(squashed) != 1 {
+		t.Fatalf("squashed to %+v, want only the parent's insert", squashed)
+	}
+	if got := squashed[0]; got.ID != 1 || !got.Timestamp.Equal(time.Unix(1, 0)) || got.TxID != 10 || string(*got.NewData) != `{"id":1,"v":2}` {
+		t.Errorf("squashed to %+v, want the insert of v 2 at the first delta's time and txid", got)
+	}
+
+	// an update chain ending in a delete is a delete where the chain began
+	squashed, err = squashDeltas(deltas[2:], func(string) ([]string, error) { return []string{"id"}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(squashed) != 2 || squashed[1].Action != "DELETE" || squashed[1].ID != 4 || !squashed[1].Timestamp.Equal(time.Unix(4, 0)) || squashed[1].TxID != 13 {
+		t.Errorf("squashed to %+v, want the child's delete at delta 4's time and txid", squashed)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+
+	"db-delta-tracker/pkg/restore"
+
+	"github.com/lib/pq"
+)
+
+// build an INSERT that writes every column of a row payload
+func insertStatement(table string, row map[string]interface{}) (string, []interface{}) {
+	return restore.Insert(table, row)
+}
+
+// build an UPDATE that sets every column of a row payload on the row whose
+// key columns have the given values
+func updateByKey(table string, row, key map[string]interface{}) (string, []interface{}) {
+	return restore.UpdateByKey(table, row, key)
+}
+
+// build a DELETE for the row whose key columns have the given values
+func deleteByKey(table string, key map[string]interface{}) (string, []interface{}) {
+	return restore.DeleteByKey(table, key)
+}
+
+// whether a statement failed because the old row of a table without a key
+// matched several rows (a subquery returning more than one row)
+func isAmbiguousMatch(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "21000"
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+)
+
+// print the state of change capture on the original database
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	status, err := loadStatus()
+	if err != nil {
+		fatal(err, "Error reading status")
+	}
+	outputFormat.Print(status, status.print)
+}
+
+// the state of change capture, as reported by the status command
+type captureStatus struct {
+	Database    string     `json:"database"`
+	Triggers    int        `json:"triggers"`
+	Paused      bool       `json:"paused"`
+	PausedSince *time.Time `json:"paused_since,omitempty"`
+	CaptureGaps int        `json:"capture_gaps"`
+	DeltaRows   int64      `json:"delta_rows"`
+	DeltaBytes  int64      `json:"delta_bytes"`
+	Unlogged    bool       `json:"unlogged"`
+	Tablespace  string     `json:"tablespace"`
+	Jobs        []jobRun   `json:"jobs"` // the latest run of each job the daemon schedules
+
+	// when the newest delta was made, and when the latest restore job that
+	// succeeded started: the target has every delta made before then
+	LatestDelta     *time.Time `json:"latest_delta,omitempty"`
+	RestoredThrough *time.Time `json:"restored_through,omitempty"`
+
+	// sessions holding up a restore running now, on the target or a routed one
+	ReplayBlockers []lockBlocker `json:"replay_blockers"`
+}
+
+// read the deltas table's size and storage and the capture state
+func loadStatus() (captureStatus, error) {
+	status := captureStatus{Database: dbName}
+	var persistence string
+	err := dbConn.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM deltas),
+			pg_total_relation_size(c.oid),
+			c.relpersistence,
+			COALESCE(t.spcname, 'pg_default')
+		FROM pg_class c
+		LEFT JOIN pg_tablespace t ON t.oid = c.reltablespace
+		WHERE c.oid = 'deltas'::regclass
+	`).Scan(&status.DeltaRows, &status.DeltaBytes, &persistence, &status.Tablespace)
+	if err != nil {
+		return status, fmt.Errorf("failed to read deltas table details: %v", err)
+	}
+	status.Unlogged = persistence == "u"
+
+	if err := dbConn.QueryRow("SELECT max(timestamp) FROM deltas").Scan(&status.LatestDelta); err != nil {
+		return status, fmt.Errorf("failed to read the newest delta: %v", err)
+	}
+
+	err = dbConn.QueryRow(`
+		SELECT COUNT(*)
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND NOT t.tgisinternal
+		  AND t.tgname = c.relname || '_trigger'
+		  AND t.tgfoid = to_regproc(quote_ident('log_' || c.relname || '_changes'))
+	`).Scan(&status.Triggers)
+	if err != nil {
+		return status, fmt.Errorf("failed to count tracking triggers: %v", err)
+	}
+
+	gaps, err := loadCaptureGaps()
+	if err != nil {
+		return status, err
+	}
+	status.CaptureGaps = len(gaps)
+
+	status.Jobs, err = loadJobRuns(dbConn, "", true, 100)
+	if err != nil {
+		return status, err
+	}
+	if status.RestoredThrough, err = lastJobSuccess(dbConn, "restore"); err != nil {
+		return status, err
+	}
+	if len(gaps) > 0 && gaps[len(gaps)-1].to == nil {
+		since := gaps[len(gaps)-1].from
+		status.Paused, status.PausedSince = true, &since
+	}
+
+	status.ReplayBlockers = loadReplayBlockers()
+	return status, nil
+}
+
+// look for restore sessions waiting on another session's lock on each
+// target; a target that can't be reached is left out, since a status check
+// shouldn't fail because nothing has been restored yet
+func loadReplayBlockers() []lockBlocker {
+	blockers := []lockBlocker{}
+	for _, target := range append([]config.Connection{cfg.Target}, routeTargets()...) {
+		conn, err := target.Open()
+		if err == nil {
+			var found []lockBlocker
+			if found, err = findLockBlockers(conn, replayAppNames()); err == nil {
+				blockers = append(blockers, found...)
+			}
+			conn.Close()
+		}
+		if err != nil {
+			log.Printf("Not checking %s for blocked restores: %v", target.DBName, err)
+		}
+	}
+	return blockers
+}
+
+// print the status as text, with what its storage choices mean
+func (status captureStatus) print() {
+	fmt.Printf("Database:        %s\n", status.Database)
+	fmt.Printf("Triggers:        %d\n", status.Triggers)
+	if status.Paused {
+		fmt.Printf("Capture:         paused since %s\n", status.PausedSince.Format(time.RFC3339))
+	} else {
+		fmt.Println("Capture:         active")
+	}
+	fmt.Printf("Capture gaps:    %d\n", status.CaptureGaps)
+	fmt.Printf("Deltas:          %d rows, %s\n", status.DeltaRows, formatBytes(status.DeltaBytes))
+	if lag := status.lag(); lag != nil {
+		fmt.Printf("Restored:        through %s, %s behind\n", status.RestoredThrough.Format(time.RFC3339), lag.Round(time.Second))
+	}
+
+	if status.Unlogged {
+		fmt.Println("Persistence:     UNLOGGED")
+		fmt.Println("                 + changes are captured without writing WAL, so capture adds less I/O")
+		fmt.Println("                 - the deltas table is emptied if the server crashes")
+		fmt.Println("                 - it is not replicated to standbys or included in WAL-based backups")
+	} else {
+		fmt.Println("Persistence:     logged")
+	}
+
+	fmt.Printf("Tablespace:      %s\n", status.Tablespace)
+	if status.Tablespace != "pg_default" {
+		fmt.Println("                 + capture I/O is kept off the application's disks")
+		fmt.Println("                 - if this tablespace fills up or fails, writes to tracked tables fail too")
+	}
+
+	if len(status.ReplayBlockers) > 0 {
+		fmt.Println("Restore:         waiting for locks")
+		for _, b := range status.ReplayBlockers {
+			fmt.Printf("                 %s\n", b)
+		}
+	}
+
+	for i, run := range status.Jobs {
+		label := ""
+		if i == 0 {
+			label = "Jobs:"
+		}
+		detail := fmt.Sprintf("%s, started %s", run.Outcome, run.StartedAt.Format(time.RFC3339))
+		if run.EndedAt != nil {
+			detail += fmt.Sprintf(", took %s", run.EndedAt.Sub(run.StartedAt).Round(time.Second))
+		}
+		if run.Error != "" {
+			detail += ": " + run.Error
+		}
+		fmt.Printf("%-17s%s (%s): %s\n", label, run.Job, run.Command, detail)
+	}
+}
+
+// how far the target trails the source: the time between the latest
+// successful restore job and the newest delta, or nil without restore jobs
+func (status captureStatus) lag() *time.Duration {
+	if status.RestoredThrough == nil {
+		return nil
+	}
+	var lag time.Duration
+	if status.LatestDelta != nil && status.LatestDelta.After(*status.RestoredThrough) {
+		lag = status.LatestDelta.Sub(*status.RestoredThrough)
+	}
+	return &lag
+}
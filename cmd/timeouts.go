@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// report whether err is a statement cancelled by statement_timeout
+func isStatementTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// the statement capping the rest of a transaction's statements at timeout
+func statementTimeoutQuery(timeout time.Duration) string {
+	return fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())
+}
+
+// run fn in a transaction whose statements are capped at timeout, from the
+// config's timeouts section; 0 keeps the server's statement_timeout
+func withStatementTimeout(conn *sql.DB, timeout time.Duration, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if timeout > 0 {
+		if _, err := tx.Exec(statementTimeoutQuery(timeout)); err != nil {
+			return fmt.Errorf("failed to set statement_timeout: %v", err)
+		}
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
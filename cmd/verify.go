@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+
+	"github.com/lib/pq"
+)
+
+// how verify samples and what it reports
+type verifyOptions struct {
+	confidence float64 // wanted confidence that at most tolerance of a table's rows differ
+	tolerance  float64
+	rangeRows  int   // consecutive ids compared per sampled range
+	seed       int64 // for the sampled ranges
+}
+
+// what verify found for one table
+type verifyTable struct {
+	Table       string   `json:"table"`
+	Key         []string `json:"key,omitempty"` // the columns rows are matched by
+	Status      string   `json:"status"`        // match, mismatch or missing
+	SourceRows  int64    `json:"source_rows"`
+	TargetRows  int64    `json:"target_rows"`
+	Sampled     int      `json:"rows_sampled"`    // rows whose content was compared
+	Mismatched  int      `json:"rows_mismatched"` // sampled rows that differ or are missing on one side
+	Confidence  float64  `json:"confidence"`      // that at most -tolerance of the rows differ; 1 when every row was compared
+	Exhaustive  bool     `json:"exhaustive"`      // the table was small enough to compare in full
+	Detail      string   `json:"detail,omitempty"`
+	MismatchIDs []string `json:"mismatch_ids,omitempty"` // a few of the ids that differ
+}
+
+// how many differing ids a table's result lists
+const verifySampleIDs = 5
+
+// compare the original and restored databases in two passes: exact row
+// counts for every table, then the content of sampled id ranges of the
+// tables whose counts agree, enough rows to reach the wanted confidence.
+// Rows are matched by primary key, composite or not.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	confidence := fs.Float64("confidence", 0.99, "wanted confidence that no more than -tolerance of a table's rows differ")
+	tolerance := fs.Float64("tolerance", 0.001, "fraction of differing rows the sampled pass must be able to detect")
+	rangeRows := fs.Int("range-rows", 100, "consecutive ids compared per sampled range")
+	seed := fs.Int64("seed", 0, "seed choosing the sampled ranges, to repeat a run (0 = random)")
+	follow := fs.Duration("follow", 0, "instead, keep checking recently changed rows this often until interrupted (0 = verify once)")
+	followRows := fs.Int("follow-rows", 100, "recently changed rows checked per round with -follow")
+	configFlag(fs)
+	readOnlyFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *confidence <= 0 || *confidence >= 1 || *tolerance <= 0 || *tolerance >= 1 {
+		usagef("-confidence and -tolerance must be between 0 and 1")
+	}
+	if *rangeRows < 1 {
+		usagef("-range-rows must be at least 1")
+	}
+	if *follow < 0 || *followRows < 1 {
+		usagef("-follow can't be negative and -follow-rows must be at least 1")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	if *follow > 0 {
+		result, err := followVerify(*follow, *followRows)
+		if err != nil {
+			fatal(err, "Error verifying")
+		}
+		printFollowResult(result)
+		if result.Mismatched > 0 {
+			os.Exit(exitcode.Mismatch)
+		}
+		return
+	}
+
+	results, err := verifyDatabases(verifyOptions{*confidence, *tolerance, *rangeRows, *seed})
+	if err != nil {
+		fatal(err, "Error verifying")
+	}
+
+	ok := true
+	for _, r := range results {
+		ok = ok && r.Status == "match"
+	}
+	report := struct {
+		OK     bool          `json:"ok"`
+		Seed   int64         `json:"seed"`
+		Tables []verifyTable `json:"tables"`
+	}{ok, *seed, results}
+	outputFormat.Print(report, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tSTATUS\tSOURCE ROWS\tTARGET ROWS\tSAMPLED\tDIFFERENT\tCONFIDENCE\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%.4f\t%s\n", r.Table, r.Status, r.SourceRows, r.TargetRows, r.Sampled, r.Mismatched, r.Confidence, r.Detail)
+		}
+		w.Flush()
+	})
+	if !ok {
+		os.Exit(exitcode.Mismatch)
+	}
+}
+
+// the rows to sample so that, if more than tolerance of a table's rows
+// differed, at least one would turn up with the given confidence
+func verifySampleSize(confidence, tolerance float64) int {
+	return int(math.Ceil(math.Log(1-confidence) / math.Log(1-tolerance)))
+}
+
+// the confidence a clean sample of n rows gives that at most tolerance of
+// the rows differ
+func sampleConfidence(n int, tolerance float64) float64 {
+	return 1 - math.Pow(1-tolerance, float64(n))
+}
+
+func verifyDatabases(opts verifyOptions) ([]verifyTable, error) {
+	targetConn, err := cfg.Target.Open()
+	if err == nil {
+		err = targetConn.Ping()
+	}
+	if err != nil {
+		return nil, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the restored database: %v", err))
+	}
+	defer targetConn.Close()
+	targets, err := openReplayTargets(targetConn)
+	if err != nil {
+		return nil, err
+	}
+	defer targets.Close()
+
+	tables, err := getTableNames()
+	if err != nil {
+		return nil, err
+	}
+
+	// first pass: row counts, cheap enough for every table
+	var results []verifyTable
+	for _, table := range tables {
+		if table == "deltas" || cfg.Backup.Excludes(table) {
+			continue
+		}
+		result := verifyTable{Table: table, Status: "match"}
+		conn := targets.connFor(table)
+		if !tableExists(conn, table) {
+			result.Status, result.Detail = "missing", "not in the restored database"
+			results = append(results, result)
+			continue
+		}
+		if result.Key, err = restore.RowKey(context.Background(), dbConn, table); err != nil {
+			return nil, err
+		}
+		if err := countRows(dbConn, table, &result.SourceRows); err != nil {
+			return nil, err
+		}
+		if err := countRows(conn, table, &result.TargetRows); err != nil {
+			return nil, err
+		}
+		if result.SourceRows != result.TargetRows {
+			result.Status, result.Detail = "mismatch", "row counts differ"
+		}
+		results = append(results, result)
+	}
+
+	// second pass: content of sampled ranges, for tables whose counts agree
+	want := verifySampleSize(opts.confidence, opts.tolerance)
+	rng := rand.New(rand.NewSource(opts.seed))
+	for i := range results {
+		r := &results[i]
+		if r.Status != "match" {
+			continue
+		}
+		if err := sampleTable(dbConn, targets.connFor(r.Table), r, want, opts, rng); err != nil {
+			return nil, err
+		}
+		if r.Mismatched > 0 {
+			r.Status = "mismatch"
+			r.Detail = fmt.Sprintf("about %.2f%% of sampled rows differ", 100*float64(r.Mismatched)/float64(r.Sampled))
+		}
+		log.Printf("Verified %s: %d of %d rows compared, confidence %.4f.", r.Table, r.Sampled, r.SourceRows, r.Confidence)
+	}
+	return results, nil
+}
+
+func countRows(conn *sql.DB, table string, n *int64) error {
+	if err := conn.QueryRow("SELECT count(*) FROM " + ident.Quote(table)).Scan(n); err != nil {
+		return fmt.Errorf("failed to count the rows of %s: %v", table, err)
+	}
+	return nil
+}
+
+// compare the content of a table's sampled key ranges, or of the whole table
+// when it has no more rows than the sample needs
+func sampleTable(source, target *sql.DB, r *verifyTable, want int, opts verifyOptions, rng *rand.Rand) error {
+	key := tableKey(r.Key)
+	if len(key) == 0 {
+		return sampleKeyless(source, target, r, want)
+	}
+	if r.SourceRows <= int64(want) {
+		sourceRows, err := rowHashes(source, r.Table, key, "")
+		if err != nil {
+			return err
+		}
+		targetRows, err := rowHashes(target, r.Table, key, "")
+		if err != nil {
+			return err
+		}
+		r.compare(sourceRows, targetRows)
+		r.Exhaustive, r.Confidence = true, 1
+		return nil
+	}
+
+	// start ranges at keys from randomly chosen blocks, a few more than
+	// needed since block sampling returns a varying number of rows
+	ranges := (want + opts.rangeRows - 1) / opts.rangeRows
+	percent := math.Min(100, 200*float64(ranges)/float64(r.SourceRows))
+	rows, err := source.Query(fmt.Sprintf("SELECT %s FROM %s TABLESAMPLE SYSTEM (%f) REPEATABLE (%d) LIMIT %d",
+		key.values(), ident.Quote(r.Table), percent, rng.Int31(), ranges*2))
+	if err != nil {
+		return fmt.Errorf("failed to sample %s: %v", r.Table, err)
+	}
+	var starts [][]interface{}
+	for rows.Next() {
+		var start pq.StringArray
+		if err := rows.Scan(&start); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to sample %s: %v", r.Table, err)
+		}
+		starts = append(starts, keyArgs(start))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to sample %s: %v", r.Table, err)
+	}
+	rng.Shuffle(len(starts), func(i, j int) { starts[i], starts[j] = starts[j], starts[i] })
+
+	compared := make(map[string]bool)
+	for _, start := range starts {
+		if len(compared) >= want {
+			break
+		}
+		sourceRows, err := rowHashes(source, r.Table, key,
+			fmt.Sprintf("WHERE %s ORDER BY %s LIMIT %d", key.compare(">=", 1), key.columns(), opts.rangeRows), start...)
+		if err != nil {
+			return err
+		}
+		if len(sourceRows.ids) == 0 {
+			continue
+		}
+		last := keyArgs(sourceRows.last)
+		targetRows, err := rowHashes(target, r.Table, key,
+			fmt.Sprintf("WHERE %s AND %s", key.compare(">=", 1), key.compare("<=", len(key)+1)), append(start, last...)...)
+		if err != nil {
+			return err
+		}
+		// overlapping ranges count their shared rows once
+		for _, id := range sourceRows.ids {
+			if compared[id] {
+				delete(sourceRows.hashes, id)
+				delete(targetRows.hashes, id)
+			}
+		}
+		r.compare(sourceRows, targetRows)
+		for _, id := range sourceRows.ids {
+			compared[id] = true
+		}
+	}
+	r.Confidence = sampleConfidence(r.Sampled, opts.tolerance)
+	return nil
+}
+
+// a table without a key has no ranges to sample, so it is only compared in
+// full when small enough; otherwise its row counts are all there is to go by
+func sampleKeyless(source, target *sql.DB, r *verifyTable, want int) error {
+	if r.SourceRows > int64(want) {
+		r.Detail = "no key to sample by; only row counts compared"
+		return nil
+	}
+	sourceRows, err := keylessHashes(source, r.Table)
+	if err != nil {
+		return err
+	}
+	targetRows, err := keylessHashes(target, r.Table)
+	if err != nil {
+		return err
+	}
+	// identical rows are told apart by how many times they occur
+	for hash, n := range sourceRows {
+		r.Sampled += n
+		if d := n - targetRows[hash]; d > 0 {
+			r.Mismatched += d
+		}
+	}
+	for hash, n := range targetRows {
+		if d := n - sourceRows[hash]; d > 0 {
+			r.Sampled += d
+			r.Mismatched += d
+		}
+	}
+	r.Exhaustive, r.Confidence = true, 1
+	return nil
+}
+
+// how many times each row content hash occurs in a table
+func keylessHashes(conn *sql.DB, table string) (map[string]int, error) {
+	rows, err := conn.Query(fmt.Sprintf("SELECT md5(row_to_json(t)::text), count(*) FROM %s t GROUP BY 1", ident.Quote(table)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows of %s: %v", table, err)
+	}
+	defer rows.Close()
+	hashes := make(map[string]int)
+	for rows.Next() {
+		var hash string
+		var n int
+		if err := rows.Scan(&hash, &n); err != nil {
+			return nil, fmt.Errorf("failed to read rows of %s: %v", table, err)
+		}
+		hashes[hash] = n
+	}
+	return hashes, rows.Err()
+}
+
+// the columns a table's rows are matched by, for building queries on them
+type tableKey []string
+
+func (k tableKey) columns() string {
+	return ident.List(k)
+}
+
+// a row's key as one text value: the column's own for a single column key,
+// a JSON array for a composite one
+func (k tableKey) text() string {
+	if len(k) == 1 {
+		return ident.Quote(k[0]) + "::text"
+	}
+	return "json_build_array(" + k.columns() + ")::text"
+}
+
+// a row's key as an array of the columns' text
+func (k tableKey) values() string {
+	values := make([]string, len(k))
+	for i, column := range k {
+		values[i] = ident.Quote(column) + "::text"
+	}
+	return "ARRAY[" + strings.Join(values, ", ") + "]"
+}
+
+// compare the key columns with placeholders from $n on, in key order
+func (k tableKey) compare(op string, n int) string {
+	placeholders := make([]string, len(k))
+	for i := range k {
+		placeholders[i] = fmt.Sprintf("$%d", n+i)
+	}
+	return fmt.Sprintf("(%s) %s (%s)", k.columns(), op, strings.Join(placeholders, ", "))
+}
+
+func keyArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+// row content hashes by key, with the keys in key order
+type hashedRows struct {
+	ids    []string
+	hashes map[string]string
+	last   []string // the last row's key values
+}
+
+func rowHashes(conn *sql.DB, table string, key tableKey, filter string, args ...interface{}) (hashedRows, error) {
+	result := hashedRows{hashes: make(map[string]string)}
+	if filter == "" {
+		filter = "ORDER BY " + key.columns()
+	}
+	rows, err := conn.Query(fmt.Sprintf("SELECT %s, %s, md5(row_to_json(t)::text) FROM %s t %s", key.text(), key.values(), ident.Quote(table), filter), args...)
+	if err != nil {
+		return result, fmt.Errorf("failed to read rows of %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, hash string
+		var values pq.StringArray
+		if err := rows.Scan(&id, &values, &hash); err != nil {
+			return result, fmt.Errorf("failed to read rows of %s: %v", table, err)
+		}
+		result.ids = append(result.ids, id)
+		result.hashes[id] = hash
+		result.last = values
+	}
+	return result, rows.Err()
+}
+
+// count the rows of a sampled range that differ, or exist on one side only
+func (r *verifyTable) compare(source, target hashedRows) {
+	mismatch := func(id string) {
+		r.Mismatched++
+		if len(r.MismatchIDs) < verifySampleIDs {
+			r.MismatchIDs = append(r.MismatchIDs, id)
+		}
+	}
+	for id, hash := range source.hashes {
+		r.Sampled++
+		if target.hashes[id] != hash {
+			mismatch(id)
+		}
+	}
+	for id := range target.hashes {
+		if _, ok := source.hashes[id]; !ok {
+			r.Sampled++
+			mismatch(id)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/restore"
+
+	"github.com/lib/pq"
+)
+
+// what continuous verification found, since it started and per table
+type followResult struct {
+	Rounds     int           `json:"rounds"`
+	Checked    int           `json:"rows_checked"`
+	Mismatched int           `json:"rows_mismatched"`
+	Rate       float64       `json:"mismatch_rate"`
+	Tables     []verifyTable `json:"tables"`
+}
+
+// keep checking rows that recently changed on the source against their
+// restored copies, every interval until interrupted: each round takes up to
+// sample rows whose latest change the targets have caught up with since the
+// previous round, and compares them with the source as it is now. A target
+// restored with -consistent has caught up to its replay position; any other
+// is assumed to be at most one interval behind.
+func followVerify(interval time.Duration, sample int) (followResult, error) {
+	var result followResult
+
+	targetConn, err := cfg.Target.Open()
+	if err == nil {
+		err = targetConn.Ping()
+	}
+	if err != nil {
+		return result, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the restored database: %v", err))
+	}
+	defer targetConn.Close()
+	targets, err := openReplayTargets(targetConn)
+	if err != nil {
+		return result, err
+	}
+	defer targets.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tables := make(map[string]*verifyTable)
+	since := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	log.Printf("Verifying up to %d recently changed rows every %s.", sample, interval)
+	for {
+		select {
+		case <-ctx.Done():
+			for _, t := range tables {
+				result.Tables = append(result.Tables, *t)
+			}
+			sort.Slice(result.Tables, func(i, j int) bool { return result.Tables[i].Table < result.Tables[j].Table })
+			return result, nil
+		case <-ticker.C:
+		}
+
+		caughtUp := caughtUpTo(targets, time.Now().Add(-interval))
+		if !caughtUp.After(since) {
+			continue
+		}
+		checked, mismatched, err := verifyChangedRows(targets, tables, since, caughtUp, sample)
+		if err != nil {
+			return result, err
+		}
+		since = caughtUp
+		result.Rounds++
+		result.Checked += checked
+		result.Mismatched += mismatched
+		if result.Checked > 0 {
+			result.Rate = float64(result.Mismatched) / float64(result.Checked)
+		}
+		if checked > 0 {
+			log.Printf("Checked %d rows changed up to %s: %d differ (%.2f%%), %.2f%% of %d since starting.",
+				checked, caughtUp.Format(time.RFC3339), mismatched, 100*float64(mismatched)/float64(checked), 100*result.Rate, result.Checked)
+		}
+	}
+}
+
+// the time every target has replayed the source up to: the oldest replay
+// position, or fallback for targets without one
+func caughtUpTo(targets *replayTargets, fallback time.Time) time.Time {
+	caughtUp := time.Time{}
+	for _, conn := range append([]*sql.DB{targets.fallback}, targets.conns...) {
+		position := fallback
+		var asOf time.Time
+		if err := conn.QueryRow("SELECT consistent_as_of FROM delta_tracker.replay_position").Scan(&asOf); err == nil {
+			position = asOf
+		}
+		if caughtUp.IsZero() || position.Before(caughtUp) {
+			caughtUp = position
+		}
+	}
+	return caughtUp
+}
+
+// compare up to sample random rows whose latest delta was made in (from, to]
+// with their restored copies, adding to the per-table results
+func verifyChangedRows(targets *replayTargets, tables map[string]*verifyTable, from, to time.Time, sample int) (int, int, error) {
+	changed, err := changedRows(from, to, sample)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	checked, mismatched := 0, 0
+	for _, r := range changed {
+		conn := targets.connFor(r.table)
+		if !tableExists(conn, r.table) {
+			continue
+		}
+		filter := "WHERE " + r.key.compare("=", 1)
+		sourceRows, err := rowHashes(dbConn, r.table, r.key, filter, keyArgs(r.values)...)
+		if err != nil {
+			return checked, mismatched, err
+		}
+		targetRows, err := rowHashes(conn, r.table, r.key, filter, keyArgs(r.values)...)
+		if err != nil {
+			return checked, mismatched, err
+		}
+		checked++
+		// a row deleted on both sides matches
+		if len(sourceRows.ids) == 0 && len(targetRows.ids) == 0 {
+			continue
+		}
+
+		t := tables[r.table]
+		if t == nil {
+			t = &verifyTable{Table: r.table, Key: r.key, Status: "match"}
+			tables[r.table] = t
+		}
+		before := t.Mismatched
+		t.compare(sourceRows, targetRows)
+		if t.Mismatched > before {
+			mismatched++
+			t.Status = "mismatch"
+			log.Printf("Warning: row %v of %s differs from its restored copy.", r.values, r.table)
+		}
+	}
+	return checked, mismatched, nil
+}
+
+// a row of the original database that recently changed
+type changedRow struct {
+	table  string
+	key    tableKey
+	values []string // of the key columns, as text
+}
+
+// pick up to sample random rows whose latest delta was made in (from, to],
+// found by the primary keys in the deltas' payloads
+func changedRows(from, to time.Time, sample int) ([]changedRow, error) {
+	rows, err := dbConn.Query(`
+		SELECT DISTINCT table_name FROM deltas
+		WHERE timestamp > $1 AND timestamp <= $2 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+	`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find recently changed tables: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan a changed table: %v", err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find recently changed tables: %v", err)
+	}
+
+	var changed []changedRow
+	for _, table := range tables {
+		// dropped and renamed tables can't be compared
+		if cfg.Backup.Excludes(table) || !tableExists(dbConn, table) {
+			continue
+		}
+		key, err := restore.RowKey(context.Background(), dbConn, table)
+		if err != nil {
+			return nil, err
+		}
+		// rows of tables without a key can't be looked up one by one
+		if len(key) == 0 {
+			continue
+		}
+		fields := make([]string, len(key))
+		for i, column := range key {
+			fields[i] = fmt.Sprintf("COALESCE(new_data, old_data)->>%s", pq.QuoteLiteral(column))
+		}
+		rows, err := dbConn.Query(fmt.Sprintf(`
+			SELECT key_values FROM (
+				SELECT ARRAY[%s] AS key_values, max(timestamp) AS changed
+				FROM deltas
+				WHERE table_name = $1 AND timestamp > $2 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+				GROUP BY 1
+			) d
+			WHERE changed <= $3 AND array_position(key_values, NULL) IS NULL
+			ORDER BY random()
+			LIMIT $4
+		`, strings.Join(fields, ", ")), table, from, to, sample)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick recently changed rows of %s: %v", table, err)
+		}
+		for rows.Next() {
+			var values pq.StringArray
+			if err := rows.Scan(&values); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan a changed row of %s: %v", table, err)
+			}
+			changed = append(changed, changedRow{table, tableKey(key), values})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to pick recently changed rows of %s: %v", table, err)
+		}
+	}
+
+	// each table gave up to sample rows; keep a random sample of them all
+	rand.Shuffle(len(changed), func(i, j int) { changed[i], changed[j] = changed[j], changed[i] })
+	if len(changed) > sample {
+		changed = changed[:sample]
+	}
+	return changed, nil
+}
+
+func printFollowResult(result followResult) {
+	outputFormat.Print(result, func() {
+		fmt.Printf("%d rows checked over %d rounds, %d differ (%.2f%%)\n", result.Checked, result.Rounds, result.Mismatched, 100*result.Rate)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tSTATUS\tCHECKED\tDIFFERENT\tDIFFERING KEYS")
+		for _, t := range result.Tables {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\n", t.Table, t.Status, t.Sampled, t.Mismatched, t.MismatchIDs)
+		}
+		w.Flush()
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
+)
+
+// what a cache in front of the database is worth warming after a restore or
+// failover: the tables and rows the deltas show changing most often lately
+type warmPlan struct {
+	Since  time.Time  `json:"since"`
+	Until  time.Time  `json:"until"`
+	Deltas int        `json:"deltas"`
+	Tables []hotTable `json:"tables"` // most changed first
+	Rows   []hotRow   `json:"rows"`   // most changed first, rows deleted since left out
+}
+
+type hotTable struct {
+	Table   string `json:"table"`
+	Changes int    `json:"changes"`
+	Inserts int    `json:"inserts"`
+	Updates int    `json:"updates"`
+	Deletes int    `json:"deletes"`
+}
+
+type hotRow struct {
+	Table       string      `json:"table"`
+	Key         tracker.Row `json:"key"` // by key column
+	Changes     int         `json:"changes"`
+	LastChanged time.Time   `json:"last_changed"`
+}
+
+// print the tables and rows changed most often over a recent window
+func runWarmPlan(args []string) {
+	fs := flag.NewFlagSet("warm-plan", flag.ExitOnError)
+	since := fs.Duration("since", time.Hour, "how far back to look at the deltas")
+	top := fs.Int("top", 100, "how many of the most changed rows to list")
+	configFlag(fs)
+	outputFlag(fs)
+	parseFlags(fs, args)
+
+	if *since <= 0 || *top < 1 {
+		usagef("-since must be positive and -top at least 1")
+	}
+
+	if err := initDB(); err != nil {
+		fatal(err, "Error initializing DB")
+	}
+	defer dbConn.Close()
+
+	plan, err := hotPlan(*since, *top)
+	if err != nil {
+		fatal(err, "Error building the warm plan")
+	}
+	outputFormat.Print(plan, func() {
+		fmt.Printf("%d deltas from %s to %s\n", plan.Deltas, plan.Since.Format(time.RFC3339), plan.Until.Format(time.RFC3339))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tCHANGES\tINSERTS\tUPDATES\tDELETES")
+		for _, t := range plan.Tables {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", t.Table, t.Changes, t.Inserts, t.Updates, t.Deletes)
+		}
+		w.Flush()
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tKEY\tCHANGES\tLAST CHANGED")
+		for _, r := range plan.Rows {
+			fmt.Fprintf(w, "%s\t%v\t%d\t%s\n", r.Table, r.Key, r.Changes, r.LastChanged.Format(time.RFC3339))
+		}
+		w.Flush()
+	})
+}
+
+// count the changes of the last window by table, and pick the top rows
+// changed most often, found by the keys in the deltas' payloads. Rows of
+// tables without a key can't be told apart, so only their tables are listed.
+func hotPlan(window time.Duration, top int) (warmPlan, error) {
+	plan := warmPlan{Until: time.Now(), Tables: []hotTable{}, Rows: []hotRow{}}
+	plan.Since = plan.Until.Add(-window)
+
+	rows, err := dbConn.Query(`
+		SELECT table_name, count(*),
+			count(*) FILTER (WHERE action = 'INSERT'),
+			count(*) FILTER (WHERE action = 'UPDATE'),
+			count(*) FILTER (WHERE action = 'DELETE')
+		FROM deltas
+		WHERE timestamp > $1 AND timestamp <= $2 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+		GROUP BY table_name
+		ORDER BY 2 DESC, 1
+	`, plan.Since, plan.Until)
+	if err != nil {
+		return plan, fmt.Errorf("failed to count recent changes: %v", err)
+	}
+	for rows.Next() {
+		var t hotTable
+		if err := rows.Scan(&t.Table, &t.Changes, &t.Inserts, &t.Updates, &t.Deletes); err != nil {
+			rows.Close()
+			return plan, fmt.Errorf("failed to scan recent changes: %v", err)
+		}
+		plan.Tables = append(plan.Tables, t)
+		plan.Deltas += t.Changes
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return plan, fmt.Errorf("failed to count recent changes: %v", err)
+	}
+
+	for _, t := range plan.Tables {
+		// dropped and renamed tables have no rows left to warm
+		if !tableExists(dbConn, t.Table) {
+			continue
+		}
+		hot, err := hotRows(t.Table, plan.Since, plan.Until, top)
+		if err != nil {
+			return plan, err
+		}
+		plan.Rows = append(plan.Rows, hot...)
+	}
+
+	// each table gave its top rows; keep the top of them all
+	sort.SliceStable(plan.Rows, func(i, j int) bool {
+		if plan.Rows[i].Changes != plan.Rows[j].Changes {
+			return plan.Rows[i].Changes > plan.Rows[j].Changes
+		}
+		return plan.Rows[i].LastChanged.After(plan.Rows[j].LastChanged)
+	})
+	if len(plan.Rows) > top {
+		plan.Rows = plan.Rows[:top]
+	}
+	return plan, nil
+}
+
+// the rows of a table changed most often in (from, to], by the key they have
+// now, leaving out the ones whose latest change deleted them
+func hotRows(table string, from, to time.Time, top int) ([]hotRow, error) {
+	key, err := restore.RowKey(context.Background(), dbConn, table)
+	if err != nil || len(key) == 0 {
+		return nil, err
+	}
+	fields := make([]string, len(key))
+	for i, column := range key {
+		fields[i] = fmt.Sprintf("%[1]s, COALESCE(new_data, old_data)->%[1]s", pq.QuoteLiteral(column))
+	}
+	rows, err := dbConn.Query(fmt.Sprintf(`
+		SELECT row_key::text, count(*), max(timestamp)
+		FROM (
+			SELECT jsonb_build_object(%s) AS row_key, action, timestamp, id
+			FROM deltas
+			WHERE table_name = $1 AND timestamp > $2 AND timestamp <= $3 AND action IN ('INSERT', 'UPDATE', 'DELETE')
+		) d
+		GROUP BY row_key
+		HAVING (array_agg(action ORDER BY timestamp DESC, id DESC))[1] <> 'DELETE'
+		ORDER BY 2 DESC, 3 DESC
+		LIMIT $4
+	`, strings.Join(fields, ", ")), table, from, to, top)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the most changed rows of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var hot []hotRow
+	for rows.Next() {
+		r := hotRow{Table: table}
+		var rowKey string
+		if err := rows.Scan(&rowKey, &r.Changes, &r.LastChanged); err != nil {
+			return nil, fmt.Errorf("failed to scan a changed row of %s: %v", table, err)
+		}
+		if r.Key, err = tracker.DecodeRow([]byte(rowKey)); err != nil {
+			return nil, fmt.Errorf("failed to decode a row key of %s: %v", table, err)
+		}
+		hot = append(hot, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find the most changed rows of %s: %v", table, err)
+	}
+	return hot, nil
+}
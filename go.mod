@@ -2,4 +2,6 @@ module db-delta-tracker
 
 go 1.23.4
 
-require github.com/lib/pq v1.10.9 // indirect
+require github.com/lib/pq v1.10.9
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-delta-tracker/pkg/exitcode"
+
+	"github.com/lib/pq"
+)
+
+var (
+	canaryTables string        // comma separated tables to instrument in canary mode
+	canaryWindow = time.Minute // how long to measure before and after
+)
+
+// write activity over one measurement window
+type overheadSample struct {
+	Seconds  float64                `json:"seconds"`
+	WALBytes int64                  `json:"wal_bytes"` // whole cluster
+	Tables   map[string]tableSample `json:"tables"`
+
+	Statements bool `json:"pg_stat_statements"` // whether latency could be measured
+}
+
+type tableSample struct {
+	Writes int64 `json:"writes"` // rows inserted, updated and deleted
+
+	// mean time of INSERT, UPDATE and DELETE statements on the table, from
+	// pg_stat_statements; nil when that extension isn't installed
+	MeanWriteMs *float64 `json:"mean_write_ms,omitempty"`
+}
+
+// the result of a canary run
+type canaryReport struct {
+	Tables []string       `json:"tables"`
+	Before overheadSample `json:"before"`
+	After  overheadSample `json:"after"`
+
+	// deltas table growth per captured change, the storage cost of capture
+	DeltaRows        int64 `json:"delta_rows"`
+	DeltaBytesPerRow int64 `json:"delta_bytes_per_row"`
+}
+
+// instrument only the given tables, measuring their write activity for a
+// window before and after, so trigger overhead is known before the whole
+// database is instrumented; a later full init keeps these triggers
+func runCanary(configPath, profile string) {
+	var tables []string
+	for _, t := range strings.Split(canaryTables, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tables = append(tables, t)
+		}
+	}
+	if len(tables) == 0 {
+		log.Printf("Usage: init -canary <table>[,<table>...]")
+		os.Exit(exitcode.Usage)
+	}
+
+	if err := openDB(configPath, profile); err != nil {
+		fatal(err, "Failed to connect to the database")
+	}
+	defer dbConn.Close()
+
+	if err := createMetadataSchema(); err != nil {
+		fatal(err, "Failed to prepare metadata")
+	}
+	if err := createDeltasTable(); err != nil {
+		fatal(err, "Failed to create deltas table")
+	}
+
+	report, err := measureCanary(tables)
+	if err != nil {
+		fatal(err, "Canary failed")
+	}
+	outputFormat.Print(report, report.print)
+}
+
+func measureCanary(tables []string) (canaryReport, error) {
+	report := canaryReport{Tables: tables}
+
+	var missing []string
+	err := dbConn.QueryRow(`
+		SELECT COALESCE(array_agg(t), '{}') FROM unnest($1::text[]) t
+		WHERE to_regclass(format('public.%I', t)) IS NULL
+	`, pq.Array(tables)).Scan(pq.Array(&missing))
+	if err != nil {
+		return report, fmt.Errorf("failed to look up canary tables: %v", err)
+	}
+	if len(missing) > 0 {
+		return report, fmt.Errorf("no such tables: %s", strings.Join(missing, ", "))
+	}
+	_, skipped, err := listTables()
+	if err != nil {
+		return report, err
+	}
+	for _, sk := range skipped {
+		for _, t := range tables {
+			if sk.Table == t {
+				return report, fmt.Errorf("can't add a trigger to %s: %s", t, sk.Reason)
+			}
+		}
+	}
+
+	log.Printf("Measuring writes to %s for %s before adding triggers.", strings.Join(tables, ", "), canaryWindow)
+	report.Before, err = sampleOverhead(tables)
+	if err != nil {
+		return report, err
+	}
+
+	err = withLockRetry("adding canary triggers", func(tx *sql.Tx) error {
+		for _, tableName := range tables {
+			if err := installTrigger(tx, tableName); err != nil {
+				return err
+			}
+		}
+		return markTriggersDone(tx, tables)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	var rowsBefore, sizeBefore int64
+	if err := dbConn.QueryRow("SELECT COUNT(*), pg_total_relation_size('deltas') FROM deltas").Scan(&rowsBefore, &sizeBefore); err != nil {
+		return report, fmt.Errorf("failed to measure deltas table: %v", err)
+	}
+
+	log.Printf("Triggers added; measuring for another %s.", canaryWindow)
+	report.After, err = sampleOverhead(tables)
+	if err != nil {
+		return report, err
+	}
+
+	var rowsAfter, sizeAfter int64
+	if err := dbConn.QueryRow("SELECT COUNT(*), pg_total_relation_size('deltas') FROM deltas").Scan(&rowsAfter, &sizeAfter); err != nil {
+		return report, fmt.Errorf("failed to measure deltas table: %v", err)
+	}
+	report.DeltaRows = rowsAfter - rowsBefore
+	if report.DeltaRows > 0 {
+		report.DeltaBytesPerRow = (sizeAfter - sizeBefore) / report.DeltaRows
+	}
+	return report, nil
+}
+
+// measure WAL volume and per-table writes over one canary window
+func sampleOverhead(tables []string) (overheadSample, error) {
+	start, err := readOverheadCounters(tables)
+	if err != nil {
+		return overheadSample{}, err
+	}
+	began := time.Now()
+	time.Sleep(canaryWindow)
+	end, err := readOverheadCounters(tables)
+	if err != nil {
+		return overheadSample{}, err
+	}
+
+	sample := overheadSample{
+		Seconds:  time.Since(began).Seconds(),
+		WALBytes: end.walBytes - start.walBytes,
+		Tables:   make(map[string]tableSample),
+
+		Statements: start.statements && end.statements,
+	}
+	for _, tableName := range tables {
+		s, e := start.tables[tableName], end.tables[tableName]
+		ts := tableSample{Writes: e.writes - s.writes}
+		if calls := e.calls - s.calls; sample.Statements && calls > 0 {
+			mean := (e.execMs - s.execMs) / float64(calls)
+			ts.MeanWriteMs = &mean
+		}
+		sample.Tables[tableName] = ts
+	}
+	return sample, nil
+}
+
+// cumulative counters read at one moment
+type overheadCounters struct {
+	walBytes   int64
+	statements bool // pg_stat_statements is available
+	tables     map[string]tableCounters
+}
+
+type tableCounters struct {
+	writes int64   // rows written
+	calls  int64   // write statements run
+	execMs float64 // total time spent in them
+}
+
+func readOverheadCounters(tables []string) (overheadCounters, error) {
+	c := overheadCounters{tables: make(map[string]tableCounters)}
+	if err := dbConn.QueryRow("SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), '0/0')::bigint").Scan(&c.walBytes); err != nil {
+		return c, fmt.Errorf("failed to read WAL position: %v", err)
+	}
+	if err := dbConn.QueryRow("SELECT to_regclass('pg_stat_statements') IS NOT NULL").Scan(&c.statements); err != nil {
+		return c, fmt.Errorf("failed to look for pg_stat_statements: %v", err)
+	}
+
+	for _, tableName := range tables {
+		t := c.tables[tableName]
+		err := dbConn.QueryRow(`
+			SELECT COALESCE(SUM(n_tup_ins + n_tup_upd + n_tup_del), 0)
+			FROM pg_stat_user_tables WHERE schemaname = 'public' AND relname = $1
+		`, tableName).Scan(&t.writes)
+		if err != nil {
+			return c, fmt.Errorf("failed to read statistics for table %s: %v", tableName, err)
+		}
+
+		if c.statements {
+			// statements are matched by the table named after INSERT INTO,
+			// UPDATE or DELETE FROM, which is close enough for a comparison;
+			// the name is quoted, since table names may hold . or $
+			err := dbConn.QueryRow(`
+				SELECT COALESCE(SUM(calls), 0), COALESCE(SUM(total_exec_time), 0)
+				FROM pg_stat_statements
+				WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+					AND query ~* ('^\s*(insert\s+into|update|delete\s+from)\s+("?public"?\.)?"?' || $1 || '\M')
+			`, regexp.QuoteMeta(tableName)).Scan(&t.calls, &t.execMs)
+			if err != nil {
+				log.Printf("Warning: can't read pg_stat_statements, reporting without latency: %v", err)
+				c.statements = false
+			}
+		}
+		c.tables[tableName] = t
+	}
+	return c, nil
+}
+
+// print the canary report as text
+func (r canaryReport) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tWRITES/S BEFORE\tWRITES/S AFTER\tMEAN WRITE BEFORE\tMEAN WRITE AFTER\tCHANGE")
+	for _, tableName := range r.Tables {
+		before, after := r.Before.Tables[tableName], r.After.Tables[tableName]
+		fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%s\t%s\t%s\n", tableName,
+			float64(before.Writes)/r.Before.Seconds, float64(after.Writes)/r.After.Seconds,
+			formatMs(before.MeanWriteMs), formatMs(after.MeanWriteMs), formatChange(before.MeanWriteMs, after.MeanWriteMs))
+	}
+	w.Flush()
+
+	fmt.Printf("\nWAL written (whole cluster): %.0f bytes/s before, %.0f bytes/s after\n",
+		float64(r.Before.WALBytes)/r.Before.Seconds, float64(r.After.WALBytes)/r.After.Seconds)
+	fmt.Printf("Deltas captured: %d rows, about %d bytes each\n", r.DeltaRows, r.DeltaBytesPerRow)
+	if !r.Before.Statements || !r.After.Statements {
+		fmt.Println("Install pg_stat_statements to also compare write latency.")
+	}
+}
+
+func formatMs(ms *float64) string {
+	if ms == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f ms", *ms)
+}
+
+func formatChange(before, after *float64) string {
+	if before == nil || after == nil || *before == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.0f%%", (*after-*before) / *before * 100)
+}
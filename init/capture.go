@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+)
+
+// per-table counters used to spot tables written while capture is paused
+type tableActivity struct {
+	Writes   int64 `json:"writes"`   // rows inserted, updated and deleted so far
+	Filenode int64 `json:"filenode"` // changes when the table is truncated or rewritten
+}
+
+// detail stored on a capture gap event
+type gapDetail struct {
+	Activity      map[string]tableActivity `json:"activity"`
+	WrittenTables []string                 `json:"written_tables,omitempty"`
+}
+
+// create the schema holding the tool's own bookkeeping, kept out of the
+// public schema so it is never instrumented or backed up
+func createMetadataSchema() error {
+	_, err := dbConn.Exec(`
+	CREATE SCHEMA IF NOT EXISTS delta_tracker;
+
+	-- operational events, e.g. windows where capture was paused
+	CREATE TABLE IF NOT EXISTS delta_tracker.events (
+		id SERIAL PRIMARY KEY,
+		kind VARCHAR(50) NOT NULL,
+		started_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ended_at TIMESTAMPTZ,
+		detail JSONB
+	);
+
+	-- tables re-copied into the restored database after the initial backup;
+	-- replay skips deltas already visible in txid_snapshot
+	CREATE TABLE IF NOT EXISTS delta_tracker.table_snapshots (
+		id SERIAL PRIMARY KEY,
+		table_name VARCHAR(100) NOT NULL,
+		taken_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		txid_snapshot TEXT NOT NULL,
+		reason VARCHAR(50)
+	);
+	ALTER TABLE delta_tracker.table_snapshots ADD COLUMN IF NOT EXISTS definition TEXT;
+	ALTER TABLE delta_tracker.table_snapshots ADD COLUMN IF NOT EXISTS lsn pg_lsn;
+
+	-- per-table steps completed by init, so an interrupted run can resume
+	CREATE TABLE IF NOT EXISTS delta_tracker.init_progress (
+		table_name VARCHAR(100) NOT NULL,
+		step VARCHAR(50) NOT NULL,
+		completed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (table_name, step)
+	);
+	ALTER TABLE delta_tracker.init_progress ALTER COLUMN step TYPE VARCHAR(50);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata schema: %v", err)
+	}
+	return nil
+}
+
+// handle `capture pause` and `capture resume`
+func runCapture(configPath, profile string, args []string) {
+	if len(args) != 1 || (args[0] != "pause" && args[0] != "resume") {
+		log.Printf("Usage: capture pause|resume")
+		os.Exit(exitcode.Usage)
+	}
+
+	if err := openDB(configPath, profile); err != nil {
+		fatal(err, "Failed to connect to the database")
+	}
+	defer dbConn.Close()
+
+	if err := createMetadataSchema(); err != nil {
+		fatal(err, "Failed to prepare metadata")
+	}
+
+	var result captureResult
+	var err error
+	if args[0] == "pause" {
+		result, err = pauseCapture()
+	} else {
+		result, err = resumeCapture()
+	}
+	if err != nil {
+		fatal(err, "Failed to "+args[0]+" capture")
+	}
+	outputFormat.Print(result, func() {})
+}
+
+// what capture pause or resume did, for -output json
+type captureResult struct {
+	Action        string   `json:"action"` // pause or resume
+	Tables        int      `json:"tables"` // tables whose triggers were toggled
+	Resnapshotted []string `json:"resnapshotted,omitempty"`
+}
+
+// disable the tracking triggers on every table in one transaction and open a
+// gap event, so changes made until resume are knowingly left out of the log
+func pauseCapture() (captureResult, error) {
+	result := captureResult{Action: "pause"}
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var since time.Time
+	err = tx.QueryRow("SELECT started_at FROM delta_tracker.events WHERE kind = 'capture_gap' AND ended_at IS NULL").Scan(&since)
+	if err == nil {
+		return result, fmt.Errorf("capture is already paused since %s", since.Format(time.RFC3339))
+	}
+	if err != sql.ErrNoRows {
+		return result, fmt.Errorf("failed to check for an open gap: %v", err)
+	}
+
+	tables, err := setTrackingTriggers(tx, false)
+	if err != nil {
+		return result, err
+	}
+
+	// remember how much each table had been written so resume can tell
+	// which ones changed while nothing was being captured
+	activity, err := readTableActivity(tx)
+	if err != nil {
+		return result, err
+	}
+	detail, err := json.Marshal(gapDetail{Activity: activity})
+	if err != nil {
+		return result, fmt.Errorf("failed to encode gap detail: %v", err)
+	}
+
+	if _, err := tx.Exec("INSERT INTO delta_tracker.events (kind, detail) VALUES ('capture_gap', $1)", detail); err != nil {
+		return result, fmt.Errorf("failed to record gap event: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit: %v", err)
+	}
+
+	log.Printf("Capture paused on %d tables. Changes are not tracked until `capture resume`.", len(tables))
+	result.Tables = len(tables)
+	return result, nil
+}
+
+// re-enable the tracking triggers on every table in one transaction, close
+// the open gap event and re-snapshot the tables written while paused
+func resumeCapture() (captureResult, error) {
+	result := captureResult{Action: "resume"}
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// read the counters before anything new is captured
+	activity, err := readTableActivity(tx)
+	if err != nil {
+		return result, err
+	}
+
+	tables, err := setTrackingTriggers(tx, true)
+	if err != nil {
+		return result, err
+	}
+
+	var eventID int
+	var since time.Time
+	var rawDetail []byte
+	err = tx.QueryRow(`
+		UPDATE delta_tracker.events SET ended_at = CURRENT_TIMESTAMP
+		WHERE kind = 'capture_gap' AND ended_at IS NULL
+		RETURNING id, started_at, detail
+	`).Scan(&eventID, &since, &rawDetail)
+	if err == sql.ErrNoRows {
+		log.Println("Capture was not paused; triggers enabled anyway.")
+		result.Tables = len(tables)
+		return result, tx.Commit()
+	} else if err != nil {
+		return result, fmt.Errorf("failed to close gap event: %v", err)
+	}
+
+	var detail gapDetail
+	if rawDetail != nil {
+		if err := json.Unmarshal(rawDetail, &detail); err != nil {
+			return result, fmt.Errorf("failed to decode gap detail: %v", err)
+		}
+	}
+	detail.WrittenTables = writtenTables(detail.Activity, activity)
+
+	encoded, err := json.Marshal(detail)
+	if err != nil {
+		return result, fmt.Errorf("failed to encode gap detail: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE delta_tracker.events SET detail = $1 WHERE id = $2", encoded, eventID); err != nil {
+		return result, fmt.Errorf("failed to record written tables: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit: %v", err)
+	}
+
+	log.Printf("Capture resumed on %d tables. Changes since %s were not tracked.", len(tables), since.Format(time.RFC3339))
+	result.Tables = len(tables)
+
+	// bring the restored copies of the written tables back in line
+	for _, tableName := range detail.WrittenTables {
+		log.Printf("Table %s was written while capture was paused, re-snapshotting it.", tableName)
+		if err := resnapshotTable(tableName, "capture_gap"); err != nil {
+			return result, err
+		}
+		result.Resnapshotted = append(result.Resnapshotted, tableName)
+	}
+	return result, nil
+}
+
+// read the write counters and storage file of every public table
+func readTableActivity(tx *sql.Tx) (map[string]tableActivity, error) {
+	rows, err := tx.Query(`
+		SELECT relname, n_tup_ins + n_tup_upd + n_tup_del, pg_relation_filenode(relid)
+		FROM pg_stat_user_tables
+		WHERE schemaname = 'public' AND relname <> 'deltas'
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table statistics: %v", err)
+	}
+	defer rows.Close()
+
+	activity := make(map[string]tableActivity)
+	for rows.Next() {
+		var tableName string
+		var a tableActivity
+		if err := rows.Scan(&tableName, &a.Writes, &a.Filenode); err != nil {
+			return nil, fmt.Errorf("failed to scan table statistics: %v", err)
+		}
+		activity[tableName] = a
+	}
+	return activity, rows.Err()
+}
+
+// list the tables whose counters moved between two readings; a counter going
+// backwards means statistics were reset, so the table is assumed written
+func writtenTables(before, after map[string]tableActivity) []string {
+	var written []string
+	for tableName, a := range after {
+		b, ok := before[tableName]
+		if !ok || a.Writes != b.Writes || a.Filenode != b.Filenode {
+			written = append(written, tableName)
+		}
+	}
+	sort.Strings(written)
+	return written
+}
+
+// replace a table's copy in the restored database with its current contents,
+// recording the snapshot it was read at so replay doesn't apply those changes twice
+func resnapshotTable(tableName, reason string) error {
+	snapshot, err := backupTable(tableName)
+	if err != nil {
+		return fmt.Errorf("failed to backup table %s: %v", tableName, err)
+	}
+	return reloadTable(tableName, snapshot, reason)
+}
+
+// load a table's restored copy again from its backup, taken at snapshot, and
+// record the snapshot
+func reloadTable(tableName, snapshot, reason string) error {
+	restoredDB, err := reconnectToDatabase(restoreDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to restored database: %v", err)
+	}
+	defer restoredDB.Close()
+
+	var exists bool
+	if err := restoredDB.QueryRow("SELECT to_regclass($1) IS NOT NULL", ident.Quote(tableName)).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up restored table %s: %v", tableName, err)
+	}
+	if exists {
+		if _, err := restoredDB.Exec("TRUNCATE " + ident.Quote(tableName)); err != nil {
+			return fmt.Errorf("failed to clear restored table %s: %v", tableName, err)
+		}
+	}
+
+	if err := restoreTable(tableName); err != nil {
+		return fmt.Errorf("failed to restore table %s: %v", tableName, err)
+	}
+
+	// keep the definition the copy was taken under along with it
+	definition, err := tableDefinition(dbConn, tableName)
+	if err != nil {
+		return err
+	}
+	// with wal.record_lsn, the WAL position once the copy is taken, which a
+	// physical recovery to includes everything in the copy
+	_, err = dbConn.Exec(`
+		INSERT INTO delta_tracker.table_snapshots (table_name, txid_snapshot, reason, definition, lsn)
+		VALUES ($1, $2, $3, $4, CASE WHEN $5 THEN pg_current_wal_lsn() END)
+	`, tableName, snapshot, reason, strings.Join(definition, ";\n")+";", cfg.WAL.RecordLSN)
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot of table %s: %v", tableName, err)
+	}
+	return nil
+}
+
+// enable or disable the tracking trigger on every instrumented table,
+// returning the tables touched
+func setTrackingTriggers(tx *sql.Tx, enable bool) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT c.relname
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND NOT t.tgisinternal AND t.tgname = c.relname || '_trigger'
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tracking triggers: %v", err)
+	}
+
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan table name: %v", err)
+		}
+		tables = append(tables, tableName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list tracking triggers: %v", err)
+	}
+
+	action := "DISABLE"
+	if enable {
+		action = "ENABLE"
+	}
+	for _, tableName := range tables {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s %s TRIGGER %s", ident.Quote(tableName), action, ident.TriggerName(tableName))); err != nil {
+			return nil, fmt.Errorf("failed to %s trigger on %s: %v", action, tableName, err)
+		}
+	}
+	return tables, nil
+}
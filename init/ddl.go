@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"db-delta-tracker/pkg/ident"
+)
+
+// one column of a source table, as read from the catalog
+type columnDef struct {
+	name      string
+	typ       string // as format_type prints it, e.g. character varying(100)
+	notNull   bool
+	expr      string // default, or generation expression for a generated column
+	identity  string // pg_attribute.attidentity: a(lways), d(efault) or empty
+	generated string // pg_attribute.attgenerated: s(tored) or empty
+	sequence  string // the serial sequence the default draws from, if any
+	collation string // set when it differs from the type's default collation
+}
+
+// build the statements creating a table's restored copy the way the table is
+// defined on the source: column types and collations, defaults, NOT NULL, the
+// primary key and check constraints. Serial columns get their sequence created first, and
+// identity columns become GENERATED BY DEFAULT so copied rows keep their ids.
+func tableDefinition(db *sql.DB, tableName string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+			COALESCE(pg_get_expr(d.adbin, d.adrelid), ''), a.attidentity, a.attgenerated,
+			CASE WHEN a.attidentity = '' THEN COALESCE(pg_get_serial_sequence($2, a.attname), '') ELSE '' END,
+			CASE WHEN a.attcollation <> t.typcollation THEN COALESCE(quote_ident(co.collname), '') ELSE '' END
+		FROM pg_attribute a
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_collation co ON co.oid = a.attcollation
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum
+	`, ident.Quote(tableName), ident.Quote(tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %v", tableName, err)
+	}
+	var columns []columnDef
+	for rows.Next() {
+		var c columnDef
+		if err := rows.Scan(&c.name, &c.typ, &c.notNull, &c.expr, &c.identity, &c.generated, &c.sequence, &c.collation); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan column of %s: %v", tableName, err)
+		}
+		columns = append(columns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %v", tableName, err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s has no columns", tableName)
+	}
+
+	rows, err = db.Query(`
+		SELECT conname, pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = $1::regclass AND contype IN ('p', 'c')
+		ORDER BY contype DESC, conname
+	`, ident.Quote(tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read constraints of %s: %v", tableName, err)
+	}
+	var constraints []string
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan constraint of %s: %v", tableName, err)
+		}
+		constraints = append(constraints, fmt.Sprintf("CONSTRAINT %s %s", ident.Quote(name), def))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read constraints of %s: %v", tableName, err)
+	}
+
+	var statements, lines []string
+	for _, c := range columns {
+		if c.sequence != "" {
+			statements = append(statements, fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s", c.sequence))
+		}
+		lines = append(lines, c.definition())
+	}
+	lines = append(lines, constraints...)
+	statements = append(statements, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", ident.Quote(tableName), strings.Join(lines, ",\n\t")))
+
+	// let dropping the table drop its sequences too, as on the source
+	for _, c := range columns {
+		if c.sequence != "" {
+			statements = append(statements, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s", c.sequence, ident.Quote(tableName), ident.Quote(c.name)))
+		}
+	}
+	return statements, nil
+}
+
+// the column's line in CREATE TABLE
+func (c columnDef) definition() string {
+	def := ident.Quote(c.name) + " " + c.typ
+	if c.collation != "" {
+		def += " COLLATE " + c.collation
+	}
+	switch {
+	case c.generated == "s":
+		def += fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED", c.expr)
+	case c.identity != "":
+		def += " GENERATED BY DEFAULT AS IDENTITY"
+	case c.expr != "":
+		def += " DEFAULT " + c.expr
+	}
+	if c.notNull {
+		def += " NOT NULL"
+	}
+	return def
+}
+
+// build the statements creating a table's indexes, unique and exclusion
+// constraints on its restored copy, leaving out the primary key, which the
+// table is created with, and whatever the copy already has. They run once the
+// copy is loaded, which is faster than keeping them up to date row by row.
+func tableIndexes(db, restoredDB *sql.DB, tableName string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT ic.relname, pg_get_indexdef(i.indexrelid), ''
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		WHERE i.indrelid = $1::regclass AND NOT i.indisprimary
+		  AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid AND c.conrelid = i.indrelid)
+		UNION ALL
+		SELECT conname, '', pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = $1::regclass AND contype IN ('u', 'x')
+		ORDER BY 1
+	`, ident.Quote(tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read indexes of %s: %v", tableName, err)
+	}
+	type index struct{ name, indexDef, constraintDef string }
+	var indexes []index
+	for rows.Next() {
+		var i index
+		if err := rows.Scan(&i.name, &i.indexDef, &i.constraintDef); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan index of %s: %v", tableName, err)
+		}
+		indexes = append(indexes, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read indexes of %s: %v", tableName, err)
+	}
+
+	var statements []string
+	for _, i := range indexes {
+		// a constraint's index has the constraint's name
+		var exists bool
+		if err := restoredDB.QueryRow("SELECT to_regclass($1) IS NOT NULL", ident.Quote(i.name)).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to look up index %s: %v", i.name, err)
+		}
+		if exists {
+			continue
+		}
+		if i.constraintDef != "" {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", ident.Quote(tableName), ident.Quote(i.name), i.constraintDef))
+		} else {
+			statements = append(statements, i.indexDef)
+		}
+	}
+	return statements, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"db-delta-tracker/pkg/backup"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
+)
+
+// how many changed keys a differential backup reads per query
+const changedKeysPerQuery = 1000
+
+// the snapshot a table was last copied at, or "" if it never was
+func lastSnapshot(tableName string) (string, error) {
+	var snapshot string
+	err := dbConn.QueryRow(`
+		SELECT txid_snapshot FROM delta_tracker.table_snapshots
+		WHERE table_name = $1
+		ORDER BY taken_at DESC, id DESC
+		LIMIT 1
+	`, tableName).Scan(&snapshot)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the last snapshot of %s: %v", tableName, err)
+	}
+	return snapshot, nil
+}
+
+// whether any delta of a table was made by a transaction the snapshot
+// doesn't see
+func changedSince(tableName, snapshot string) (bool, error) {
+	var changed bool
+	err := dbConn.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM deltas
+			WHERE table_name = $1 AND (txid IS NULL OR NOT txid_visible_in_snapshot(txid, $2::txid_snapshot))
+		)
+	`, tableName, snapshot).Scan(&changed)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for changes to %s: %v", tableName, err)
+	}
+	return changed, nil
+}
+
+// bring a table's backup up to date by reading again only the rows whose key
+// a delta since the last snapshot carries, and merging them into the backup
+// file. It returns the new snapshot and how many keys were read, or ok false
+// if the table needs a full copy: it has no single column key, or no backup.
+func backupChangedRows(tableName, since string) (snapshot string, keys int, ok bool, err error) {
+	key, err := restore.RowKey(context.Background(), dbConn, tableName)
+	if err != nil || len(key) != 1 {
+		return "", 0, false, err
+	}
+	fileName, err := cfg.BackupFile(tableName)
+	if err != nil {
+		return "", 0, false, err
+	}
+	previous, err := tracker.FileSnapshots(cfg.BackupFile).Snapshot(context.Background(), tableName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	originalDB, err := reconnectToDatabase(dbName)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to reconnect to original database: %v", err)
+	}
+	defer originalDB.Close()
+
+	// the deltas and the rows are read in one transaction, so the changed
+	// keys are exactly those of the changes the new snapshot sees
+	tx, err := originalDB.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to begin backup transaction for table %s: %v", tableName, err)
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow("SELECT txid_current_snapshot()::text").Scan(&snapshot); err != nil {
+		return "", 0, false, fmt.Errorf("failed to read snapshot for table %s: %v", tableName, err)
+	}
+	var keyType string
+	err = tx.QueryRow(`
+		SELECT format_type(atttypid, atttypmod) FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attname = $2
+	`, ident.Quote(tableName), key[0]).Scan(&keyType)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to read the key type of %s: %v", tableName, err)
+	}
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT k FROM deltas, LATERAL (VALUES (old_data->>$2), (new_data->>$2)) v(k)
+		WHERE table_name = $1 AND k IS NOT NULL
+		  AND (txid IS NULL OR NOT txid_visible_in_snapshot(txid, $3::txid_snapshot))
+	`, tableName, key[0], since)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to read the changed keys of %s: %v", tableName, err)
+	}
+	var changed []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return "", 0, false, fmt.Errorf("failed to scan a changed key of %s: %v", tableName, err)
+		}
+		changed = append(changed, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", 0, false, fmt.Errorf("failed to read the changed keys of %s: %v", tableName, err)
+	}
+
+	// the rows those keys have now; a key without one was deleted
+	var current []tracker.Row
+	query := fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t WHERE %s = ANY($1::%s[])", ident.Quote(tableName), ident.Quote(key[0]), keyType)
+	for start := 0; start < len(changed); start += changedKeysPerQuery {
+		end := min(start+changedKeysPerQuery, len(changed))
+		rows, err := tx.Query(query, pq.Array(changed[start:end]))
+		if err != nil {
+			return "", 0, false, fmt.Errorf("failed to fetch changed rows of %s: %v", tableName, err)
+		}
+		for rows.Next() {
+			var data string
+			if err := rows.Scan(&data); err != nil {
+				rows.Close()
+				return "", 0, false, fmt.Errorf("failed to scan row from table %s: %v", tableName, err)
+			}
+			row, err := tracker.DecodeRow([]byte(data))
+			if err != nil {
+				rows.Close()
+				return "", 0, false, fmt.Errorf("failed to decode row from table %s: %v", tableName, err)
+			}
+			current = append(current, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return "", 0, false, fmt.Errorf("failed to fetch changed rows of %s: %v", tableName, err)
+		}
+	}
+
+	isChanged := make(map[string]bool, len(changed))
+	for _, k := range changed {
+		isChanged[k] = true
+	}
+	merged := make([]tracker.Row, 0, len(previous)+len(current))
+	for _, row := range previous {
+		if !isChanged[keyText(row[key[0]])] {
+			merged = append(merged, row)
+		}
+	}
+	merged = append(merged, current...)
+	if err := backup.WriteFile(fileName, merged); err != nil {
+		return "", 0, false, fmt.Errorf("failed to back up table %s: %v", tableName, err)
+	}
+	return snapshot, len(changed), true, nil
+}
+
+// a key value as the ->> operator gives it
+func keyText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"db-delta-tracker/pkg/ident"
+)
+
+var (
+	skipUnlogged  bool           // leave UNLOGGED tables uninstrumented and uncopied
+	skippedTables []skippedTable // what listTables skipped, for the init output
+
+	// comma separated patterns added to capture.tables and
+	// capture.exclude_tables
+	includeTables string
+	excludeTables string
+)
+
+// a relation in the public schema init leaves alone, and why
+type skippedTable struct {
+	Table  string `json:"table"`
+	Reason string `json:"reason"`
+}
+
+// list the public tables init instruments and copies, in name order, along
+// with the relations it skips. Views and foreign tables can't carry row
+// triggers, and a partitioned table's rows are captured by its partitions.
+// Temporary, catalog and TOAST relations never live in the public schema, so
+// they are never listed.
+func listTables() ([]string, []skippedTable, error) {
+	rows, err := dbConn.Query(`
+		SELECT c.relname, c.relkind, c.relpersistence
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND c.relkind IN ('r', 'p', 'v', 'm', 'f')
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch tables from database: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	var skipped []skippedTable
+	for rows.Next() {
+		var tableName, kind, persistence string
+		if err := rows.Scan(&tableName, &kind, &persistence); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan table name: %v", err)
+		}
+		reason := skipReason(kind, persistence)
+		if reason == "" && !cfg.Capture.Tracks(tableName) {
+			reason = excludedReason
+		}
+		if reason != "" {
+			skipped = append(skipped, skippedTable{tableName, reason})
+			continue
+		}
+		tables = append(tables, tableName)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating over tables: %v", err)
+	}
+	return tables, skipped, nil
+}
+
+// why a relation of the given pg_class relkind and relpersistence is
+// skipped, or "" to track it
+func skipReason(kind, persistence string) string {
+	switch kind {
+	case "v":
+		return "view"
+	case "m":
+		return "materialized view"
+	case "f":
+		return "foreign table"
+	case "p":
+		return "partitioned table, its partitions are tracked instead"
+	}
+	switch {
+	case persistence == "t":
+		return "temporary table"
+	case persistence == "u" && skipUnlogged:
+		return "unlogged table (-skip-unlogged)"
+	}
+	return ""
+}
+
+// the skip reason of tables left out by capture.tables and
+// capture.exclude_tables
+const excludedReason = "excluded by capture.tables or capture.exclude_tables"
+
+// add the -tables and -exclude-tables patterns to the config's
+func applyTableFlags() {
+	for _, p := range []struct {
+		flag string
+		dest *[]string
+	}{{includeTables, &cfg.Capture.Tables}, {excludeTables, &cfg.Capture.ExcludeTables}} {
+		for _, pattern := range strings.Split(p.flag, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				*p.dest = append(*p.dest, pattern)
+			}
+		}
+	}
+}
+
+// remove the triggers an earlier init installed on tables now excluded, and
+// forget that it did, so including them again installs them afresh
+func dropExcludedTriggers(skipped []skippedTable) error {
+	for _, s := range skipped {
+		if s.Reason != excludedReason {
+			continue
+		}
+		var installed bool
+		err := dbConn.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM pg_trigger
+				WHERE tgrelid = $1::regclass AND tgname = $2 AND NOT tgisinternal
+			)
+		`, ident.Quote(s.Table), s.Table+"_trigger").Scan(&installed)
+		if err != nil {
+			return fmt.Errorf("failed to look for a trigger on %s: %v", s.Table, err)
+		}
+		if !installed {
+			continue
+		}
+		err = withLockRetry("removing the trigger from "+s.Table, func(tx *sql.Tx) error {
+			_, err := tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s; DROP FUNCTION IF EXISTS %s()",
+				ident.TriggerName(s.Table), ident.Quote(s.Table), ident.TriggerFunc(s.Table)))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				DELETE FROM delta_tracker.init_progress
+				WHERE table_name = $1 AND (step = $2 OR step LIKE $2 || ':%')
+			`, s.Table, stepTrigger)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove the trigger from %s: %v", s.Table, err)
+		}
+		log.Printf("Removed the trigger from %s, which is now excluded.", s.Table)
+	}
+	return nil
+}
+
+// tables without the named one
+func removeTable(tables []string, name string) []string {
+	kept := tables[:0]
+	for _, t := range tables {
+		if t != name {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// log the relations listTables skipped, and keep them for the init output
+func logSkipped(skipped []skippedTable) {
+	skippedTables = skipped
+	for _, s := range skipped {
+		log.Printf("Skipping %s: %s.", s.Table, s.Reason)
+	}
+}
+
+// why a table is left out of the initial backup, or "" to back it up
+func excludedFromBackup(tableName string) string {
+	switch {
+	case tableName == "deltas" && !cfg.Backup.IncludeDeltas:
+		return "it is the delta log (set backup.include_deltas to copy it)"
+	case cfg.Backup.Excludes(tableName):
+		return "it matches backup.exclude"
+	}
+	return ""
+}
@@ -1,29 +1,61 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-
-	_ "github.com/lib/pq"
+	"os"
+	"sync"
+
+	"db-delta-tracker/pkg/backup"
+	"db-delta-tracker/pkg/capture"
+	"db-delta-tracker/pkg/config"
+	"db-delta-tracker/pkg/envflag"
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/opslog"
+	"db-delta-tracker/pkg/output"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
 )
 
 var (
-	dbConn        *sql.DB
-	originalDB    *sql.DB
-	dbName        = ""
-	restoreDB     = fmt.Sprintf("%s_restored", dbName)
+	dbConn     *sql.DB
+	originalDB *sql.DB
+	cfg        *config.Config // settings loaded from the config file
+	dbName     string         // original database name, from the config
+	restoreDB  string         // restored database name, from the config
+
+	// storage options for the deltas table
+	deltasUnlogged   bool   // skip WAL for the deltas table
+	deltasTablespace string // tablespace to keep the deltas table in
+
+	matchLocale bool // create the restored database with the original's encoding and locale
+
+	outputFormat = output.Table // set by -output
+
+	// this run in the operations log, once connected
+	operation    *opslog.Operation
+	auditCommand = "init"
 )
 
-// initialize the DB connection to the default "postgres" database
-func initDB() error {
-	var err error
-	connStr := "user= password= dbname= sslmode=disable" // MUST FILL IN USERNAME AND PASSWORD
-	dbConn, err = sql.Open("postgres", connStr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to the database: %v", err)
+// initialize the DB connection to the original database
+func initDB(configPath, profile string) error {
+	if err := openDB(configPath, profile); err != nil {
+		return err
+	}
+
+	// create the tool's metadata schema
+	if err := createMetadataSchema(); err != nil {
+		return err
+	}
+	if initRestart {
+		if err := clearProgress(); err != nil {
+			return err
+		}
 	}
 
 	// create the deltas table in the original database
@@ -31,6 +63,11 @@ func initDB() error {
 		return fmt.Errorf("failed to create deltas table: %v", err)
 	}
 
+	// keep tracking tables through renames
+	if err := installRenameTracking(); err != nil {
+		return err
+	}
+
 	// add triggers to all tables in the original database
 	if err := addTriggersToTables(); err != nil {
 		return fmt.Errorf("failed to add triggers to tables: %v", err)
@@ -40,108 +77,180 @@ func initDB() error {
 	return nil
 }
 
+// load the config and open the connection to the original database
+func openDB(configPath, profile string) error {
+	var err error
+	cfg, err = config.Load(configPath, profile)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Config, err)
+	}
+	applyTableFlags()
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return exitcode.Wrap(exitcode.Config, fmt.Errorf("invalid config: %v", errs[0]))
+	}
+	dbName, restoreDB = cfg.Source.DBName, cfg.Target.DBName
+	if cfg.Profile != "" {
+		log.Printf("Using profile %s.", cfg.Profile)
+	}
+
+	dbConn, err = cfg.Source.Open()
+	if err != nil {
+		return exitcode.Wrap(exitcode.Config, fmt.Errorf("invalid connection settings: %v", err))
+	}
+	if err := dbConn.Ping(); err != nil {
+		return exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to connect to the database: %v", err))
+	}
+	startOperation()
+	return nil
+}
+
+// record this run in the operations log, on a connection of its own so it
+// outlasts dbConn; a failure to is only a warning
+func startOperation() {
+	conn, err := cfg.Source.Open()
+	if err == nil {
+		operation, err = opslog.Start(conn, auditCommand, os.Args[1:])
+	}
+	if err != nil {
+		log.Printf("Warning: not recording this run in the operations log: %v", err)
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// record how this run ended in the operations log, if it is recorded there
+func finishOperation(code int, err error) {
+	if operation == nil {
+		return
+	}
+	if err := operation.Finish(code, err); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	operation = nil
+}
+
+// exit with a status, recording it in the operations log first
+func exit(code int) {
+	finishOperation(code, nil)
+	os.Exit(code)
+}
+
 // create the deltas table (if it doesn't exist)
 func createDeltasTable() error {
-	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS deltas (
-		id SERIAL PRIMARY KEY,
-		action VARCHAR(10),
-		table_name VARCHAR(100),
-		old_data JSONB,
-		new_data JSONB,
-		timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-	_, err := dbConn.Exec(createTableQuery)
+	capturer, err := newCapture()
 	if err != nil {
-		return fmt.Errorf("failed to create deltas table: %v", err)
+		return err
+	}
+	if err := capturer.CreateDeltasTable(context.Background()); err != nil {
+		return err
 	}
 	log.Println("Deltas table created (or already exists).")
+	if deltasUnlogged {
+		log.Println("Deltas table is UNLOGGED: it is emptied after a crash and not replicated to standbys.")
+	}
+	if deltasTablespace != "" {
+		log.Printf("Deltas table is stored in tablespace %s.", deltasTablespace)
+	}
 	return nil
 }
 
-// add triggers to track changes in all tables in the original database
+// the capture installer for the original database, with init's options
+func newCapture() (*capture.Tracker, error) {
+	sample, err := cfg.Capture.SampleWindows() // checked by Validate
+	if err != nil {
+		return nil, err
+	}
+	return capture.New(dbConn, capture.Options{
+		Unlogged:   deltasUnlogged,
+		Tablespace: deltasTablespace,
+		Origin:     cfg.Origin,
+		Statements: captureStatements,
+
+		ExcludeRoles:        cfg.Capture.ExcludeRoles,
+		ExcludeApplications: cfg.Capture.ExcludeApplications,
+		Sample:              sample,
+		ExcludeColumns:      cfg.Capture.ExcludeColumns,
+		Mask:                captureMask(),
+		RecordLSN:           cfg.WAL.RecordLSN,
+	})
+}
+
+// add triggers to track changes in all tables in the original database,
+// a batch of tables per transaction and several batches at once; progress is
+// recorded so a rerun only instruments the tables still missing a trigger
 func addTriggersToTables() error {
 	
-	// query to get all tables in the testdatabase
-	tablesQuery := "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public';"
-	rows, err := dbConn.Query(tablesQuery)
+	tables, skipped, err := listTables()
 	if err != nil {
-		return fmt.Errorf("failed to fetch tables from database: %v", err)
+		return err
+	}
+	logSkipped(skipped)
+	if err := dropExcludedTriggers(skipped); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	// add triggers for each table in testdatabase
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return fmt.Errorf("failed to scan table name: %v", err)
-		}
+	// skip the 'deltas' table (tracking triggers just in other databases)
+	tables = removeTable(tables, "deltas")
 
-		// skip the 'deltas' table (tracking triggers just in other databases)
-		if tableName == "deltas" {
-			continue
-		}
+	pending, err := pendingTables(triggerStep(), tables)
+	if err != nil {
+		return err
+	}
+	pending, err = orderByActivity(pending)
+	if err != nil {
+		return err
+	}
 
-		// create trigger function for INSERT, UPDATE, DELETE actions
-		triggerFuncQuery := fmt.Sprintf(`
-		CREATE OR REPLACE FUNCTION log_%s_changes() RETURNS TRIGGER AS $$
-		BEGIN
-			-- Log INSERT action
-			IF (TG_OP = 'INSERT') THEN
-				INSERT INTO deltas (action, table_name, new_data)
-				VALUES ('INSERT', TG_TABLE_NAME, row_to_json(NEW));
-				RETURN NEW;
-			END IF;
-
-			-- Log UPDATE action
-			IF (TG_OP = 'UPDATE') THEN
-				INSERT INTO deltas (action, table_name, old_data, new_data)
-				VALUES ('UPDATE', TG_TABLE_NAME, row_to_json(OLD), row_to_json(NEW));
-				RETURN NEW;
-			END IF;
-
-			-- Log DELETE action
-			IF (TG_OP = 'DELETE') THEN
-				INSERT INTO deltas (action, table_name, old_data)
-				VALUES ('DELETE', TG_TABLE_NAME, row_to_json(OLD));
-				RETURN OLD;
-			END IF;
-
-			RETURN NULL;
-		END;
-		$$ LANGUAGE plpgsql;
-		`, tableName)
-
-		_, err := dbConn.Exec(triggerFuncQuery)
-		if err != nil {
-			return fmt.Errorf("failed to create trigger function for table %s: %v", tableName, err)
+	var mu sync.Mutex
+	done := len(tables) - len(pending)
+	return runBatches(pending, initBatchSize, func(batch []string) error {
+		what := fmt.Sprintf("adding triggers to %s", batch[0])
+		if len(batch) > 1 {
+			what = fmt.Sprintf("adding triggers to %s and %d more tables", batch[0], len(batch)-1)
 		}
-
-		// create the trigger that calls the above function
-		triggerQuery := fmt.Sprintf(`
-		CREATE TRIGGER %s_trigger
-		AFTER INSERT OR UPDATE OR DELETE ON %s
-		FOR EACH ROW EXECUTE FUNCTION log_%s_changes();
-		`, tableName, tableName, tableName)
-
-		_, err = dbConn.Exec(triggerQuery)
+		err := withLockRetry(what, func(tx *sql.Tx) error {
+			for _, tableName := range batch {
+				if err := installTrigger(tx, tableName); err != nil {
+					return err
+				}
+			}
+			return markTriggersDone(tx, batch)
+		})
 		if err != nil {
-			return fmt.Errorf("failed to create trigger for table %s: %v", tableName, err)
+			return err
 		}
 
-		log.Printf("Trigger added to table %s.", tableName)
-	}
+		mu.Lock()
+		done += len(batch)
+		log.Printf("Triggers added to %d of %d tables.", done, len(tables))
+		mu.Unlock()
+		return nil
+	})
+}
 
-	return nil
+// create the trigger function and trigger capturing a table's changes
+func installTrigger(tx *sql.Tx, tableName string) error {
+	capturer, err := newCapture()
+	if err != nil {
+		return err
+	}
+	return capturer.InstallTrigger(context.Background(), tx, tableName)
 }
 
-// reconnect to a specified database
+// reconnect to a specified database, with the target's login for the
+// restored database and the source's for any other
 func reconnectToDatabase(dbName string) (*sql.DB, error) {
-	connStr := fmt.Sprintf("user=postgres password=password dbname=%s sslmode=disable", dbName)
-	db, err := sql.Open("postgres", connStr)
+	conn := cfg.Source.WithDatabase(dbName)
+	if dbName == restoreDB {
+		conn = cfg.Target
+	}
+	db, err := conn.Open()
+	if err == nil {
+		err = db.Ping()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to reconnect to database %s: %v", dbName, err)
+		return nil, exitcode.Wrap(exitcode.Connection, fmt.Errorf("failed to reconnect to database %s: %v", dbName, err))
 	}
 	return db, nil
 }
@@ -159,7 +268,22 @@ func createRestoredDatabase() error {
 		return nil
 	}
 
-	_, err = dbConn.Exec(fmt.Sprintf("CREATE DATABASE %s;", restoreDB))
+	create := "CREATE DATABASE " + ident.Quote(restoreDB)
+	if matchLocale {
+		// template0, since template1 may have been created with another locale
+		var encoding, collate, ctype string
+		err := dbConn.QueryRow(`
+			SELECT pg_encoding_to_char(encoding), datcollate, datctype
+			FROM pg_database WHERE datname = current_database()
+		`).Scan(&encoding, &collate, &ctype)
+		if err != nil {
+			return fmt.Errorf("failed to read the original database's encoding: %v", err)
+		}
+		create += fmt.Sprintf(" TEMPLATE template0 ENCODING %s LC_COLLATE %s LC_CTYPE %s",
+			pq.QuoteLiteral(encoding), pq.QuoteLiteral(collate), pq.QuoteLiteral(ctype))
+		log.Printf("Creating %s with encoding %s and locale %s/%s, as the original.", restoreDB, encoding, collate, ctype)
+	}
+	_, err = dbConn.Exec(create)
 	if err != nil {
 		return fmt.Errorf("failed to create restored database %s: %v", restoreDB, err)
 	}
@@ -168,71 +292,67 @@ func createRestoredDatabase() error {
 	return nil
 }
 
-// backup a table as a JSON file
-func backupTable(tableName string) error {
+// backup a table as a JSON file, returning the transaction snapshot
+// (txid_current_snapshot) the backup was read at
+func backupTable(tableName string) (string, error) {
 	
 	// connect to the original database
 	originalDB, err := reconnectToDatabase(dbName)
 	if err != nil {
-		return fmt.Errorf("failed to reconnect to original database: %v", err)
+		return "", fmt.Errorf("failed to reconnect to original database: %v", err)
 	}
 	defer originalDB.Close()
 
-	// query to fetch all rows from the table
-	query := fmt.Sprintf("SELECT * FROM %s", tableName)
-	rows, err := originalDB.Query(query)
+	// read the table and its snapshot in one repeatable read transaction so the
+	// snapshot says exactly which changes the backup contains
+	rows, snapshot, err := readTable(originalDB, tableName)
 	if err != nil {
-		return fmt.Errorf("failed to fetch data from table %s: %v", tableName, err)
+		return "", err
 	}
-	defer rows.Close()
 
-	// get columns for the table
-	columns, err := rows.Columns()
+	// write the rows to the table's backup file
+	fileName, err := cfg.BackupFile(tableName)
 	if err != nil {
-		return fmt.Errorf("failed to get columns for table %s: %v", tableName, err)
+		return "", err
+	}
+	if err := backup.WriteFile(fileName, rows); err != nil {
+		return "", fmt.Errorf("failed to back up table %s: %v", tableName, err)
 	}
 
-	var allRows []map[string]interface{}
-	for rows.Next() {
-		
-		// create a slice to hold the column values
-		columnsValues := make([]interface{}, len(columns))
-		for i := range columnsValues {
-			columnsValues[i] = new(interface{})
-		}
+	log.Printf("Table %s successfully backed up as JSON.", tableName)
+	return snapshot, nil
+}
 
-		// scan the row into the slice
-		err := rows.Scan(columnsValues...)
-		if err != nil {
-			return fmt.Errorf("failed to scan row from table %s: %v", tableName, err)
-		}
+// the first and smallest page sizes a timed out table read is retried with
+const (
+	snapshotRetryPageSize = 10000
+	snapshotMinPageSize   = 100
+)
 
-		// map the column names to the corresponding values
-		rowMap := make(map[string]interface{})
-		for i, colName := range columns {
-			val := *(columnsValues[i].(*interface{}))
-			rowMap[colName] = val
+// read a table for its backup under timeouts.snapshot; with on_timeout:
+// retry, a read that times out is started over in pages of ids, halving the
+// page each time one times out again
+func readTable(db *sql.DB, tableName string) ([]tracker.Row, string, error) {
+	timeout, _ := cfg.Timeouts.Snapshot.Duration() // checked by Validate
+	opts := backup.Options{StatementTimeout: timeout}
+	for {
+		rows, snapshot, err := backup.Table(context.Background(), db, tableName, opts)
+		if err == nil || !backup.IsTimeout(err) {
+			return rows, snapshot, err
 		}
 
-		// add the row map to the allRows slice
-		allRows = append(allRows, rowMap)
-	}
-
-	// serialize the rows to JSON
-	fileName := fmt.Sprintf("%s.json", tableName)
-	data, err := json.Marshal(allRows)
-	if err != nil {
-		return fmt.Errorf("failed to serialize data to JSON for table %s: %v", tableName, err)
-	}
-
-	// write the JSON data to a file
-	err = ioutil.WriteFile(fileName, data, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write JSON data for table %s: %v", tableName, err)
+		switch {
+		case !cfg.Timeouts.Snapshot.Retry():
+			return nil, "", fmt.Errorf("reading %s took longer than timeouts.snapshot.statement (%s): %v", tableName, timeout, err)
+		case opts.PageSize == 0:
+			opts.PageSize = snapshotRetryPageSize
+		case opts.PageSize/2 < snapshotMinPageSize:
+			return nil, "", fmt.Errorf("reading %s in pages of %d rows still took longer than %s: %v", tableName, opts.PageSize, timeout, err)
+		default:
+			opts.PageSize /= 2
+		}
+		log.Printf("Reading %s timed out after %s, retrying %d rows at a time.", tableName, timeout, opts.PageSize)
 	}
-
-	log.Printf("Table %s successfully backed up as JSON.", tableName)
-	return nil
 }
 
 // restore a table from a JSON file
@@ -245,41 +365,37 @@ func restoreTable(tableName string) error {
 	}
 	defer restoredDB.Close()
 
-	// read the JSON file containing the backup data
-	fileName := fmt.Sprintf("%s.json", tableName)
-	fileData, err := ioutil.ReadFile(fileName)
+	// read the table's backup file
+	rows, err := tracker.FileSnapshots(cfg.BackupFile).Snapshot(context.Background(), tableName)
 	if err != nil {
-		return fmt.Errorf("failed to read JSON file for table %s: %v", tableName, err)
+		return err
 	}
 
-	// deserialize the JSON data
-	var rows []map[string]interface{}
-	err = json.Unmarshal(fileData, &rows)
+	// create the table in the restored database the way it is defined in the
+	// original, so replayed inserts get the same defaults and checks
+	definition, err := tableDefinition(dbConn, tableName)
 	if err != nil {
-		return fmt.Errorf("failed to deserialize JSON data for table %s: %v", tableName, err)
+		return err
 	}
-
-	// create the table in the restored database (assuming schema matches)
-	createTableQuery := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id SERIAL PRIMARY KEY,
-			name VARCHAR(100),
-			age INT
-		);`, tableName)
-	_, err = restoredDB.Exec(createTableQuery)
-	if err != nil {
-		return fmt.Errorf("failed to create restored table %s: %v", tableName, err)
+	for _, statement := range definition {
+		if _, err := restoredDB.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create restored table %s: %v", tableName, err)
+		}
 	}
 
-	// prepare the insert query based on the columns in the table
-	// 		assuming a simple table schema for now; adjust as needed
-	insertQuery := fmt.Sprintf("INSERT INTO %s (id, name, age) VALUES ($1, $2, $3)", tableName)
-
 	// insert each row into the restored table
-	for _, row := range rows {
-		_, err := restoredDB.Exec(insertQuery, row["id"], row["name"], row["age"])
-		if err != nil {
-			return fmt.Errorf("failed to insert data into restored table %s: %v", tableName, err)
+	if err := backup.Load(context.Background(), restoredDB, tableName, rows); err != nil {
+		return err
+	}
+
+	// then index it the way the original is, so it can stand in for it
+	indexes, err := tableIndexes(dbConn, restoredDB, tableName)
+	if err != nil {
+		return err
+	}
+	for _, statement := range indexes {
+		if _, err := restoredDB.Exec(statement); err != nil {
+			log.Printf("Warning: failed to index restored table %s: %v (%s)", tableName, err, statement)
 		}
 	}
 
@@ -287,69 +403,140 @@ func restoreTable(tableName string) error {
 	return nil
 }
 
-// backup and restore all tables
-func backupAndRestoreTables() error {
-	// connect to the original database
-	originalDB, err := reconnectToDatabase(dbName)
+// backup and restore all tables, several at once; each table's backup
+// snapshot is recorded so replay skips the changes it already contains, and
+// a rerun only copies the tables not done yet
+func backupAndRestoreTables() ([]string, error) {
+	// fetch the list of tables to backup
+	listed, _, err := listTables()
 	if err != nil {
-		return fmt.Errorf("failed to reconnect to original database: %v", err)
+		return nil, err
 	}
-	defer originalDB.Close()
 
-	// connect to the restored database
-	restoredDB, err := reconnectToDatabase(restoreDB)
-	if err != nil {
-		return fmt.Errorf("failed to connect to restored database: %v", err)
+	var tables []string
+	for _, tableName := range listed {
+		if reason := excludedFromBackup(tableName); reason != "" {
+			log.Printf("Not backing up %s: %s.", tableName, reason)
+			continue
+		}
+		tables = append(tables, tableName)
 	}
-	defer restoredDB.Close()
 
-	// fetch the list of tables to backup
-	tablesQuery := "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public';"
-	rows, err := originalDB.Query(tablesQuery)
+	pending, err := pendingTables(stepBackup, tables)
 	if err != nil {
-		return fmt.Errorf("failed to fetch tables from original database: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	// backup and restore each table
-	for rows.Next() {
-		var tableName string
-		err := rows.Scan(&tableName)
-		if err != nil {
-			return fmt.Errorf("failed to scan table name: %v", err)
-		}
 
-		// Backup and restore the table
-		if err := backupTable(tableName); err != nil {
-			return fmt.Errorf("failed to backup table %s: %v", tableName, err)
-		}
-		if err := restoreTable(tableName); err != nil {
-			return fmt.Errorf("failed to restore table %s: %v", tableName, err)
+	// backup and restore each table, replacing whatever an interrupted run
+	// left in the restored copy
+	err = runBatches(pending, 1, func(batch []string) error {
+		if err := resnapshotTable(batch[0], "init"); err != nil {
+			return err
 		}
+		return markDone(dbConn, stepBackup, batch)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	log.Println("Backup and restore completed successfully.")
-	return nil
+	return pending, nil
+}
+
+// log a fatal error and exit with the status for its class (see pkg/exitcode)
+func fatal(err error, prefix string) {
+	log.Printf("%s: %v", prefix, err)
+	finishOperation(exitcode.Of(err), err)
+	os.Exit(exitcode.Of(err))
 }
 
 func main() {
+	flag.BoolVar(&deltasUnlogged, "unlogged", false, "create the deltas table UNLOGGED (less WAL, but emptied after a crash)")
+	flag.StringVar(&deltasTablespace, "tablespace", "", "tablespace to store the deltas table in")
+	configPath := flag.String("config", config.DefaultPath, "path to the config file")
+	profile := flag.String("profile", "", "config profile (environment) to use")
+	flag.Var(&outputFormat, "output", "result format: table or json")
+	flag.IntVar(&initBatchSize, "batch-size", initBatchSize, "tables to add triggers to per transaction")
+	flag.IntVar(&initParallel, "parallel", initParallel, "batches of tables to work on at once")
+	flag.BoolVar(&initRestart, "restart", false, "ignore the progress of an earlier, interrupted init and redo every table")
+	flag.DurationVar(&lockTimeout, "lock-timeout", lockTimeout, "how long adding a trigger may wait for a table lock before backing off (0 = wait forever)")
+	flag.IntVar(&lockRetries, "lock-retries", lockRetries, "how many times to retry a batch after a lock timeout")
+	flag.DurationVar(&lockBackoff, "lock-backoff", lockBackoff, "wait before the first retry after a lock timeout, doubled after each")
+	flag.BoolVar(&quietestFirst, "quietest-first", quietestFirst, "add triggers to the least written tables first")
+	flag.StringVar(&captureStatements, "capture-statements", "off", "record the statement behind each change: off, text or fingerprint (literals replaced by ?)")
+	flag.BoolVar(&matchLocale, "match-locale", false, "create the restored database with the original's encoding, collation and ctype")
+	flag.BoolVar(&skipUnlogged, "skip-unlogged", false, "don't add triggers to or copy UNLOGGED tables")
+	flag.StringVar(&includeTables, "tables", "", "only add triggers to and copy tables matching these comma separated names, globs or /regexps/")
+	flag.StringVar(&excludeTables, "exclude-tables", "", "don't add triggers to or copy tables matching these comma separated names, globs or /regexps/")
+	flag.StringVar(&canaryTables, "canary", "", "only add triggers to these comma separated tables, reporting write overhead before and after")
+	flag.DurationVar(&canaryWindow, "canary-window", canaryWindow, "how long -canary measures before and after adding triggers")
+	flag.Parse()
+	if err := envflag.Apply(flag.CommandLine); err != nil {
+		log.Printf("%v", err)
+		os.Exit(exitcode.Usage)
+	}
+	if initBatchSize < 1 || initParallel < 1 {
+		log.Printf("-batch-size and -parallel must be at least 1")
+		os.Exit(exitcode.Usage)
+	}
+	if statementExpr() == "" {
+		log.Printf("-capture-statements must be off, text or fingerprint")
+		os.Exit(exitcode.Usage)
+	}
+
+	// runs that return from here succeeded; failures finish in fatal
+	defer finishOperation(exitcode.OK, nil)
+
+	// `capture pause|resume` toggles tracking instead of initializing
+	if flag.Arg(0) == "capture" {
+		auditCommand = "init capture"
+		runCapture(*configPath, *profile, flag.Args()[1:])
+		return
+	}
+
+	// `snapshot <table>...` copies a few tables again, nothing more
+	if flag.Arg(0) == "snapshot" {
+		auditCommand = "init snapshot"
+		runSnapshot(*configPath, *profile, flag.Args()[1:])
+		return
+	}
+
+	// a canary instruments a few tables to measure overhead, nothing more
+	if canaryTables != "" {
+		auditCommand = "init canary"
+		runCanary(*configPath, *profile)
+		return
+	}
+
 	// initialize database connections
-	err := initDB()
+	err := initDB(*configPath, *profile)
 	if err != nil {
-		log.Fatalf("Failed to initialize the database: %v", err)
+		fatal(err, "Failed to initialize the database")
 	}
 
 	// create the restored database
 	err = createRestoredDatabase()
 	if err != nil {
-		log.Fatalf("Failed to create restored database: %v", err)
+		fatal(err, "Failed to create restored database")
+	}
+
+	// copy the types the table definitions use before creating any table
+	err = copySchemaTypes()
+	if err != nil {
+		fatal(err, "Failed to copy the schema's types")
 	}
 
 	// backup and restore all tables
-	err = backupAndRestoreTables()
+	tables, err := backupAndRestoreTables()
 	if err != nil {
-		log.Fatalf("Backup and restore failed: %v", err)
+		fatal(err, "Backup and restore failed")
 	}
 
 	log.Println("All tables backed up and restored successfully.")
+	outputFormat.Print(struct {
+		Database         string         `json:"database"`
+		RestoredDatabase string         `json:"restored_database"`
+		Tables           []string       `json:"tables"`
+		Skipped          []skippedTable `json:"skipped,omitempty"`
+	}{dbName, restoreDB, tables, skippedTables}, func() {})
 }
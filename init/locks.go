@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CREATE TRIGGER needs a lock that conflicts with writes to the table, and
+// while it waits behind a long transaction every new write queues behind it
+// too; so installs give up quickly, back off and try again later
+var (
+	lockTimeout   = 2 * time.Second // how long to wait for a table lock
+	lockRetries   = 5               // further attempts after a lock timeout
+	lockBackoff   = time.Second     // wait before the first retry, doubled after each
+	quietestFirst = true            // instrument the least written tables first
+)
+
+// order tables so the least written come first, putting the busiest, whose
+// locks are hardest to get, at the end where they hold up nothing else
+func orderByActivity(tables []string) ([]string, error) {
+	if !quietestFirst {
+		return tables, nil
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	activity, err := readTableActivity(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := append([]string(nil), tables...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return activity[ordered[i]].Writes < activity[ordered[j]].Writes
+	})
+	return ordered, nil
+}
+
+// run fn in a transaction whose lock waits are capped at lockTimeout,
+// retrying with exponential backoff while it fails on a lock timeout
+func withLockRetry(what string, fn func(tx *sql.Tx) error) error {
+	backoff := lockBackoff
+	for attempt := 0; ; attempt++ {
+		err := inLockTimeoutTx(fn)
+		if err == nil || !isLockTimeout(err) {
+			return err
+		}
+		if attempt >= lockRetries {
+			return fmt.Errorf("%s: gave up after %d attempts: %v", what, attempt+1, err)
+		}
+
+		log.Printf("%s: lock not granted within %s, retrying in %s.", what, lockTimeout, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func inLockTimeoutTx(fn func(tx *sql.Tx) error) error {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", lockTimeout.Milliseconds())); err != nil {
+		return fmt.Errorf("failed to set lock_timeout: %v", err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// report whether err (or what it wraps) is Postgres giving up on a lock
+func isLockTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "55P03"
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// steps of init recorded per table in delta_tracker.init_progress, so an
+// interrupted init resumes where it stopped instead of starting over
+const (
+	stepTrigger = "trigger" // capture trigger installed
+	stepBackup  = "backup"  // table copied into the restored database
+)
+
+var (
+	initBatchSize = 100 // tables instrumented per transaction
+	initParallel  = 4   // batches worked on at once
+	initRestart   bool  // forget recorded progress and redo every table
+)
+
+// list the tables that still need a step, in a stable order
+func pendingTables(step string, tables []string) ([]string, error) {
+	rows, err := dbConn.Query("SELECT table_name FROM delta_tracker.init_progress WHERE step = $1", step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read init progress: %v", err)
+	}
+	defer rows.Close()
+
+	done := make(map[string]bool)
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return nil, fmt.Errorf("failed to scan init progress: %v", err)
+		}
+		done[tableName] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over init progress: %v", err)
+	}
+
+	var pending []string
+	for _, tableName := range tables {
+		if !done[tableName] {
+			pending = append(pending, tableName)
+		}
+	}
+	if skipped := len(tables) - len(pending); skipped > 0 {
+		log.Printf("Resuming: %s already done for %d of %d tables.", step, skipped, len(tables))
+	}
+	return pending, nil
+}
+
+// the parts of *sql.DB and *sql.Tx progress is recorded through
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// record a step as done for the given tables
+func markDone(db execer, step string, tables []string) error {
+	_, err := db.Exec(`
+		INSERT INTO delta_tracker.init_progress (table_name, step)
+		SELECT unnest($1::text[]), $2
+		ON CONFLICT DO NOTHING
+	`, pq.Array(tables), step)
+	if err != nil {
+		return fmt.Errorf("failed to record init progress: %v", err)
+	}
+	return nil
+}
+
+// record triggers as installed with the current statement mode, replacing
+// any record of them installed with another
+func markTriggersDone(db execer, tables []string) error {
+	_, err := db.Exec(`
+		DELETE FROM delta_tracker.init_progress
+		WHERE table_name = ANY($1) AND (step = $2 OR step LIKE $2 || ':%')
+	`, pq.Array(tables), stepTrigger)
+	if err != nil {
+		return fmt.Errorf("failed to record init progress: %v", err)
+	}
+	return markDone(db, triggerStep(), tables)
+}
+
+// forget all recorded progress, for -restart
+func clearProgress() error {
+	if _, err := dbConn.Exec("DELETE FROM delta_tracker.init_progress"); err != nil {
+		return fmt.Errorf("failed to clear init progress: %v", err)
+	}
+	log.Println("Init progress cleared, every table will be processed again.")
+	return nil
+}
+
+// split tables into batches and run work on up to initParallel of them at
+// once; no new batch starts after one fails, and the first error is returned
+func runBatches(tables []string, batchSize int, work func(batch []string) error) error {
+	batches := make(chan []string)
+	go func() {
+		defer close(batches)
+		for start := 0; start < len(tables); start += batchSize {
+			batches <- tables[start:min(start+batchSize, len(tables))]
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < max(1, initParallel); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					continue // drain so the producer can finish
+				}
+
+				if err := work(batch); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// install the event trigger that follows renames of tracked tables: the
+// tracking trigger and its function are renamed with the table, init's
+// progress moves to the new name, and a RENAME delta tells replay to rename
+// the restored copy at the same point in the stream. Event triggers need a
+// superuser, so without one renames are only warned about.
+func installRenameTracking() error {
+	_, err := dbConn.Exec(`
+	CREATE OR REPLACE FUNCTION delta_tracker.follow_renames() RETURNS event_trigger AS $$
+	DECLARE
+		cmd RECORD;
+		old_name TEXT;
+		new_name TEXT;
+	BEGIN
+		FOR cmd IN
+			SELECT * FROM pg_event_trigger_ddl_commands()
+			WHERE object_type = 'table' AND schema_name = 'public'
+		LOOP
+			-- the tracking trigger still carries the name the table had
+			SELECT left(t.tgname, -length('_trigger')), c.relname INTO old_name, new_name
+			FROM pg_trigger t
+			JOIN pg_class c ON c.oid = t.tgrelid
+			WHERE t.tgrelid = cmd.objid AND NOT t.tgisinternal
+			  AND t.tgname LIKE '%\_trigger'
+			  AND t.tgfoid = to_regproc(quote_ident('log_' || left(t.tgname, -length('_trigger')) || '_changes'));
+			IF old_name IS NULL OR old_name = new_name THEN
+				CONTINUE;
+			END IF;
+
+			EXECUTE format('ALTER TRIGGER %I ON %I RENAME TO %I', old_name || '_trigger', new_name, new_name || '_trigger');
+			EXECUTE format('ALTER FUNCTION %I() RENAME TO %I', 'log_' || old_name || '_changes', 'log_' || new_name || '_changes');
+			UPDATE delta_tracker.init_progress SET table_name = new_name WHERE table_name = old_name;
+
+			INSERT INTO deltas (action, table_name, old_data, new_data)
+			VALUES ('RENAME', new_name, jsonb_build_object('table', old_name), jsonb_build_object('table', new_name));
+		END LOOP;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP EVENT TRIGGER IF EXISTS delta_tracker_renames;
+	CREATE EVENT TRIGGER delta_tracker_renames ON ddl_command_end
+		WHEN TAG IN ('ALTER TABLE')
+		EXECUTE FUNCTION delta_tracker.follow_renames();
+	`)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42501" {
+		log.Printf("Warning: only a superuser can install the event trigger that follows table renames; renaming a tracked table will stop its deltas from reaching the restored copy.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to install rename tracking: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"db-delta-tracker/pkg/ident"
+
+	"github.com/lib/pq"
+)
+
+// copy what the table definitions may refer to into the restored database
+// before any table is created there: the source's extensions, then the enum
+// and domain types of its public schema. Whatever the restored database
+// already has is left as it is, so a rerun only adds what's new.
+func copySchemaTypes() error {
+	restoredDB, err := reconnectToDatabase(restoreDB)
+	if err != nil {
+		return fmt.Errorf("failed to reconnect to restored database: %v", err)
+	}
+	defer restoredDB.Close()
+
+	statements, err := schemaTypeStatements(dbConn, restoredDB)
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := restoredDB.Exec(s.statement); err != nil {
+			return fmt.Errorf("failed to create %s in the restored database: %v", s.name, err)
+		}
+		log.Printf("Created %s in the restored database.", s.name)
+	}
+	return nil
+}
+
+type schemaStatement struct {
+	name      string // e.g. "type mood", for messages
+	statement string
+}
+
+// the statements creating the source's extensions, enums and domains the
+// restored database doesn't have yet, in an order that creates each before
+// what uses it
+func schemaTypeStatements(source, restored *sql.DB) ([]schemaStatement, error) {
+	var statements []schemaStatement
+
+	rows, err := source.Query(`SELECT extname FROM pg_extension WHERE extname <> 'plpgsql' ORDER BY oid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the extensions: %v", err)
+	}
+	var extensions []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan an extension: %v", err)
+		}
+		extensions = append(extensions, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the extensions: %v", err)
+	}
+	for _, name := range extensions {
+		statements = append(statements, schemaStatement{"extension " + name, "CREATE EXTENSION IF NOT EXISTS " + ident.Quote(name)})
+	}
+
+	// enums and domains in the order they were created, so a domain over an
+	// enum or another domain comes after it
+	rows, err = source.Query(`
+		SELECT t.typname, t.typtype,
+			COALESCE((SELECT array_agg(e.enumlabel ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = t.oid), '{}'),
+			CASE WHEN t.typtype = 'd' THEN format_type(t.typbasetype, t.typtypmod) ELSE '' END,
+			t.typnotnull, COALESCE(t.typdefault, ''),
+			COALESCE((SELECT array_agg(pg_get_constraintdef(c.oid) ORDER BY c.conname) FROM pg_constraint c WHERE c.contypid = t.oid AND c.contype = 'c'), '{}')
+		FROM pg_type t
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		LEFT JOIN pg_depend d ON d.objid = t.oid AND d.deptype = 'e'
+		WHERE n.nspname = 'public' AND t.typtype IN ('e', 'd') AND d.objid IS NULL
+		ORDER BY t.oid
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the types: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, kind, baseType, def string
+		var notNull bool
+		var labels, checks []string
+		if err := rows.Scan(&name, &kind, pq.Array(&labels), &baseType, &notNull, &def, pq.Array(&checks)); err != nil {
+			return nil, fmt.Errorf("failed to scan a type: %v", err)
+		}
+
+		var exists bool
+		err := restored.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM pg_type t JOIN pg_namespace n ON n.oid = t.typnamespace
+			WHERE n.nspname = 'public' AND t.typname = $1)
+		`, name).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for type %s in the restored database: %v", name, err)
+		}
+		if exists {
+			continue
+		}
+
+		if kind == "e" {
+			quoted := make([]string, len(labels))
+			for i, label := range labels {
+				quoted[i] = pq.QuoteLiteral(label)
+			}
+			statements = append(statements, schemaStatement{"type " + name,
+				fmt.Sprintf("CREATE TYPE %s AS ENUM (%s)", ident.Quote(name), strings.Join(quoted, ", "))})
+			continue
+		}
+		statement := fmt.Sprintf("CREATE DOMAIN %s AS %s", ident.Quote(name), baseType)
+		if def != "" {
+			statement += " DEFAULT " + def
+		}
+		if notNull {
+			statement += " NOT NULL"
+		}
+		for _, check := range checks {
+			statement += " " + check
+		}
+		statements = append(statements, schemaStatement{"domain " + name, statement})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the types: %v", err)
+	}
+	return statements, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"db-delta-tracker/pkg/exitcode"
+	"db-delta-tracker/pkg/ident"
+)
+
+// what `snapshot` took, for -output json
+type snapshotResult struct {
+	Tables []tableSnapshot `json:"tables"`
+}
+
+type tableSnapshot struct {
+	Table       string     `json:"table"`
+	Mode        string     `json:"mode"`                   // full, changed_rows, or unchanged when skipped
+	ChangedKeys int        `json:"changed_keys,omitempty"` // read again by a changed_rows backup
+	BackupFile  string     `json:"backup_file,omitempty"`
+	TakenAt     *time.Time `json:"taken_at,omitempty"`
+}
+
+// handle `snapshot [-all] [-force] [-changed-rows] [<table>...]`: copy each
+// table again right now, replacing its backup and its restored copy, and
+// record the snapshot the copy was read at and the table's definition, so
+// restores of the table start from this copy and skip the deltas it already
+// contains. Tables without deltas since their last copy are skipped.
+func runSnapshot(configPath, profile string, args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	all := fs.Bool("all", false, "snapshot every table init copies")
+	force := fs.Bool("force", false, "copy tables again even if they have no deltas since their last copy")
+	changedRows := fs.Bool("changed-rows", false, "for tables with a single column key, read only the rows changed since the last copy and merge them into the backup")
+	fs.Parse(args)
+	tables := fs.Args()
+	if *all == (len(tables) > 0) {
+		log.Printf("Usage: snapshot [-force] [-changed-rows] -all | <table>...")
+		os.Exit(exitcode.Usage)
+	}
+
+	if err := openDB(configPath, profile); err != nil {
+		fatal(err, "Failed to connect to the database")
+	}
+	defer dbConn.Close()
+
+	if err := createMetadataSchema(); err != nil {
+		fatal(err, "Failed to prepare metadata")
+	}
+
+	if *all {
+		listed, _, err := listTables()
+		if err != nil {
+			fatal(err, "Failed to list tables")
+		}
+		for _, table := range listed {
+			if excludedFromBackup(table) == "" {
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	result := snapshotResult{Tables: []tableSnapshot{}}
+	for _, table := range tables {
+		var exists, tracked bool
+		err := dbConn.QueryRow(`
+			SELECT to_regclass($1) IS NOT NULL,
+				EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = to_regclass($1) AND tgname = $2)
+		`, ident.Quote(table), ident.TriggerName(table)).Scan(&exists, &tracked)
+		if err != nil {
+			fatal(err, "Failed to look up "+table)
+		}
+		if !exists {
+			log.Printf("Table %s does not exist.", table)
+			exit(exitcode.Usage)
+		}
+		if reason := excludedFromBackup(table); reason != "" {
+			log.Printf("Not snapshotting %s: %s.", table, reason)
+			exit(exitcode.Usage)
+		}
+		if !tracked {
+			log.Printf("Warning: %s has no tracking trigger; restores will have this copy but none of the changes after it. Run init to track it.", table)
+		}
+
+		taken, err := snapshotTable(table, tracked && !*force, *changedRows)
+		if err != nil {
+			fatal(err, "Failed to snapshot "+table)
+		}
+		result.Tables = append(result.Tables, taken)
+	}
+	outputFormat.Print(result, func() {})
+}
+
+// copy one table again, unless skipUnchanged and no delta changed it since
+// its last copy; with changedRows only the rows deltas changed are read
+func snapshotTable(table string, skipUnchanged, changedRows bool) (tableSnapshot, error) {
+	taken := tableSnapshot{Table: table, Mode: "full"}
+	since, err := lastSnapshot(table)
+	if err != nil {
+		return taken, err
+	}
+	if since != "" && skipUnchanged {
+		changed, err := changedSince(table, since)
+		if err != nil {
+			return taken, err
+		}
+		if !changed {
+			log.Printf("%s has no changes since its last copy; skipping it.", table)
+			taken.Mode = "unchanged"
+			return taken, nil
+		}
+	}
+
+	if taken.BackupFile, err = cfg.BackupFile(table); err != nil {
+		return taken, err
+	}
+	if since != "" && changedRows {
+		snapshot, keys, ok, err := backupChangedRows(table, since)
+		if err != nil {
+			return taken, err
+		}
+		if ok {
+			if err := reloadTable(table, snapshot, "snapshot"); err != nil {
+				return taken, err
+			}
+			log.Printf("Snapshot of %s taken from %d changed keys; restores of it start from %s.", table, keys, taken.BackupFile)
+			now := time.Now()
+			taken.Mode, taken.ChangedKeys, taken.TakenAt = "changed_rows", keys, &now
+			return taken, nil
+		}
+		log.Printf("%s has no single column key or no backup to merge into; copying it whole.", table)
+	}
+
+	if err := resnapshotTable(table, "snapshot"); err != nil {
+		return taken, err
+	}
+	log.Printf("Snapshot of %s taken; restores of it start from %s.", table, taken.BackupFile)
+	now := time.Now()
+	taken.TakenAt = &now
+	return taken, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"db-delta-tracker/pkg/capture"
+	"db-delta-tracker/pkg/mask"
+)
+
+// which SQL statement caused each change, as recorded in deltas.statement:
+// "off", "text" for the full statement, or "fingerprint" for the statement
+// with its literals replaced by ?, which also keeps values out of the log
+var captureStatements = "off"
+
+// the SQL expression the trigger functions record as the statement, or ""
+// for an unknown mode
+func statementExpr() string {
+	return capture.StatementExpr(captureStatements)
+}
+
+// version of the trigger function template; bump it when the template
+// changes so the next init reinstalls the functions on every table
+const triggerVersion = 2
+
+// the columns the trigger functions mask, none when mask.at is restore
+func captureMask() mask.Rules {
+	if !cfg.Mask.Capturing() {
+		return nil
+	}
+	return cfg.Mask.Columns
+}
+
+// the init_progress step for installed triggers; it names the template
+// version, statement mode, excluded sessions, sampled tables, excluded
+// columns and masked ones, so changing any of them reinstalls every trigger
+func triggerStep() string {
+	step := fmt.Sprintf("%s:%d", stepTrigger, triggerVersion)
+	if captureStatements != "off" {
+		step += ":" + captureStatements
+	}
+	if len(cfg.Capture.ExcludeRoles) > 0 || len(cfg.Capture.ExcludeApplications) > 0 || len(cfg.Capture.Sample) > 0 || len(cfg.Capture.ExcludeColumns) > 0 || len(captureMask()) > 0 {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%q %q %v", cfg.Capture.ExcludeRoles, cfg.Capture.ExcludeApplications, cfg.Capture.Sample)
+		// only when set, so existing installs keep their step
+		if len(cfg.Capture.ExcludeColumns) > 0 {
+			fmt.Fprintf(h, " %q", cfg.Capture.ExcludeColumns)
+		}
+		if mask := captureMask(); len(mask) > 0 {
+			fmt.Fprintf(h, " mask %s", mask)
+		}
+		step += fmt.Sprintf(":capture-%08x", h.Sum32())
+	}
+	return step
+}
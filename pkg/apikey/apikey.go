@@ -0,0 +1,225 @@
+// Package apikey manages the keys the daemon's HTTP API accepts besides its
+// token, kept in delta_tracker.api_keys on the original database. Each key
+// has a name, naming whoever uses it, and scopes limiting what it may do,
+// so every team can be given only the access it needs.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os/user"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/config"
+
+	"github.com/lib/pq"
+)
+
+// the scopes that aren't run: scopes
+const (
+	ReadStatus = "read:status" // GET /status
+	ReadJobs   = "read:jobs"   // GET /jobs and /jobs/<name>
+	ReadDeltas = "read:deltas" // GET /deltas and /warm-plan
+)
+
+// RunScope is the scope starting jobs that run a command needs, e.g.
+// run:restore.
+func RunScope(command string) string {
+	return "run:" + command
+}
+
+// Scopes lists every scope a key may be given.
+func Scopes() []string {
+	scopes := []string{ReadStatus, ReadJobs, ReadDeltas}
+	for _, command := range config.JobCommands {
+		scopes = append(scopes, RunScope(command))
+	}
+	return scopes
+}
+
+// Key is an API key as the table keeps it; the key itself is only kept
+// hashed, so it can't be read back.
+type Key struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Allows reports whether the key has a scope.
+func (k Key) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// keys are this prefix and 48 hex digits
+const prefix = "dtk_"
+
+// Create adds a key with a name no other unrevoked key has, returning the
+// key itself, which is shown this once. The table is created on first use.
+func Create(db *sql.DB, name string, scopes []string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("a key needs a name")
+	}
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("a key needs at least one scope (one of %s)", strings.Join(Scopes(), ", "))
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes() {
+			known = known || scope == s
+		}
+		if !known {
+			return "", fmt.Errorf("unknown scope %q (want one of %s)", scope, strings.Join(Scopes(), ", "))
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE SCHEMA IF NOT EXISTS delta_tracker;
+		CREATE TABLE IF NOT EXISTS delta_tracker.api_keys (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT[] NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS api_keys_active_name_idx ON delta_tracker.api_keys (name) WHERE revoked_at IS NULL;
+	`)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the API keys table: %v", err)
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate a key: %v", err)
+	}
+	key := prefix + hex.EncodeToString(random)
+	createdBy := "unknown"
+	if u, err := user.Current(); err == nil {
+		createdBy = u.Username
+	}
+	_, err = db.Exec(`
+		INSERT INTO delta_tracker.api_keys (name, key_hash, scopes, created_by)
+		VALUES ($1, $2, $3, $4)
+	`, name, hash(key), pq.Array(scopes), createdBy)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return "", fmt.Errorf("there is already a key named %s; revoke it first", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store key %s: %v", name, err)
+	}
+	return key, nil
+}
+
+// Revoke stops a key from being accepted. Revoked keys stay listed.
+func Revoke(db *sql.DB, name string) error {
+	exists, err := tableExists(db)
+	if err != nil {
+		return err
+	}
+	if exists {
+		res, err := db.Exec(`
+			UPDATE delta_tracker.api_keys SET revoked_at = CURRENT_TIMESTAMP
+			WHERE name = $1 AND revoked_at IS NULL
+		`, name)
+		if err != nil {
+			return fmt.Errorf("failed to revoke key %s: %v", name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("no key named %s", name)
+}
+
+// List returns every key, revoked ones included, oldest first.
+func List(db *sql.DB) ([]Key, error) {
+	keys := []Key{}
+	exists, err := tableExists(db)
+	if err != nil || !exists {
+		return keys, err
+	}
+	rows, err := db.Query(`
+		SELECT name, scopes, created_by, created_at, last_used_at, revoked_at
+		FROM delta_tracker.api_keys
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k Key
+		if err := rows.Scan(&k.Name, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan an API key: %v", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Any reports whether there is an unrevoked key.
+func Any(db *sql.DB) (bool, error) {
+	exists, err := tableExists(db)
+	if err != nil || !exists {
+		return false, err
+	}
+	var found bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM delta_tracker.api_keys WHERE revoked_at IS NULL)").Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up API keys: %v", err)
+	}
+	return found, nil
+}
+
+// Authenticate returns the unrevoked key a request presented, noting that it
+// was used, or nil if there is no such key.
+func Authenticate(db *sql.DB, key string) (*Key, error) {
+	if !strings.HasPrefix(key, prefix) {
+		return nil, nil
+	}
+	exists, err := tableExists(db)
+	if err != nil || !exists {
+		return nil, err
+	}
+	var k Key
+	err = db.QueryRow(`
+		UPDATE delta_tracker.api_keys SET last_used_at = CURRENT_TIMESTAMP
+		WHERE key_hash = $1 AND revoked_at IS NULL
+		RETURNING name, scopes, created_by, created_at, last_used_at
+	`, hash(key)).Scan(&k.Name, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up an API key: %v", err)
+	}
+	return &k, nil
+}
+
+// keys are random enough that an unsalted hash is as good as any
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func tableExists(db *sql.DB) (bool, error) {
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('delta_tracker.api_keys') IS NOT NULL").Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up the API keys table: %v", err)
+	}
+	return exists, nil
+}
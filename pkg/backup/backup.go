@@ -0,0 +1,156 @@
+// Package backup copies tables' rows out of a database and back into
+// another, the snapshot deltas are replayed on top of, for applications that
+// embed delta-tracker instead of running its commands.
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/compression"
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/objstore"
+	"db-delta-tracker/pkg/restore"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
+)
+
+// Options tune how Table reads a table.
+type Options struct {
+	// StatementTimeout caps each query; 0 keeps the server's statement_timeout.
+	StatementTimeout time.Duration
+
+	// PageSize reads the table this many rows per query, in key order (see
+	// restore.RowKey), so each query is small enough to finish within the
+	// timeout; 0 reads it in one query, as are tables without a key.
+	PageSize int
+}
+
+// Table reads every row of a table in one repeatable read transaction,
+// returning the rows and the transaction snapshot (txid_current_snapshot)
+// they were read at, which says exactly which changes the backup contains.
+// IsTimeout tells whether it failed because a query hit StatementTimeout.
+func Table(ctx context.Context, db *sql.DB, table string, opts Options) ([]tracker.Row, string, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin backup transaction for table %s: %v", table, err)
+	}
+	defer tx.Rollback()
+
+	if opts.StatementTimeout > 0 {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", opts.StatementTimeout.Milliseconds())); err != nil {
+			return nil, "", fmt.Errorf("failed to set statement_timeout: %v", err)
+		}
+	}
+
+	var snapshot string
+	if err := tx.QueryRowContext(ctx, "SELECT txid_current_snapshot()::text").Scan(&snapshot); err != nil {
+		return nil, "", fmt.Errorf("failed to read snapshot for table %s: %w", table, err)
+	}
+
+	// a table without a key can't be paged through, so it is read whole
+	var key []string
+	if opts.PageSize > 0 {
+		if key, err = restore.RowKey(ctx, db, table); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(key) == 0 {
+		all, err := readRows(ctx, tx, table, fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t", ident.Quote(table)))
+		return all, snapshot, err
+	}
+
+	// each page starts after the last key of the one before
+	columns := ident.List(key)
+	placeholders := make([]string, len(key))
+	for i := range key {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	var all []tracker.Row
+	page, err := readRows(ctx, tx, table, fmt.Sprintf("SELECT row_to_json(t)::text FROM (SELECT * FROM %s ORDER BY %s LIMIT %d) t", ident.Quote(table), columns, opts.PageSize))
+	next := fmt.Sprintf("SELECT row_to_json(t)::text FROM (SELECT * FROM %s WHERE (%s) > (%s) ORDER BY %s LIMIT %d) t",
+		ident.Quote(table), columns, strings.Join(placeholders, ", "), columns, opts.PageSize)
+	for {
+		if err != nil {
+			return nil, "", err
+		}
+		all = append(all, page...)
+		if len(page) < opts.PageSize {
+			return all, snapshot, nil
+		}
+		last := make([]interface{}, len(key))
+		for i, column := range key {
+			last[i] = page[len(page)-1][column]
+		}
+		page, err = readRows(ctx, tx, table, next, last...)
+	}
+}
+
+// run a query returning a table's rows as JSON, the way the triggers record
+// them, decoding each into a Row
+func readRows(ctx context.Context, tx *sql.Tx, table, query string, args ...interface{}) ([]tracker.Row, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch data from table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var all []tracker.Row
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to scan row from table %s: %v", table, err)
+		}
+		row, err := tracker.DecodeRow([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode row from table %s: %v", table, err)
+		}
+		all = append(all, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %w", table, err)
+	}
+	return all, nil
+}
+
+// IsTimeout reports whether err is a query cancelled by statement_timeout.
+func IsTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// WriteFile writes rows as the JSON file init keeps a table's backup in,
+// creating its directory if the path has one. The path may also be in object
+// storage (see objstore), and ending in .gz or .zst compresses the file.
+// tracker.FileSnapshots reads it back.
+func WriteFile(path string, rows []tracker.Row) error {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return fmt.Errorf("failed to serialize backup to JSON: %v", err)
+	}
+	if data, err = compression.Compress(path, data); err != nil {
+		return err
+	}
+	if err := objstore.WriteFile(context.Background(), path, data); err != nil {
+		return fmt.Errorf("failed to write backup %s: %v", path, err)
+	}
+	return nil
+}
+
+// Load inserts rows into a table that already exists in db, writing every
+// column each row has.
+func Load(ctx context.Context, db *sql.DB, table string, rows []tracker.Row) error {
+	for _, row := range rows {
+		query, args := restore.Insert(table, row)
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to insert data into restored table %s: %v", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+// Package capture instruments a database so every change to its tables is
+// recorded in a deltas table: what init does, for applications that embed
+// delta-tracker instead of running its commands.
+package capture
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/mask"
+
+	"github.com/lib/pq"
+)
+
+// Options control how the deltas table is stored and what the triggers record.
+type Options struct {
+	Unlogged   bool   // skip WAL for the deltas table; it is emptied after a crash
+	Tablespace string // tablespace to keep the deltas table in; empty for the default
+	Origin     string // label stamped on every delta, e.g. config.Config.Origin
+	Statements string // "off" (or empty), "text" or "fingerprint"; see StatementExpr
+
+	// sessions whose changes aren't recorded: logged in as or acting as one
+	// of the roles, or running under one of the application_names
+	ExcludeRoles        []string
+	ExcludeApplications []string
+
+	// tables whose updates are sampled: the updates of a row after the first
+	// change of a window are logged as one delta, holding its latest values,
+	// once the window ends; see sampledTriggerFunc
+	Sample map[string]time.Duration
+
+	// columns left out of the old and new values recorded for a table, e.g.
+	// password hashes or large blobs; "*" lists ones left out of every table
+	ExcludeColumns map[string][]string
+
+	// columns whose values are hashed or redacted before they are recorded
+	Mask mask.Rules
+
+	// record the WAL position in each mark, under "lsn"
+	RecordLSN bool
+}
+
+// Tracker installs change capture on one database.
+type Tracker struct {
+	db   *sql.DB
+	opts Options
+}
+
+// New returns a Tracker instrumenting the database db connects to. The caller
+// keeps ownership of db.
+func New(db *sql.DB, opts Options) (*Tracker, error) {
+	if opts.Statements == "" {
+		opts.Statements = "off"
+	}
+	if StatementExpr(opts.Statements) == "" {
+		return nil, fmt.Errorf("statement capture must be off, text or fingerprint, not %q", opts.Statements)
+	}
+	return &Tracker{db: db, opts: opts}, nil
+}
+
+// CreateDeltasTable creates the deltas table, or brings an existing one up to
+// date with the current columns and the Tracker's storage options, along with
+// the dbdelta_mark function applications record markers with.
+func (t *Tracker) CreateDeltasTable(ctx context.Context) error {
+	persistence := ""
+	if t.opts.Unlogged {
+		persistence = "UNLOGGED "
+	}
+	tablespace := ""
+	if t.opts.Tablespace != "" {
+		tablespace = " TABLESPACE " + ident.Quote(t.opts.Tablespace)
+	}
+
+	createTableQuery := fmt.Sprintf(`
+	CREATE %sTABLE IF NOT EXISTS deltas (
+		id SERIAL PRIMARY KEY,
+		action VARCHAR(10),
+		table_name VARCHAR(100),
+		old_data JSONB,
+		new_data JSONB,
+		timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		txid BIGINT DEFAULT txid_current(),
+		statement TEXT,
+		context JSONB
+	)%s;
+
+	-- older installs were created without the source transaction id
+	ALTER TABLE deltas ADD COLUMN IF NOT EXISTS txid BIGINT DEFAULT txid_current();
+	ALTER TABLE deltas ADD COLUMN IF NOT EXISTS statement TEXT;
+	ALTER TABLE deltas ADD COLUMN IF NOT EXISTS context JSONB;
+
+	-- every delta is stamped with where it came from
+	ALTER TABLE deltas ADD COLUMN IF NOT EXISTS origin TEXT;
+	ALTER TABLE deltas ALTER COLUMN origin SET DEFAULT %s;
+
+	-- and with the role that logged in to make it; older deltas have none
+	ALTER TABLE deltas ADD COLUMN IF NOT EXISTS db_user TEXT;
+	ALTER TABLE deltas ALTER COLUMN db_user SET DEFAULT session_user;
+	`, persistence, tablespace, pq.QuoteLiteral(t.opts.Origin))
+	if _, err := t.db.ExecContext(ctx, createTableQuery); err != nil {
+		return fmt.Errorf("failed to create deltas table: %v", err)
+	}
+
+	// bring an existing table in line with the requested storage options
+	if t.opts.Unlogged {
+		if _, err := t.db.ExecContext(ctx, "ALTER TABLE deltas SET UNLOGGED"); err != nil {
+			return fmt.Errorf("failed to make deltas table unlogged: %v", err)
+		}
+	}
+	if t.opts.Tablespace != "" {
+		if _, err := t.db.ExecContext(ctx, "ALTER TABLE deltas SET TABLESPACE "+ident.Quote(t.opts.Tablespace)); err != nil {
+			return fmt.Errorf("failed to move deltas table to tablespace %s: %v", t.opts.Tablespace, err)
+		}
+	}
+
+	// SELECT dbdelta_mark('order-batch-123') records a MARK delta at that
+	// point in the stream, which a restore can stop at
+	markData := "jsonb_build_object('label', label)"
+	if t.opts.RecordLSN {
+		markData = "jsonb_build_object('label', label, 'lsn', pg_current_wal_lsn())"
+	}
+	markFuncQuery := fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION dbdelta_mark(label TEXT) RETURNS INTEGER AS $$
+	DECLARE
+		raw_context TEXT := NULLIF(current_setting('dbdelta.context', true), '');
+		delta_context JSONB;
+		mark_id INTEGER;
+	BEGIN
+		IF raw_context IS NOT NULL THEN
+			BEGIN
+				delta_context := raw_context::jsonb;
+			EXCEPTION WHEN invalid_text_representation THEN
+				delta_context := to_jsonb(raw_context);
+			END;
+		END IF;
+
+		INSERT INTO deltas (action, table_name, new_data, context)
+		VALUES ('MARK', '', %s, delta_context)
+		RETURNING id INTO mark_id;
+		RETURN mark_id;
+	END;
+	$$ LANGUAGE plpgsql;
+	`, markData)
+	if _, err := t.db.ExecContext(ctx, markFuncQuery); err != nil {
+		return fmt.Errorf("failed to create dbdelta_mark function: %v", err)
+	}
+
+	if len(t.opts.Sample) > 0 {
+		if _, err := t.db.ExecContext(ctx, sampledRowsQuery); err != nil {
+			return fmt.Errorf("failed to create sampled rows table: %v", err)
+		}
+	}
+	return nil
+}
+
+// Track starts capturing a table's changes, replacing any trigger an earlier
+// install left on it.
+func (t *Tracker) Track(ctx context.Context, table string) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := t.InstallTrigger(ctx, tx, table); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InstallTrigger creates a table's trigger function and trigger inside tx, so
+// several tables can be instrumented in one transaction.
+func (t *Tracker) InstallTrigger(ctx context.Context, tx *sql.Tx, table string) error {
+	statement := StatementExpr(t.opts.Statements)
+
+	// create trigger function for INSERT, UPDATE, DELETE actions
+	triggerFuncQuery := fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION %[1]s() RETURNS TRIGGER AS $$
+	DECLARE
+		raw_context TEXT := NULLIF(current_setting('dbdelta.context', true), '');
+		delta_context JSONB;
+	BEGIN
+		-- application context set with SET dbdelta.context; a value that isn't
+		-- JSON is kept as a string rather than failing the application's write
+		IF raw_context IS NOT NULL THEN
+			BEGIN
+				delta_context := raw_context::jsonb;
+			EXCEPTION WHEN invalid_text_representation THEN
+				delta_context := to_jsonb(raw_context);
+			END;
+		END IF;
+
+		-- Log INSERT action
+		IF (TG_OP = 'INSERT') THEN
+			INSERT INTO deltas (action, table_name, new_data, statement, context)
+			VALUES ('INSERT', TG_TABLE_NAME, %[3]s, %[2]s, delta_context);
+			RETURN NEW;
+		END IF;
+
+		-- Log UPDATE action
+		IF (TG_OP = 'UPDATE') THEN
+			INSERT INTO deltas (action, table_name, old_data, new_data, statement, context)
+			VALUES ('UPDATE', TG_TABLE_NAME, %[4]s, %[3]s, %[2]s, delta_context);
+			RETURN NEW;
+		END IF;
+
+		-- Log DELETE action
+		IF (TG_OP = 'DELETE') THEN
+			INSERT INTO deltas (action, table_name, old_data, statement, context)
+			VALUES ('DELETE', TG_TABLE_NAME, %[4]s, %[2]s, delta_context);
+			RETURN OLD;
+		END IF;
+
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	`, ident.TriggerFunc(table), statement, t.rowData(table, "NEW"), t.rowData(table, "OLD"))
+	if window, ok := t.opts.Sample[table]; ok {
+		var err error
+		if triggerFuncQuery, err = t.sampledTriggerFunc(ctx, table, statement, window); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, triggerFuncQuery); err != nil {
+		return fmt.Errorf("failed to create trigger function for table %s: %w", table, err)
+	}
+
+	// create the trigger that calls the above function, replacing one left
+	// by an earlier, interrupted install
+	triggerQuery := fmt.Sprintf(`
+	DROP TRIGGER IF EXISTS %[1]s ON %[2]s;
+	CREATE TRIGGER %[1]s
+	AFTER INSERT OR UPDATE OR DELETE ON %[2]s
+	FOR EACH ROW %[3]sEXECUTE FUNCTION %[4]s();
+	`, ident.TriggerName(table), ident.Quote(table), t.when(), ident.TriggerFunc(table))
+
+	if _, err := tx.ExecContext(ctx, triggerQuery); err != nil {
+		return fmt.Errorf("failed to create trigger for table %s: %w", table, err)
+	}
+	return nil
+}
+
+// the trigger's WHEN clause leaving out changes made by excluded sessions,
+// or "" when none are excluded; it is checked before the trigger function
+// runs, so excluded writes cost next to nothing
+func (t *Tracker) when() string {
+	var conditions []string
+	if len(t.opts.ExcludeRoles) > 0 {
+		roles := quoteLiterals(t.opts.ExcludeRoles)
+		conditions = append(conditions, fmt.Sprintf("session_user::text <> ALL (ARRAY[%s]) AND current_user::text <> ALL (ARRAY[%s])", roles, roles))
+	}
+	if len(t.opts.ExcludeApplications) > 0 {
+		conditions = append(conditions, fmt.Sprintf("current_setting('application_name') <> ALL (ARRAY[%s])", quoteLiterals(t.opts.ExcludeApplications)))
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHEN (" + strings.Join(conditions, " AND ") + ") "
+}
+
+// the expression a trigger function records a row version as: the record
+// as JSON, without the table's excluded columns and with its masked ones
+// masked
+func (t *Tracker) rowData(table, record string) string {
+	excluded := append(append([]string{}, t.opts.ExcludeColumns["*"]...), t.opts.ExcludeColumns[table]...)
+	if len(excluded) == 0 && len(t.opts.Mask.For(table)) == 0 {
+		return "row_to_json(" + record + ")"
+	}
+	data := "to_jsonb(" + record + ")"
+	if len(excluded) > 0 {
+		data = fmt.Sprintf("(%s - ARRAY[%s]::text[])", data, quoteLiterals(excluded))
+	}
+	return t.opts.Mask.SQL(table, record, data)
+}
+
+func quoteLiterals(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = pq.QuoteLiteral(v)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// StatementExpr returns the SQL expression the trigger functions record in
+// deltas.statement for a mode: "off" records nothing, "text" the full
+// statement, and "fingerprint" the statement with its literals replaced by ?,
+// which also keeps values out of the log. It returns "" for an unknown mode.
+func StatementExpr(mode string) string {
+	switch mode {
+	case "off":
+		return "NULL"
+	case "text":
+		return "current_query()"
+	case "fingerprint":
+		// string literals, then numbers, then runs of whitespace
+		return `regexp_replace(regexp_replace(regexp_replace(current_query(),
+			'''(?:[^'']|'''')*''', '?', 'g'),
+			'\m-?\d+(?:\.\d+)?\M', '?', 'g'),
+			'\s+', ' ', 'g')`
+	}
+	return ""
+}
@@ -0,0 +1,198 @@
+package capture
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/restore"
+)
+
+// the table remembering, for each row of a sampled table, when its current
+// window ends and the latest values of the updates folded into it, which are
+// logged as a delta of their own once it has; and the function logging them.
+// Installs from before windows were logged at their end kept the id of the
+// delta folded into instead.
+const sampledRowsQuery = `
+	CREATE SCHEMA IF NOT EXISTS delta_tracker;
+	CREATE TABLE IF NOT EXISTS delta_tracker.sampled_rows (
+		table_name TEXT NOT NULL,
+		row_key TEXT NOT NULL,
+		window_end TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (table_name, row_key)
+	);
+	ALTER TABLE delta_tracker.sampled_rows DROP COLUMN IF EXISTS delta_id;
+	ALTER TABLE delta_tracker.sampled_rows DROP COLUMN IF EXISTS window_start;
+	ALTER TABLE delta_tracker.sampled_rows ADD COLUMN IF NOT EXISTS window_end TIMESTAMPTZ NOT NULL DEFAULT now();
+	ALTER TABLE delta_tracker.sampled_rows ADD COLUMN IF NOT EXISTS old_data JSONB;
+	ALTER TABLE delta_tracker.sampled_rows ADD COLUMN IF NOT EXISTS new_data JSONB;
+	ALTER TABLE delta_tracker.sampled_rows ADD COLUMN IF NOT EXISTS statement TEXT;
+	ALTER TABLE delta_tracker.sampled_rows ADD COLUMN IF NOT EXISTS context JSONB;
+	DROP INDEX IF EXISTS delta_tracker.sampled_rows_window;
+	CREATE INDEX IF NOT EXISTS sampled_rows_window_end ON delta_tracker.sampled_rows (window_end);
+
+	-- log the updates folded into up to max_rows windows that have ended, a
+	-- delta per row, and forget those windows; without waiting on rows other
+	-- transactions hold
+	CREATE OR REPLACE FUNCTION delta_tracker.flush_sampled_rows(max_rows INTEGER) RETURNS INTEGER AS $$
+	DECLARE
+		ended INTEGER;
+	BEGIN
+		WITH forgotten AS (
+			DELETE FROM delta_tracker.sampled_rows WHERE ctid IN (
+				SELECT ctid FROM delta_tracker.sampled_rows
+				WHERE window_end <= now()
+				ORDER BY window_end
+				LIMIT max_rows
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *
+		), logged AS (
+			INSERT INTO deltas (action, table_name, old_data, new_data, statement, context)
+			SELECT 'UPDATE', table_name, old_data, new_data, statement, context
+			FROM forgotten WHERE new_data IS NOT NULL
+			ORDER BY window_end
+		)
+		SELECT COUNT(*) INTO ended FROM forgotten;
+		RETURN ended;
+	END;
+	$$ LANGUAGE plpgsql;
+`
+
+// how many ended windows a trigger logs and forgets at a time, and how often
+// it does, as a fraction of the windows started
+const (
+	sampledExpireBatch = 1000
+	sampledExpireRate  = 0.01
+)
+
+// FlushSampled logs the updates folded into the windows of sampled rows that
+// have ended, for rows that haven't changed since; the triggers do it now
+// and then as well, but not for a table nothing writes to any more. It
+// returns how many windows it closed. Databases without sampled tables are
+// left alone.
+func FlushSampled(ctx context.Context, db *sql.DB) (int, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regproc('delta_tracker.flush_sampled_rows') IS NOT NULL").Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to look up sampled rows: %v", err)
+	}
+	total := 0
+	for exists {
+		var ended int
+		if err := db.QueryRowContext(ctx, "SELECT delta_tracker.flush_sampled_rows($1)", sampledExpireBatch).Scan(&ended); err != nil {
+			return total, fmt.Errorf("failed to log ended sample windows: %v", err)
+		}
+		total += ended
+		if ended < sampledExpireBatch {
+			break
+		}
+	}
+	return total, nil
+}
+
+// the trigger function of a sampled table (see Options.Sample): inserts and
+// deletes are recorded as usual, and so is the update that starts a row's
+// window, but further updates of the row within the window are folded into
+// sampled_rows instead, keeping the row's latest values. Once the window has
+// ended, they are logged as one update, under a new id like any other delta,
+// so readers that already passed the window's first delta still see it: by
+// the row's next change, by the trigger of another row now and then, or by
+// FlushSampled. Updates that change the key start over.
+func (t *Tracker) sampledTriggerFunc(ctx context.Context, table, statement string, window time.Duration) (string, error) {
+	key, err := restore.RowKey(ctx, t.db, table)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		return "", fmt.Errorf("table %s has no key to sample its rows by", table)
+	}
+	rowKey := func(record string) string {
+		columns := make([]string, len(key))
+		for i, column := range key {
+			columns[i] = record + "." + ident.Quote(column)
+		}
+		return "jsonb_build_array(" + strings.Join(columns, ", ") + ")::text"
+	}
+
+	// log, then forget, what was folded into a row's window
+	flushRow := func(key string) string {
+		return fmt.Sprintf(`
+		DELETE FROM delta_tracker.sampled_rows WHERE table_name = TG_TABLE_NAME AND row_key = %[1]s
+		RETURNING old_data, new_data, statement, context INTO v_old, v_new, v_statement, v_context;
+		IF v_new IS NOT NULL THEN
+			INSERT INTO deltas (action, table_name, old_data, new_data, statement, context)
+			VALUES ('UPDATE', TG_TABLE_NAME, v_old, v_new, v_statement, v_context);
+		END IF;`, key)
+	}
+
+	return fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION %[1]s() RETURNS TRIGGER AS $$
+	DECLARE
+		raw_context TEXT := NULLIF(current_setting('dbdelta.context', true), '');
+		delta_context JSONB;
+		v_key TEXT;
+		v_old JSONB;
+		v_new JSONB;
+		v_statement TEXT;
+		v_context JSONB;
+	BEGIN
+		IF raw_context IS NOT NULL THEN
+			BEGIN
+				delta_context := raw_context::jsonb;
+			EXCEPTION WHEN invalid_text_representation THEN
+				delta_context := to_jsonb(raw_context);
+			END;
+		END IF;
+
+		IF (TG_OP = 'DELETE') THEN
+			%[10]s
+			INSERT INTO deltas (action, table_name, old_data, statement, context)
+			VALUES ('DELETE', TG_TABLE_NAME, %[7]s, %[2]s, delta_context);
+			RETURN OLD;
+		END IF;
+
+		v_key := %[3]s;
+
+		-- fold an update into the row's open window, to be logged once it ends
+		IF (TG_OP = 'UPDATE') THEN
+			IF v_key = %[4]s THEN
+				UPDATE delta_tracker.sampled_rows
+				SET old_data = COALESCE(old_data, %[7]s), new_data = %[6]s, statement = %[2]s, context = delta_context
+				WHERE table_name = TG_TABLE_NAME AND row_key = v_key AND window_end > now();
+				IF FOUND THEN
+					RETURN NEW;
+				END IF;
+			END IF;
+
+			-- the window has ended, or the row is new to its key: log what
+			-- was folded into the windows before this change
+			%[10]s
+		END IF;
+		%[11]s
+
+		IF (TG_OP = 'UPDATE') THEN
+			INSERT INTO deltas (action, table_name, old_data, new_data, statement, context)
+			VALUES ('UPDATE', TG_TABLE_NAME, %[7]s, %[6]s, %[2]s, delta_context);
+		ELSE
+			INSERT INTO deltas (action, table_name, new_data, statement, context)
+			VALUES ('INSERT', TG_TABLE_NAME, %[6]s, %[2]s, delta_context);
+		END IF;
+
+		-- the row's window starts with this delta
+		INSERT INTO delta_tracker.sampled_rows (table_name, row_key, window_end)
+		VALUES (TG_TABLE_NAME, v_key, now() + interval '%[5]d milliseconds');
+
+		-- log the windows that have ended, of any table, now and then
+		IF random() < %[8]g THEN
+			PERFORM delta_tracker.flush_sampled_rows(%[9]d);
+		END IF;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+	`, ident.TriggerFunc(table), statement, rowKey("NEW"), rowKey("OLD"), window.Milliseconds(),
+		t.rowData(table, "NEW"), t.rowData(table, "OLD"), sampledExpireRate, sampledExpireBatch,
+		flushRow(rowKey("OLD")), flushRow("v_key")), nil
+}
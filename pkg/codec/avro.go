@@ -0,0 +1,279 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// Avro writes an Avro object container file of Delta records, as AvroSchema
+// describes them, one block per delta and uncompressed. Row payloads stay
+// JSON text, since their columns differ from table to table.
+var Avro Codec = avroCodec{}
+
+// AvroSchema is the schema of the records the Avro codec writes, and of the
+// single records EncodeAvro returns.
+const AvroSchema = `{"type":"record","name":"Delta","namespace":"deltatracker","fields":[` +
+	`{"name":"id","type":"long"},` +
+	`{"name":"action","type":"string"},` +
+	`{"name":"table_name","type":"string"},` +
+	`{"name":"old_data","type":["null","string"],"default":null},` +
+	`{"name":"new_data","type":["null","string"],"default":null},` +
+	`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-micros"}},` +
+	`{"name":"txid","type":"long"},` +
+	`{"name":"statement","type":"string","default":""},` +
+	`{"name":"context","type":["null","string"],"default":null},` +
+	`{"name":"origin","type":"string","default":""}]}`
+
+type avroCodec struct{}
+
+func (avroCodec) Name() string      { return "avro" }
+func (avroCodec) Extension() string { return ".avro" }
+
+func (avroCodec) NewEncoder(w io.Writer) Encoder { return newAvroEncoder(w) }
+func (avroCodec) NewDecoder(r io.Reader) Decoder { return &avroDecoder{r: bufio.NewReader(r)} }
+
+// the magic bytes starting every object container file
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+type avroEncoder struct {
+	w    io.Writer
+	sync []byte // marker after every block
+	buf  []byte
+	err  error // writing the header, returned by the first Encode
+}
+
+// write the header straight away, so a stream without deltas is still a
+// valid, empty file
+func newAvroEncoder(w io.Writer) *avroEncoder {
+	e := &avroEncoder{w: w, sync: make([]byte, 16)}
+	if _, e.err = rand.Read(e.sync); e.err != nil {
+		return e
+	}
+	b := append([]byte(nil), avroMagic...)
+	b = appendAvroLong(b, 2) // metadata map: one block of two entries
+	b = appendAvroString(b, "avro.schema")
+	b = appendAvroString(b, AvroSchema)
+	b = appendAvroString(b, "avro.codec")
+	b = appendAvroString(b, "null")
+	b = appendAvroLong(b, 0)
+	b = append(b, e.sync...)
+	_, e.err = w.Write(b)
+	return e
+}
+
+func (e *avroEncoder) Encode(d tracker.Delta) error {
+	if e.err != nil {
+		return e.err
+	}
+	record := EncodeAvro(d)
+	b := appendAvroLong(e.buf[:0], 1)
+	b = appendAvroLong(b, int64(len(record)))
+	b = append(b, record...)
+	b = append(b, e.sync...)
+	e.buf = b
+	_, err := e.w.Write(b)
+	return err
+}
+
+// EncodeAvro returns a delta as a single Avro record in AvroSchema, without
+// any framing, e.g. for the body of a Kafka message.
+func EncodeAvro(d tracker.Delta) []byte {
+	var b []byte
+	b = appendAvroLong(b, d.ID)
+	b = appendAvroString(b, d.Action)
+	b = appendAvroString(b, d.TableName)
+	b = appendAvroOptional(b, d.OldData)
+	b = appendAvroOptional(b, d.NewData)
+	b = appendAvroLong(b, d.Timestamp.UnixMicro())
+	b = appendAvroLong(b, d.TxID)
+	b = appendAvroString(b, d.Statement)
+	b = appendAvroOptional(b, d.Context)
+	b = appendAvroString(b, d.Origin)
+	return b
+}
+
+// longs and ints are zigzag varints
+func appendAvroLong(b []byte, v int64) []byte {
+	return binary.AppendVarint(b, v)
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = appendAvroLong(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// a ["null","string"] union holding JSON, or null
+func appendAvroOptional(b []byte, raw *json.RawMessage) []byte {
+	if raw == nil {
+		return appendAvroLong(b, 0)
+	}
+	b = appendAvroLong(b, 1)
+	b = appendAvroLong(b, int64(len(*raw)))
+	return append(b, *raw...)
+}
+
+type avroDecoder struct {
+	r       *bufio.Reader
+	sync    []byte // read from the header; nil until then
+	pending int64  // records left in the current block
+}
+
+var errAvroTruncated = errors.New("avro: truncated file")
+
+func (d *avroDecoder) Decode(delta *tracker.Delta) error {
+	if d.sync == nil {
+		if err := d.readHeader(); err != nil {
+			return err
+		}
+	}
+	for d.pending == 0 {
+		// the end of the previous block, or of the header
+		count, err := binary.ReadVarint(d.r)
+		if err == io.EOF {
+			return io.EOF // between two blocks
+		}
+		if err != nil {
+			return errAvroTruncated
+		}
+		if _, err := binary.ReadVarint(d.r); err != nil { // the block's size
+			return errAvroTruncated
+		}
+		if count < 0 {
+			count = -count
+		}
+		d.pending = count
+		if count == 0 {
+			if err := d.readSync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	*delta = tracker.Delta{}
+	r := avroReader{r: d.r}
+	delta.ID = r.long()
+	delta.Action = r.string()
+	delta.TableName = r.string()
+	delta.OldData = r.optional()
+	delta.NewData = r.optional()
+	micros := r.long()
+	delta.TxID = r.long()
+	delta.Statement = r.string()
+	delta.Context = r.optional()
+	delta.Origin = r.string()
+	if r.err != nil {
+		return errAvroTruncated
+	}
+	delta.Timestamp = time.UnixMicro(micros).UTC()
+
+	if d.pending--; d.pending == 0 {
+		return d.readSync()
+	}
+	return nil
+}
+
+// read the magic bytes, the metadata and the sync marker
+func (d *avroDecoder) readHeader() error {
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil {
+		if err == io.EOF {
+			return io.EOF // an empty stream
+		}
+		return errAvroTruncated
+	}
+	if !bytes.Equal(magic, avroMagic) {
+		return fmt.Errorf("avro: not an object container file")
+	}
+	for {
+		count, err := binary.ReadVarint(d.r)
+		if err != nil {
+			return errAvroTruncated
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			count = -count
+			if _, err := binary.ReadVarint(d.r); err != nil {
+				return errAvroTruncated
+			}
+		}
+		for ; count > 0; count-- {
+			r := avroReader{r: d.r}
+			key, value := r.string(), r.string()
+			if r.err != nil {
+				return errAvroTruncated
+			}
+			if key == "avro.codec" && value != "null" {
+				return fmt.Errorf("avro: unsupported codec %q; only uncompressed files can be read", value)
+			}
+		}
+	}
+	d.sync = make([]byte, 16)
+	if _, err := io.ReadFull(d.r, d.sync); err != nil {
+		return errAvroTruncated
+	}
+	return nil
+}
+
+func (d *avroDecoder) readSync() error {
+	marker := make([]byte, len(d.sync))
+	if _, err := io.ReadFull(d.r, marker); err != nil {
+		return errAvroTruncated
+	}
+	if !bytes.Equal(marker, d.sync) {
+		return fmt.Errorf("avro: corrupt file, a block doesn't end in the sync marker")
+	}
+	return nil
+}
+
+// reads the values of a record, keeping the first error
+type avroReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *avroReader) long() int64 {
+	if r.err != nil {
+		return 0
+	}
+	var v int64
+	v, r.err = binary.ReadVarint(r.r)
+	return v
+}
+
+func (r *avroReader) bytes() []byte {
+	n := r.long()
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 {
+		r.err = fmt.Errorf("avro: negative length")
+		return nil
+	}
+	data := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, data)
+	return data
+}
+
+func (r *avroReader) string() string {
+	return string(r.bytes())
+}
+
+// a ["null","string"] union holding JSON
+func (r *avroReader) optional() *json.RawMessage {
+	if r.long() == 0 || r.err != nil {
+		return nil
+	}
+	raw := json.RawMessage(r.bytes())
+	return &raw
+}
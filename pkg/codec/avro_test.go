@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// the zigzag varints of the Avro specification's examples, and the extremes
+func TestAppendAvroLong(t *testing.T) {
+	for _, tt := range []struct {
+		v    int64
+		want string
+	}{
+		{0, "00"},
+		{-1, "01"},
+		{1, "02"},
+		{-2, "03"},
+		{2, "04"},
+		{-64, "7f"},
+		{64, "8001"},
+		{math.MinInt64, "ffffffffffffffffff01"},
+		{math.MaxInt64, "feffffffffffffffff01"},
+	} {
+		if got := hex.EncodeToString(appendAvroLong(nil, tt.v)); got != tt.want {
+			t.Errorf("appendAvroLong(%d) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeAvro(t *testing.T) {
+	d := tracker.Delta{
+		ID: 1, Action: "INSERT", TableName: "t", NewData: rawJSON(`{"a":1}`),
+		Timestamp: time.Unix(1714528800, 0), TxID: 9, Origin: "eu",
+	}
+	want := "02" + "0c494e53455254" + "0274" + // id, action, table_name
+		"00" + "02" + "0e7b2261223a317d" + // old_data null, new_data
+		"80a0a681dbd68b06" + "12" + // timestamp in microseconds, txid
+		"00" + "00" + "046575" // statement, context null, origin
+	if got := hex.EncodeToString(EncodeAvro(d)); got != want {
+		t.Errorf("EncodeAvro =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func avroDeltas() []tracker.Delta {
+	at := time.Date(2024, 5, 1, 2, 0, 0, 123456000, time.UTC)
+	return []tracker.Delta{
+		{ID: 1, Action: "INSERT", TableName: "users", NewData: rawJSON(`{"id":1}`), Timestamp: at, TxID: 700, Origin: "eu"},
+		{ID: 2, Action: "UPDATE", TableName: "users", OldData: rawJSON(`{"id":1}`), NewData: rawJSON(`{"id":2}`), Timestamp: at, TxID: 701,
+			Statement: "UPDATE users SET id = 2", Context: rawJSON(`{"user":"ann"}`)},
+		{ID: 3, Action: "DELETE", TableName: "users", OldData: rawJSON(`{"id":2}`), Timestamp: at},
+	}
+}
+
+// read every delta of an Avro file
+func decodeAvro(t *testing.T, data []byte) ([]tracker.Delta, error) {
+	t.Helper()
+	dec := Avro.NewDecoder(bytes.NewReader(data))
+	var deltas []tracker.Delta
+	for {
+		var d tracker.Delta
+		err := dec.Decode(&d)
+		if err == io.EOF {
+			return deltas, nil
+		}
+		if err != nil {
+			return deltas, err
+		}
+		deltas = append(deltas, d)
+	}
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := Avro.NewEncoder(&buf)
+	want := avroDeltas()
+	for _, d := range want {
+		if err := enc.Encode(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := decodeAvro(t, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// a file written by another encoder: metadata in a block with its size, and
+// several records per block, one of them counted negative with its size
+func TestAvroDecodeBlocks(t *testing.T) {
+	sync := bytes.Repeat([]byte{0xab}, 16)
+	b := append([]byte(nil), avroMagic...)
+	b = appendAvroLong(b, -2)
+	b = appendAvroLong(b, 0) // the block's size, which readers may skip
+	b = appendAvroString(b, "avro.schema")
+	b = appendAvroString(b, AvroSchema)
+	b = appendAvroString(b, "avro.codec")
+	b = appendAvroString(b, "null")
+	b = appendAvroLong(b, 0)
+	b = append(b, sync...)
+
+	deltas := avroDeltas()
+	var block []byte
+	for _, d := range deltas[:2] {
+		block = append(block, EncodeAvro(d)...)
+	}
+	b = appendAvroLong(b, 2)
+	b = appendAvroLong(b, int64(len(block)))
+	b = append(append(b, block...), sync...)
+	record := EncodeAvro(deltas[2])
+	b = appendAvroLong(b, -1)
+	b = appendAvroLong(b, int64(len(record)))
+	b = append(append(b, record...), sync...)
+
+	got, err := decodeAvro(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, deltas) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", got, deltas)
+	}
+}
+
+func TestAvroDecodeEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	Avro.NewEncoder(&buf)
+	for name, data := range map[string][]byte{"no bytes": nil, "header only": buf.Bytes()} {
+		got, err := decodeAvro(t, data)
+		if err != nil || len(got) != 0 {
+			t.Errorf("%s: decoded %v, %v; want nothing", name, got, err)
+		}
+	}
+}
+
+func TestAvroDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	enc := Avro.NewEncoder(&buf)
+	if err := enc.Encode(avroDeltas()[0]); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	corrupt := append([]byte(nil), file...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	deflate := append([]byte(nil), avroMagic...)
+	deflate = appendAvroLong(deflate, 1)
+	deflate = appendAvroString(deflate, "avro.codec")
+	deflate = appendAvroString(deflate, "deflate")
+	deflate = appendAvroLong(deflate, 0)
+	deflate = append(deflate, make([]byte, 16)...)
+
+	for name, data := range map[string][]byte{
+		"not avro":   []byte("PAR1"),
+		"truncated":  file[:len(file)-5],
+		"bad sync":   corrupt,
+		"compressed": deflate,
+	} {
+		_, err := decodeAvro(t, data)
+		if err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Package codec serializes deltas for the paths that write them out of the
+// database, such as archive files. JSON is the default and what any tool can
+// read; MessagePack and Protobuf are smaller and cheaper to parse for
+// high-volume streams, and Avro suits consumers that expect typed records.
+package codec
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// Encoder writes deltas to a stream, one after another.
+type Encoder interface {
+	Encode(tracker.Delta) error
+}
+
+// Decoder reads back the deltas an Encoder of the same codec wrote. Decode
+// returns io.EOF once the stream ends between two deltas.
+type Decoder interface {
+	Decode(*tracker.Delta) error
+}
+
+// Codec is one serialization format for streams of deltas.
+type Codec interface {
+	Name() string      // as given to -archive-codec
+	Extension() string // of files holding the format, with the dot
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// every codec, the default first
+var codecs = []Codec{JSON, MessagePack, Protobuf, Avro}
+
+// Names lists the names Lookup accepts.
+func Names() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// Lookup returns the codec with the given name; empty means JSON.
+func Lookup(name string) (Codec, error) {
+	if name == "" {
+		return JSON, nil
+	}
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q (want one of %s)", name, strings.Join(Names(), ", "))
+}
+
+// ForFile returns the codec a file was written with, going by its extension.
+func ForFile(name string) (Codec, bool) {
+	ext := filepath.Ext(name)
+	for _, c := range codecs {
+		if c.Extension() == ext {
+			return c, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,31 @@
+package codec
+
+import (
+	"encoding/json"
+	"io"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// JSON writes one JSON object per line (NDJSON), with the same field names
+// as -output json.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string      { return "json" }
+func (jsonCodec) Extension() string { return ".ndjson" }
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return jsonEncoder{json.NewEncoder(w)} }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return jsonDecoder{json.NewDecoder(r)} }
+
+type jsonEncoder struct{ enc *json.Encoder }
+
+func (e jsonEncoder) Encode(d tracker.Delta) error { return e.enc.Encode(d) }
+
+type jsonDecoder struct{ dec *json.Decoder }
+
+func (d jsonDecoder) Decode(delta *tracker.Delta) error {
+	*delta = tracker.Delta{}
+	return d.dec.Decode(delta)
+}
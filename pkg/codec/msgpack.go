@@ -0,0 +1,467 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// MessagePack writes each delta as a MessagePack map with the same keys as
+// JSON, one after another. Row payloads become native MessagePack values
+// rather than embedded JSON text, and timestamps use the timestamp extension
+// (type -1). Numbers neither int64 nor float64 holds exactly, such as large
+// numerics, keep their decimal text in extension type 1 so they read back
+// unchanged.
+var MessagePack Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string      { return "msgpack" }
+func (msgpackCodec) Extension() string { return ".msgpack" }
+
+func (msgpackCodec) NewEncoder(w io.Writer) Encoder { return &msgpackEncoder{w: w} }
+func (msgpackCodec) NewDecoder(r io.Reader) Decoder { return &msgpackDecoder{r: bufio.NewReader(r)} }
+
+// MessagePack extension types
+const (
+	extTimestamp = -1
+	extNumber    = 1
+)
+
+type msgpackEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *msgpackEncoder) Encode(d tracker.Delta) error {
+	payloads := make(map[string]interface{}, 3)
+	for key, raw := range map[string]*json.RawMessage{"old_data": d.OldData, "new_data": d.NewData, "context": d.Context} {
+		v, err := payloadValue(raw)
+		if err != nil {
+			return fmt.Errorf("delta %d: %s: %v", d.ID, key, err)
+		}
+		payloads[key] = v
+	}
+
+	b := appendMapHeader(e.buf[:0], 10)
+	b = appendInt(appendString(b, "id"), d.ID)
+	b = appendString(appendString(b, "action"), d.Action)
+	b = appendString(appendString(b, "table_name"), d.TableName)
+	b = appendTime(appendString(b, "timestamp"), d.Timestamp)
+	b = appendInt(appendString(b, "txid"), d.TxID)
+	b = appendString(appendString(b, "statement"), d.Statement)
+	b = appendString(appendString(b, "origin"), d.Origin)
+	for _, key := range []string{"old_data", "new_data", "context"} {
+		var err error
+		if b, err = appendValue(appendString(b, key), payloads[key]); err != nil {
+			return fmt.Errorf("delta %d: %s: %v", d.ID, key, err)
+		}
+	}
+	e.buf = b
+	_, err := e.w.Write(b)
+	return err
+}
+
+// decode a JSON payload keeping numbers as written; nil stays nil
+func payloadValue(raw *json.RawMessage) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(*raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case string:
+		return appendString(b, v), nil
+	case json.Number:
+		return appendNumber(b, v), nil
+	case []interface{}:
+		b = appendArrayHeader(b, len(v))
+		for _, item := range v {
+			var err error
+			if b, err = appendValue(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMapHeader(b, len(v))
+		for _, k := range keys {
+			var err error
+			if b, err = appendValue(appendString(b, k), v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("can't encode %T", v)
+}
+
+// a JSON number as an integer or float when either holds it exactly
+func appendNumber(b []byte, n json.Number) []byte {
+	if i, err := n.Int64(); err == nil {
+		return appendInt(b, i)
+	}
+	if f, err := n.Float64(); err == nil && strconv.FormatFloat(f, 'g', -1, 64) == n.String() {
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+	}
+	return appendExt(b, extNumber, []byte(n))
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= -32 && n <= math.MaxInt8:
+		return append(b, byte(n)) // positive and negative fixint
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+}
+
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+}
+
+func appendExt(b []byte, typ int8, data []byte) []byte {
+	switch n := len(data); {
+	case n == 1:
+		b = append(b, 0xd4)
+	case n == 2:
+		b = append(b, 0xd5)
+	case n == 4:
+		b = append(b, 0xd6)
+	case n == 8:
+		b = append(b, 0xd7)
+	case n == 16:
+		b = append(b, 0xd8)
+	case n <= math.MaxUint8:
+		b = append(b, 0xc7, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc8), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc9), uint32(n))
+	}
+	return append(append(b, byte(typ)), data...)
+}
+
+// the 96-bit form of the timestamp extension: nanoseconds, then seconds
+func appendTime(b []byte, t time.Time) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(t.Nanosecond()))
+	data = binary.BigEndian.AppendUint64(data, uint64(t.Unix()))
+	return appendExt(b, extTimestamp, data)
+}
+
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *msgpackDecoder) Decode(delta *tracker.Delta) error {
+	v, err := d.value()
+	if err != nil {
+		return err
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("msgpack: expected a map, got %T", v)
+	}
+
+	*delta = tracker.Delta{}
+	for key, v := range fields {
+		var ok bool
+		switch key {
+		case "id":
+			delta.ID, ok = v.(int64)
+		case "txid":
+			delta.TxID, ok = v.(int64)
+		case "action":
+			delta.Action, ok = v.(string)
+		case "table_name":
+			delta.TableName, ok = v.(string)
+		case "statement":
+			delta.Statement, ok = v.(string)
+		case "origin":
+			delta.Origin, ok = v.(string)
+		case "timestamp":
+			delta.Timestamp, ok = v.(time.Time)
+		case "old_data", "new_data", "context":
+			raw, err := payloadJSON(v)
+			if err != nil {
+				return fmt.Errorf("msgpack: %s: %v", key, err)
+			}
+			switch key {
+			case "old_data":
+				delta.OldData = raw
+			case "new_data":
+				delta.NewData = raw
+			default:
+				delta.Context = raw
+			}
+			ok = true
+		default:
+			ok = true // written by a newer version
+		}
+		if !ok {
+			return fmt.Errorf("msgpack: unexpected %T for %s", v, key)
+		}
+	}
+	return nil
+}
+
+// turn a decoded payload back into JSON; nil stays nil
+func payloadJSON(v interface{}) (*json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(data)
+	return &raw, nil
+}
+
+// read one value; io.EOF means the stream ended cleanly before it
+func (d *msgpackDecoder) value() (interface{}, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return json.Number(strconv.FormatUint(n, 10)), nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.read(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unknown type byte 0x%02x", c)
+}
+
+// read a value inside another, where the stream can't end
+func (d *msgpackDecoder) inner() (interface{}, error) {
+	v, err := d.value()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// read a big-endian unsigned integer of size bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	data, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range data {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	data, err := d.read(n)
+	return string(data), err
+}
+
+func (d *msgpackDecoder) arrayOf(n int) (interface{}, error) {
+	items := make([]interface{}, n)
+	for i := range items {
+		v, err := d.inner()
+		if err != nil {
+			return nil, err
+		}
+		items[i] = v
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.inner()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key is %T, not a string", k)
+		}
+		if m[key], err = d.inner(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) ext(n int) (interface{}, error) {
+	typ, err := d.uint(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	switch int8(typ) {
+	case extNumber:
+		return json.Number(data), nil
+	case extTimestamp:
+		switch n {
+		case 4:
+			return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+		case 8:
+			v := binary.BigEndian.Uint64(data)
+			return time.Unix(int64(v&0x3ffffffff), int64(v>>34)).UTC(), nil
+		case 12:
+			return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data[:4]))).UTC(), nil
+		}
+		return nil, fmt.Errorf("msgpack: timestamp of %d bytes", n)
+	}
+	return nil, fmt.Errorf("msgpack: unknown extension type %d", int8(typ))
+}
@@ -0,0 +1,259 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// the narrowest signed form for each integer, at both ends of every width
+func TestAppendInt(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0df"},
+		{-128, "d080"},
+		{128, "d10080"},
+		{-129, "d1ff7f"},
+		{math.MaxInt16, "d17fff"},
+		{math.MinInt16, "d18000"},
+		{math.MaxInt16 + 1, "d200008000"},
+		{math.MaxInt32, "d27fffffff"},
+		{math.MinInt32, "d280000000"},
+		{math.MaxInt32 + 1, "d30000000080000000"},
+		{math.MinInt32 - 1, "d3ffffffff7fffffff"},
+		{math.MaxInt64, "d37fffffffffffffff"},
+		{math.MinInt64, "d38000000000000000"},
+	} {
+		if got := hex.EncodeToString(appendInt(nil, tt.n)); got != tt.want {
+			t.Errorf("appendInt(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+// integers and floats that hold a number exactly, and the decimal text of
+// those that don't
+func TestAppendNumber(t *testing.T) {
+	for _, tt := range []struct {
+		n    string
+		want string
+	}{
+		{"42", "2a"},
+		{"-300", "d1fed4"},
+		{"1.5", "cb3ff8000000000000"},
+		{"0.1", "cb3fb999999999999a"},
+		{"-0.25", "cbbfd0000000000000"},
+		{"1.10", "d601" + "312e3130"},                             // trailing zero: fixext 4
+		{"1e400", "c70501" + hex.EncodeToString([]byte("1e400"))}, // out of range: ext 8
+		{"18446744073709551616", "c71401" + hex.EncodeToString([]byte("18446744073709551616"))}, // beyond int64
+	} {
+		if got := hex.EncodeToString(appendNumber(nil, json.Number(tt.n))); got != tt.want {
+			t.Errorf("appendNumber(%s) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+// fixstr, str8, str16 and str32 on either side of their limits
+func TestAppendString(t *testing.T) {
+	for _, tt := range []struct {
+		n      int
+		header string
+	}{
+		{0, "a0"},
+		{31, "bf"},
+		{32, "d920"},
+		{255, "d9ff"},
+		{256, "da0100"},
+		{65535, "daffff"},
+		{65536, "db00010000"},
+	} {
+		s := strings.Repeat("x", tt.n)
+		b := appendString(nil, s)
+		header := len(tt.header) / 2
+		if got := hex.EncodeToString(b[:header]); got != tt.header || string(b[header:]) != s {
+			t.Errorf("appendString of %d bytes has header %s and %d bytes, want %s", tt.n, got, len(b)-header, tt.header)
+		}
+		v, err := (&msgpackDecoder{r: bufio.NewReader(bytes.NewReader(b))}).value()
+		if err != nil || v != s {
+			t.Errorf("string of %d bytes decoded to %d bytes, %v", tt.n, len(v.(string)), err)
+		}
+	}
+}
+
+func TestAppendHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		n            int
+		array, mapOf string
+	}{
+		{0, "90", "80"},
+		{15, "9f", "8f"},
+		{16, "dc0010", "de0010"},
+		{65535, "dcffff", "deffff"},
+		{65536, "dd00010000", "df00010000"},
+	} {
+		if got := hex.EncodeToString(appendArrayHeader(nil, tt.n)); got != tt.array {
+			t.Errorf("appendArrayHeader(%d) = %s, want %s", tt.n, got, tt.array)
+		}
+		if got := hex.EncodeToString(appendMapHeader(nil, tt.n)); got != tt.mapOf {
+			t.Errorf("appendMapHeader(%d) = %s, want %s", tt.n, got, tt.mapOf)
+		}
+	}
+}
+
+// nulls, booleans and maps nested in maps and arrays, keys in order
+func TestAppendValue(t *testing.T) {
+	v, err := payloadValue(rawJSON(`{"b":{"d":null,"c":[true,false,{}]},"a":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := appendValue(nil, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "82" + "a161" + "c0" + // a: nil
+		"a162" + "82" + "a163" + "93c3c280" + "a164" + "c0" // b: {c: [true, false, {}], d: nil}
+	if got := hex.EncodeToString(b); got != want {
+		t.Errorf("appendValue = %s, want %s", got, want)
+	}
+	if got := hex.EncodeToString(appendTime(nil, time.Unix(1714528800, 500000000))); got != "c70cff"+"1dcd6500"+"000000006631a220" {
+		t.Errorf("appendTime = %s", got)
+	}
+}
+
+func TestEncodeMessagePack(t *testing.T) {
+	var buf bytes.Buffer
+	err := MessagePack.NewEncoder(&buf).Encode(tracker.Delta{
+		ID: 1, Action: "INSERT", TableName: "t", NewData: rawJSON(`{"b":[1.5,12345678901234567890],"a":1}`),
+		Timestamp: time.Unix(1714528800, 500000000), TxID: 700, Origin: "eu",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "8a" + "a2696401" + "a6616374696f6ea6494e53455254" + "aa7461626c655f6e616d65a174" + // id, action, table_name
+		"a974696d657374616d70" + "c70cff1dcd6500000000006631a220" + // timestamp
+		"a474786964d102bc" + "a973746174656d656e74a0" + "a66f726967696ea26575" + // txid, statement, origin
+		"a86f6c645f64617461c0" + // old_data
+		"a86e65775f64617461" + "82a16101a16292cb3ff8000000000000" + "c714013132333435363738393031323334353637383930" + // new_data
+		"a7636f6e74657874c0" // context
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("Encode =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// read every delta of a MessagePack stream
+func decodeMessagePack(t *testing.T, data []byte) ([]tracker.Delta, error) {
+	t.Helper()
+	dec := MessagePack.NewDecoder(bytes.NewReader(data))
+	var deltas []tracker.Delta
+	for {
+		var d tracker.Delta
+		err := dec.Decode(&d)
+		if err == io.EOF {
+			return deltas, nil
+		}
+		if err != nil {
+			return deltas, err
+		}
+		deltas = append(deltas, d)
+	}
+}
+
+// payloads come back as compact JSON with sorted keys, so these are written
+// that way
+func TestMessagePackRoundTrip(t *testing.T) {
+	want := avroDeltas()
+	want = append(want,
+		tracker.Delta{ID: math.MaxInt64, Action: "UPDATE", TableName: strings.Repeat("t", 300), Timestamp: time.Unix(-86400, 1).UTC(), TxID: -5,
+			OldData: rawJSON(`{"big":123456789012345678901234567890,"deep":{"a":[[],{"b":null}]},"f":-0.25,"n":-70000,"s":"` + strings.Repeat("é", 40000) + `"}`),
+			NewData: rawJSON(`{"e":1e400,"x":1.10}`), Context: rawJSON(`[]`)},
+		tracker.Delta{ID: 5, Action: "TRUNCATE", TableName: "users", Timestamp: time.Unix(0, 0).UTC()},
+	)
+	var buf bytes.Buffer
+	enc := MessagePack.NewEncoder(&buf)
+	for _, d := range want {
+		if err := enc.Encode(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := decodeMessagePack(t, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// forms other encoders write that this one doesn't
+func TestMessagePackDecodeForeign(t *testing.T) {
+	at := time.Unix(1714528800, 500000000).UTC()
+	for _, tt := range []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"uint8", "ccff", int64(255)},
+		{"uint16", "cdffff", int64(65535)},
+		{"uint32", "ceffffffff", int64(math.MaxUint32)},
+		{"uint64 beyond int64", "cfffffffffffffffff", json.Number("18446744073709551615")},
+		{"float32", "ca3fc00000", 1.5},
+		{"bin8", "c4026869", []byte("hi")},
+		{"array16", "dc000101", []interface{}{int64(1)}},
+		{"map16", "de0001a161c0", map[string]interface{}{"a": nil}},
+		{"timestamp32", "d6ff6631a220", time.Unix(1714528800, 0).UTC()},
+		{"timestamp64", "d7ff773594006631a220", at},
+		{"timestamp96", "c70cff1dcd6500000000006631a220", at},
+		{"fixext1 number", "d40137", json.Number("7")},
+	} {
+		got, err := (&msgpackDecoder{r: bufio.NewReader(hexReader(t, tt.data))}).value()
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decoded %#v, %v; want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMessagePackDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := MessagePack.NewEncoder(&buf).Encode(avroDeltas()[1]); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+	for name, data := range map[string][]byte{
+		"truncated":        stream[:len(stream)-3],
+		"truncated header": {0xda, 0x01},
+		"not a map":        {0x93, 0x01, 0x02, 0x03},
+		"reserved byte":    {0xc1},
+		"integer key":      {0x81, 0x01, 0xc0},
+		"unknown ext":      {0xd4, 0x05, 0x00},
+		"id as string":     {0x81, 0xa2, 'i', 'd', 0xa1, '1'},
+	} {
+		_, err := decodeMessagePack(t, data)
+		if err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
+
+func hexReader(t *testing.T, s string) io.Reader {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(data)
+}
@@ -0,0 +1,193 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// Protobuf writes each delta as the Delta message in delta.proto, preceded
+// by its length as a varint. Row payloads stay JSON inside bytes fields.
+var Protobuf Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string      { return "protobuf" }
+func (protobufCodec) Extension() string { return ".pb" }
+
+func (protobufCodec) NewEncoder(w io.Writer) Encoder { return &protobufEncoder{w: w} }
+func (protobufCodec) NewDecoder(r io.Reader) Decoder { return &protobufDecoder{r: bufio.NewReader(r)} }
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protobufEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *protobufEncoder) Encode(d tracker.Delta) error {
+	var ts []byte
+	ts = appendVarintField(ts, 1, uint64(d.Timestamp.Unix()))
+	ts = appendVarintField(ts, 2, uint64(d.Timestamp.Nanosecond()))
+
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(d.ID))
+	msg = appendBytesField(msg, 2, []byte(d.Action))
+	msg = appendBytesField(msg, 3, []byte(d.TableName))
+	msg = appendBytesField(msg, 4, rawBytes(d.OldData))
+	msg = appendBytesField(msg, 5, rawBytes(d.NewData))
+	msg = appendBytesField(msg, 6, ts)
+	msg = appendVarintField(msg, 7, uint64(d.TxID))
+	msg = appendBytesField(msg, 8, []byte(d.Statement))
+	msg = appendBytesField(msg, 9, rawBytes(d.Context))
+	msg = appendBytesField(msg, 10, []byte(d.Origin))
+
+	e.buf = append(binary.AppendUvarint(e.buf[:0], uint64(len(msg))), msg...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func rawBytes(raw *json.RawMessage) []byte {
+	if raw == nil {
+		return nil
+	}
+	return *raw
+}
+
+// proto3 leaves fields with their zero value out
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+type protobufDecoder struct {
+	r *bufio.Reader
+}
+
+var errTruncated = errors.New("protobuf: truncated message")
+
+func (d *protobufDecoder) Decode(delta *tracker.Delta) error {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err // io.EOF between messages
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(d.r, msg); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	*delta = tracker.Delta{}
+	var seconds, nanos int64
+	err = eachField(msg, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			delta.ID = int64(v)
+		case 2:
+			delta.Action = string(data)
+		case 3:
+			delta.TableName = string(data)
+		case 4:
+			delta.OldData = rawMessage(data)
+		case 5:
+			delta.NewData = rawMessage(data)
+		case 6:
+			return eachField(data, func(field int, v uint64, _ []byte) error {
+				switch field {
+				case 1:
+					seconds = int64(v)
+				case 2:
+					nanos = int64(v)
+				}
+				return nil
+			})
+		case 7:
+			delta.TxID = int64(v)
+		case 8:
+			delta.Statement = string(data)
+		case 9:
+			delta.Context = rawMessage(data)
+		case 10:
+			delta.Origin = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	delta.Timestamp = time.Unix(seconds, nanos).UTC()
+	return nil
+}
+
+func rawMessage(data []byte) *json.RawMessage {
+	raw := json.RawMessage(append([]byte(nil), data...))
+	return &raw
+}
+
+// call fn for every field of a message with its varint value or bytes;
+// fields of other wire types, which Delta doesn't use, are skipped
+func eachField(msg []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errTruncated
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case wireVarint:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errTruncated
+			}
+			msg = msg[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return errTruncated
+			}
+			data, msg = msg[n:n+int(size)], msg[n+int(size):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if key&7 == wireFixed32 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errTruncated
+			}
+			msg = msg[size:]
+			continue
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", key&7)
+		}
+		if err := fn(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+func TestEncodeProtobuf(t *testing.T) {
+	var buf bytes.Buffer
+	err := Protobuf.NewEncoder(&buf).Encode(tracker.Delta{
+		ID: 1, Action: "INSERT", TableName: "t", NewData: rawJSON(`{"a":1}`),
+		Timestamp: time.Unix(1714528800, 500000000), TxID: 700, Origin: "eu",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2b" + // the message's length
+		"0801" + "1206494e53455254" + "1a0174" + // id, action, table_name
+		"2a077b2261223a317d" + // new_data; old_data, empty, left out
+		"320c" + "08a0c4c6b106" + "1080cab5ee01" + // timestamp: seconds, nanos
+		"38bc05" + "52026575" // txid, origin; statement and context left out
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("Encode =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// int64 fields take the ten-byte two's complement varint when negative, and
+// a length-delimited field of 128 bytes or more a two-byte length
+func TestEncodeProtobufWide(t *testing.T) {
+	var buf bytes.Buffer
+	err := Protobuf.NewEncoder(&buf).Encode(tracker.Delta{
+		ID: 2, Action: "DELETE", TableName: "t", OldData: rawJSON(`{"s":"` + strings.Repeat("x", 200) + `"}`),
+		Timestamp: time.Unix(-1, 999999999),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := hex.EncodeToString(buf.Bytes())
+	for _, want := range []string{
+		"f301",                                   // the message's length, 243
+		"22d0017b",                               // old_data, 208 bytes
+		"321108ffffffffffffffffff0110ff93ebdc03", // timestamp: seconds -1, nanos
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Encode = %s, without %s", got, want)
+		}
+	}
+}
+
+// read every delta of a protobuf stream
+func decodeProtobuf(t *testing.T, data []byte) ([]tracker.Delta, error) {
+	t.Helper()
+	dec := Protobuf.NewDecoder(bytes.NewReader(data))
+	var deltas []tracker.Delta
+	for {
+		var d tracker.Delta
+		err := dec.Decode(&d)
+		if err == io.EOF {
+			return deltas, nil
+		}
+		if err != nil {
+			return deltas, err
+		}
+		deltas = append(deltas, d)
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	want := avroDeltas()
+	want = append(want,
+		tracker.Delta{ID: -7, Action: "UPDATE", TableName: strings.Repeat("t", 300), Timestamp: time.Unix(-86400, 1).UTC(), TxID: -5,
+			OldData: rawJSON(`{"s":"` + strings.Repeat("é", 40000) + `"}`), NewData: rawJSON(`{"n":1e400}`), Context: rawJSON(`[]`)},
+		tracker.Delta{ID: 5, Action: "TRUNCATE", TableName: "users", Timestamp: time.Unix(0, 0).UTC()},
+	)
+	var buf bytes.Buffer
+	enc := Protobuf.NewEncoder(&buf)
+	for _, d := range want {
+		if err := enc.Encode(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := decodeProtobuf(t, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// a message written by another encoder: fields out of order, a field
+// repeated, and fixed-width and unknown fields to skip
+func TestProtobufDecodeForeign(t *testing.T) {
+	msg := "52026575" + // origin
+		"2d01020304" + // field 5 as fixed32, skipped
+		"5901020304050607" + "08" + // field 11 as fixed64, skipped
+		"6a03616263" + // field 13, unknown
+		"0802" + "0801" + // id twice; the last wins
+		"3206" + "10ff93ebdc03" + // timestamp of nanos only
+		"1a0174" + "1206494e53455254"
+	data, _ := hex.DecodeString(msg)
+	data = append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+	got, err := decodeProtobuf(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tracker.Delta{{ID: 1, Action: "INSERT", TableName: "t", Timestamp: time.Unix(0, 999999999).UTC(), Origin: "eu"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestProtobufDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Protobuf.NewEncoder(&buf).Encode(avroDeltas()[1]); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+	for name, data := range map[string]string{
+		"truncated":            hex.EncodeToString(stream[:len(stream)-3]),
+		"length past message":  "03" + "1205494e",
+		"varint past message":  "02" + "08ff",
+		"fixed64 past message": "03" + "090102",
+		"group":                "02" + "0b0c",
+		"bad timestamp":        "04" + "3202" + "08ff",
+	} {
+		b, _ := hex.DecodeString(data)
+		_, err := decodeProtobuf(t, b)
+		if err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
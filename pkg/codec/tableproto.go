@@ -0,0 +1,319 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// TableProto is the typed protobuf schema of one table's deltas: a Delta
+// message like delta.proto's, with the same field numbers, whose old and
+// new rows are messages with a field per column instead of JSON. Deltas
+// that aren't row changes, such as marks, keep their JSON payloads.
+type TableProto struct {
+	Package string // e.g. deltatracker.tables
+	Table   string
+	Columns []ProtoColumn
+	Dropped []int // the numbers of dropped columns, reserved so they aren't reused
+}
+
+// ProtoColumn is a field of a TableProto's row message.
+type ProtoColumn struct {
+	Name   string // the column, as in the table
+	Type   string // its PostgreSQL type, as information_schema's data_type names it
+	Number int    // the column's attnum, which stays the same as columns come and go
+}
+
+// proto types of the PostgreSQL types whose to_jsonb values aren't strings,
+// or whose strings are times; the rest, and numeric, whose digits a double
+// would lose, are strings
+var protoTypes = map[string]string{
+	"smallint":                    "int32",
+	"integer":                     "int32",
+	"bigint":                      "int64",
+	"real":                        "float",
+	"double precision":            "double",
+	"boolean":                     "bool",
+	"timestamp without time zone": "google.protobuf.Timestamp",
+	"timestamp with time zone":    "google.protobuf.Timestamp",
+}
+
+func protoType(pgType string) string {
+	if t, ok := protoTypes[pgType]; ok {
+		return t
+	}
+	return "string"
+}
+
+// MessageName is the name of the table's Delta message, e.g. OrderItemsDelta.
+// Its row message is named the same with Row instead of Delta.
+func (p TableProto) MessageName() string {
+	return protoName(p.Table, true) + "Delta"
+}
+
+// Proto returns the .proto file declaring the table's messages, the Delta
+// message first.
+func (p TableProto) Proto() string {
+	delta, row := p.MessageName(), protoName(p.Table, true)+"Row"
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Deltas of the %s table, as kafka-sink publishes them with format protobuf.\n", p.Table)
+	b.WriteString("// Row fields are numbered by the columns' attnums, so they keep their\n")
+	b.WriteString("// numbers as columns are added and dropped; null columns are left unset.\n")
+	b.WriteString("syntax = \"proto3\";\n\n")
+	fmt.Fprintf(&b, "package %s;\n\n", p.Package)
+	b.WriteString("import \"google/protobuf/timestamp.proto\";\n\n")
+
+	fmt.Fprintf(&b, "message %s {\n", delta)
+	b.WriteString("  int64 id = 1;\n")
+	b.WriteString("  string action = 2;\n")
+	b.WriteString("  string table_name = 3;\n")
+	fmt.Fprintf(&b, "  %s old_row = 4; // unset when the delta has no old row\n", row)
+	fmt.Fprintf(&b, "  %s new_row = 5; // unset when the delta has no new row\n", row)
+	b.WriteString("  google.protobuf.Timestamp timestamp = 6;\n")
+	b.WriteString("  int64 txid = 7;\n")
+	b.WriteString("  string statement = 8;\n")
+	b.WriteString("  bytes context = 9; // JSON\n")
+	b.WriteString("  string origin = 10;\n")
+	b.WriteString("  bytes old_data = 11; // JSON, for deltas that aren't row changes, such as marks\n")
+	b.WriteString("  bytes new_data = 12; // JSON, likewise\n")
+	b.WriteString("}\n\n")
+
+	fmt.Fprintf(&b, "message %s {\n", row)
+	used := make(map[string]bool)
+	for _, c := range p.Columns {
+		name := protoName(c.Name, false)
+		for used[name] {
+			name += "_"
+		}
+		used[name] = true
+		fmt.Fprintf(&b, "  optional %s %s = %d; // %s\n", protoType(c.Type), name, c.Number, c.Type)
+	}
+	if len(p.Dropped) > 0 {
+		numbers := make([]string, len(p.Dropped))
+		for i, n := range p.Dropped {
+			numbers[i] = strconv.Itoa(n)
+		}
+		fmt.Fprintf(&b, "  reserved %s; // dropped columns\n", strings.Join(numbers, ", "))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// a valid proto identifier for a table or column name: CamelCase for
+// messages, lower case with underscores for fields
+func protoName(name string, message bool) string {
+	var b strings.Builder
+	upper := message
+	for _, r := range name {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if upper {
+				r = unicode.ToUpper(r)
+			} else if !message {
+				r = unicode.ToLower(r)
+			}
+			b.WriteRune(r)
+			upper = false
+		case message:
+			upper = true
+		default:
+			b.WriteByte('_')
+		}
+	}
+	s := b.String()
+	if s == "" || unicode.IsDigit(rune(s[0])) {
+		if message {
+			return "T" + s
+		}
+		return "_" + s
+	}
+	return s
+}
+
+// Encode returns a delta of the table as its Delta message, without any
+// framing, and the columns its rows hold that the schema doesn't have, which
+// are left out. Rows must decode as JSON objects, with values of the types
+// the columns have.
+func (p TableProto) Encode(d tracker.Delta) ([]byte, []string, error) {
+	rowChange := d.Action == "INSERT" || d.Action == "UPDATE" || d.Action == "DELETE"
+	var unknown []string
+	var rows [2][]byte
+	for i, data := range []*json.RawMessage{d.OldData, d.NewData} {
+		if data == nil || !rowChange {
+			continue
+		}
+		row, missing, err := p.encodeRow(*data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("delta %d: %v", d.ID, err)
+		}
+		rows[i] = row
+		unknown = append(unknown, missing...)
+	}
+
+	var ts []byte
+	ts = appendVarintField(ts, 1, uint64(d.Timestamp.Unix()))
+	ts = appendVarintField(ts, 2, uint64(d.Timestamp.Nanosecond()))
+
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(d.ID))
+	msg = appendBytesField(msg, 2, []byte(d.Action))
+	msg = appendBytesField(msg, 3, []byte(d.TableName))
+	if d.OldData != nil && rowChange {
+		msg = appendMessageField(msg, 4, rows[0])
+	}
+	if d.NewData != nil && rowChange {
+		msg = appendMessageField(msg, 5, rows[1])
+	}
+	msg = appendBytesField(msg, 6, ts)
+	msg = appendVarintField(msg, 7, uint64(d.TxID))
+	msg = appendBytesField(msg, 8, []byte(d.Statement))
+	msg = appendBytesField(msg, 9, rawBytes(d.Context))
+	msg = appendBytesField(msg, 10, []byte(d.Origin))
+	if !rowChange {
+		msg = appendBytesField(msg, 11, rawBytes(d.OldData))
+		msg = appendBytesField(msg, 12, rawBytes(d.NewData))
+	}
+	return msg, unknown, nil
+}
+
+// a row as the row message, with the columns it has that the schema doesn't
+func (p TableProto) encodeRow(data []byte) ([]byte, []string, error) {
+	row, err := tracker.DecodeRow(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("row isn't a JSON object: %v", err)
+	}
+	var msg []byte
+	for _, c := range p.Columns {
+		value, ok := row[c.Name]
+		delete(row, c.Name)
+		if !ok || value == nil {
+			continue
+		}
+		if msg, err = appendProtoValue(msg, c, value); err != nil {
+			return nil, nil, fmt.Errorf("column %s: %v", c.Name, err)
+		}
+	}
+	var unknown []string
+	for name := range row {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	return msg, unknown, nil
+}
+
+// append a column's value as its field, even a zero value, since the field
+// is optional and being set tells it apart from null
+func appendProtoValue(b []byte, c ProtoColumn, value interface{}) ([]byte, error) {
+	field := uint64(c.Number)
+	switch t := protoType(c.Type); t {
+	case "int32", "int64":
+		n, ok := value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a number", value)
+		}
+		bits := 64
+		if t == "int32" {
+			bits = 32
+		}
+		v, err := strconv.ParseInt(n.String(), 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		b = binary.AppendUvarint(b, field<<3|wireVarint)
+		return binary.AppendUvarint(b, uint64(v)), nil
+	case "float", "double":
+		v, err := protoFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		if t == "float" {
+			b = binary.AppendUvarint(b, field<<3|wireFixed32)
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v))), nil
+		}
+		b = binary.AppendUvarint(b, field<<3|wireFixed64)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v)), nil
+	case "bool":
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a boolean", value)
+		}
+		b = binary.AppendUvarint(b, field<<3|wireVarint)
+		if v {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case "google.protobuf.Timestamp":
+		s, _ := value.(string)
+		if s == "infinity" || s == "-infinity" {
+			return b, nil // which no Timestamp holds, so left unset
+		}
+		ts, err := protoTime(s)
+		if err != nil {
+			return nil, err
+		}
+		var msg []byte
+		msg = appendVarintField(msg, 1, uint64(ts.Unix()))
+		msg = appendVarintField(msg, 2, uint64(ts.Nanosecond()))
+		return appendMessageField(b, int(field), msg), nil
+	default:
+		s, ok := value.(string)
+		if !ok {
+			// json and array columns, and numeric, keep their JSON text
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.Encode(value)
+			s = strings.TrimSuffix(buf.String(), "\n")
+		}
+		b = binary.AppendUvarint(b, field<<3|wireBytes)
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		return append(b, s...), nil
+	}
+}
+
+// a real or double precision value, which to_jsonb writes as a number, or
+// as a string for NaN and the infinities
+func protoFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		switch v {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+	}
+	return 0, fmt.Errorf("%v isn't a number", value)
+}
+
+// a timestamp as to_jsonb writes it: with an offset for timestamptz, and
+// without one, taken as UTC, for timestamp
+func protoTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q isn't a timestamp", s)
+}
+
+// a message field, written even when the message is empty, so a row whose
+// columns are all null is still there
+func appendMessageField(b []byte, field int, msg []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
@@ -0,0 +1,161 @@
+package codec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+func rawJSON(s string) *json.RawMessage {
+	r := json.RawMessage(s)
+	return &r
+}
+
+var orderItemsProto = TableProto{
+	Package: "deltatracker.tables",
+	Table:   "order_items",
+	Columns: []ProtoColumn{
+		{Name: "id", Type: "bigint", Number: 1},
+		{Name: "name", Type: "text", Number: 2},
+		{Name: "active", Type: "boolean", Number: 3},
+		{Name: "price", Type: "numeric", Number: 5},
+		{Name: "created", Type: "timestamp with time zone", Number: 6},
+		{Name: "score", Type: "double precision", Number: 7},
+		{Name: "qty", Type: "integer", Number: 8},
+		{Name: "tags", Type: "ARRAY", Number: 9},
+	},
+	Dropped: []int{4},
+}
+
+func TestTableProtoProto(t *testing.T) {
+	want := `// Deltas of the order_items table, as kafka-sink publishes them with format protobuf.
+// Row fields are numbered by the columns' attnums, so they keep their
+// numbers as columns are added and dropped; null columns are left unset.
+syntax = "proto3";
+
+package deltatracker.tables;
+
+import "google/protobuf/timestamp.proto";
+
+message OrderItemsDelta {
+  int64 id = 1;
+  string action = 2;
+  string table_name = 3;
+  OrderItemsRow old_row = 4; // unset when the delta has no old row
+  OrderItemsRow new_row = 5; // unset when the delta has no new row
+  google.protobuf.Timestamp timestamp = 6;
+  int64 txid = 7;
+  string statement = 8;
+  bytes context = 9; // JSON
+  string origin = 10;
+  bytes old_data = 11; // JSON, for deltas that aren't row changes, such as marks
+  bytes new_data = 12; // JSON, likewise
+}
+
+message OrderItemsRow {
+  optional int64 id = 1; // bigint
+  optional string name = 2; // text
+  optional bool active = 3; // boolean
+  optional string price = 5; // numeric
+  optional google.protobuf.Timestamp created = 6; // timestamp with time zone
+  optional double score = 7; // double precision
+  optional int32 qty = 8; // integer
+  optional string tags = 9; // ARRAY
+  reserved 4; // dropped columns
+}
+`
+	if got := orderItemsProto.Proto(); got != want {
+		t.Errorf("Proto() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestProtoName(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		message bool
+		want    string
+	}{
+		{"order_items", true, "OrderItems"},
+		{"order_items", false, "order_items"},
+		{"Total Price", false, "total_price"},
+		{"2fa", true, "T2fa"},
+		{"2fa", false, "_2fa"},
+		{"café", true, "Caf"},
+		{"café", false, "caf_"},
+	} {
+		if got := protoName(tt.name, tt.message); got != tt.want {
+			t.Errorf("protoName(%q, %v) = %q, want %q", tt.name, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestTableProtoEncode(t *testing.T) {
+	at := time.Unix(1714528800, 0)
+	for _, tt := range []struct {
+		name    string
+		delta   tracker.Delta
+		want    string
+		unknown []string
+	}{
+		{
+			name: "insert",
+			delta: tracker.Delta{
+				ID: 7, Action: "INSERT", TableName: "order_items", Timestamp: at.Add(5), TxID: 9, Origin: "eu",
+				NewData: rawJSON(`{"id":300,"name":"a","active":false,"price":1.50,"created":"2024-05-01T02:00:00+00:00","score":0.5,"qty":-2,"tags":["x"],"extra":1}`),
+			},
+			want: "0807" + "1206494e53455254" + "1a0b6f726465725f6974656d73" +
+				"2a31" + "08ac02" + "120161" + "1800" + "2a04312e3530" + "320608a0c4c6b106" +
+				"39000000000000e03f" + "40feffffffffffffffff01" + "4a055b2278225d" +
+				"320808a0c4c6b1061005" + "3809" + "52026575",
+			unknown: []string{"extra"},
+		},
+		{
+			name: "null columns",
+			delta: tracker.Delta{
+				ID: 9, Action: "DELETE", TableName: "t", Timestamp: at,
+				OldData: rawJSON(`{"id":null,"name":null}`),
+			},
+			want: "0809" + "120644454c455445" + "1a0174" + "2200" + "320608a0c4c6b106",
+		},
+		{
+			name: "mark",
+			delta: tracker.Delta{
+				ID: 8, Action: "MARK", Timestamp: at,
+				NewData: rawJSON(`{"label":"x"}`),
+			},
+			want: "0808" + "12044d41524b" + "320608a0c4c6b106" + "620d7b226c6162656c223a2278227d",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, unknown, err := orderItemsProto.Encode(tt.delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("Encode =\n%x\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(unknown, tt.unknown) {
+				t.Errorf("unknown columns = %v, want %v", unknown, tt.unknown)
+			}
+		})
+	}
+}
+
+func TestTableProtoEncodeErrors(t *testing.T) {
+	for _, row := range []string{
+		`[1]`,
+		`{"id":"300"}`,
+		`{"qty":3000000000}`,
+		`{"active":"yes"}`,
+		`{"created":"May 1st"}`,
+	} {
+		d := tracker.Delta{ID: 1, Action: "INSERT", TableName: "order_items", NewData: rawJSON(row)}
+		if _, _, err := orderItemsProto.Encode(d); err == nil {
+			t.Errorf("row %s was encoded", row)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package compression compresses the files delta-tracker writes, table
+// backups and delta archives, which as JSON get large. A file's extension
+// says how it is compressed, so files are read back whatever the setting
+// was when they were written. gzip is built in; zstd runs the zstd command
+// line tool, which must be on PATH.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Method is one way of compressing files.
+type Method struct {
+	Name      string // as given in the config
+	Extension string // added to the names of files it compresses
+}
+
+var (
+	None = Method{}
+	Gzip = Method{Name: "gzip", Extension: ".gz"}
+	Zstd = Method{Name: "zstd", Extension: ".zst"}
+)
+
+// every method, the default first
+var methods = []Method{None, Gzip, Zstd}
+
+// Names lists the names Lookup accepts besides the empty default.
+func Names() []string {
+	return []string{Gzip.Name, Zstd.Name}
+}
+
+// Lookup returns the method with the given name; empty means none.
+func Lookup(name string) (Method, error) {
+	for _, m := range methods {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return None, fmt.Errorf("unknown compression %q (want %s, or empty for none)", name, strings.Join(Names(), " or "))
+}
+
+// ForFile returns the method a file was compressed with, going by its
+// extension; None for any other file.
+func ForFile(fileName string) Method {
+	for _, m := range methods[1:] {
+		if strings.HasSuffix(fileName, m.Extension) {
+			return m
+		}
+	}
+	return None
+}
+
+// Trim returns a file name without its compression extension.
+func Trim(fileName string) string {
+	return strings.TrimSuffix(fileName, ForFile(fileName).Extension)
+}
+
+// FileName returns a file name with the method's extension, unless it has
+// it already.
+func (m Method) FileName(fileName string) string {
+	if strings.HasSuffix(fileName, m.Extension) {
+		return fileName
+	}
+	return fileName + m.Extension
+}
+
+// Compress compresses data the way a file's extension says.
+func Compress(fileName string, data []byte) ([]byte, error) {
+	switch ForFile(fileName) {
+	case Gzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to gzip %s: %v", fileName, err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip %s: %v", fileName, err)
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return runZstd(fileName, data, "-q", "-c")
+	}
+	return data, nil
+}
+
+// Decompress reverses Compress, for a file with the same name.
+func Decompress(fileName string, data []byte) ([]byte, error) {
+	switch ForFile(fileName) {
+	case Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not gzipped: %v", fileName, err)
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to gunzip %s: %v", fileName, err)
+		}
+		return out, nil
+	case Zstd:
+		return runZstd(fileName, data, "-d", "-q", "-c")
+	}
+	return data, nil
+}
+
+// pipe data through the zstd command line tool
+func runZstd(fileName string, data []byte, args ...string) ([]byte, error) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("%s: zstd compression needs the zstd command line tool on PATH; install it, or use gzip", fileName)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(zstd, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("zstd failed on %s: %v: %s", fileName, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,802 @@
+// Package config loads the settings shared by the init and restore programs
+// from a YAML file, by default delta-tracker.yaml in the working directory.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"db-delta-tracker/pkg/compression"
+	"db-delta-tracker/pkg/mask"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is where the programs look for their config file.
+const DefaultPath = "delta-tracker.yaml"
+
+// Config is the parsed config file, with the selected profile applied.
+type Config struct {
+	Source    Connection `yaml:"source"` // the tracked database
+	Target    Connection `yaml:"target"` // the restored database
+	Notify    Notify     `yaml:"notify"`
+	Retention Retention  `yaml:"retention"`
+	Backup    Backup     `yaml:"backup"`
+	Timeouts  Timeouts   `yaml:"timeouts"`
+	Keyless   Keyless    `yaml:"keyless"`
+	Capture   Capture    `yaml:"capture"`
+	Mask      Mask       `yaml:"mask"`
+	WAL       WAL        `yaml:"wal"`
+
+	// where Avro delta streams register their schema, if anywhere
+	SchemaRegistry SchemaRegistry `yaml:"schema_registry"`
+
+	// where the kafka-sink command publishes deltas, if anywhere
+	Kafka Kafka `yaml:"kafka"`
+
+	// foreign keys the schema doesn't declare, followed like declared ones
+	// when ordering a replay
+	Relations []Relation `yaml:"relations"`
+
+	// send some tables' deltas to other databases than the target; the
+	// first matching route wins and unmatched tables go to the target
+	Routes []Route `yaml:"routes"`
+
+	// shard databases the merge command consolidates into the target
+	Merge Merge `yaml:"merge"`
+
+	// commands the daemon runs on a schedule
+	Jobs []Job `yaml:"jobs"`
+
+	// label stamped on every delta captured from the source, telling delta
+	// streams apart once they are merged; defaults to the source dbname
+	Origin string `yaml:"origin"`
+
+	// named environments (dev, staging, prod, ...) whose settings override
+	// the ones above field by field
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+
+	// Profile is the name of the applied profile, if any.
+	Profile string `yaml:"-"`
+}
+
+// Connection holds the settings for one database connection. Unset fields
+// fall back to the PG* environment variables, and an empty password is
+// looked up in ~/.pgpass (or PGPASSFILE), as with psql.
+type Connection struct {
+	Host      string `yaml:"host"`       // TCP host name or address
+	Port      int    `yaml:"port"`       // defaults to 5432
+	SocketDir string `yaml:"socket_dir"` // Unix-domain socket directory, instead of host
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+	DBName    string `yaml:"dbname"`
+	SSLMode   string `yaml:"sslmode"`
+
+	// role to SET ROLE to after logging in, so a least-privilege login can
+	// act as the role owning the schema
+	Role string `yaml:"role"`
+
+	// server settings for the session, e.g. "-c search_path=app"
+	Options string `yaml:"options"`
+
+	// any other connection parameters, e.g. application_name or sslrootcert
+	Params map[string]string `yaml:"params"`
+
+	passwordFrom string // environment variable the password was taken from
+}
+
+// Notify configures where operational notifications are delivered.
+type Notify struct {
+	Webhook string `yaml:"webhook"` // URL notifications are POSTed to
+	Message string `yaml:"message"` // template for the text, default {{.Message}}
+}
+
+// SchemaRegistry is a Confluent Schema Registry to register the Avro schema
+// of deltas with, so consumers can look it up by id.
+type SchemaRegistry struct {
+	URL     string `yaml:"url"`     // e.g. http://registry:8081; user:password@ in it for basic auth
+	Subject string `yaml:"subject"` // default <origin>-deltas-value
+}
+
+// Kafka is a Kafka cluster the kafka-sink command publishes every delta
+// to as it is recorded.
+type Kafka struct {
+	Brokers  []string `yaml:"brokers"`  // host:port of one or more brokers
+	Topic    string   `yaml:"topic"`    // template, default {{.Database}}.deltas; use {{.Table}} for a topic per table
+	Format   string   `yaml:"format"`   // json (default), avro, framed with the schema_registry id, or protobuf, typed per table
+	TLS      bool     `yaml:"tls"`      // connect over TLS
+	Username string   `yaml:"username"` // for SASL PLAIN, if the cluster requires it
+	Password string   `yaml:"password"`
+}
+
+// Backup picks the tables init copies into the restored database. The
+// deltas table is left out unless asked for.
+type Backup struct {
+	Exclude       []string `yaml:"exclude"`        // more tables to leave out, names or patterns such as tmp_*
+	IncludeDeltas bool     `yaml:"include_deltas"` // copy the deltas table too, e.g. to archive it with the rest
+	Path          string   `yaml:"path"`           // template for each table's copy, default {{.Table}}.json
+	Compression   string   `yaml:"compression"`    // gzip or zstd, adding .gz or .zst to the path; empty means none
+}
+
+// Excludes reports whether a table matches one of the exclude patterns.
+func (b Backup) Excludes(table string) bool {
+	for _, pattern := range b.Exclude {
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Relation is a logical parent/child link between two tables that has no
+// foreign key constraint behind it.
+type Relation struct {
+	Child        string `yaml:"child"`         // the referencing table
+	Column       string `yaml:"column"`        // its column holding the parent's key
+	Parent       string `yaml:"parent"`        // the referenced table
+	ParentColumn string `yaml:"parent_column"` // defaults to id
+}
+
+// Job is a command the daemon runs on a schedule.
+type Job struct {
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command"` // restore, guard, merge, status, prune or archive
+	Every   string   `yaml:"every"`   // interval between runs, e.g. 24h
+	Args    []string `yaml:"args"`    // extra flags for the command
+}
+
+// Interval parses Every.
+func (j Job) Interval() (time.Duration, error) {
+	d, err := time.ParseDuration(j.Every)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// JobCommands are the commands a job may run.
+var JobCommands = []string{"restore", "guard", "merge", "status", "prune", "archive"}
+
+// Timeouts caps how long a single statement may run in each phase, so a
+// giant delete or a slow scan fails instead of hanging the run.
+type Timeouts struct {
+	Snapshot PhaseTimeout `yaml:"snapshot"` // init copying a table
+	Replay   PhaseTimeout `yaml:"replay"`   // restore applying deltas
+	Verify   PhaseTimeout `yaml:"verify"`   // restore checking relations afterwards
+}
+
+// Capture leaves some sessions' changes out of the deltas table, e.g. bulk
+// jobs that can simply be run again. Init builds it into each table's
+// trigger, so changes take effect when init runs again.
+type Capture struct {
+	ExcludeRoles        []string `yaml:"exclude_roles"`        // logged in as, or acting as after SET ROLE
+	ExcludeApplications []string `yaml:"exclude_applications"` // the session's application_name
+
+	// the public tables init adds triggers to, as names, globs such as
+	// orders_* or regular expressions between slashes such as /^queue_\d+$/:
+	// those matching Tables (every table when it is empty) and not
+	// ExcludeTables
+	Tables        []string `yaml:"tables"`
+	ExcludeTables []string `yaml:"exclude_tables"`
+
+	// columns left out of the recorded values, by table name, e.g. password
+	// hashes or large blobs; those under "*" are left out of every table
+	ExcludeColumns map[string][]string `yaml:"exclude_columns"`
+
+	// tables whose rows churn constantly (counters, heartbeats), with a
+	// window such as 1m: a row's updates after the first change of a window
+	// are logged as one delta, holding its latest values, once it ends
+	Sample map[string]string `yaml:"sample"`
+}
+
+// SampleWindows parses Sample's windows by table.
+func (c Capture) SampleWindows() (map[string]time.Duration, error) {
+	windows := make(map[string]time.Duration, len(c.Sample))
+	for table, window := range c.Sample {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("capture.sample.%s %q: %v", table, window, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("capture.sample.%s must be positive", table)
+		}
+		windows[table] = d
+	}
+	return windows, nil
+}
+
+// Tracks reports whether init adds a trigger to a table.
+func (c Capture) Tracks(table string) bool {
+	if len(c.Tables) > 0 && !matchAny(c.Tables, table) {
+		return false
+	}
+	return !matchAny(c.ExcludeTables, table)
+}
+
+// whether a table matches one of Capture's patterns; bad ones match nothing
+// (Validate reports them)
+func matchAny(patterns []string, table string) bool {
+	for _, pattern := range patterns {
+		if re, ok := strings.CutPrefix(pattern, "/"); ok && strings.HasSuffix(re, "/") {
+			if r, err := regexp.Compile(strings.TrimSuffix(re, "/")); err == nil && r.MatchString(table) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check a list of Capture's patterns
+func validatePatterns(field string, patterns []string) []error {
+	var errs []error
+	for _, pattern := range patterns {
+		var err error
+		if re, ok := strings.CutPrefix(pattern, "/"); ok && strings.HasSuffix(re, "/") {
+			_, err = regexp.Compile(strings.TrimSuffix(re, "/"))
+		} else {
+			_, err = path.Match(pattern, "")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: bad pattern %q: %v", field, pattern, err))
+		}
+	}
+	return errs
+}
+
+// Mask hides personal data, such as emails or national ids, in the rows the
+// deltas record.
+type Mask struct {
+	// capture (the default) masks in the trigger functions, so the deltas
+	// table never holds the plain values; restore keeps them in the deltas
+	// table and masks them as restore and merge read the deltas
+	At string `yaml:"at"`
+
+	// the method, hash or redact, of each masked column, by table; columns
+	// under "*" are masked in every table that has them
+	Columns mask.Rules `yaml:"columns"`
+}
+
+// Capturing reports whether the trigger functions mask the columns.
+func (m Mask) Capturing() bool {
+	return len(m.Columns) > 0 && m.At != "restore"
+}
+
+// Restoring reports whether deltas are masked as they are read.
+func (m Mask) Restoring() bool {
+	return len(m.Columns) > 0 && m.At == "restore"
+}
+
+// WAL coordinates the deltas with WAL archiving, for point-in-time recovery
+// from physical backups.
+type WAL struct {
+	// record the WAL position (pg_current_wal_lsn) in marks and table
+	// snapshots, so recovery-target can turn them into recovery_target_lsn
+	RecordLSN bool `yaml:"record_lsn"`
+}
+
+// Keyless says how replay treats tables with neither a primary key nor an id
+// column, whose rows are matched on all their columns.
+type Keyless struct {
+	OnMultiple string `yaml:"on_multiple"` // error or skip, when a row matches several; defaults to error
+}
+
+// Skip reports whether deltas matching several rows are left out.
+func (k Keyless) Skip() bool {
+	return k.OnMultiple == "skip"
+}
+
+// PhaseTimeout is one phase's statement_timeout.
+type PhaseTimeout struct {
+	Statement string `yaml:"statement"`  // e.g. 30s; empty keeps the server's statement_timeout
+	OnTimeout string `yaml:"on_timeout"` // abort, or retry the work in smaller pieces; defaults to abort
+}
+
+// Duration parses Statement; it is 0 when none is set.
+func (p PhaseTimeout) Duration() (time.Duration, error) {
+	if p.Statement == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(p.Statement)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// Retry reports whether work that timed out is retried in smaller pieces.
+func (p PhaseTimeout) Retry() bool {
+	return p.OnTimeout == "retry"
+}
+
+func (p PhaseTimeout) validate(name string) []error {
+	var errs []error
+	if _, err := p.Duration(); err != nil {
+		errs = append(errs, fmt.Errorf("timeouts.%s.statement %q: %v", name, p.Statement, err))
+	}
+	if p.OnTimeout != "" && p.OnTimeout != "abort" && p.OnTimeout != "retry" {
+		errs = append(errs, fmt.Errorf("timeouts.%s.on_timeout must be abort or retry", name))
+	}
+	return errs
+}
+
+// Route sends the deltas of matching tables to their own database.
+type Route struct {
+	Tables []string   `yaml:"tables"` // table names or patterns such as analytics_*
+	Target Connection `yaml:"target"` // unset fields default to the top-level target's
+}
+
+// Matches reports whether the route applies to a table.
+func (r Route) Matches(table string) bool {
+	for _, pattern := range r.Tables {
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge describes the shards consolidated by the merge command and how
+// their primary keys are kept from colliding in the target.
+type Merge struct {
+	// "composite" stores each shard's name in ShardColumn and keys rows by
+	// (ShardColumn, id); "offset" shifts each shard's ids by its Offset
+	Strategy    string  `yaml:"strategy"`
+	ShardColumn string  `yaml:"shard_column"` // defaults to shard_id
+	Shards      []Shard `yaml:"shards"`
+}
+
+// Shard is one source database whose deltas are merged.
+type Shard struct {
+	Name   string     `yaml:"name"`   // also the origin label of its deltas
+	Source Connection `yaml:"source"` // unset fields default to the top-level source's
+	Offset int64      `yaml:"offset"` // added to ids with the offset strategy
+}
+
+// Retention limits how much change history is kept in the deltas table.
+type Retention struct {
+	MaxRows      int64   `yaml:"max_rows"`      // 0 means no limit
+	MaxSize      string  `yaml:"max_size"`      // e.g. 20GB; empty means no limit
+	WarnAt       float64 `yaml:"warn_at"`       // fraction of a limit at which to warn
+	ArchiveDir   string  `yaml:"archive_dir"`   // where to move deltas over the limit
+	ArchiveCodec string  `yaml:"archive_codec"` // json, msgpack or protobuf; empty means json
+	KeepFor      string  `yaml:"keep_for"`      // how long prune keeps deltas, e.g. 30d or 12h; empty means forever
+
+	// gzip or zstd to compress archive files with; empty means none
+	ArchiveCompression string `yaml:"archive_compression"`
+}
+
+// Keep parses KeepFor, which takes a number of days (30d) as well as Go
+// durations; it returns 0 when deltas are kept forever.
+func (r Retention) Keep() (time.Duration, error) {
+	if r.KeepFor == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(r.KeepFor, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(r.KeepFor)
+	}
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// Load reads and parses the config file at path, applies the named profile
+// (if not empty) and fills in defaults. A config that defines profiles
+// requires one to be chosen, so nothing runs against the wrong environment
+// by accident. DELTA_SOURCE_DSN and DELTA_RESTORE_DSN override the file. If
+// the file at DefaultPath doesn't exist, the settings come from the
+// environment alone.
+func Load(path, profile string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && path == DefaultPath) {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var cfg Config
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := decodeStrict(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	if profile == "" && len(cfg.Profiles) > 0 {
+		return nil, fmt.Errorf("config file %s defines profiles (%s); choose one with -profile", path, strings.Join(cfg.profileNames(), ", "))
+	}
+	if profile != "" {
+		node, ok := cfg.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("profile %q not found in %s (available: %s)", profile, path, strings.Join(cfg.profileNames(), ", "))
+		}
+
+		// decoding onto the loaded config only replaces the fields the profile sets
+		overrides, err := yaml.Marshal(&node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read profile %q: %v", profile, err)
+		}
+		if err := decodeStrict(overrides, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse profile %q: %v", profile, err)
+		}
+		cfg.Profile = profile
+	}
+
+	if err := cfg.applyDSNEnv(); err != nil {
+		return nil, err
+	}
+	cfg.applyDefaults()
+	if err := cfg.expandTemplates(); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// decode YAML, rejecting unknown keys so typos don't go unnoticed
+func decodeStrict(data []byte, out interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
+
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fill in unset settings the way libpq does (PG* environment variables,
+// then the OS user), and have the target live on the same server as the
+// source unless told otherwise
+func (c *Config) applyDefaults() {
+	if c.Source.User == "" {
+		c.Source.User = os.Getenv("PGUSER")
+	}
+	if c.Source.User == "" {
+		if u, err := user.Current(); err == nil {
+			c.Source.User = u.Username
+		}
+	}
+	if c.Source.DBName == "" {
+		c.Source.DBName = os.Getenv("PGDATABASE")
+	}
+	if c.Source.DBName == "" {
+		c.Source.DBName = c.Source.User
+	}
+	if c.Source.SSLMode == "" {
+		c.Source.SSLMode = os.Getenv("PGSSLMODE")
+	}
+	if c.Source.SSLMode == "" {
+		c.Source.SSLMode = "disable"
+	}
+
+	c.Target = c.Target.inherit(c.Source)
+	if c.Target.DBName == "" && c.Source.DBName != "" {
+		c.Target.DBName = "{{.Database}}_restored"
+	}
+	if c.Backup.Path == "" {
+		c.Backup.Path = "{{.Table}}.json"
+	}
+	if c.Notify.Message == "" {
+		c.Notify.Message = "{{.Message}}"
+	}
+
+	if c.Merge.ShardColumn == "" {
+		c.Merge.ShardColumn = "shard_id"
+	}
+	for i := range c.Relations {
+		if c.Relations[i].ParentColumn == "" {
+			c.Relations[i].ParentColumn = "id"
+		}
+	}
+	for i := range c.Routes {
+		c.Routes[i].Target = c.Routes[i].Target.inherit(c.Target)
+	}
+	for i := range c.Merge.Shards {
+		c.Merge.Shards[i].Source = c.Merge.Shards[i].Source.inherit(c.Source)
+	}
+
+	if c.Origin == "" {
+		c.Origin = c.Source.DBName
+	}
+	if c.SchemaRegistry.URL != "" && c.SchemaRegistry.Subject == "" {
+		c.SchemaRegistry.Subject = c.Origin + "-deltas-value"
+	}
+
+	if c.Kafka.Topic == "" {
+		c.Kafka.Topic = "{{.Database}}.deltas"
+	}
+	if c.Kafka.Format == "" {
+		c.Kafka.Format = "json"
+	}
+
+	if c.Retention.WarnAt == 0 {
+		c.Retention.WarnAt = 0.8
+	}
+}
+
+// Validate reports every problem with the config rather than just the first.
+func (c *Config) Validate() []error {
+	var errs []error
+	errs = append(errs, c.Source.validate("source")...)
+	errs = append(errs, c.Target.validate("target")...)
+
+	if c.Source.DBName != "" && c.Source.DBName == c.Target.DBName {
+		errs = append(errs, fmt.Errorf("target.dbname must differ from source.dbname"))
+	}
+	if c.Retention.WarnAt <= 0 || c.Retention.WarnAt > 1 {
+		errs = append(errs, fmt.Errorf("retention.warn_at must be between 0 and 1"))
+	}
+	if _, err := c.Retention.Keep(); err != nil {
+		errs = append(errs, fmt.Errorf("retention.keep_for %q: %v", c.Retention.KeepFor, err))
+	}
+	if _, err := compression.Lookup(c.Retention.ArchiveCompression); err != nil {
+		errs = append(errs, fmt.Errorf("retention.archive_compression: %v", err))
+	}
+	if _, err := compression.Lookup(c.Backup.Compression); err != nil {
+		errs = append(errs, fmt.Errorf("backup.compression: %v", err))
+	}
+	for _, pattern := range c.Backup.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("backup.exclude: bad pattern %q", pattern))
+		}
+	}
+	jobNames := make(map[string]bool)
+	for i, job := range c.Jobs {
+		field := fmt.Sprintf("jobs[%d]", i)
+		if job.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is required", field))
+		} else if jobNames[job.Name] {
+			errs = append(errs, fmt.Errorf("%s.name %q is used twice", field, job.Name))
+		}
+		jobNames[job.Name] = true
+		known := false
+		for _, command := range JobCommands {
+			known = known || job.Command == command
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("%s.command %q is not one of %s", field, job.Command, strings.Join(JobCommands, ", ")))
+		}
+		if _, err := job.Interval(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.every %q: %v", field, job.Every, err))
+		}
+	}
+	errs = append(errs, c.Timeouts.Snapshot.validate("snapshot")...)
+	errs = append(errs, c.Timeouts.Replay.validate("replay")...)
+	errs = append(errs, c.Timeouts.Verify.validate("verify")...)
+	if _, err := c.Capture.SampleWindows(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, validatePatterns("capture.tables", c.Capture.Tables)...)
+	errs = append(errs, validatePatterns("capture.exclude_tables", c.Capture.ExcludeTables)...)
+	for table, columns := range c.Capture.ExcludeColumns {
+		for _, column := range columns {
+			if column == "" {
+				errs = append(errs, fmt.Errorf("capture.exclude_columns.%s: empty column name", table))
+			}
+		}
+	}
+	if c.Keyless.OnMultiple != "" && c.Keyless.OnMultiple != "error" && c.Keyless.OnMultiple != "skip" {
+		errs = append(errs, fmt.Errorf("keyless.on_multiple must be error or skip"))
+	}
+	if c.Mask.At != "" && c.Mask.At != "capture" && c.Mask.At != "restore" {
+		errs = append(errs, fmt.Errorf("mask.at must be capture or restore"))
+	}
+	if err := c.Mask.Columns.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("mask.columns.%v", err))
+	}
+	for i, rel := range c.Relations {
+		if rel.Child == "" || rel.Column == "" || rel.Parent == "" {
+			errs = append(errs, fmt.Errorf("relations[%d] needs child, column and parent", i))
+		}
+	}
+	for i, route := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if len(route.Tables) == 0 {
+			errs = append(errs, fmt.Errorf("%s.tables is required", field))
+		}
+		for _, pattern := range route.Tables {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s.tables: bad pattern %q", field, pattern))
+			}
+		}
+		errs = append(errs, route.Target.validate(field+".target")...)
+		if route.Target.DBName == c.Source.DBName && route.Target.Host == c.Source.Host && route.Target.SocketDir == c.Source.SocketDir {
+			errs = append(errs, fmt.Errorf("%s.target must differ from source", field))
+		}
+	}
+	errs = append(errs, c.Merge.validate()...)
+	if c.Notify.Webhook != "" && !strings.HasPrefix(c.Notify.Webhook, "http://") && !strings.HasPrefix(c.Notify.Webhook, "https://") {
+		errs = append(errs, fmt.Errorf("notify.webhook must be an http(s) URL"))
+	}
+	if u := c.SchemaRegistry.URL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		errs = append(errs, fmt.Errorf("schema_registry.url must be an http(s) URL"))
+	}
+	errs = append(errs, c.Kafka.validate(c.SchemaRegistry)...)
+	return errs
+}
+
+func (k Kafka) validate(registry SchemaRegistry) []error {
+	var errs []error
+	if k.Format != "json" && k.Format != "avro" && k.Format != "protobuf" {
+		errs = append(errs, fmt.Errorf("kafka.format must be json, avro or protobuf"))
+	}
+	if k.Format == "avro" && len(k.Brokers) > 0 && registry.URL == "" {
+		errs = append(errs, fmt.Errorf("kafka.format avro requires schema_registry.url, for the schema id every message carries"))
+	}
+	if _, err := Expand(k.Topic, TemplateData{Table: "t"}); err != nil {
+		errs = append(errs, fmt.Errorf("kafka.topic: %v", err))
+	}
+	for _, broker := range k.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			errs = append(errs, fmt.Errorf("kafka.brokers: %q must be host:port", broker))
+		}
+	}
+	return errs
+}
+
+func (m *Merge) validate() []error {
+	if len(m.Shards) == 0 {
+		return nil
+	}
+
+	var errs []error
+	if m.Strategy != "composite" && m.Strategy != "offset" {
+		errs = append(errs, fmt.Errorf("merge.strategy %q is not one of composite, offset", m.Strategy))
+	}
+	names := make(map[string]bool)
+	for i, shard := range m.Shards {
+		field := fmt.Sprintf("merge.shards[%d]", i)
+		if shard.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is required", field))
+		} else if names[shard.Name] {
+			errs = append(errs, fmt.Errorf("%s.name %q is used twice", field, shard.Name))
+		}
+		names[shard.Name] = true
+		errs = append(errs, shard.Source.validate(field+".source")...)
+	}
+	return errs
+}
+
+// fill in a connection's unset server and login settings from another's,
+// the way the target defaults to the source
+func (c Connection) inherit(from Connection) Connection {
+	if c.Host == "" && c.SocketDir == "" {
+		c.Host, c.SocketDir = from.Host, from.SocketDir
+		if c.Port == 0 {
+			c.Port = from.Port
+		}
+	}
+	if c.User == "" {
+		c.User = from.User
+		if c.Password == "" {
+			c.Password, c.passwordFrom = from.Password, from.passwordFrom
+		}
+		if c.Role == "" {
+			c.Role = from.Role
+		}
+	}
+	if c.SSLMode == "" {
+		c.SSLMode = from.SSLMode
+	}
+	return c
+}
+
+// the modes lib/pq supports; libpq's allow and prefer are not among them
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+func (c Connection) validate(name string) []error {
+	var errs []error
+	if c.User == "" {
+		errs = append(errs, fmt.Errorf("%s.user is required", name))
+	}
+	if c.DBName == "" {
+		errs = append(errs, fmt.Errorf("%s.dbname is required", name))
+	}
+
+	if c.Host != "" && c.SocketDir != "" {
+		errs = append(errs, fmt.Errorf("%s.host and %s.socket_dir can't both be set", name, name))
+	}
+	if c.SocketDir != "" && !strings.HasPrefix(c.SocketDir, "/") {
+		errs = append(errs, fmt.Errorf("%s.socket_dir must be an absolute path", name))
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("%s.port %d is out of range", name, c.Port))
+	}
+
+	valid := false
+	for _, mode := range sslModes {
+		valid = valid || c.SSLMode == mode
+	}
+	if !valid {
+		errs = append(errs, fmt.Errorf("%s.sslmode %q is not one of %s", name, c.SSLMode, strings.Join(sslModes, ", ")))
+	}
+	return errs
+}
+
+// DSN renders the connection as a lib/pq key=value connection string, with
+// any extra parameters (e.g. connect_timeout) added on top.
+func (c Connection) DSN(extra ...string) string {
+	params := make(map[string]string)
+	for key, value := range c.Params {
+		params[key] = value
+	}
+
+	// lib/pq takes a socket directory through host, like libpq
+	params["host"] = c.Host
+	if c.SocketDir != "" {
+		params["host"] = c.SocketDir
+	}
+	if c.Port != 0 {
+		params["port"] = strconv.Itoa(c.Port)
+	}
+	params["user"] = c.User
+	params["password"] = c.Password
+	params["dbname"] = c.DBName
+	params["sslmode"] = c.SSLMode
+	params["options"] = c.Options
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		params[extra[i]] = extra[i+1]
+	}
+
+	keys := make([]string, 0, len(params))
+	for key, value := range params {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + quoteValue(params[key])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// quote a connection string value so spaces and quotes survive
+func quoteValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// ReadOnly returns a copy of the connection whose sessions start with
+// default_transaction_read_only on, so the server rejects any write.
+func (c Connection) ReadOnly() Connection {
+	params := map[string]string{"default_transaction_read_only": "on"}
+	for key, value := range c.Params {
+		if key != "default_transaction_read_only" {
+			params[key] = value
+		}
+	}
+	c.Params = params
+	return c
+}
+
+// WithDatabase returns a copy of the connection pointing at another database
+// on the same server.
+func (c Connection) WithDatabase(dbName string) Connection {
+	c.DBName = dbName
+	return c
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Environment variables holding a whole connection string, as a
+// postgres:// URL or libpq key=value pairs. Settings they contain win over
+// the config file and its profile; the rest still come from there.
+const (
+	SourceDSNEnv  = "DELTA_SOURCE_DSN"
+	RestoreDSNEnv = "DELTA_RESTORE_DSN"
+)
+
+// apply the connection strings in the environment to the source and target
+func (c *Config) applyDSNEnv() error {
+	for _, env := range []struct {
+		name string
+		conn *Connection
+	}{{SourceDSNEnv, &c.Source}, {RestoreDSNEnv, &c.Target}} {
+		dsn := os.Getenv(env.name)
+		if dsn == "" {
+			continue
+		}
+		if err := env.conn.applyDSN(dsn, env.name); err != nil {
+			return fmt.Errorf("%s: %v", env.name, err)
+		}
+	}
+	return nil
+}
+
+// set the fields a connection string names, noting where a password came from
+func (c *Connection) applyDSN(dsn, from string) error {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		converted, err := pq.ParseURL(dsn)
+		if err != nil {
+			return err
+		}
+		dsn = converted
+	}
+	params, err := parseKeywordValues(dsn)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range params {
+		switch key {
+		case "host":
+			if strings.HasPrefix(value, "/") {
+				c.Host, c.SocketDir = "", value
+			} else {
+				c.Host, c.SocketDir = value, ""
+			}
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid port %q", value)
+			}
+			c.Port = port
+		case "user":
+			c.User = value
+		case "password":
+			c.Password, c.passwordFrom = value, from
+		case "dbname":
+			c.DBName = value
+		case "sslmode":
+			c.SSLMode = value
+		case "options":
+			c.Options = value
+		default:
+			params := make(map[string]string, len(c.Params)+1)
+			for k, v := range c.Params {
+				params[k] = v
+			}
+			params[key] = value
+			c.Params = params
+		}
+	}
+	return nil
+}
+
+// parse libpq key=value pairs, where values may be single-quoted and use
+// backslash escapes
+func parseKeywordValues(dsn string) (map[string]string, error) {
+	params := make(map[string]string)
+	s := strings.TrimSpace(dsn)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing \"=\" after %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t\n")
+
+		var value strings.Builder
+		quoted := strings.HasPrefix(s, "'")
+		if quoted {
+			s = s[1:]
+		}
+		i := 0
+		for ; i < len(s); i++ {
+			ch := s[i]
+			if ch == '\\' && i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+				continue
+			}
+			if quoted && ch == '\'' {
+				break
+			}
+			if !quoted && (ch == ' ' || ch == '\t' || ch == '\n') {
+				break
+			}
+			value.WriteByte(ch)
+		}
+		if quoted {
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quoted value for %s", key)
+			}
+			i++
+		}
+		params[key] = value.String()
+		s = strings.TrimLeft(s[i:], " \t\n")
+	}
+	return params, nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fleet is the coordinator's file: the agents it watches, one daemon next
+// to each tracked database, and the config each of them runs with.
+type Fleet struct {
+	Agents []Agent `yaml:"agents"`
+}
+
+// Agent is a daemon the coordinator talks to.
+type Agent struct {
+	Name    string `yaml:"name"`
+	URL     string `yaml:"url"`     // where its -listen API is, e.g. http://db1:8080
+	Config  string `yaml:"config"`  // its config file, relative to the fleet file
+	Profile string `yaml:"profile"` // the profile it runs with, if its config has profiles
+}
+
+// LoadFleet reads the fleet file at path. Agent config paths are made
+// relative to the directory it is in, and every agent's config is loaded,
+// so a fleet with a broken config is caught before any agent fetches it.
+func LoadFleet(path string) (*Fleet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fleet file: %v", err)
+	}
+	var fleet Fleet
+	if err := decodeStrict(data, &fleet); err != nil {
+		return nil, fmt.Errorf("failed to parse fleet file %s: %v", path, err)
+	}
+
+	var errs []string
+	names := make(map[string]bool)
+	for i, agent := range fleet.Agents {
+		field := fmt.Sprintf("agents[%d]", i)
+		if agent.Name == "" || strings.Contains(agent.Name, "/") {
+			errs = append(errs, fmt.Sprintf("%s.name is required and can't contain /", field))
+		} else if names[agent.Name] {
+			errs = append(errs, fmt.Sprintf("%s.name %q is used twice", field, agent.Name))
+		}
+		names[agent.Name] = true
+		if !strings.HasPrefix(agent.URL, "http://") && !strings.HasPrefix(agent.URL, "https://") {
+			errs = append(errs, fmt.Sprintf("%s.url must be an http(s) URL", field))
+		}
+		if agent.Config == "" {
+			errs = append(errs, fmt.Sprintf("%s.config is required", field))
+			continue
+		}
+		if !filepath.IsAbs(agent.Config) {
+			fleet.Agents[i].Config = filepath.Join(filepath.Dir(path), agent.Config)
+		}
+		cfg, err := Load(fleet.Agents[i].Config, agent.Profile)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s.config: %v", field, err))
+			continue
+		}
+		for _, err := range cfg.Validate() {
+			errs = append(errs, fmt.Sprintf("%s.config: %v", field, err))
+		}
+	}
+	if len(fleet.Agents) == 0 {
+		errs = append(errs, "no agents under agents:")
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("fleet file %s: %s", path, strings.Join(errs, "; "))
+	}
+	return &fleet, nil
+}
+
+// Agent returns the agent with a name.
+func (f *Fleet) Agent(name string) (Agent, bool) {
+	for _, agent := range f.Agents {
+		if agent.Name == name {
+			return agent, true
+		}
+	}
+	return Agent{}, false
+}
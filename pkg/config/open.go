@@ -0,0 +1,49 @@
+package config
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Open connects to the database described by the connection, with any extra
+// parameters added to its DSN. When Role is set, every pooled connection
+// runs SET ROLE right after logging in.
+func (c Connection) Open(extra ...string) (*sql.DB, error) {
+	connector, err := pq.NewConnector(c.DSN(extra...))
+	if err != nil {
+		return nil, err
+	}
+	if c.Role == "" {
+		return sql.OpenDB(connector), nil
+	}
+	return sql.OpenDB(roleConnector{connector, c.Role}), nil
+}
+
+// a connector that switches role on each new connection, since database/sql
+// may open several and SET ROLE only lasts for the session
+type roleConnector struct {
+	driver.Connector
+	role string
+}
+
+func (rc roleConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := rc.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("driver can't run SET ROLE")
+	}
+	if _, err := execer.ExecContext(ctx, "SET ROLE "+pq.QuoteIdentifier(rc.role), nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to SET ROLE %s: %v", rc.role, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PasswordSource reports where the connection's password will come from:
+// "config", DELTA_SOURCE_DSN or DELTA_RESTORE_DSN, "PGPASSWORD", ".pgpass"
+// or "none". The driver does the actual environment and password file
+// lookups; this only explains them.
+func (c Connection) PasswordSource() string {
+	if c.passwordFrom != "" {
+		return c.passwordFrom
+	}
+	if c.Password != "" {
+		return "config"
+	}
+	if os.Getenv("PGPASSWORD") != "" {
+		return "PGPASSWORD"
+	}
+
+	// sockets match "localhost" entries, as in libpq
+	host := c.Host
+	if host == "" && c.SocketDir == "" {
+		host = os.Getenv("PGHOST")
+	}
+	if host == "" || strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+	port := os.Getenv("PGPORT")
+	if c.Port != 0 {
+		port = strconv.Itoa(c.Port)
+	}
+	if port == "" {
+		port = "5432"
+	}
+
+	if _, ok := pgpassLookup(host, port, c.DBName, c.User); ok {
+		return ".pgpass"
+	}
+	return "none"
+}
+
+// find the password for a connection in the libpq password file, whose
+// lines are host:port:database:user:password with * as a wildcard
+func pgpassLookup(host, port, dbName, userName string) (string, bool) {
+	fileName := os.Getenv("PGPASSFILE")
+	if fileName == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		fileName = filepath.Join(home, ".pgpass")
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	want := []string{host, port, dbName, userName}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+
+		matched := true
+		for i, value := range want {
+			if fields[i] != "*" && fields[i] != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return fields[4], true
+		}
+	}
+	return "", false
+}
+
+// split a password file line on unescaped colons, undoing \: and \\
+func splitPgpassLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
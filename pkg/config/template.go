@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"db-delta-tracker/pkg/compression"
+)
+
+// TemplateData is what names, paths and messages in the config can refer
+// to, e.g. dbname: "{{.Database}}_{{.Date}}".
+type TemplateData struct {
+	Database string // the source database
+	Table    string // the table, where a name or path is per table
+	Date     string // today, as 2006-01-02
+	Time     string // now, as 150405
+	Level    string // notification messages only: info, warning or error
+	Message  string // notification messages only: the message itself
+}
+
+// the moment the config was loaded, so every name rendered from one config
+// agrees on the date
+var loadedAt = time.Now()
+
+// Data returns the template data for the config, with Table set.
+func (c *Config) Data(table string) TemplateData {
+	return TemplateData{
+		Database: c.Source.DBName,
+		Table:    table,
+		Date:     loadedAt.Format("2006-01-02"),
+		Time:     loadedAt.Format("150405"),
+	}
+}
+
+// Expand renders a config string as a template. Strings without {{ are
+// returned as they are.
+func Expand(text string, data TemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("bad template %q: %v", text, err)
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("bad template %q: %v", text, err)
+	}
+	return out.String(), nil
+}
+
+// render the templated settings that don't depend on a table
+func (c *Config) expandTemplates() error {
+	data := c.Data("")
+	for _, field := range []*string{&c.Target.DBName, &c.Retention.ArchiveDir} {
+		expanded, err := Expand(*field, data)
+		if err != nil {
+			return err
+		}
+		*field = expanded
+	}
+	for i := range c.Routes {
+		expanded, err := Expand(c.Routes[i].Target.DBName, data)
+		if err != nil {
+			return fmt.Errorf("routes[%d].target.dbname: %v", i, err)
+		}
+		c.Routes[i].Target.DBName = expanded
+	}
+
+	// the per-table and per-message templates are rendered when used, but
+	// checked now
+	if _, err := Expand(c.Backup.Path, c.Data("table")); err != nil {
+		return fmt.Errorf("backup.path: %v", err)
+	}
+	if _, err := Expand(c.Notify.Message, TemplateData{}); err != nil {
+		return fmt.Errorf("notify.message: %v", err)
+	}
+	return nil
+}
+
+// BackupFile returns the file init keeps a table's copy in, with the
+// extension of backup.compression.
+func (c *Config) BackupFile(table string) (string, error) {
+	path, err := Expand(c.Backup.Path, c.Data(table))
+	if err != nil {
+		return "", err
+	}
+	method, err := compression.Lookup(c.Backup.Compression)
+	if err != nil {
+		return "", err
+	}
+	return method.FileName(path), nil
+}
+
+// NotifyMessage renders a notification through notify.message.
+func (c *Config) NotifyMessage(level, message string) (string, error) {
+	data := c.Data("")
+	data.Level, data.Message = level, message
+	return Expand(c.Notify.Message, data)
+}
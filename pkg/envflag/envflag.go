@@ -0,0 +1,43 @@
+// Package envflag lets every command line flag be given as an environment
+// variable instead, so the programs can run as a container or Kubernetes Job
+// configured entirely through its environment.
+package envflag
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix starts the name of every flag's environment variable.
+const Prefix = "DELTA_TRACKER_"
+
+// Name returns the environment variable for a flag: -lock-timeout is read
+// from DELTA_TRACKER_LOCK_TIMEOUT.
+func Name(flagName string) string {
+	return Prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Apply sets each flag of fs that wasn't given on the command line from its
+// environment variable, if that is set. Call it after fs.Parse; flags on the
+// command line win over the environment.
+func Apply(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(Name(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, Name(f.Name), setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,48 @@
+// Package exitcode defines the exit statuses shared by the init and restore
+// programs, so wrapper scripts and schedulers can tell failures apart
+// without matching log messages.
+package exitcode
+
+import "errors"
+
+const (
+	OK         = 0
+	Failure    = 1 // any failure without a more specific code
+	Usage      = 2 // bad command line, as with the flag package
+	Config     = 3 // the config file is missing, unreadable or invalid
+	Connection = 4 // a database could not be reached or logged into
+	Mismatch   = 5 // verification found the databases differ
+	Partial    = 6 // the restore stopped after applying some deltas
+	Conflict   = 7 // conflicting changes were detected
+	Limit      = 8 // guard found the deltas table over a limit
+)
+
+// Error is an error that ends the program with a particular exit code.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// Wrap marks err as ending the program with code. A nil err stays nil.
+func Wrap(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{code, err}
+}
+
+// Of returns the exit code for err: the code of the outermost Error in its
+// chain, Failure for any other error, and OK for nil.
+func Of(err error) int {
+	if err == nil {
+		return OK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Failure
+}
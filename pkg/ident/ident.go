@@ -0,0 +1,36 @@
+// Package ident quotes the table, column and other names the init and
+// restore programs put into SQL, so mixed-case and reserved-word names work
+// and no name can change the statement it is part of.
+package ident
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Quote returns name as a quoted identifier, e.g. "Orders" or "order".
+func Quote(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// List quotes each name and joins them with commas, for column lists.
+func List(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = Quote(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// TriggerName returns the quoted name of the trigger init installs on a
+// table.
+func TriggerName(table string) string {
+	return Quote(table + "_trigger")
+}
+
+// TriggerFunc returns the quoted name of the function a table's trigger
+// calls.
+func TriggerFunc(table string) string {
+	return Quote("log_" + table + "_changes")
+}
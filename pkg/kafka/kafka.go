@@ -0,0 +1,709 @@
+// Package kafka is a small Kafka producer: enough of the wire protocol to
+// find partition leaders and write record batches to them, waiting for every
+// in-sync replica. Messages are partitioned by key the way the Java client
+// does it, so consumers of other producers' topics see the same layout.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config says how to reach a cluster.
+type Config struct {
+	Brokers  []string // host:port of one or more brokers, to find the rest
+	TLS      bool
+	Username string // for SASL PLAIN; empty for none
+	Password string
+	ClientID string
+}
+
+// Message is a record to produce.
+type Message struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers []Header
+	Time    time.Time
+}
+
+// Header is a record header.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Producer writes messages to a cluster. It is not safe for concurrent use.
+type Producer struct {
+	cfg     Config
+	brokers map[int32]string   // addresses, by node id
+	leaders map[string][]int32 // each partition's leader, by topic
+	conns   map[int32]*conn
+}
+
+// the API keys and versions used
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+)
+
+// how big a record batch may get before a partition's messages are split
+// over several requests, below the brokers' default message.max.bytes
+const maxBatchBytes = 900 << 10
+
+// how often a request failing with a retriable error is tried
+const attempts = 5
+
+// how long a request may take when the context has no deadline
+const requestTimeout = 30 * time.Second
+
+// NewProducer returns a producer for a cluster. It connects when first used.
+func NewProducer(cfg Config) *Producer {
+	if cfg.ClientID == "" {
+		cfg.ClientID = "db-delta-tracker"
+	}
+	return &Producer{cfg: cfg, leaders: make(map[string][]int32), conns: make(map[int32]*conn)}
+}
+
+// Close closes the connections to the brokers.
+func (p *Producer) Close() error {
+	for id, c := range p.conns {
+		c.Close()
+		delete(p.conns, id)
+	}
+	return nil
+}
+
+// a partition's messages, ready to send
+type partitionBatch struct {
+	topic     string
+	partition int32
+	messages  []Message
+}
+
+// Produce writes messages and returns once every in-sync replica has them
+// (acks=all). Messages with the same key go to the same partition, in the
+// order given. A failed call may have written some messages, so callers
+// that retry it deliver them at least once.
+func (p *Producer) Produce(ctx context.Context, messages []Message) error {
+	var pending []*partitionBatch
+	for attempt := 1; ; attempt++ {
+		err := p.produce(ctx, messages, &pending)
+		if err == nil {
+			return nil
+		}
+		if !retriable(err) || attempt == attempts {
+			return err
+		}
+		// the cluster may have moved leaders; look them up again and send
+		// what hasn't been written
+		p.Close()
+		p.leaders = make(map[string][]int32)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+		}
+	}
+}
+
+// send messages, or the batches still pending from an earlier attempt,
+// leaving in pending those that weren't written
+func (p *Producer) produce(ctx context.Context, messages []Message, pending *[]*partitionBatch) error {
+	if *pending == nil {
+		batches, err := p.partition(ctx, messages)
+		if err != nil {
+			return err
+		}
+		*pending = batches
+	} else {
+		// the partitions stay as they were, so per-key order holds even if
+		// a topic gained partitions in between
+		topics := make(map[string]bool)
+		for _, b := range *pending {
+			topics[b.topic] = true
+		}
+		if err := p.refresh(ctx, topics); err != nil {
+			return err
+		}
+	}
+
+	for len(*pending) > 0 {
+		// one record batch per partition in each round, as brokers take
+		requests := make(map[int32][]*partitionBatch)
+		var next []*partitionBatch
+		for _, b := range *pending {
+			leaders := p.leaders[b.topic]
+			if int(b.partition) >= len(leaders) || leaders[b.partition] < 0 {
+				return kafkaError{code: 5, where: fmt.Sprintf("%s/%d", b.topic, b.partition)}
+			}
+			leader := leaders[b.partition]
+			n := batchLength(b.messages)
+			requests[leader] = append(requests[leader], &partitionBatch{b.topic, b.partition, b.messages[:n]})
+			if n < len(b.messages) {
+				next = append(next, &partitionBatch{b.topic, b.partition, b.messages[n:]})
+			}
+		}
+		for leader, batches := range requests {
+			failed, err := p.send(ctx, leader, batches)
+			delete(requests, leader)
+			if err != nil {
+				// put back what this round didn't write, ahead of the rest
+				// of its partitions' messages
+				for _, unsent := range requests {
+					failed = append(failed, unsent...)
+				}
+				*pending = requeue(failed, next)
+				return err
+			}
+		}
+		*pending = next
+	}
+	return nil
+}
+
+// join the batches a round failed to write with the ones after them
+func requeue(failed, next []*partitionBatch) []*partitionBatch {
+	for _, b := range next {
+		joined := false
+		for _, f := range failed {
+			if f.topic == b.topic && f.partition == b.partition {
+				f.messages = append(append([]Message(nil), f.messages...), b.messages...)
+				joined = true
+			}
+		}
+		if !joined {
+			failed = append(failed, b)
+		}
+	}
+	return failed
+}
+
+// group messages by partition, keeping their order
+func (p *Producer) partition(ctx context.Context, messages []Message) ([]*partitionBatch, error) {
+	topics := make(map[string]bool)
+	for _, m := range messages {
+		if _, ok := p.leaders[m.Topic]; !ok {
+			topics[m.Topic] = true
+		}
+	}
+	if err := p.refresh(ctx, topics); err != nil {
+		return nil, err
+	}
+	var batches []*partitionBatch
+	byPartition := make(map[string]*partitionBatch)
+	for _, m := range messages {
+		partition := Partition(m.Key, len(p.leaders[m.Topic]))
+		id := m.Topic + "/" + strconv.Itoa(int(partition))
+		b := byPartition[id]
+		if b == nil {
+			b = &partitionBatch{topic: m.Topic, partition: partition}
+			byPartition[id] = b
+			batches = append(batches, b)
+		}
+		b.messages = append(b.messages, m)
+	}
+	return batches, nil
+}
+
+// how many of a partition's messages fit in one record batch; at least one
+func batchLength(messages []Message) int {
+	size := 0
+	for i, m := range messages {
+		size += len(m.Key) + len(m.Value) + 32
+		for _, h := range m.Headers {
+			size += len(h.Key) + len(h.Value) + 4
+		}
+		if size > maxBatchBytes && i > 0 {
+			return i
+		}
+	}
+	return len(messages)
+}
+
+// Partition picks the partition for a key out of n, as the Java client's
+// default partitioner does: murmur2 of the key, made positive, modulo n.
+func Partition(key []byte, n int) int32 {
+	if n <= 0 {
+		return 0
+	}
+	return int32((murmur2(key) & 0x7fffffff) % uint32(n))
+}
+
+// Kafka's variant of MurmurHash2
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// look up the brokers and the leaders of topics' partitions
+func (p *Producer) refresh(ctx context.Context, topics map[string]bool) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	var req encoder
+	req.int32(int32(len(topics)))
+	for topic := range topics {
+		req.string(topic)
+	}
+
+	var resp *decoder
+	var err error
+	if len(p.brokers) > 0 {
+		for id := range p.brokers {
+			if resp, err = p.request(ctx, id, apiMetadata, 1, req.b); err == nil {
+				break
+			}
+		}
+	}
+	if resp == nil {
+		for _, addr := range p.cfg.Brokers {
+			var c *conn
+			if c, err = p.dial(ctx, addr); err != nil {
+				continue
+			}
+			resp, err = c.roundTrip(ctx, apiMetadata, 1, req.b)
+			c.Close()
+			if err == nil {
+				break
+			}
+		}
+	}
+	if resp == nil {
+		return fmt.Errorf("failed to reach any of the brokers %s: %v", strings.Join(p.cfg.Brokers, ", "), err)
+	}
+
+	brokers := make(map[int32]string)
+	for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+		id, host, port := resp.int32(), resp.string(), resp.int32()
+		resp.nullableString() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.int32() // controller
+	leaders := make(map[string][]int32)
+	var topicErr error
+	for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+		code, topic := resp.int16(), resp.string()
+		resp.bool() // internal
+		var partitions []int32
+		for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+			resp.int16() // the partition's own error, e.g. no leader yet
+			index, leader := resp.int32(), resp.int32()
+			resp.int32s() // replicas
+			resp.int32s() // in-sync replicas
+			for int(index) >= len(partitions) {
+				partitions = append(partitions, -1)
+			}
+			partitions[index] = leader
+		}
+		if code != 0 {
+			topicErr = kafkaError{code: code, where: topic}
+			continue
+		}
+		leaders[topic] = partitions
+	}
+	if resp.err != nil {
+		return fmt.Errorf("failed to read metadata: %v", resp.err)
+	}
+	if topicErr != nil {
+		return topicErr
+	}
+	p.brokers = brokers
+	for topic, partitions := range leaders {
+		p.leaders[topic] = partitions
+	}
+	for topic := range topics {
+		if len(p.leaders[topic]) == 0 {
+			return kafkaError{code: 3, where: topic}
+		}
+	}
+	return nil
+}
+
+// send one record batch per partition to their leader, returning the ones
+// the leader refused with a retriable error, or all of them if the request
+// failed
+func (p *Producer) send(ctx context.Context, leader int32, batches []*partitionBatch) ([]*partitionBatch, error) {
+	byTopic := make(map[string][]*partitionBatch)
+	var topics []string
+	for _, b := range batches {
+		if byTopic[b.topic] == nil {
+			topics = append(topics, b.topic)
+		}
+		byTopic[b.topic] = append(byTopic[b.topic], b)
+	}
+	var req encoder
+	req.int16(-1) // no transactional id
+	req.int16(-1) // acks from every in-sync replica
+	req.int32(int32(requestTimeout / time.Millisecond))
+	req.int32(int32(len(topics)))
+	for _, topic := range topics {
+		req.string(topic)
+		req.int32(int32(len(byTopic[topic])))
+		for _, b := range byTopic[topic] {
+			req.int32(b.partition)
+			req.bytes(recordBatch(b.messages))
+		}
+	}
+
+	resp, err := p.request(ctx, leader, apiProduce, 3, req.b)
+	if err != nil {
+		return batches, err
+	}
+	var failed []*partitionBatch
+	var firstErr error
+	for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+		topic := resp.string()
+		for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+			partition, code := resp.int32(), resp.int16()
+			resp.int64() // base offset
+			resp.int64() // log append time
+			if code == 0 {
+				continue
+			}
+			err := kafkaError{code: code, where: fmt.Sprintf("%s/%d", topic, partition)}
+			if !retriable(err) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			for _, b := range byTopic[topic] {
+				if b.partition == partition {
+					failed = append(failed, b)
+				}
+			}
+		}
+	}
+	if resp.err != nil {
+		return batches, fmt.Errorf("failed to read the produce response: %v", resp.err)
+	}
+	return failed, firstErr
+}
+
+// encode messages as a record batch (magic 2), uncompressed
+func recordBatch(messages []Message) []byte {
+	first, last := messages[0].Time, messages[0].Time
+	for _, m := range messages {
+		if m.Time.Before(first) {
+			first = m.Time
+		}
+		if m.Time.After(last) {
+			last = m.Time
+		}
+	}
+
+	var records []byte
+	var record []byte
+	for i, m := range messages {
+		record = record[:0]
+		record = append(record, 0) // attributes
+		record = binary.AppendVarint(record, m.Time.UnixMilli()-first.UnixMilli())
+		record = binary.AppendVarint(record, int64(i))
+		record = appendVarBytes(record, m.Key)
+		record = appendVarBytes(record, m.Value)
+		record = binary.AppendVarint(record, int64(len(m.Headers)))
+		for _, h := range m.Headers {
+			record = appendVarBytes(record, []byte(h.Key))
+			record = appendVarBytes(record, h.Value)
+		}
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	// the part the checksum covers, from the attributes on
+	var body encoder
+	body.int16(0) // attributes: uncompressed, create time
+	body.int32(int32(len(messages) - 1))
+	body.int64(first.UnixMilli())
+	body.int64(last.UnixMilli())
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(messages)))
+	body.b = append(body.b, records...)
+
+	var batch encoder
+	batch.int64(0)                              // base offset, set by the broker
+	batch.int32(int32(4 + 1 + 4 + len(body.b))) // length after this field
+	batch.int32(-1)                             // partition leader epoch
+	batch.int8(2)                               // magic
+	batch.int32(int32(crc32.Checksum(body.b, castagnoli)))
+	batch.b = append(batch.b, body.b...)
+	return batch.b
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// a varint length and bytes, or -1 for nil
+func appendVarBytes(b, data []byte) []byte {
+	if data == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(data)))
+	return append(b, data...)
+}
+
+// make a request of a broker, connecting to it if need be
+func (p *Producer) request(ctx context.Context, broker int32, key, version int16, body []byte) (*decoder, error) {
+	c := p.conns[broker]
+	if c == nil {
+		addr, ok := p.brokers[broker]
+		if !ok {
+			return nil, kafkaError{code: 6, where: fmt.Sprintf("broker %d", broker)}
+		}
+		var err error
+		if c, err = p.dial(ctx, addr); err != nil {
+			return nil, err
+		}
+		p.conns[broker] = c
+	}
+	resp, err := c.roundTrip(ctx, key, version, body)
+	if err != nil {
+		c.Close()
+		delete(p.conns, broker)
+	}
+	return resp, err
+}
+
+// connect to a broker, authenticating if configured to
+func (p *Producer) dial(ctx context.Context, addr string) (*conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var nc net.Conn
+	var err error
+	if p.cfg.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, connError{fmt.Errorf("failed to connect to %s: %v", addr, err)}
+	}
+	c := &conn{Conn: nc, clientID: p.cfg.ClientID}
+	if p.cfg.Username != "" {
+		if err := c.authenticate(ctx, p.cfg.Username, p.cfg.Password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate to %s: %v", addr, err)
+		}
+	}
+	return c, nil
+}
+
+// a connection to a broker
+type conn struct {
+	net.Conn
+	clientID    string
+	correlation int32
+}
+
+// authenticate with SASL PLAIN
+func (c *conn) authenticate(ctx context.Context, username, password string) error {
+	var req encoder
+	req.string("PLAIN")
+	resp, err := c.roundTrip(ctx, apiSaslHandshake, 1, req.b)
+	if err != nil {
+		return err
+	}
+	if code := resp.int16(); code != 0 {
+		return kafkaError{code: code, where: "SASL handshake"}
+	}
+
+	req = encoder{}
+	req.bytes([]byte("\x00" + username + "\x00" + password))
+	if resp, err = c.roundTrip(ctx, apiSaslAuthenticate, 0, req.b); err != nil {
+		return err
+	}
+	if code := resp.int16(); code != 0 {
+		message := resp.nullableString()
+		return fmt.Errorf("%v: %s", kafkaError{code: code, where: "SASL authentication"}, message)
+	}
+	return nil
+}
+
+// send a request and read its response, past the correlation id
+func (c *conn) roundTrip(ctx context.Context, key, version int16, body []byte) (*decoder, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(requestTimeout + 10*time.Second)
+	}
+	c.SetDeadline(deadline)
+	c.correlation++
+
+	var req encoder
+	req.int32(0) // the size, filled in below
+	req.int16(key)
+	req.int16(version)
+	req.int32(c.correlation)
+	req.string(c.clientID)
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+	if _, err := c.Write(req.b); err != nil {
+		return nil, connError{err}
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, connError{err}
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, connError{err}
+	}
+	resp := &decoder{b: data}
+	if id := resp.int32(); id != c.correlation {
+		return nil, connError{fmt.Errorf("response %d to request %d", id, c.correlation)}
+	}
+	return resp, nil
+}
+
+// a broker that couldn't be reached, or dropped the connection
+type connError struct{ err error }
+
+func (e connError) Error() string { return e.err.Error() }
+
+// an error code a broker answered with
+type kafkaError struct {
+	code  int16
+	where string
+}
+
+// the names of the error codes a producer sees most, and whether a retry
+// may succeed
+var errorCodes = map[int16]struct {
+	name      string
+	retriable bool
+}{
+	2:  {"CORRUPT_MESSAGE", true},
+	3:  {"UNKNOWN_TOPIC_OR_PARTITION", true},
+	5:  {"LEADER_NOT_AVAILABLE", true},
+	6:  {"NOT_LEADER_OR_FOLLOWER", true},
+	7:  {"REQUEST_TIMED_OUT", true},
+	10: {"MESSAGE_TOO_LARGE", false},
+	17: {"INVALID_TOPIC_EXCEPTION", false},
+	18: {"RECORD_LIST_TOO_LARGE", false},
+	19: {"NOT_ENOUGH_REPLICAS", true},
+	20: {"NOT_ENOUGH_REPLICAS_AFTER_APPEND", true},
+	29: {"TOPIC_AUTHORIZATION_FAILED", false},
+	31: {"CLUSTER_AUTHORIZATION_FAILED", false},
+	33: {"UNSUPPORTED_SASL_MECHANISM", false},
+	35: {"UNSUPPORTED_VERSION", false},
+	58: {"SASL_AUTHENTICATION_FAILED", false},
+}
+
+func (e kafkaError) Error() string {
+	name := errorCodes[e.code].name
+	if name == "" {
+		name = "error code " + strconv.Itoa(int(e.code))
+	}
+	return fmt.Sprintf("%s: %s", e.where, name)
+}
+
+// whether trying again, after looking up the leaders again, may succeed
+func retriable(err error) bool {
+	switch e := err.(type) {
+	case connError:
+		return true
+	case kafkaError:
+		return errorCodes[e.code].retriable
+	}
+	return false
+}
+
+// builds a request, big-endian as the protocol is
+type encoder struct{ b []byte }
+
+func (e *encoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *encoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *encoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *encoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// reads a response, keeping the first error
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("truncated response")
+		return make([]byte, max(n, 0))
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) bool() bool     { return d.next(1)[0] != 0 }
+func (d *decoder) int16() int16   { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *decoder) int32() int32   { return int32(binary.BigEndian.Uint32(d.next(4))) }
+func (d *decoder) int64() int64   { return int64(binary.BigEndian.Uint64(d.next(8))) }
+func (d *decoder) string() string { return string(d.next(int(d.int16()))) }
+
+func (d *decoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) int32s() []int32 {
+	var values []int32
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		values = append(values, d.int32())
+	}
+	return values
+}
@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// the vectors of the Java client's UtilsTest.testMurmur2, as the signed
+// ints Java prints
+var murmur2Vectors = []struct {
+	key  string
+	hash int32
+}{
+	{"21", -973932308},
+	{"foobar", -790332482},
+	{"a-little-bit-long-string", -985981536},
+	{"a-little-bit-longer-string", -1486304829},
+	{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+	{"abc", 479470107},
+}
+
+func TestMurmur2(t *testing.T) {
+	for _, tt := range murmur2Vectors {
+		if got := int32(murmur2([]byte(tt.key))); got != tt.hash {
+			t.Errorf("murmur2(%q) = %d, want %d", tt.key, got, tt.hash)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for _, tt := range murmur2Vectors {
+		// Utils.toPositive(murmur2(key)) % numPartitions
+		want := int32(uint32(tt.hash)&0x7fffffff) % 12
+		if got := Partition([]byte(tt.key), 12); got != want {
+			t.Errorf("Partition(%q, 12) = %d, want %d", tt.key, got, want)
+		}
+	}
+	if got := Partition([]byte("abc"), 0); got != 0 {
+		t.Errorf("Partition with no partitions = %d, want 0", got)
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		messages []Message
+		want     string
+	}{
+		{
+			name:     "one record",
+			messages: []Message{{Key: []byte("k"), Value: []byte("v"), Time: time.UnixMilli(1000)}},
+			want: "0000000000000000" + "0000003a" + "ffffffff" + "02" + "716a6189" +
+				"0000" + "00000000" + "00000000000003e8" + "00000000000003e8" +
+				"ffffffffffffffff" + "ffff" + "ffffffff" + "00000001" +
+				"10" + "00" + "00" + "00" + "026b" + "0276" + "00",
+		},
+		{
+			// timestamps are deltas from the earliest, which needn't be first
+			name: "headers and out of order times",
+			messages: []Message{
+				{Key: []byte("a"), Value: []byte("1"), Headers: []Header{{"h", []byte("x")}}, Time: time.UnixMilli(1500)},
+				{Key: []byte("b"), Value: []byte("22"), Time: time.UnixMilli(1000)},
+			},
+			want: "0000000000000000" + "00000049" + "ffffffff" + "02" + "c8a5ae7c" +
+				"0000" + "00000001" + "00000000000003e8" + "00000000000005dc" +
+				"ffffffffffffffff" + "ffff" + "ffffffff" + "00000002" +
+				"1a" + "00" + "e807" + "00" + "0261" + "0231" + "02" + "0268" + "0278" +
+				"12" + "00" + "00" + "02" + "0262" + "043232" + "00",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(recordBatch(tt.messages)); got != tt.want {
+				t.Errorf("recordBatch =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordBatchNullKey(t *testing.T) {
+	batch := recordBatch([]Message{{Value: []byte("v"), Time: time.UnixMilli(0)}})
+	// the record and its length, with the varint -1 as its key length
+	if got, want := hex.EncodeToString(batch[len(batch)-8:]), "0e"+"00"+"00"+"00"+"01"+"0276"+"00"; got != want {
+		t.Errorf("record = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+// Package mask hides personal data in the rows deltas record: each chosen
+// column's value is replaced by a hash of it or redacted, either by the
+// trigger functions as changes are captured (SQL), so the deltas table never
+// holds the plain values, or as deltas are read for a restore (Row).
+package mask
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// The masking methods.
+const (
+	Hash   = "hash"   // the hex SHA-256 of the value's text, so equal values still match
+	Redact = "redact" // null
+)
+
+// Rules are the masked columns of each table, by table name, with the method
+// for each; columns under "*" are masked in every table that has them.
+type Rules map[string]map[string]string
+
+// For returns the masked columns of a table and their methods.
+func (r Rules) For(table string) map[string]string {
+	columns := make(map[string]string)
+	for _, t := range []string{"*", table} {
+		for column, method := range r[t] {
+			columns[column] = method
+		}
+	}
+	return columns
+}
+
+// SQL wraps data, a jsonb expression holding the row version record (e.g. NEW)
+// of table, so it yields the row with the table's masked columns replaced.
+// A column the row doesn't have is left out rather than added. It returns
+// data unchanged when the table has no masked columns.
+func (r Rules) SQL(table, record, data string) string {
+	columns := r.For(table)
+	for _, column := range sortedKeys(columns) {
+		value := "'null'::jsonb"
+		if columns[column] == Hash {
+			value = fmt.Sprintf("COALESCE(to_jsonb(encode(sha256(convert_to(to_jsonb(%s)->>%s, 'UTF8')), 'hex')), 'null'::jsonb)",
+				record, pq.QuoteLiteral(column))
+		}
+		data = fmt.Sprintf("jsonb_set(%s, %s, %s, false)", data, pq.QuoteLiteral("{"+column+"}"), value)
+	}
+	return data
+}
+
+// Row masks the columns of one row, as recorded in a delta, the way SQL
+// does. Values already masked at capture would be hashed again, so use one
+// or the other.
+func (r Rules) Row(table string, data json.RawMessage) (json.RawMessage, error) {
+	columns := r.For(table)
+	if len(columns) == 0 || len(data) == 0 || string(data) == "null" {
+		return data, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var row map[string]interface{}
+	if err := dec.Decode(&row); err != nil {
+		return nil, fmt.Errorf("failed to decode row: %v", err)
+	}
+	for column, method := range columns {
+		value, ok := row[column]
+		if !ok {
+			continue
+		}
+		switch {
+		case method == Redact || value == nil:
+			row[column] = nil
+		default:
+			sum := sha256.Sum256([]byte(text(value)))
+			row[column] = hex.EncodeToString(sum[:])
+		}
+	}
+	return json.Marshal(row)
+}
+
+// a JSON value as PostgreSQL's ->> operator gives it: strings unquoted,
+// anything else as JSON
+func text(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// Validate reports the first rule with an unknown method.
+func (r Rules) Validate() error {
+	for _, table := range sortedKeys(r) {
+		for _, column := range sortedKeys(r[table]) {
+			if method := r[table][column]; method != Hash && method != Redact {
+				return fmt.Errorf("%s.%s: method must be %s or %s, not %q", table, column, Hash, Redact, method)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String lists the rules in a stable order, e.g. for telling whether they
+// changed.
+func (r Rules) String() string {
+	var parts []string
+	for _, table := range sortedKeys(r) {
+		for _, column := range sortedKeys(r[table]) {
+			parts = append(parts, table+"."+column+"="+r[table][column])
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,190 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the Blob service version requests are made against
+const azureVersion = "2021-08-06"
+
+// an Azure Blob Storage container in the account AZURE_STORAGE_ACCOUNT,
+// authorized with a SAS token in AZURE_STORAGE_SAS_TOKEN or the account key
+// in AZURE_STORAGE_KEY. AZURE_STORAGE_ENDPOINT points it at another endpoint,
+// e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+type azureStore struct {
+	container string
+	account   string
+	key       []byte // the decoded account key; nil with a SAS token
+	sas       url.Values
+	endpoint  string
+}
+
+func newAzureStore(container string) (*azureStore, error) {
+	s := &azureStore{container: container, account: os.Getenv("AZURE_STORAGE_ACCOUNT")}
+	if s.account == "" {
+		return nil, fmt.Errorf("set AZURE_STORAGE_ACCOUNT to use az://%s", container)
+	}
+	s.endpoint = strings.TrimSuffix(os.Getenv("AZURE_STORAGE_ENDPOINT"), "/")
+	if s.endpoint == "" {
+		s.endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.account)
+	}
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_SAS_TOKEN: %v", err)
+		}
+		s.sas = values
+		return s, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("set AZURE_STORAGE_SAS_TOKEN, or AZURE_STORAGE_KEY to the base64 account key, to use az://%s", container)
+	}
+	s.key = key
+	return s, nil
+}
+
+func (s *azureStore) get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, key, nil, nil)
+}
+
+func (s *azureStore) put(ctx context.Context, key string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, key, nil, data)
+	return err
+}
+
+func (s *azureStore) remove(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	return err
+}
+
+func (s *azureStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}, "delimiter": {"/"}}
+	for {
+		data, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs struct {
+				Blob []struct {
+					Name string `xml:"Name"`
+				} `xml:"Blob"`
+			} `xml:"Blobs"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		if err := xml.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse the listing of az://%s/%s: %v", s.container, prefix, err)
+		}
+		for _, blob := range page.Blobs.Blob {
+			keys = append(keys, blob.Name)
+		}
+		if page.NextMarker == "" {
+			return keys, nil
+		}
+		query.Set("marker", page.NextMarker)
+	}
+}
+
+// make an authorized request for a blob, or the container when key is empty
+func (s *azureStore) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AZURE_STORAGE_ENDPOINT %q: %v", s.endpoint, err)
+	}
+	u.Path += "/" + s.container
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = awsEscape(u.Path, false)
+	all := url.Values{}
+	for name, values := range query {
+		all[name] = values
+	}
+	for name, values := range s.sas {
+		all[name] = values
+	}
+	u.RawQuery = all.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if method == http.MethodPut {
+		req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	}
+	if s.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.signature(req, query))
+	}
+	return send(req, fmt.Sprintf("az://%s/%s", s.container, key))
+}
+
+// sign a request with the account key, as Shared Key authorization defines
+func (s *azureStore) signature(req *http.Request, query url.Values) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(s.stringToSign(req, query)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// the standard headers, x-ms- headers and canonicalized resource of a
+// request that Shared Key signs
+func (s *azureStore) stringToSign(req *http.Request, query url.Values) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + s.account + req.URL.EscapedPath()
+	parameters := map[string][]string{}
+	var names []string
+	for name, values := range query {
+		lower := strings.ToLower(name)
+		if _, ok := parameters[lower]; !ok {
+			names = append(names, lower)
+		}
+		parameters[lower] = append(parameters[lower], values...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := parameters[name]
+		sort.Strings(values)
+		resource += "\n" + name + ":" + strings.Join(values, ",")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		"", // Content-Encoding
+		"", // Content-Language
+		length,
+		"", // Content-MD5
+		req.Header.Get("Content-Type"),
+		"",                 // Date, given as x-ms-date instead
+		"", "", "", "", "", // If-Modified-Since, If-Match, If-None-Match, If-Unmodified-Since, Range
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+}
@@ -0,0 +1,90 @@
+package objstore
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// the canonicalized resources of the Shared Key documentation's examples,
+// signed with the x-ms- headers of its canonicalized headers example
+func TestAzureStringToSign(t *testing.T) {
+	s := &azureStore{account: "myaccount"}
+	for _, tt := range []struct {
+		name     string
+		url      string
+		query    url.Values
+		resource string
+	}{
+		{
+			name:     "container metadata",
+			url:      "https://myaccount.blob.core.windows.net/mycontainer",
+			query:    url.Values{"restype": {"container"}, "comp": {"metadata"}},
+			resource: "/myaccount/mycontainer\ncomp:metadata\nrestype:container",
+		},
+		{
+			name:     "list with repeated parameter",
+			url:      "https://myaccount.blob.core.windows.net/mycontainer",
+			query:    url.Values{"restype": {"container"}, "comp": {"list"}, "include": {"snapshots", "metadata", "uncommittedblobs"}},
+			resource: "/myaccount/mycontainer\ncomp:list\ninclude:metadata,snapshots,uncommittedblobs\nrestype:container",
+		},
+		{
+			name:     "secondary location",
+			url:      "https://myaccount-secondary.blob.core.windows.net/mycontainer/myblob",
+			resource: "/myaccount/mycontainer/myblob",
+		},
+		{
+			name:     "parameter names in any case",
+			url:      "https://myaccount.blob.core.windows.net/mycontainer",
+			query:    url.Values{"Comp": {"list"}, "comp": {"metadata"}, "RESTYPE": {"container"}},
+			resource: "/myaccount/mycontainer\ncomp:list,metadata\nrestype:container",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Ms-Version", "2009-09-19")
+			req.Header.Set("X-Ms-Date", "Sun, 11 Oct 2009 21:49:13 GMT")
+			want := "GET\n\n\n\n\n\n\n\n\n\n\n\nx-ms-date:Sun, 11 Oct 2009 21:49:13 GMT\nx-ms-version:2009-09-19\n" + tt.resource
+			if got := s.stringToSign(req, tt.query); got != want {
+				t.Errorf("string to sign =\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+// requests signed with Azurite's well-known account key
+func TestAzureSignature(t *testing.T) {
+	key, _ := base64.StdEncoding.DecodeString("Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==")
+	s := &azureStore{container: "mycontainer", account: "devstoreaccount1", key: key}
+	for _, tt := range []struct {
+		name      string
+		method    string
+		path      string
+		query     url.Values
+		body      string
+		signature string
+	}{
+		{"put blob", http.MethodPut, "/mycontainer/path/my%20blob.txt", nil, "hello world", "o0HHwvvCKDjQLdezSft1tfC7+AXQHyfBXVh90kVGtfQ="},
+		{"list page", http.MethodGet, "/mycontainer", url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {"deltas/"}, "delimiter": {"/"}, "marker": {"2!48!x"}}, "", "3bZQF/jZ4/fwALGqCuLFHILjs9CDfpvWAn9Ox10UYGc="},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "https://devstoreaccount1.blob.core.windows.net"+tt.path+"?"+tt.query.Encode(), strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Ms-Date", "Sun, 11 Oct 2009 21:49:13 GMT")
+			req.Header.Set("X-Ms-Version", azureVersion)
+			if tt.method == http.MethodPut {
+				req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+			}
+			if got := s.signature(req, tt.query); got != tt.signature {
+				t.Errorf("signature = %s, want %s", got, tt.signature)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a Google Cloud Storage bucket, through the JSON API. The access token is
+// GOOGLE_OAUTH_ACCESS_TOKEN if set; otherwise one is requested for the
+// service account key in GOOGLE_APPLICATION_CREDENTIALS or, without one, from
+// the metadata server of the VM or container it runs in.
+// STORAGE_EMULATOR_HOST points it at an emulator, which needs no token.
+type gcsStore struct {
+	bucket   string
+	endpoint string
+}
+
+func newGCSStore(bucket string) *gcsStore {
+	s := &gcsStore{bucket: bucket, endpoint: "https://storage.googleapis.com"}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		s.endpoint = strings.TrimSuffix(host, "/")
+	}
+	return s
+}
+
+func (s *gcsStore) get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, "/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(key)+"?alt=media", key, nil)
+}
+
+func (s *gcsStore) put(ctx context.Context, key string, data []byte) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	_, err := s.do(ctx, http.MethodPost, "/upload/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), key, data)
+	return err
+}
+
+func (s *gcsStore) remove(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, "/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(key), key, nil)
+	return err
+}
+
+func (s *gcsStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"prefix": {prefix}, "delimiter": {"/"}, "fields": {"items(name),nextPageToken"}}
+	for {
+		data, err := s.do(ctx, http.MethodGet, "/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), prefix, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse the listing of gs://%s/%s: %v", s.bucket, prefix, err)
+		}
+		for _, object := range page.Items {
+			keys = append(keys, object.Name)
+		}
+		if page.NextPageToken == "" {
+			return keys, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+func (s *gcsStore) do(ctx context.Context, method, path, key string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		token, err := gcsToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return send(req, fmt.Sprintf("gs://%s/%s", s.bucket, key))
+}
+
+// the access token last obtained, reused until shortly before it expires
+var gcsAuth struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// an OAuth access token for Cloud Storage
+func gcsToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	gcsAuth.Lock()
+	defer gcsAuth.Unlock()
+	if gcsAuth.token != "" && time.Until(gcsAuth.expires) > time.Minute {
+		return gcsAuth.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); keyFile != "" {
+		req, err = serviceAccountTokenRequest(ctx, keyFile)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	data, err := send(req, req.URL.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to get a Cloud Storage access token (set GOOGLE_APPLICATION_CREDENTIALS or GOOGLE_OAUTH_ACCESS_TOKEN): %v", err)
+	}
+	var answer struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &answer); err != nil || answer.AccessToken == "" {
+		return "", fmt.Errorf("failed to read the Cloud Storage access token: %v", err)
+	}
+	gcsAuth.token, gcsAuth.expires = answer.AccessToken, time.Now().Add(time.Duration(answer.ExpiresIn)*time.Second)
+	return gcsAuth.token, nil
+}
+
+// a request exchanging a JWT signed with a service account's key for an
+// access token, as described in Google's OAuth 2.0 for service accounts
+func serviceAccountTokenRequest(ctx context.Context, keyFile string) (*http.Request, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GOOGLE_APPLICATION_CREDENTIALS: %v", err)
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse service account key %s: %v", keyFile, err)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("service account key %s has no private key", keyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the private key in %s: %v", keyFile, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key in %s is not an RSA key", keyFile)
+	}
+
+	assertion, err := serviceAccountAssertion(account.ClientEmail, account.TokenURI, key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// a JWT, signed with a service account's key, claiming read-write access to
+// Cloud Storage for an hour from now
+func serviceAccountAssertion(email, audience string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": "https://www.googleapis.com/auth/devstorage.read_write",
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the token request: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
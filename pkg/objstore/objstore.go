@@ -0,0 +1,207 @@
+// Package objstore keeps the files delta-tracker writes outside the
+// databases, table backups and delta archives, on the local filesystem or in
+// object storage. A location is a path, or a URL naming a bucket and key:
+// s3://bucket/key (Amazon S3 or an S3-compatible service), gs://bucket/key
+// (Google Cloud Storage) or az://container/key (Azure Blob Storage).
+// Credentials come from each provider's usual environment variables.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a bucket or container the objects are kept in
+type store interface {
+	get(ctx context.Context, key string) ([]byte, error)
+	put(ctx context.Context, key string, data []byte) error
+	// the keys starting with prefix that have no / after it
+	list(ctx context.Context, prefix string) ([]string, error)
+	remove(ctx context.Context, key string) error
+}
+
+// shared by every provider; an archive file can take a while to send
+var httpClient = &http.Client{Timeout: 10 * time.Minute}
+
+// IsRemote reports whether a location is in object storage rather than a
+// local path.
+func IsRemote(location string) bool {
+	for _, scheme := range []string{"s3://", "gs://", "az://"} {
+		if strings.HasPrefix(location, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Join adds a file name to a directory location.
+func Join(dir, name string) string {
+	if IsRemote(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + name
+	}
+	return filepath.Join(dir, name)
+}
+
+// ReadFile reads the file at a location. A missing file gives an error
+// matching fs.ErrNotExist, wherever it was looked for.
+func ReadFile(ctx context.Context, location string) ([]byte, error) {
+	s, key, err := open(location)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(ctx, key)
+}
+
+// WriteFile writes a file whole, replacing any file at the location. No
+// reader ever sees part of it: object stores only show an object once it is
+// all uploaded, and local files go through a temporary file, synced to disk
+// before it is renamed into place. Local directories are created as needed.
+func WriteFile(ctx context.Context, location string, data []byte) error {
+	s, key, err := open(location)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, key, data)
+}
+
+// List returns the names of the files in a directory location, sorted; a
+// directory that doesn't exist has none.
+func List(ctx context.Context, dir string) ([]string, error) {
+	s, key, err := open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" && IsRemote(dir) && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	keys, err := s.list(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// local files are listed by name already
+	prefix := key
+	if !IsRemote(dir) {
+		prefix = ""
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if name := strings.TrimPrefix(k, prefix); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Remove deletes the file at a location.
+func Remove(ctx context.Context, location string) error {
+	s, key, err := open(location)
+	if err != nil {
+		return err
+	}
+	return s.remove(ctx, key)
+}
+
+// the store a location is in and its key there
+func open(location string) (store, string, error) {
+	scheme, rest, ok := strings.Cut(location, "://")
+	if !ok || !IsRemote(location) {
+		return localStore{}, location, nil
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("%s: no bucket or container named", location)
+	}
+	switch scheme {
+	case "s3":
+		return newS3Store(bucket), key, nil
+	case "gs":
+		return newGCSStore(bucket), key, nil
+	default:
+		s, err := newAzureStore(bucket)
+		return s, key, err
+	}
+}
+
+// send a request, returning the body of a 2xx answer; a 404 is reported as
+// a missing file
+func send(req *http.Request, location string) ([]byte, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", req.Method, location, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", req.Method, location, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: strings.ToLower(req.Method), Path: location, Err: fs.ErrNotExist}
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, location, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// the local filesystem; keys are paths
+type localStore struct{}
+
+func (localStore) get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(key)
+}
+
+func (localStore) put(ctx context.Context, key string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(key), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	tmpName := key + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, bytes.NewReader(data))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, key)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+func (localStore) list(ctx context.Context, dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (localStore) remove(ctx context.Context, key string) error {
+	return os.Remove(key)
+}
@@ -0,0 +1,183 @@
+// Package opslog keeps an audit trail of the tool's own operations, such as
+// init, restores and prunes, in delta_tracker.operations on the original
+// database: who ran each, with which arguments, and how it ended.
+package opslog
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ActorEnv names whoever a run is on behalf of, when that isn't only the OS
+// user running it; the daemon sets it for the jobs it runs.
+const ActorEnv = "DELTA_OPS_ACTOR"
+
+// Entry is one operation as the log keeps it.
+type Entry struct {
+	ID        int64      `json:"id"`
+	Command   string     `json:"command"` // e.g. restore or init snapshot
+	Args      []string   `json:"args"`    // with secrets redacted
+	OSUser    string     `json:"os_user"`
+	DBUser    string     `json:"db_user"`
+	Actor     string     `json:"actor,omitempty"` // e.g. a daemon job, and the API caller that started it
+	Host      string     `json:"host"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	Outcome   string     `json:"outcome"` // running, ok or failed
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Operation is a run being recorded.
+type Operation struct {
+	db *sql.DB
+	id int64
+}
+
+// Start records that a command started, with its arguments, the OS user and
+// host running it and ActorEnv. The table is created on first use.
+func Start(db *sql.DB, command string, args []string) (*Operation, error) {
+	_, err := db.Exec(`
+		CREATE SCHEMA IF NOT EXISTS delta_tracker;
+		CREATE TABLE IF NOT EXISTS delta_tracker.operations (
+			id BIGSERIAL PRIMARY KEY,
+			command TEXT NOT NULL,
+			args TEXT[] NOT NULL,
+			os_user TEXT NOT NULL,
+			db_user TEXT NOT NULL DEFAULT session_user,
+			actor TEXT,
+			host TEXT NOT NULL,
+			started_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			ended_at TIMESTAMPTZ,
+			outcome TEXT NOT NULL DEFAULT 'running',
+			exit_code INT,
+			error TEXT
+		);
+		CREATE INDEX IF NOT EXISTS operations_started_idx ON delta_tracker.operations (started_at DESC);
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the operations log: %v", err)
+	}
+
+	osUser := "unknown"
+	if u, err := user.Current(); err == nil {
+		osUser = u.Username
+	}
+	host, _ := os.Hostname()
+	op := &Operation{db: db}
+	err = db.QueryRow(`
+		INSERT INTO delta_tracker.operations (command, args, os_user, actor, host)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		RETURNING id
+	`, command, pq.Array(Redact(args)), osUser, os.Getenv(ActorEnv), host).Scan(&op.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the start of %s in the operations log: %v", command, err)
+	}
+	return op, nil
+}
+
+// Finish records how the operation ended: its exit code and, when it
+// failed, the error.
+func (op *Operation) Finish(code int, failure error) error {
+	outcome, message := "ok", ""
+	if code != 0 {
+		outcome = "failed"
+	}
+	if failure != nil {
+		message = failure.Error()
+	}
+	_, err := op.db.Exec(`
+		UPDATE delta_tracker.operations
+		SET ended_at = CURRENT_TIMESTAMP, outcome = $2, exit_code = $3, error = NULLIF($4, '')
+		WHERE id = $1
+	`, op.id, outcome, code, message)
+	if err != nil {
+		return fmt.Errorf("failed to record the end of operation %d: %v", op.id, err)
+	}
+	return nil
+}
+
+// Filter narrows History down.
+type Filter struct {
+	Command string    // only this command; empty for every one
+	User    string    // only runs by this OS user, database user or actor
+	Since   time.Time // only runs started after this; zero for all
+	Limit   int
+}
+
+// History reads the operations log, newest first.
+func History(db *sql.DB, f Filter) ([]Entry, error) {
+	// the table only exists once something has been recorded
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('delta_tracker.operations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up the operations log: %v", err)
+	}
+	if !exists {
+		return []Entry{}, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, command, args, os_user, db_user, COALESCE(actor, ''), host, started_at, ended_at, outcome, exit_code, COALESCE(error, '')
+		FROM delta_tracker.operations
+		WHERE ($1 = '' OR command = $1)
+			AND ($2 = '' OR $2 IN (os_user, db_user) OR actor LIKE '%' || $2 || '%')
+			AND ($3::timestamptz IS NULL OR started_at >= $3)
+		ORDER BY started_at DESC, id DESC
+		LIMIT $4
+	`, f.Command, f.User, sql.NullTime{Time: f.Since, Valid: !f.Since.IsZero()}, f.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the operations log: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var code sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Command, pq.Array(&e.Args), &e.OSUser, &e.DBUser, &e.Actor, &e.Host, &e.StartedAt, &e.EndedAt, &e.Outcome, &code, &e.Error); err != nil {
+			return nil, fmt.Errorf("failed to scan an operation: %v", err)
+		}
+		if code.Valid {
+			c := int(code.Int64)
+			e.ExitCode = &c
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// flags whose values are secrets
+var secretFlag = regexp.MustCompile(`(?i)token|password|secret|key$`)
+
+// Redact blanks out what shouldn't be kept in the log: the values of flags
+// named like secrets, e.g. -ship-token, and passwords in URLs.
+func Redact(args []string) []string {
+	redacted := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "="); strings.HasPrefix(arg, "-") && secretFlag.MatchString(name) {
+			if hasValue {
+				arg = arg[:strings.Index(arg, "=")+1] + "REDACTED"
+			} else if i+1 < len(args) {
+				redacted[i] = arg
+				i++
+				arg = "REDACTED"
+			}
+		} else if u, err := url.Parse(arg); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+				arg = u.String()
+			}
+		}
+		redacted[i] = arg
+	}
+	return redacted
+}
@@ -0,0 +1,54 @@
+// Package output prints command results either as text for people or, with
+// -output json, as a single JSON document for scripts. Logs always go to
+// stderr, so with JSON output stdout holds nothing but the document.
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format is the value of a command's -output flag.
+type Format string
+
+const (
+	Table Format = "table" // aligned text, the default
+	JSON  Format = "json"  // one JSON object per run
+)
+
+func (f *Format) String() string { return string(*f) }
+
+// Set implements flag.Value, rejecting unknown formats when flags are parsed.
+func (f *Format) Set(value string) error {
+	switch Format(value) {
+	case Table, JSON:
+		*f = Format(value)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q (expected table or json)", value)
+}
+
+// Progress is where running commentary such as executed statements goes:
+// stdout for table output, stderr for JSON so it can't corrupt the document.
+func (f Format) Progress() io.Writer {
+	if f == JSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Print writes a command's result, encoding it as JSON or calling table to
+// print it as text.
+func (f Format) Print(result interface{}, table func()) {
+	if f != JSON {
+		table()
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode result: %v\n", err)
+	}
+}
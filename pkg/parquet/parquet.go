@@ -0,0 +1,233 @@
+// Package parquet writes tables of text values as Parquet files, the columnar
+// format analytics tools and data lakes read. It covers only what the tool
+// needs: one row group, every column an optional UTF-8 string, plain
+// encoding and no compression, which every Parquet reader understands.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Parquet enum values used below, from parquet.thrift
+const (
+	typeByteArray      = 6
+	repetitionOptional = 1
+	convertedUTF8      = 0
+	encodingPlain      = 0
+	encodingRLE        = 3
+	pageData           = 0
+	codecUncompressed  = 0
+)
+
+// Write writes rows as a Parquet file with the given columns. Each row holds
+// one value per column, nil for null.
+func Write(w io.Writer, columns []string, rows [][]*string) error {
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return fmt.Errorf("row %d has %d values for %d columns", i, len(row), len(columns))
+		}
+	}
+
+	file := bytes.NewBufferString("PAR1")
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(columns))
+	for c := range columns {
+		page := columnPage(rows, c)
+		header := &compact{}
+		header.i32(1, pageData)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.structField(5, func(h *compact) {
+			h.i32(1, int32(len(rows)))
+			h.i32(2, encodingPlain)
+			h.i32(3, encodingRLE)
+			h.i32(4, encodingRLE)
+		})
+		header.stop()
+
+		chunks[c].offset = int64(file.Len())
+		file.Write(header.buf.Bytes())
+		file.Write(page)
+		chunks[c].size = int64(file.Len()) - chunks[c].offset
+	}
+
+	meta := &compact{}
+	meta.i32(1, 1)
+	meta.structList(2, len(columns)+1, func(i int, e *compact) {
+		if i == 0 {
+			e.str(4, "schema")
+			e.i32(5, int32(len(columns)))
+			return
+		}
+		e.i32(1, typeByteArray)
+		e.i32(3, repetitionOptional)
+		e.str(4, columns[i-1])
+		e.i32(6, convertedUTF8)
+	})
+	meta.i64(3, int64(len(rows)))
+	meta.structList(4, 1, func(_ int, g *compact) {
+		var total int64
+		g.structList(1, len(columns), func(c int, cc *compact) {
+			total += chunks[c].size
+			cc.i64(2, chunks[c].offset)
+			cc.structField(3, func(m *compact) {
+				m.i32(1, typeByteArray)
+				m.i32List(2, encodingPlain, encodingRLE)
+				m.strList(3, columns[c])
+				m.i32(4, codecUncompressed)
+				m.i64(5, int64(len(rows)))
+				m.i64(6, chunks[c].size)
+				m.i64(7, chunks[c].size)
+				m.i64(9, chunks[c].offset)
+			})
+		})
+		g.i64(2, total)
+		g.i64(3, int64(len(rows)))
+	})
+	meta.str(6, "db-delta-tracker")
+	meta.stop()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// the data page of one column: its definition levels (1 for a value, 0 for
+// null) as RLE runs behind their length, then the values, each behind its
+// length
+func columnPage(rows [][]*string, c int) []byte {
+	var levels bytes.Buffer
+	for start := 0; start < len(rows); {
+		defined := rows[start][c] != nil
+		end := start
+		for end < len(rows) && (rows[end][c] != nil) == defined {
+			end++
+		}
+		levels.Write(binary.AppendUvarint(nil, uint64(end-start)<<1))
+		if defined {
+			levels.WriteByte(1)
+		} else {
+			levels.WriteByte(0)
+		}
+		start = end
+	}
+
+	var page bytes.Buffer
+	binary.Write(&page, binary.LittleEndian, uint32(levels.Len()))
+	page.Write(levels.Bytes())
+	for _, row := range rows {
+		if v := row[c]; v != nil {
+			binary.Write(&page, binary.LittleEndian, uint32(len(*v)))
+			page.WriteString(*v)
+		}
+	}
+	return page.Bytes()
+}
+
+// a struct in Thrift's compact protocol, which Parquet's metadata is
+// written in
+type compact struct {
+	buf  *bytes.Buffer
+	last int16 // id of the previous field, which the next one's is relative to
+}
+
+// compact protocol type ids
+const (
+	tI32    = 5
+	tI64    = 6
+	tBinary = 8
+	tList   = 9
+	tStruct = 12
+)
+
+func (c *compact) field(id int16, kind byte) {
+	if c.buf == nil {
+		c.buf = &bytes.Buffer{}
+	}
+	if delta := id - c.last; delta > 0 && delta <= 15 {
+		c.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		c.buf.WriteByte(kind)
+		c.varint(int64(id))
+	}
+	c.last = id
+}
+
+// a zigzag varint, as the compact protocol writes integers
+func (c *compact) varint(v int64) {
+	c.buf.Write(binary.AppendUvarint(nil, uint64((v<<1)^(v>>63))))
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.field(id, tI32)
+	c.varint(int64(v))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.field(id, tI64)
+	c.varint(v)
+}
+
+func (c *compact) str(id int16, s string) {
+	c.field(id, tBinary)
+	c.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	c.buf.WriteString(s)
+}
+
+func (c *compact) listHeader(id int16, kind byte, n int) {
+	c.field(id, tList)
+	if n < 15 {
+		c.buf.WriteByte(byte(n)<<4 | kind)
+		return
+	}
+	c.buf.WriteByte(0xf0 | kind)
+	c.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (c *compact) i32List(id int16, values ...int32) {
+	c.listHeader(id, tI32, len(values))
+	for _, v := range values {
+		c.varint(int64(v))
+	}
+}
+
+func (c *compact) strList(id int16, values ...string) {
+	c.listHeader(id, tBinary, len(values))
+	for _, v := range values {
+		c.buf.Write(binary.AppendUvarint(nil, uint64(len(v))))
+		c.buf.WriteString(v)
+	}
+}
+
+// a nested struct, whose fields write writes
+func (c *compact) structField(id int16, write func(*compact)) {
+	c.field(id, tStruct)
+	nested := &compact{buf: c.buf}
+	write(nested)
+	nested.stop()
+}
+
+// a list of n structs, the fields of each written by write
+func (c *compact) structList(id int16, n int, write func(i int, e *compact)) {
+	c.listHeader(id, tStruct, n)
+	for i := 0; i < n; i++ {
+		e := &compact{buf: c.buf}
+		write(i, e)
+		e.stop()
+	}
+}
+
+// end the struct
+func (c *compact) stop() {
+	if c.buf == nil {
+		c.buf = &bytes.Buffer{}
+	}
+	c.buf.WriteByte(0)
+}
@@ -0,0 +1,236 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func str(s string) *string { return &s }
+
+// a file of two columns and three rows, one value null, as encoded by hand
+// from parquet.thrift
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, []string{"id", "name"}, [][]*string{
+		{str("1"), str("a")},
+		{str("2"), nil},
+		{str("3"), str("bc")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "50415231" + // PAR1
+		// page header: data page, 21 bytes, 3 values, plain, RLE levels
+		"1500152a152a2c15061500150615060000" +
+		"02000000" + "0601" + // levels: a run of 3 defined
+		"0100000031" + "0100000032" + "0100000033" +
+		"1500152a152a2c15061500150615060000" +
+		"06000000" + "020102000201" + // levels: 1 defined, 1 null, 1 defined
+		"0100000061" + "020000006263" +
+		// file metadata: version, schema, rows, the row group, created_by
+		"1502" + "193c" + "4806736368656d611504" + "00" +
+		"150c250218026964250000" + "150c250218046e616d65250000" +
+		"1606" + "191c" + "192c" +
+		"26081c150c19250006191802696415001606164c164c26080000" +
+		"26541c150c192500061918046e616d6515001606164c164c26540000" +
+		"169801" + "1606" + "00" + "2810" + "64622d64656c74612d747261636b6572" + "00" +
+		"7c000000" + "50415231" // footer length, PAR1
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("Write =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteRowLength(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, []string{"a", "b"}, [][]*string{{str("1")}}); err == nil {
+		t.Error("a row short of a value was written")
+	}
+}
+
+// a file read back through its footer: many columns, so the schema list
+// takes the long list header, and runs of nulls of every length
+func TestWriteReadBack(t *testing.T) {
+	var columns []string
+	for c := 0; c < 20; c++ {
+		columns = append(columns, fmt.Sprintf("c%d", c))
+	}
+	var rows [][]*string
+	for r := 0; r < 200; r++ {
+		row := make([]*string, len(columns))
+		for c := range columns {
+			if r%(c+2) != 0 {
+				row[c] = str(strings.Repeat("é", r%7) + fmt.Sprint(r, c))
+			}
+		}
+		rows = append(rows, row)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, columns, rows); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	if string(file[:4]) != "PAR1" || string(file[len(file)-4:]) != "PAR1" {
+		t.Fatal("file isn't framed by PAR1")
+	}
+	size := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	r := &thriftReader{b: file[len(file)-8-size : len(file)-8]}
+	meta := r.readStruct()
+	if len(r.b) != 0 || r.err != nil {
+		t.Fatalf("footer has %d bytes left over after its metadata: %v", len(r.b), r.err)
+	}
+
+	if meta[1] != int64(1) || meta[3] != int64(len(rows)) {
+		t.Errorf("version %v and rows %v, want 1 and %d", meta[1], meta[3], len(rows))
+	}
+	schema := meta[2].([]interface{})
+	if len(schema) != len(columns)+1 || schema[0].(map[int16]interface{})[5] != int64(len(columns)) {
+		t.Fatalf("schema = %v, want a root of %d columns", schema, len(columns))
+	}
+	groups := meta[4].([]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups, want 1", len(groups))
+	}
+	chunks := groups[0].(map[int16]interface{})[1].([]interface{})
+	for c, column := range columns {
+		element := schema[c+1].(map[int16]interface{})
+		if element[4] != column || element[1] != int64(typeByteArray) || element[3] != int64(repetitionOptional) || element[6] != int64(convertedUTF8) {
+			t.Errorf("schema element %d = %v", c+1, element)
+		}
+		chunk := chunks[c].(map[int16]interface{})[3].(map[int16]interface{})
+		if !reflect.DeepEqual(chunk[3], []interface{}{column}) {
+			t.Errorf("chunk %d is of %v, want %s", c, chunk[3], column)
+		}
+
+		// the page the chunk points at, holding the column's values
+		page := &thriftReader{b: file[chunk[9].(int64):]}
+		header := page.readStruct()
+		data := header[5].(map[int16]interface{})
+		if header[1] != int64(pageData) || data[1] != int64(len(rows)) || header[2] != header[3] {
+			t.Fatalf("column %s has page header %v", column, header)
+		}
+		if got := int64(len(file)) - int64(len(page.b)) - chunk[9].(int64) + header[2].(int64); got != chunk[6] {
+			t.Errorf("column %s chunk is %d bytes, metadata says %v", column, got, chunk[6])
+		}
+		got := readPage(t, page.b[:header[2].(int64)], len(rows))
+		for i, row := range rows {
+			if !reflect.DeepEqual(got[i], row[c]) {
+				t.Fatalf("column %s row %d = %v, want %v", column, i, got[i], row[c])
+			}
+		}
+	}
+}
+
+// the values of a data page: RLE definition levels of bit width 1 behind
+// their length, then the defined values
+func readPage(t *testing.T, page []byte, n int) []*string {
+	t.Helper()
+	levels := page[4 : 4+binary.LittleEndian.Uint32(page)]
+	values := page[4+len(levels):]
+	var defined []bool
+	for len(levels) > 0 {
+		header, k := binary.Uvarint(levels)
+		if header&1 != 0 {
+			t.Fatal("bit-packed run of definition levels")
+		}
+		for i := uint64(0); i < header>>1; i++ {
+			defined = append(defined, levels[k] == 1)
+		}
+		levels = levels[k+1:]
+	}
+	if len(defined) != n {
+		t.Fatalf("%d definition levels, want %d", len(defined), n)
+	}
+	out := make([]*string, n)
+	for i := range out {
+		if defined[i] {
+			size := binary.LittleEndian.Uint32(values)
+			out[i] = str(string(values[4 : 4+size]))
+			values = values[4+size:]
+		}
+	}
+	if len(values) != 0 {
+		t.Fatalf("%d bytes of values left over", len(values))
+	}
+	return out
+}
+
+// reads Thrift's compact protocol into maps of field id to int64, string,
+// []interface{} and nested maps
+type thriftReader struct {
+	b   []byte
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.err = fmt.Errorf("truncated")
+		return 0
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("bad varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) value(kind byte) interface{} {
+	switch kind {
+	case tI32, tI64:
+		v := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case tBinary:
+		n := r.uvarint()
+		if uint64(len(r.b)) < n {
+			r.err = fmt.Errorf("truncated")
+			return ""
+		}
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case tList:
+		header := r.byte()
+		n := uint64(header >> 4)
+		if n == 15 {
+			n = r.uvarint()
+		}
+		list := []interface{}{}
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			list = append(list, r.value(header&0x0f))
+		}
+		return list
+	case tStruct:
+		return r.readStruct()
+	}
+	r.err = fmt.Errorf("unexpected type %d", kind)
+	return nil
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for r.err == nil {
+		b := r.byte()
+		if b == 0 {
+			break
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			id = int16(r.value(tI32).(int64))
+		}
+		fields[id] = r.value(b & 0x0f)
+		last = id
+	}
+	return fields
+}
@@ -0,0 +1,369 @@
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/tracker"
+
+	"github.com/lib/pq"
+)
+
+// Column is one column of a target table, as information_schema.columns
+// describes it.
+type Column struct {
+	Name           string
+	Type           string // schema-qualified type placeholders are cast to, e.g. pg_catalog.int4
+	Array          bool
+	Generated      bool // GENERATED ALWAYS AS (...), which can't be written
+	IdentityAlways bool // GENERATED ALWAYS AS IDENTITY, written with OVERRIDING SYSTEM VALUE
+}
+
+// Builder builds the statements applying deltas to fit the target tables as
+// they are: keys of a delta's row the table has no column for are left out
+// and counted, generated columns are never written, every placeholder is
+// cast to its column's type, and rows are updated and deleted by the table's
+// primary key. Each table's columns and key are read once and cached; call
+// Forget after changing a table's columns or name.
+//
+// Rows of a table with no key (see RowKey) are matched on every column of
+// their old values. When that matches several identical rows, the statement
+// fails, or with SkipAmbiguous changes none of them.
+type Builder struct {
+	db            *sql.DB
+	mu            sync.Mutex
+	tables        map[string]map[string]Column
+	keys          map[string][]string
+	skipped       map[string]map[string]int // by table and column, how many values were left out
+	skipAmbiguous bool
+}
+
+// NewBuilder returns a Builder reading table definitions through db, a
+// connection to the target. The caller keeps ownership of db.
+func NewBuilder(db *sql.DB) *Builder {
+	return &Builder{db: db, tables: make(map[string]map[string]Column), keys: make(map[string][]string), skipped: make(map[string]map[string]int)}
+}
+
+// Columns returns a table's columns by name, or an error if the target has
+// no such table.
+func (b *Builder) Columns(ctx context.Context, table string) (map[string]Column, error) {
+	b.mu.Lock()
+	columns, ok := b.tables[table]
+	b.mu.Unlock()
+	if ok {
+		return columns, nil
+	}
+
+	rows, err := b.db.QueryContext(ctx, `
+		SELECT column_name, udt_schema, udt_name, data_type = 'ARRAY', is_generated = 'ALWAYS',
+			COALESCE(identity_generation, '') = 'ALWAYS'
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = $1
+		ORDER BY ordinal_position
+	`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	columns = make(map[string]Column)
+	for rows.Next() {
+		var c Column
+		var typeSchema, typeName string
+		if err := rows.Scan(&c.Name, &typeSchema, &typeName, &c.Array, &c.Generated, &c.IdentityAlways); err != nil {
+			return nil, fmt.Errorf("failed to scan a column of %s: %v", table, err)
+		}
+		c.Type = pq.QuoteIdentifier(typeSchema) + "." + pq.QuoteIdentifier(typeName)
+		columns[c.Name] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %v", table, err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s not found in the target", table)
+	}
+
+	b.mu.Lock()
+	b.tables[table] = columns
+	b.mu.Unlock()
+	return columns, nil
+}
+
+// SkipAmbiguous makes updates and deletes on tables without a key change
+// nothing, instead of failing, when their old row matches several rows.
+func (b *Builder) SkipAmbiguous(skip bool) {
+	b.skipAmbiguous = skip
+}
+
+// Key returns the columns a table's rows are matched by, see RowKey.
+func (b *Builder) Key(ctx context.Context, table string) ([]string, error) {
+	b.mu.Lock()
+	key, ok := b.keys[table]
+	b.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := RowKey(ctx, b.db, table)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.keys[table] = key
+	b.mu.Unlock()
+	return key, nil
+}
+
+// Forget drops what the Builder knows about a table, so its columns and key
+// are read again the next time they are needed.
+func (b *Builder) Forget(table string) {
+	b.mu.Lock()
+	delete(b.tables, table)
+	delete(b.keys, table)
+	b.mu.Unlock()
+}
+
+// Skipped returns, by table, the row keys left out because the target table
+// has no such column, with how many values each lost.
+func (b *Builder) Skipped() map[string]map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	skipped := make(map[string]map[string]int, len(b.skipped))
+	for table, columns := range b.skipped {
+		skipped[table] = make(map[string]int, len(columns))
+		for column, n := range columns {
+			skipped[table][column] = n
+		}
+	}
+	return skipped
+}
+
+// Insert builds an INSERT of the columns of row the table has.
+func (b *Builder) Insert(ctx context.Context, table string, row map[string]interface{}) (string, []interface{}, error) {
+	columns, err := b.Columns(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	names, types, row := b.fit(table, columns, row, false)
+	if len(names) == 0 {
+		return "", nil, fmt.Errorf("no column of the row matches a column of %s", table)
+	}
+	overriding := false
+	for _, name := range names {
+		overriding = overriding || columns[name].IdentityAlways
+	}
+	query, args := insert(table, row, names, types, overriding)
+	return query, args, nil
+}
+
+// Update builds an UPDATE of the columns of row the table has, on the row
+// whose key columns have the given values.
+func (b *Builder) Update(ctx context.Context, table string, row, key map[string]interface{}) (string, []interface{}, error) {
+	columns, err := b.Columns(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	names, types, row := b.fit(table, columns, row, true)
+	if len(names) == 0 {
+		return "", nil, fmt.Errorf("no column of the row matches a column of %s", table)
+	}
+	for name := range key {
+		if _, ok := columns[name]; !ok {
+			return "", nil, fmt.Errorf("table %s has no key column %s", table, name)
+		}
+		types[name] = columns[name].Type
+	}
+	query, args := update(table, row, names, key, types)
+	return query, args, nil
+}
+
+// Delete builds a DELETE of the row whose key columns have the given values.
+func (b *Builder) Delete(ctx context.Context, table string, key map[string]interface{}) (string, []interface{}, error) {
+	columns, err := b.Columns(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	types := make(map[string]string, len(key))
+	for name := range key {
+		if _, ok := columns[name]; !ok {
+			return "", nil, fmt.Errorf("table %s has no key column %s", table, name)
+		}
+		types[name] = columns[name].Type
+	}
+	where, args := keyCondition(key, nil, types)
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", ident.Quote(table), where), args, nil
+}
+
+// Statement builds the statement applying an INSERT, UPDATE or DELETE delta,
+// like the package's Statement but fitted to the target table.
+func (b *Builder) Statement(ctx context.Context, delta tracker.Delta) (string, []interface{}, error) {
+	oldData, err := payload(delta.OldData)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshalling old_data: %v", err)
+	}
+	newData, err := payload(delta.NewData)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshalling new_data: %v", err)
+	}
+
+	switch delta.Action {
+	case "INSERT":
+		return b.Insert(ctx, delta.TableName, newData)
+	case "UPDATE", "DELETE":
+		key, err := b.Key(ctx, delta.TableName)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(key) == 0 {
+			if delta.Action == "UPDATE" {
+				return b.UpdateRow(ctx, delta.TableName, newData, oldData)
+			}
+			return b.DeleteRow(ctx, delta.TableName, oldData)
+		}
+		// the row is found by the key it had before the change
+		values, err := KeyOf(key, oldData)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s delta %d: %v", strings.ToLower(delta.Action), delta.ID, err)
+		}
+		if delta.Action == "UPDATE" {
+			return b.Update(ctx, delta.TableName, newData, values)
+		}
+		return b.Delete(ctx, delta.TableName, values)
+	}
+	return "", nil, fmt.Errorf("unknown delta action %q", delta.Action)
+}
+
+// UpdateRow builds an UPDATE of the columns of row the table has, on the one
+// row whose columns all equal old's, for tables without a key.
+func (b *Builder) UpdateRow(ctx context.Context, table string, row, old map[string]interface{}) (string, []interface{}, error) {
+	columns, err := b.Columns(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	names, types, row := b.fit(table, columns, row, true)
+	if len(names) == 0 {
+		return "", nil, fmt.Errorf("no column of the row matches a column of %s", table)
+	}
+	assignments := make([]string, len(names))
+	values := make([]interface{}, 0, len(names)+len(old))
+	for i, name := range names {
+		assignments[i] = fmt.Sprintf("%s = %s", ident.Quote(name), placeholder(i+1, types[name]))
+		values = append(values, columnValue(row[name]))
+	}
+	with, where, values, err := b.matchRow(table, columns, old, values)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%sUPDATE %s SET %s WHERE %s", with, ident.Quote(table), strings.Join(assignments, ", "), where), values, nil
+}
+
+// DeleteRow builds a DELETE of the one row whose columns all equal old's,
+// for tables without a key.
+func (b *Builder) DeleteRow(ctx context.Context, table string, old map[string]interface{}) (string, []interface{}, error) {
+	columns, err := b.Columns(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	with, where, values, err := b.matchRow(table, columns, old, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%sDELETE FROM %s WHERE %s", with, ident.Quote(table), where), values, nil
+}
+
+// the condition picking the one row equal to old on every column the table
+// has, NULLs included, with the WITH clause it needs. Several matches make
+// the statement fail (the subquery returns more than one row), or with
+// skipAmbiguous match nothing. json columns are compared as jsonb, since
+// json has no equality.
+func (b *Builder) matchRow(table string, columns map[string]Column, old map[string]interface{}, values []interface{}) (string, string, []interface{}, error) {
+	var conditions []string
+	for _, name := range sortedColumns(old) {
+		column, ok := columns[name]
+		if !ok {
+			continue
+		}
+		value := old[name]
+		if items, ok := value.([]interface{}); ok && column.Array {
+			value = arrayLiteral(items)
+		}
+		values = append(values, columnValue(value))
+		if column.Type == `"pg_catalog"."json"` {
+			conditions = append(conditions, fmt.Sprintf("%s::jsonb IS NOT DISTINCT FROM $%d::jsonb", ident.Quote(name), len(values)))
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("%s IS NOT DISTINCT FROM %s", ident.Quote(name), placeholder(len(values), column.Type)))
+	}
+	if len(conditions) == 0 {
+		return "", "", nil, fmt.Errorf("no column of the old row matches a column of %s", table)
+	}
+
+	matches := fmt.Sprintf("SELECT ctid FROM %s WHERE %s LIMIT 2", ident.Quote(table), strings.Join(conditions, " AND "))
+	if b.skipAmbiguous {
+		return "WITH matches AS (" + matches + ") ", "ctid IN (SELECT ctid FROM matches) AND (SELECT count(*) FROM matches) = 1", values, nil
+	}
+	return "", "ctid = (" + matches + ")", values, nil
+}
+
+// pick the keys of a row the table can be written with, in a stable order,
+// with their types, counting the ones it has no column for. Arrays are
+// turned into array literals, since the JSON form isn't one.
+func (b *Builder) fit(table string, columns map[string]Column, row map[string]interface{}, forUpdate bool) ([]string, map[string]string, map[string]interface{}) {
+	var names []string
+	types := make(map[string]string)
+	fitted := make(map[string]interface{}, len(row))
+	for name, value := range row {
+		column, ok := columns[name]
+		switch {
+		case !ok:
+			b.mu.Lock()
+			if b.skipped[table] == nil {
+				b.skipped[table] = make(map[string]int)
+			}
+			b.skipped[table][name]++
+			b.mu.Unlock()
+			continue
+		case column.Generated, forUpdate && column.IdentityAlways:
+			continue
+		}
+		if items, ok := value.([]interface{}); ok && column.Array {
+			value = arrayLiteral(items)
+		}
+		names = append(names, name)
+		types[name] = column.Type
+		fitted[name] = value
+	}
+	sort.Strings(names)
+	return names, types, fitted
+}
+
+// the text form of an array, e.g. {1,2,"a b"}, from its JSON form
+func arrayLiteral(items []interface{}) string {
+	elements := make([]string, len(items))
+	for i, item := range items {
+		switch v := item.(type) {
+		case nil:
+			elements[i] = "NULL"
+		case []interface{}:
+			elements[i] = arrayLiteral(v)
+		case string:
+			elements[i] = quoteArrayElement(v)
+		case map[string]interface{}:
+			data, _ := json.Marshal(v)
+			elements[i] = quoteArrayElement(string(data))
+		default:
+			elements[i] = fmt.Sprint(v)
+		}
+	}
+	return "{" + strings.Join(elements, ",") + "}"
+}
+
+func quoteArrayElement(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
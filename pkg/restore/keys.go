@@ -0,0 +1,75 @@
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"db-delta-tracker/pkg/ident"
+)
+
+// PrimaryKey returns the columns of a table's primary key in key order, read
+// from pg_constraint, or nil if the table has none.
+func PrimaryKey(ctx context.Context, db *sql.DB, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.attname
+		FROM pg_constraint c
+		CROSS JOIN LATERAL unnest(c.conkey) WITH ORDINALITY AS k(attnum, n)
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		WHERE c.conrelid = $1::regclass AND c.contype = 'p'
+		ORDER BY k.n
+	`, ident.Quote(table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the primary key of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var key []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan the primary key of %s: %v", table, err)
+		}
+		key = append(key, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the primary key of %s: %v", table, err)
+	}
+	return key, nil
+}
+
+// RowKey returns the columns rows of a table are matched by: its primary key,
+// or id for a table without one that has an id column. It returns nil for a
+// table with neither, whose rows can only be matched on all their columns.
+func RowKey(ctx context.Context, db *sql.DB, table string) ([]string, error) {
+	key, err := PrimaryKey(ctx, db, table)
+	if err != nil || len(key) > 0 {
+		return key, err
+	}
+	var hasID bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_attribute
+			WHERE attrelid = $1::regclass AND attname = 'id' AND attnum > 0 AND NOT attisdropped
+		)`, ident.Quote(table)).Scan(&hasID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for an id column in %s: %v", table, err)
+	}
+	if hasID {
+		return []string{"id"}, nil
+	}
+	return nil, nil
+}
+
+// KeyOf returns the values a row payload has for the given key columns.
+func KeyOf(key []string, row map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(key))
+	for _, name := range key {
+		value, ok := row[name]
+		if !ok {
+			return nil, fmt.Errorf("row has no value for key column %s", name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
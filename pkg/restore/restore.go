@@ -0,0 +1,177 @@
+// Package restore applies captured deltas to a copy of the tracked database,
+// for applications that embed delta-tracker instead of running its commands.
+package restore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"db-delta-tracker/pkg/ident"
+	"db-delta-tracker/pkg/tracker"
+)
+
+// RenameAction is the action of the deltas init's event trigger records when
+// a tracked table is renamed; table_name is the new name, and old_data and
+// new_data hold {"table": <name>} before and after.
+const RenameAction = "RENAME"
+
+// MarkAction is the action of the marker deltas applications record with
+// SELECT dbdelta_mark('<label>'); new_data holds {"label": <label>} and
+// table_name is empty. Markers change nothing and are never applied.
+const MarkAction = "MARK"
+
+// Restorer applies deltas to one database, the copy init restored the
+// tracked tables into.
+type Restorer struct {
+	db      *sql.DB
+	builder *Builder
+}
+
+// New returns a Restorer writing through db. The caller keeps ownership of db.
+func New(db *sql.DB) *Restorer {
+	return &Restorer{db: db, builder: NewBuilder(db)}
+}
+
+// Builder returns the Builder fitting the Restorer's statements to the
+// target, e.g. to see which columns it left out.
+func (r *Restorer) Builder() *Builder {
+	return r.builder
+}
+
+// Apply applies one delta: a row is inserted, updated or deleted, or a table
+// renamed; markers are passed over. A rename is skipped if the database has no table by the old name
+// or already has one by the new name.
+func (r *Restorer) Apply(ctx context.Context, delta tracker.Delta) error {
+	if delta.Action == MarkAction {
+		return nil
+	}
+	if delta.Action == RenameAction {
+		from, to, err := RenamedTables(delta)
+		if err != nil {
+			return err
+		}
+		if !r.tableExists(ctx, from) || r.tableExists(ctx, to) {
+			return nil
+		}
+		if _, err := r.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", ident.Quote(from), ident.Quote(to))); err != nil {
+			return fmt.Errorf("error renaming %s to %s: %v", from, to, err)
+		}
+		r.builder.Forget(from)
+		r.builder.Forget(to)
+		return nil
+	}
+
+	query, args, err := r.builder.Statement(ctx, delta)
+	if err != nil {
+		return err
+	}
+	if _, err := r.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("error applying %s: %v", strings.ToLower(delta.Action), err)
+	}
+	return nil
+}
+
+// ApplyAll applies every delta of a stream in order, returning how many were
+// applied before the stream ended or one failed.
+func (r *Restorer) ApplyAll(ctx context.Context, stream *tracker.Stream) (int, error) {
+	applied := 0
+	for stream.Next() {
+		if err := r.Apply(ctx, stream.Delta()); err != nil {
+			return applied, fmt.Errorf("delta %d: %v", stream.Delta().ID, err)
+		}
+		applied++
+	}
+	return applied, stream.Err()
+}
+
+// Statement builds the statement applying an INSERT, UPDATE or DELETE delta,
+// and its arguments. Every column in the delta's row is written, so a table
+// of any shape can be restored; rows are matched by id. A Builder matches
+// them by the table's primary key instead.
+func Statement(delta tracker.Delta) (string, []interface{}, error) {
+	oldData, err := payload(delta.OldData)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshalling old_data: %v", err)
+	}
+	newData, err := payload(delta.NewData)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshalling new_data: %v", err)
+	}
+
+	switch delta.Action {
+	case "INSERT":
+		if len(newData) == 0 {
+			return "", nil, fmt.Errorf("insert delta %d has no new row", delta.ID)
+		}
+		query, args := Insert(delta.TableName, newData)
+		return query, args, nil
+	case "UPDATE":
+		if len(newData) == 0 {
+			return "", nil, fmt.Errorf("update delta %d has no new row", delta.ID)
+		}
+		query, args := UpdateByKey(delta.TableName, newData, map[string]interface{}{"id": oldData["id"]})
+		return query, args, nil
+	case "DELETE":
+		query, args := DeleteByKey(delta.TableName, map[string]interface{}{"id": oldData["id"]})
+		return query, args, nil
+	}
+	return "", nil, fmt.Errorf("unknown delta action %q", delta.Action)
+}
+
+// RenamedTables returns the names a RENAME delta moves a table between.
+func RenamedTables(delta tracker.Delta) (from, to string, err error) {
+	oldData, err := payload(delta.OldData)
+	if err != nil {
+		return "", "", fmt.Errorf("error unmarshalling old_data: %v", err)
+	}
+	from, _ = oldData["table"].(string)
+	if from == "" {
+		return "", "", fmt.Errorf("rename delta %d has no previous table name", delta.ID)
+	}
+	return from, delta.TableName, nil
+}
+
+// MarkLabel returns the label of a MARK delta.
+func MarkLabel(delta tracker.Delta) (string, error) {
+	newData, err := payload(delta.NewData)
+	if err != nil {
+		return "", fmt.Errorf("error unmarshalling new_data: %v", err)
+	}
+	label, _ := newData["label"].(string)
+	if label == "" {
+		return "", fmt.Errorf("mark delta %d has no label", delta.ID)
+	}
+	return label, nil
+}
+
+// decode a delta payload, treating a SQL NULL as an empty row; numbers are
+// kept as written, so bigint and numeric values don't lose digits
+func payload(raw *json.RawMessage) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if raw == nil {
+		return data, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(*raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *Restorer) tableExists(ctx context.Context, table string) bool {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM information_schema.tables
+			WHERE table_schema = 'public' AND table_name = $1
+		)`, table).Scan(&exists)
+	return err == nil && exists
+}
+
+var _ tracker.Applier = (*Restorer)(nil)
@@ -0,0 +1,145 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"db-delta-tracker/pkg/ident"
+
+	"github.com/lib/pq"
+)
+
+// Insert builds an INSERT writing every column of a row payload.
+func Insert(table string, row map[string]interface{}) (string, []interface{}) {
+	return insert(table, row, sortedColumns(row), nil, false)
+}
+
+// UpdateByKey builds an UPDATE setting every column of a row payload on the
+// row whose key columns have the given values.
+func UpdateByKey(table string, row, key map[string]interface{}) (string, []interface{}) {
+	return update(table, row, sortedColumns(row), key, nil)
+}
+
+// DeleteByKey builds a DELETE for the row whose key columns have the given
+// values.
+func DeleteByKey(table string, key map[string]interface{}) (string, []interface{}) {
+	where, values := keyCondition(key, nil, nil)
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", ident.Quote(table), where), values
+}
+
+// Inline returns a statement with its placeholders replaced by its arguments
+// as SQL literals, for writing statements to a script that runs without a
+// driver to bind them. NULLs stay NULL; every other value becomes a quoted
+// literal, cast by the statement where the builder cast its placeholder.
+func Inline(query string, args []interface{}) string {
+	var out strings.Builder
+	quote := byte(0) // the quote of the identifier or literal being copied
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(query[i+1 : j])
+			if err != nil || n < 1 || n > len(args) {
+				break
+			}
+			if args[n-1] == nil {
+				out.WriteString("NULL")
+			} else {
+				out.WriteString(pq.QuoteLiteral(fmt.Sprint(args[n-1])))
+			}
+			i = j - 1
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// an INSERT of the given columns of a row, casting each placeholder to the
+// column's type when types has one
+func insert(table string, row map[string]interface{}, columns []string, types map[string]string, overriding bool) (string, []interface{}) {
+	placeholders := make([]string, len(columns))
+	values := make([]interface{}, len(columns))
+	for i, col := range columns {
+		placeholders[i] = placeholder(i+1, types[col])
+		values[i] = columnValue(row[col])
+	}
+
+	override := ""
+	if overriding {
+		override = " OVERRIDING SYSTEM VALUE"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s)%s VALUES (%s)",
+		ident.Quote(table), ident.List(columns), override, strings.Join(placeholders, ", "))
+	return query, values
+}
+
+// an UPDATE of the given columns of a row, on the row matching key
+func update(table string, row map[string]interface{}, columns []string, key map[string]interface{}, types map[string]string) (string, []interface{}) {
+	assignments := make([]string, len(columns))
+	values := make([]interface{}, 0, len(columns)+len(key))
+	for i, col := range columns {
+		assignments[i] = fmt.Sprintf("%s = %s", ident.Quote(col), placeholder(i+1, types[col]))
+		values = append(values, columnValue(row[col]))
+	}
+	where, values := keyCondition(key, values, types)
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", ident.Quote(table), strings.Join(assignments, ", "), where)
+	return query, values
+}
+
+// match key columns against values appended after the ones already bound
+func keyCondition(key map[string]interface{}, values []interface{}, types map[string]string) (string, []interface{}) {
+	columns := sortedColumns(key)
+	conditions := make([]string, len(columns))
+	for i, col := range columns {
+		values = append(values, columnValue(key[col]))
+		conditions[i] = fmt.Sprintf("%s = %s", ident.Quote(col), placeholder(len(values), types[col]))
+	}
+	return strings.Join(conditions, " AND "), values
+}
+
+// the n-th placeholder, cast to a type if one is given
+func placeholder(n int, typ string) string {
+	if typ == "" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return fmt.Sprintf("$%d::%s", n, typ)
+}
+
+// column names of a row payload in a stable order
+func sortedColumns(row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	for col := range row {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// convert a decoded JSON value into something the driver can bind;
+// nested objects and arrays (json/jsonb/array columns) are sent back as JSON text
+func columnValue(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return v
+		}
+		return string(data)
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"db-delta-tracker/pkg/compression"
+	"db-delta-tracker/pkg/objstore"
+)
+
+// DeltaStore is where deltas are read from. *Tracker reads a database's
+// deltas table; testutil.Store holds them in memory.
+type DeltaStore interface {
+	Deltas(ctx context.Context, opts ...Option) (*Stream, error)
+}
+
+// Applier applies deltas, in the order given, to wherever an application
+// keeps its copy of the data.
+type Applier interface {
+	Apply(ctx context.Context, delta Delta) error
+}
+
+// Row is one table row, by column name, as init backs it up. Numbers are
+// json.Number, so bigint and numeric values keep every digit.
+type Row = map[string]interface{}
+
+// DecodeRow decodes a row from the JSON row_to_json produces.
+func DecodeRow(data []byte) (Row, error) {
+	var row Row
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// SnapshotStore holds the rows each table had when it was backed up, the
+// state its deltas apply on top of.
+type SnapshotStore interface {
+	Snapshot(ctx context.Context, table string) ([]Row, error)
+}
+
+// FileSnapshots reads the JSON backups init writes, finding each table's
+// file through path, e.g. config.Config.BackupFile. Files may be local or
+// in object storage (see objstore), and compressed (see compression).
+type FileSnapshots func(table string) (string, error)
+
+// Snapshot reads a table's backup file. A file missing under its path is
+// looked for with another compression extension, or none, so backups taken
+// before backup.compression changed are still found.
+func (f FileSnapshots) Snapshot(ctx context.Context, table string) ([]Row, error) {
+	path, err := f(table)
+	if err != nil {
+		return nil, err
+	}
+	data, err := objstore.ReadFile(ctx, path)
+	missing := err
+	for _, m := range []compression.Method{compression.None, compression.Gzip, compression.Zstd} {
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if other := m.FileName(compression.Trim(path)); other != path {
+			if data, err = objstore.ReadFile(ctx, other); err == nil {
+				path = other
+			}
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		err = missing
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup of table %s: %w", table, err)
+	}
+	if data, err = compression.Decompress(path, data); err != nil {
+		return nil, fmt.Errorf("failed to read backup of table %s: %v", table, err)
+	}
+	var rows []Row
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, fmt.Errorf("failed to decode backup of table %s: %v", table, err)
+	}
+	return rows, nil
+}
+
+var (
+	_ DeltaStore    = (*Tracker)(nil)
+	_ SnapshotStore = FileSnapshots(nil)
+)
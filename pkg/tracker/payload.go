@@ -0,0 +1,118 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoPayload is returned when decoding a row a delta doesn't have, such as
+// the old row of an INSERT.
+var ErrNoPayload = errors.New("delta has no such row")
+
+// New decodes the row after the change into dest, as json.Unmarshal would.
+func (d Delta) New(dest interface{}) error {
+	return decode(d.NewData, dest)
+}
+
+// Old decodes the row before the change into dest, as json.Unmarshal would.
+func (d Delta) Old(dest interface{}) error {
+	return decode(d.OldData, dest)
+}
+
+func decode(raw *json.RawMessage, dest interface{}) error {
+	if raw == nil || string(*raw) == "null" {
+		return ErrNoPayload
+	}
+	return json.Unmarshal(*raw, dest)
+}
+
+// ChangedColumns returns, sorted, the columns an UPDATE changed, every column
+// of an inserted or deleted row, and nothing for a RENAME.
+func (d Delta) ChangedColumns() []string {
+	var oldRow, newRow map[string]json.RawMessage
+	d.Old(&oldRow)
+	d.New(&newRow)
+	if d.Action == "RENAME" {
+		return nil
+	}
+
+	var columns []string
+	for column, value := range newRow {
+		// jsonb renders equal values identically
+		if old, ok := oldRow[column]; !ok || d.Action != "UPDATE" || !bytes.Equal(old, value) {
+			columns = append(columns, column)
+		}
+	}
+	for column := range oldRow {
+		if _, ok := newRow[column]; !ok {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// SchemaInfo holds the primary key columns of each table, by table name.
+type SchemaInfo map[string][]string
+
+// LoadSchemaInfo reads the primary keys of the tables in schema public.
+func LoadSchemaInfo(ctx context.Context, db *sql.DB) (SchemaInfo, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, a.attname
+		FROM pg_constraint k
+		JOIN pg_class c ON c.oid = k.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN unnest(k.conkey) WITH ORDINALITY AS key(attnum, position) ON true
+		JOIN pg_attribute a ON a.attrelid = k.conrelid AND a.attnum = key.attnum
+		WHERE k.contype = 'p' AND n.nspname = 'public'
+		ORDER BY c.relname, key.position
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read primary keys: %v", err)
+	}
+	defer rows.Close()
+
+	info := make(SchemaInfo)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, fmt.Errorf("failed to scan primary key column: %v", err)
+		}
+		info[table] = append(info[table], column)
+	}
+	return info, rows.Err()
+}
+
+// PrimaryKey returns the primary key values of the changed row, taken from
+// the new row of an INSERT and the old row otherwise, by column name.
+func (d Delta) PrimaryKey(schema SchemaInfo) (map[string]interface{}, error) {
+	columns, ok := schema[d.TableName]
+	if !ok {
+		return nil, fmt.Errorf("no primary key known for table %s", d.TableName)
+	}
+	var row map[string]interface{}
+	var err error
+	if d.Action == "INSERT" {
+		err = d.New(&row)
+	} else {
+		err = d.Old(&row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("delta %d: %v", d.ID, err)
+	}
+
+	key := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		value, ok := row[column]
+		if !ok {
+			return nil, fmt.Errorf("delta %d has no value for key column %s", d.ID, column)
+		}
+		key[column] = value
+	}
+	return key, nil
+}
@@ -0,0 +1,259 @@
+package tracker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultBatchSize is how many deltas a Stream reads per query unless
+// BatchSize says otherwise.
+const DefaultBatchSize = 500
+
+// the filters and paging of a Deltas call
+type streamQuery struct {
+	from      int64
+	tables    []string
+	columns   []string // as table.column
+	batchSize int
+}
+
+// Option narrows or tunes a Deltas call.
+type Option func(*streamQuery)
+
+// From starts the stream at the delta with the given id, so a consumer can
+// resume after the last id it processed with From(last + 1).
+func From(id int64) Option {
+	return func(q *streamQuery) { q.from = id }
+}
+
+// Tables keeps only the deltas of the named tables.
+func Tables(names ...string) Option {
+	return func(q *streamQuery) { q.tables = append(q.tables, names...) }
+}
+
+// Columns keeps only the deltas that change one of the named columns, each
+// given as table.column (e.g. "users.email"), going by ChangedColumns: an
+// UPDATE that leaves them as they were is skipped, while an INSERT or DELETE
+// changes every column of its row. Their tables are read as if named with
+// Tables, and the other tables named there keep all their deltas.
+func Columns(names ...string) Option {
+	return func(q *streamQuery) { q.columns = append(q.columns, names...) }
+}
+
+// BatchSize sets how many deltas are read per query.
+func BatchSize(n int) Option {
+	return func(q *streamQuery) { q.batchSize = n }
+}
+
+// Stream iterates over deltas in id order, reading them a batch at a time:
+//
+//	stream, err := t.Deltas(ctx, tracker.From(id), tracker.Tables("users"))
+//	...
+//	for stream.Next() {
+//		delta := stream.Delta()
+//		...
+//	}
+//	if err := stream.Err(); err != nil { ... }
+//
+// Each batch is its own query, keyed on the last id read, so deltas written
+// while the stream is open are seen once it reaches them, and holding a
+// Stream keeps no connection busy between batches. Ids are handed out as
+// deltas are inserted, not as their transactions commit, so a batch with
+// ids missing while transactions are running waits for those transactions
+// to finish before going past the missing ids, instead of skipping a delta
+// committed late. Ids follow insertion order, which can differ slightly from
+// the timestamp order restore replays in.
+type Stream struct {
+	ctx     context.Context
+	read    BatchReader
+	query   streamQuery
+	watched map[string]map[string]bool // by table, the columns of Columns
+	next    int64                      // id the next batch starts at
+	batch   []Delta
+	current Delta
+	done    bool
+	err     error
+}
+
+// BatchReader reads up to limit deltas with an id of at least from, in id
+// order, keeping only the given tables unless tables is empty. It must not
+// return a delta while one with a lower id may still be committed. It is
+// what a Stream reads from, so other DeltaStores can reuse Stream.
+type BatchReader func(ctx context.Context, from int64, tables []string, limit int) ([]Delta, error)
+
+// Deltas returns a Stream over the deltas table, from the first delta unless
+// From says otherwise.
+func (t *Tracker) Deltas(ctx context.Context, opts ...Option) (*Stream, error) {
+	return NewStream(ctx, t.readBatch, opts...)
+}
+
+// NewStream returns a Stream reading its batches from read.
+func NewStream(ctx context.Context, read BatchReader, opts ...Option) (*Stream, error) {
+	q := streamQuery{batchSize: DefaultBatchSize}
+	for _, opt := range opts {
+		opt(&q)
+	}
+	if q.batchSize < 1 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", q.batchSize)
+	}
+	watched := make(map[string]map[string]bool)
+	for _, name := range q.columns {
+		table, column, ok := strings.Cut(name, ".")
+		if !ok || table == "" || column == "" {
+			return nil, fmt.Errorf("column %q must be given as table.column", name)
+		}
+		if watched[table] == nil {
+			watched[table] = make(map[string]bool)
+			q.tables = append(q.tables, table)
+		}
+		watched[table][column] = true
+	}
+	return &Stream{ctx: ctx, read: read, query: q, watched: watched, next: q.from}, nil
+}
+
+// Next advances to the next delta, reading another batch when needed. It
+// returns false at the end of the deltas table or on an error; check Err.
+func (s *Stream) Next() bool {
+	for {
+		if s.err != nil {
+			return false
+		}
+		if len(s.batch) == 0 && !s.done {
+			s.batch, s.err = s.read(s.ctx, s.next, s.query.tables, s.query.batchSize)
+			if s.err != nil {
+				return false
+			}
+			s.done = len(s.batch) < s.query.batchSize
+		}
+		if len(s.batch) == 0 {
+			return false
+		}
+		s.current, s.batch = s.batch[0], s.batch[1:]
+		s.next = s.current.ID + 1
+		if s.changesWatched(s.current) {
+			return true
+		}
+	}
+}
+
+// whether a delta changes one of the columns Columns named for its table,
+// or its table has none named
+func (s *Stream) changesWatched(d Delta) bool {
+	columns, ok := s.watched[d.TableName]
+	if !ok {
+		return true
+	}
+	for _, column := range d.ChangedColumns() {
+		if columns[column] {
+			return true
+		}
+	}
+	return false
+}
+
+// Delta returns the delta Next advanced to.
+func (s *Stream) Delta() Delta {
+	return s.current
+}
+
+// Err returns the error that ended the stream, if any.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// how often a batch waiting on running transactions checks for them
+const inFlightPoll = 50 * time.Millisecond
+
+// read a batch from the deltas table. While ids in the batch's range are
+// missing and transactions are running, one of them may still commit a
+// delta there, so the batch is read again once every transaction running
+// when it was read has finished; the ids still missing then never will be.
+func (t *Tracker) readBatch(ctx context.Context, from int64, tables []string, limit int) ([]Delta, error) {
+	from = max(from, 1)
+	var settled int64 // missing ids up to it are known to stay missing
+	for {
+		deltas, xmin, xmax, missing, err := t.readSnapshot(ctx, from, tables, limit, settled)
+		if err != nil || !missing || xmin == xmax {
+			return deltas, err
+		}
+		if err := t.awaitTransactions(ctx, xmax); err != nil {
+			return nil, err
+		}
+		settled = deltas[len(deltas)-1].ID
+	}
+}
+
+// read a batch in a snapshot, with the snapshot's xmin and xmax and whether
+// any id after settled and up to the batch's last one is missing
+func (t *Tracker) readSnapshot(ctx context.Context, from int64, tables []string, limit int, settled int64) ([]Delta, int64, int64, bool, error) {
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, 0, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var xmin, xmax int64
+	if err := tx.QueryRowContext(ctx, `SELECT txid_snapshot_xmin(s), txid_snapshot_xmax(s) FROM txid_current_snapshot() s`).Scan(&xmin, &xmax); err != nil {
+		return nil, 0, 0, false, fmt.Errorf("failed to read the running transactions: %v", err)
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, action, table_name, old_data, new_data, timestamp, COALESCE(txid, 0), COALESCE(statement, ''), context, COALESCE(origin, '')
+		FROM deltas
+		WHERE id >= $1 AND (cardinality($2::text[]) = 0 OR table_name = ANY($2))
+		ORDER BY id
+		LIMIT $3`, from, pq.Array(tables), limit)
+	if err != nil {
+		return nil, 0, 0, false, fmt.Errorf("error fetching deltas: %v", err)
+	}
+	defer rows.Close()
+
+	var deltas []Delta
+	for rows.Next() {
+		var d Delta
+		if err := rows.Scan(&d.ID, &d.Action, &d.TableName, &d.OldData, &d.NewData, &d.Timestamp, &d.TxID, &d.Statement, &d.Context, &d.Origin); err != nil {
+			return nil, 0, 0, false, fmt.Errorf("error scanning delta: %v", err)
+		}
+		deltas = append(deltas, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, false, fmt.Errorf("error iterating over deltas: %v", err)
+	}
+	if len(deltas) == 0 {
+		return nil, xmin, xmax, false, nil
+	}
+
+	// every table's deltas count here, since a gap in the ids of the
+	// tables read isn't one in the table
+	low, high := max(from, settled+1), deltas[len(deltas)-1].ID
+	if low > high {
+		return deltas, xmin, xmax, false, nil
+	}
+	var present int64
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM deltas WHERE id BETWEEN $1 AND $2`, low, high).Scan(&present); err != nil {
+		return nil, 0, 0, false, fmt.Errorf("error counting deltas: %v", err)
+	}
+	return deltas, xmin, xmax, present < high-low+1, nil
+}
+
+// wait until every transaction with an id below xmax has finished
+func (t *Tracker) awaitTransactions(ctx context.Context, xmax int64) error {
+	for {
+		var xmin int64
+		if err := t.db.QueryRowContext(ctx, `SELECT txid_snapshot_xmin(txid_current_snapshot())`).Scan(&xmin); err != nil {
+			return fmt.Errorf("failed to read the running transactions: %v", err)
+		}
+		if xmin >= xmax {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(inFlightPoll):
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package testutil has in-memory fakes of the tracker interfaces, so
+// applications embedding the library can test their integration without a
+// running PostgreSQL.
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+// Store is an in-memory DeltaStore and SnapshotStore. The zero value is
+// empty and ready to use.
+type Store struct {
+	mu        sync.Mutex
+	deltas    []tracker.Delta
+	snapshots map[string][]tracker.Row
+	nextID    int64
+}
+
+// Add appends deltas as init's triggers would. A delta without an id gets
+// the next one, so tests only need to fill in what they check.
+func (s *Store) Add(deltas ...tracker.Delta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deltas {
+		if d.ID == 0 {
+			d.ID = s.nextID + 1
+		}
+		s.nextID = max(s.nextID, d.ID)
+		s.deltas = append(s.deltas, d)
+	}
+	sort.SliceStable(s.deltas, func(i, j int) bool { return s.deltas[i].ID < s.deltas[j].ID })
+}
+
+// SetSnapshot sets the backed up rows of a table.
+func (s *Store) SetSnapshot(table string, rows []tracker.Row) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshots == nil {
+		s.snapshots = make(map[string][]tracker.Row)
+	}
+	s.snapshots[table] = rows
+}
+
+// Deltas streams the added deltas, honoring the same options as a Tracker.
+func (s *Store) Deltas(ctx context.Context, opts ...tracker.Option) (*tracker.Stream, error) {
+	return tracker.NewStream(ctx, s.readBatch, opts...)
+}
+
+func (s *Store) readBatch(ctx context.Context, from int64, tables []string, limit int) ([]tracker.Delta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var batch []tracker.Delta
+	for _, d := range s.deltas {
+		if len(batch) == limit {
+			break
+		}
+		if d.ID >= from && (len(tables) == 0 || contains(tables, d.TableName)) {
+			batch = append(batch, d)
+		}
+	}
+	return batch, nil
+}
+
+// Snapshot returns the rows set with SetSnapshot, failing like a missing
+// backup file for a table that has none.
+func (s *Store) Snapshot(ctx context.Context, table string) ([]tracker.Row, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, ok := s.snapshots[table]
+	if !ok {
+		return nil, fmt.Errorf("no backup of table %s", table)
+	}
+	return rows, nil
+}
+
+// Applier is a fake Applier that records what it is given.
+type Applier struct {
+	// Fail, when set, is called before each delta is recorded; an error it
+	// returns is returned from Apply and the delta isn't recorded.
+	Fail func(tracker.Delta) error
+
+	mu      sync.Mutex
+	applied []tracker.Delta
+}
+
+// Apply records a delta.
+func (a *Applier) Apply(ctx context.Context, delta tracker.Delta) error {
+	if a.Fail != nil {
+		if err := a.Fail(delta); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applied = append(a.applied, delta)
+	return nil
+}
+
+// Applied returns the deltas applied so far, in order.
+func (a *Applier) Applied() []tracker.Delta {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]tracker.Delta(nil), a.applied...)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ tracker.DeltaStore    = (*Store)(nil)
+	_ tracker.SnapshotStore = (*Store)(nil)
+	_ tracker.Applier       = (*Applier)(nil)
+)
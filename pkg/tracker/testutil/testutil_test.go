@@ -0,0 +1,169 @@
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"db-delta-tracker/pkg/tracker"
+)
+
+func raw(s string) *json.RawMessage {
+	r := json.RawMessage(s)
+	return &r
+}
+
+// the ids a stream over the store yields
+func streamIDs(t *testing.T, s *Store, opts ...tracker.Option) []int64 {
+	t.Helper()
+	stream, err := s.Deltas(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for stream.Next() {
+		ids = append(ids, stream.Delta().ID)
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestStoreStream(t *testing.T) {
+	var s Store
+	s.Add(
+		tracker.Delta{Action: "INSERT", TableName: "users", NewData: raw(`{"id":1,"email":"a@x"}`)},
+		tracker.Delta{Action: "INSERT", TableName: "orders", NewData: raw(`{"id":1,"total":5}`)},
+		tracker.Delta{Action: "UPDATE", TableName: "users", OldData: raw(`{"id":1,"email":"a@x","name":"A"}`), NewData: raw(`{"id":1,"email":"a@x","name":"B"}`)},
+		tracker.Delta{Action: "UPDATE", TableName: "users", OldData: raw(`{"id":1,"email":"a@x","name":"B"}`), NewData: raw(`{"id":1,"email":"b@x","name":"B"}`)},
+		tracker.Delta{Action: "DELETE", TableName: "orders", OldData: raw(`{"id":1,"total":5}`)},
+	)
+
+	for _, tt := range []struct {
+		name string
+		opts []tracker.Option
+		want []int64
+	}{
+		{"all", nil, []int64{1, 2, 3, 4, 5}},
+		{"from", []tracker.Option{tracker.From(3)}, []int64{3, 4, 5}},
+		{"past the end", []tracker.Option{tracker.From(6)}, nil},
+		{"tables", []tracker.Option{tracker.Tables("orders")}, []int64{2, 5}},
+		{"columns", []tracker.Option{tracker.Columns("users.email")}, []int64{1, 4}},
+		{"columns and tables", []tracker.Option{tracker.Columns("users.email"), tracker.Tables("orders")}, []int64{1, 2, 4, 5}},
+		{"batches", []tracker.Option{tracker.BatchSize(2)}, []int64{1, 2, 3, 4, 5}},
+		{"batches of filtered deltas", []tracker.Option{tracker.BatchSize(1), tracker.Columns("users.email")}, []int64{1, 4}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamIDs(t, &s, tt.opts...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stream yielded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreStreamOptionErrors(t *testing.T) {
+	var s Store
+	for _, opts := range [][]tracker.Option{
+		{tracker.BatchSize(0)},
+		{tracker.Columns("email")},
+		{tracker.Columns("users.")},
+	} {
+		if _, err := s.Deltas(context.Background(), opts...); err == nil {
+			t.Errorf("options %v were accepted", opts)
+		}
+	}
+}
+
+func TestStoreAddKeepsIDOrder(t *testing.T) {
+	var s Store
+	s.Add(tracker.Delta{ID: 10, TableName: "t"}, tracker.Delta{ID: 3, TableName: "t"})
+	s.Add(tracker.Delta{TableName: "t"})
+	if got, want := streamIDs(t, &s), []int64{3, 10, 11}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stream yielded %v, want %v", got, want)
+	}
+}
+
+func TestStoreStreamSeesLaterDeltas(t *testing.T) {
+	var s Store
+	s.Add(tracker.Delta{TableName: "t"})
+	stream, err := s.Deltas(context.Background(), tracker.BatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stream.Next() {
+		t.Fatal("stream ended before the first delta")
+	}
+	s.Add(tracker.Delta{TableName: "t"})
+	if !stream.Next() || stream.Delta().ID != 2 {
+		t.Fatalf("stream didn't read the delta added while it was open: %v", stream.Err())
+	}
+}
+
+func TestStoreStreamCanceled(t *testing.T) {
+	var s Store
+	s.Add(tracker.Delta{TableName: "t"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream, err := s.Deltas(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Next() {
+		t.Fatal("canceled stream yielded a delta")
+	}
+	if !errors.Is(stream.Err(), context.Canceled) {
+		t.Errorf("stream ended with %v, want context.Canceled", stream.Err())
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	var s Store
+	if _, err := s.Snapshot(context.Background(), "users"); err == nil {
+		t.Error("a table without a snapshot was read")
+	}
+	rows := []tracker.Row{{"id": json.Number("1")}}
+	s.SetSnapshot("users", rows)
+	got, err := s.Snapshot(context.Background(), "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("snapshot is %v, want %v", got, rows)
+	}
+}
+
+func TestApplierFromStream(t *testing.T) {
+	var s Store
+	s.Add(tracker.Delta{TableName: "a"}, tracker.Delta{TableName: "b"}, tracker.Delta{TableName: "a"})
+	failure := errors.New("refused")
+	a := &Applier{Fail: func(d tracker.Delta) error {
+		if d.ID == 3 {
+			return failure
+		}
+		return nil
+	}}
+
+	stream, err := s.Deltas(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applyErr error
+	for stream.Next() {
+		if applyErr = a.Apply(context.Background(), stream.Delta()); applyErr != nil {
+			break
+		}
+	}
+	if !errors.Is(applyErr, failure) {
+		t.Errorf("Apply returned %v, want %v", applyErr, failure)
+	}
+	var ids []int64
+	for _, d := range a.Applied() {
+		ids = append(ids, d.ID)
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("applied %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,36 @@
+// Package tracker reads the changes captured in a tracked database's deltas
+// table, for applications that embed delta-tracker instead of running its
+// commands.
+package tracker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Delta is one captured change: a row inserted, updated or deleted, or a
+// tracked table renamed.
+type Delta struct {
+	ID        int64            `json:"id"`
+	Action    string           `json:"action"`
+	TableName string           `json:"table_name"`
+	OldData   *json.RawMessage `json:"old_data,omitempty"` // pointer to handle nulls
+	NewData   *json.RawMessage `json:"new_data,omitempty"` // pointer to handle nulls
+	Timestamp time.Time        `json:"timestamp"`
+	TxID      int64            `json:"txid"`                // source transaction that made the change
+	Statement string           `json:"statement,omitempty"` // SQL behind the change, when init captures it
+	Context   *json.RawMessage `json:"context,omitempty"`   // set by the application through dbdelta.context
+	Origin    string           `json:"origin,omitempty"`    // label of the source database (config origin)
+}
+
+// Tracker reads the deltas of one tracked database.
+type Tracker struct {
+	db *sql.DB
+}
+
+// New returns a Tracker reading the deltas table through db, a connection to
+// a database init has instrumented. The caller keeps ownership of db.
+func New(db *sql.DB) *Tracker {
+	return &Tracker{db: db}
+}